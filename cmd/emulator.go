@@ -2,47 +2,574 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"log"
 	"net"
+	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
 	"github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
+// logger writes the emulator's own lines, plain unless -log-format is json
+var logger = log.New(os.Stderr, "", 0)
+
 func main() {
 	var initialQueues arrayFlags
+	var iamPermissions arrayFlags
+	var urlRewrites arrayFlags
+	var queueTargets arrayFlags
+	var allowedHosts arrayFlags
+	var deniedHosts arrayFlags
+	var dispatchHeaders arrayFlags
+	var authTokens arrayFlags
 
-	host := flag.String("host", "localhost", "The host name")
-	port := flag.String("port", "8123", "The port")
+	host := flag.String("host", "localhost", "The host name or IP address, e.g. 0.0.0.0 for every IPv4 address or :: for every IPv4 and IPv6 address")
+	port := flag.String("port", "8123", "The port, 0 to pick a free one")
+	adminPort := flag.String("admin-port", "", "The port of the admin HTTP API, disabled unless set")
+	logFormat := flag.String("log-format", "text", "The format of log lines: text, or json for a JSON object per line with the time, message and correlation ID of the task if any")
+	logLevel := flag.String("log-level", "info", "How much to log about dispatches: info, or debug to also log the request and response of every attempt with their bodies truncated")
+	logGrpc := flag.String("log-grpc", "off", "Log incoming RPCs: off, info, or debug to include request and response payloads")
+	maxQueuesPerProject := flag.Int("max-queues-per-project", 0, fmt.Sprintf("Limit the number of queues per project, unlimited if 0 (production allows %d)", cloud_task_emulator.ProductionMaxQueuesPerProject))
+	defaultRetryConfig := flag.String("default-retry-config", "", `Retry config JSON for queues created without one, e.g. '{"maxAttempts": 5, "minBackoff": "1s"}'`)
+	defaultRateLimits := flag.String("default-rate-limits", "", `Rate limits JSON for queues created without them, e.g. '{"maxDispatchesPerSecond": 10}'`)
+	defaultMaxAttempts := flag.Int("default-max-attempts", 0, "The max attempts of queues created without one, -1 for unlimited; overrides -default-retry-config")
+	defaultMinBackoff := flag.Duration("default-min-backoff", 0, "The min backoff of queues created without one; overrides -default-retry-config")
+	defaultMaxBackoff := flag.Duration("default-max-backoff", 0, "The max backoff of queues created without one; overrides -default-retry-config")
+	defaultMaxDoublings := flag.Int("default-max-doublings", 0, "The max doublings of queues created without one; overrides -default-retry-config")
+	defaultMaxDispatchesPerSecond := flag.Float64("default-max-dispatches-per-second", 0, "The max dispatches per second of queues created without one; overrides -default-rate-limits")
+	defaultMaxConcurrentDispatches := flag.Int("default-max-concurrent-dispatches", 0, "The max concurrent dispatches of queues created without one; overrides -default-rate-limits")
+	autoCreateQueues := flag.Bool("auto-create-queues", false, "Create missing queues with default settings when a task is created on them (differs from production)")
+	disableTaskNameDeduplication := flag.Bool("disable-task-name-deduplication", false, "Allow reusing the names of completed or deleted tasks straight away (differs from production)")
+	maxFinishedTasks := flag.Int("max-finished-tasks", 0, "Limit the tasks that ran out of attempts and reserved task names kept, evicting the oldest; unlimited if 0")
+	maxMemory := flag.Uint64("max-memory", 0, "Evict the oldest finished tasks and reserved task names while the heap is larger, in bytes; unlimited if 0")
+	compactTasks := flag.Bool("compact-tasks", false, "Store the HTTP or App Engine request of tasks serialized, for large backlogs to take less memory")
+	compressTasks := flag.Bool("compress-tasks", false, "Also compress the requests of tasks stored with -compact-tasks")
+	namespaceMetadataKey := flag.String("namespace-metadata-key", "", "Partition all queue and task state by the value of this gRPC metadata key, e.g. x-emulator-namespace, for parallel test suites to share the emulator")
+	sequentialTaskIDs := flag.Bool("sequential-task-ids", false, "Name the tasks created without a name task-0001, task-0002 and so on per queue, for stable golden files (differs from production)")
+	taskIDSeed := flag.Int64("task-id-seed", 0, "Generate the IDs of tasks created without a name from this seed, the same on every run; random if 0")
+	taskIDFormat := flag.String("task-id-format", "", "A prefix or template of the IDs of tasks created without a name, with {queue}, {timestamp} and {id} placeholders, e.g. {queue}-{timestamp}-{id}")
+	keepTombstonedNames := flag.Bool("keep-tombstoned-names", false, "Keep the names of completed or deleted tasks for the admin API to list while they are reserved")
+	configPath := flag.String("config", "", "A YAML config file with queues and defaults, reloaded on SIGHUP")
+	warnOnExternalHosts := flag.Bool("warn-on-external-hosts", false, "Log a warning when dispatching to a host that isn't allowed instead of failing the attempt")
+	dispatchProxy := flag.String("dispatch-proxy", "", "An HTTP(S) proxy URL to dispatch tasks through, instead of the HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables")
+	dispatchInsecureSkipVerify := flag.Bool("dispatch-insecure-skip-verify", false, "Accept any certificate from HTTPS targets, e.g. self-signed ones")
+	dispatchCAFile := flag.String("dispatch-ca-file", "", "A PEM file of CA certificates trusted, besides the system roots, when dispatching to HTTPS targets")
+	dispatchMaxIdleConns := flag.Int("dispatch-max-idle-conns", 0, "The idle connections kept for reuse across all targets, Go's default of 100 if 0")
+	dispatchMaxIdleConnsPerHost := flag.Int("dispatch-max-idle-conns-per-host", 0, "The idle connections kept for reuse per target host, Go's default of 2 if 0; raise it for high-rate load tests against one worker")
+	dispatchMaxConnsPerHost := flag.Int("dispatch-max-conns-per-host", 0, "Bound the connections per target host, further dispatches waiting for one; unbounded if 0")
+	dispatchIdleConnTimeout := flag.Duration("dispatch-idle-conn-timeout", 0, "How long idle connections are kept for reuse, Go's default of 90s if 0")
+	dispatchProtocol := flag.String("dispatch-protocol", "auto", "The HTTP version tasks are delivered with: auto (HTTP/2 to https:// targets offering it, HTTP/1.1 otherwise), http1, or http2 (h2c to http:// targets)")
+	dispatchTimeout := flag.Duration("dispatch-timeout", 0, "Bound every dispatch whatever the task's dispatch deadline, e.g. 5s, unbounded if 0")
+	maxConcurrentDispatches := flag.Int("max-concurrent-dispatches", 0, "Bound the dispatches in flight across all queues, e.g. to stay within the file descriptor limit; unbounded if 0")
+	maxConcurrentDispatchesPerQueue := flag.Int("max-concurrent-dispatches-per-queue", 0, "Cap the dispatches in flight of every queue, whatever its rate limits allow; unbounded if 0")
+	resumeRampUpRate := flag.Float64("resume-ramp-up-rate", 0, "Dispatches per second of a queue right after it resumes, ramping up to its rate limit; off if 0, e.g. 500 to emulate production's 500/50/5 pattern")
+	resumeRampUpGrowth := flag.Float64("resume-ramp-up-growth", 1.5, "The factor the dispatch rate of a resumed queue grows by every -resume-ramp-up-interval")
+	resumeRampUpInterval := flag.Duration("resume-ramp-up-interval", 5*time.Minute, "How often the dispatch rate of a resumed queue grows")
+	timeScale := flag.Float64("time-scale", 0, "Run the emulator's clock this many times faster, so that schedule times, retry backoffs and reserved task names come and go sooner, e.g. 3600 for an hour a second; real time if 0")
+	clockOffset := flag.Duration("clock-offset", 0, "Move the emulator's clock ahead of the host's, or behind it if negative, e.g. 5m, to test clients tolerate clock skew")
+	dispatchHook := flag.String("dispatch-hook", "", "A Starlark script deciding, per dispatch, to delay, fail or rewrite it, see the readme")
+	chaosPercent := flag.Float64("chaos-percent", 0, "Fail this percentage of the dispatches at random without sending them, e.g. 10, to exercise retries; off if 0")
+	chaosFailures := flag.String("chaos-failures", "500,timeout,reset", "The failures chaos picks from at random: 500, timeout or reset, comma separated")
+	chaosSeed := flag.Int64("chaos-seed", 0, "Seed the chaos failures to reproduce them, random if 0")
+	openIDIssuer := flag.String("openid-issuer", "", "The issuer of OIDC tokens, e.g. http://localhost:8980, also serving the OpenID discovery document and signing keys on its port")
+	openIDKey := flag.String("openid-key", "", "A PEM file with the RSA private key signing OIDC tokens, instead of the emulator's published key")
+	maxRecvMsgSize := flag.Int("max-recv-msg-size", 0, "The largest gRPC message in bytes the emulator receives, gRPC's 4MB default if 0")
+	maxSendMsgSize := flag.Int("max-send-msg-size", 0, "The largest gRPC message in bytes the emulator sends, unlimited if 0")
+	keepaliveTime := flag.Duration("keepalive-time", 0, "Ping clients after a connection is idle this long, gRPC's 2h default if 0")
+	keepaliveTimeout := flag.Duration("keepalive-timeout", 0, "Close a connection whose ping isn't answered within this long, gRPC's 20s default if 0")
+	keepaliveMaxConnectionIdle := flag.Duration("keepalive-max-connection-idle", 0, "Close connections without RPCs for this long, never if 0")
+	keepaliveMaxConnectionAge := flag.Duration("keepalive-max-connection-age", 0, "Close connections this old, never if 0")
+	keepaliveMaxConnectionAgeGrace := flag.Duration("keepalive-max-connection-age-grace", 0, "Let the RPCs of a connection closed for its age finish within this long, forever if 0")
+	keepaliveMinTime := flag.Duration("keepalive-min-time", 5*time.Minute, "Close connections of clients pinging more often than this")
+	keepalivePermitWithoutStream := flag.Bool("keepalive-permit-without-stream", false, "Let clients ping connections without RPCs in flight")
+	requireAuth := flag.Bool("require-auth", false, "Reject gRPC calls without an 'authorization: Bearer <token>' header with UNAUTHENTICATED, to check clients attach credentials")
+	listenUnix := flag.String("listen-unix", "", "Serve gRPC on a Unix domain socket at this path instead of the TCP host and port")
+	singlePort := flag.Bool("single-port", false, "Also serve the admin API and OpenID endpoints on the gRPC port")
+	fixturePath := flag.String("fixture", "", "A YAML fixture of queues and tasks to create on startup, see the readme")
+	replayPath := flag.String("replay", "", "Re-create the tasks of a file recorded with -record, or of a scenario in the same format, with their original relative timings")
+	recordPath := flag.String("record", "", "Append every dispatched request, with its response and timing, to this file as JSON lines")
+	walPath := flag.String("wal", "", "A write-ahead log of the queues and tasks: restored from on startup if it exists, then appended to, so that a crashed emulator picks up where it left off")
+	portFile := flag.String("port-file", "", "Write the port the emulator listens on to this file once listening, e.g. with -port 0")
 	hardResetOnPurgeQueue := flag.Bool("hard-reset-on-purge-queue", false, "Set to force the 'Purge Queue' call to perform a hard reset of all state (differs from production)")
+	tombstoneTTL := flag.Duration("tombstone-ttl", 0, "How long the names of completed or deleted tasks stay reserved, an hour as in production if 0; e.g. 24h to keep them reserved for a whole test run")
 
 	flag.Var(&initialQueues, "queue", "A queue to create on startup (repeat as required)")
+	flag.Var(&urlRewrites, "rewrite-url", "Rewrite HTTP task URLs starting with a prefix before dispatch, formatted <FROM>=<TO> e.g. https://api.example.com=http://localhost:9000 (repeat as required)")
+	flag.Var(&queueTargets, "queue-target", "Send all the tasks of a queue to a target whatever their URL host, keeping the path and query, formatted <QUEUE>=<TARGET> e.g. projects/dev/locations/here/queues/firstq=http://localhost:9000 (repeat as required)")
+	flag.Var(&allowedHosts, "allow-host", "A host name or CIDR range tasks may be dispatched to besides loopback and private addresses, which are the only ones allowed by default; * for any host, as before this guard (repeat as required)")
+	flag.Var(&deniedHosts, "deny-host", "A host name or CIDR range tasks are never dispatched to (repeat as required)")
+	flag.Var(&dispatchHeaders, "dispatch-header", "A header added to every dispatch unless the task sets it, formatted '<NAME>: <VALUE>' (repeat as required)")
+	flag.Var(&authTokens, "auth-token", "A bearer token -require-auth accepts, any token if none is given (repeat as required)")
+	flag.Var(&iamPermissions, "iam-permissions", "Restrict the permissions TestIamPermissions grants a caller, formatted <CALLER>=<PERMISSION>[,<PERMISSION>...] (repeat as required)")
 
 	flag.Parse()
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("%v:%v", *host, *port))
+	grpcLogLevel, err := cloud_task_emulator.ParseGrpcLogLevel(*logGrpc)
 	if err != nil {
 		panic(err)
 	}
+	format, err := cloud_task_emulator.ParseLogFormat(*logFormat)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -log-format: %v", err))
+	}
+	if format == cloud_task_emulator.LogJSON {
+		// The standard logger is the emulator's and the gRPC logging's
+		jsonWriter := cloud_task_emulator.NewJSONLogWriter(os.Stderr)
+		log.SetOutput(jsonWriter)
+		log.SetFlags(0)
+		logger.SetOutput(jsonWriter)
+	}
 
-	print(fmt.Sprintf("Starting cloud tasks emulator, listening on %v:%v\n", *host, *port))
+	lis, err := listen(*host, *port, *listenUnix)
+	if err != nil {
+		panic(err)
+	}
+
+	logger.Printf("Starting cloud tasks emulator, listening on %v\n", lis.Addr())
+	if tcpAddr, ok := lis.Addr().(*net.TCPAddr); ok {
+		if err := announcePort(tcpAddr.Port, *portFile); err != nil {
+			panic(err)
+		}
+	}
 
-	grpcServer := grpc.NewServer()
-	emulatorServer := cloud_task_emulator.NewServer()
-	emulatorServer.Options.HardResetOnPurgeQueue = *hardResetOnPurgeQueue
-	tasks.RegisterCloudTasksServer(grpcServer, emulatorServer)
+	var options cloud_task_emulator.ServerOptions
+	options.HardResetOnPurgeQueue = *hardResetOnPurgeQueue
+	options.TaskNameTombstoneTTL = *tombstoneTTL
+	options.IamPermissions = parseIamPermissions(iamPermissions)
+	options.MaxQueuesPerProject = *maxQueuesPerProject
+	options.MaxRecvMsgSize = *maxRecvMsgSize
+	options.MaxSendMsgSize = *maxSendMsgSize
+	options.Keepalive = &keepalive.ServerParameters{
+		Time:                  *keepaliveTime,
+		Timeout:               *keepaliveTimeout,
+		MaxConnectionIdle:     *keepaliveMaxConnectionIdle,
+		MaxConnectionAge:      *keepaliveMaxConnectionAge,
+		MaxConnectionAgeGrace: *keepaliveMaxConnectionAgeGrace,
+	}
+	options.RequireAuthentication = *requireAuth || len(authTokens) > 0
+	options.AuthTokens = authTokens
+	options.KeepaliveEnforcement = &keepalive.EnforcementPolicy{
+		MinTime:             *keepaliveMinTime,
+		PermitWithoutStream: *keepalivePermitWithoutStream,
+	}
+	options.AutoCreateQueues = *autoCreateQueues
+	options.DisableTaskNameDeduplication = *disableTaskNameDeduplication
+	options.KeepTombstonedNames = *keepTombstonedNames
+	options.SequentialTaskIDs = *sequentialTaskIDs
+	options.TaskIDSeed = *taskIDSeed
+	options.NamespaceMetadataKey = *namespaceMetadataKey
+	options.TimeScale = *timeScale
+	options.ClockOffset = *clockOffset
+	options.MaxFinishedTasks = *maxFinishedTasks
+	options.MaxMemory = *maxMemory
+	options.CompactTasks = *compactTasks || *compressTasks
+	options.CompressTasks = *compressTasks
+	options.Dispatch.URLRewrites = parseURLRewrites(urlRewrites)
+	options.Dispatch.QueueTargets = parseQueueTargets(queueTargets)
+	options.Dispatch.AllowedHosts = allowedHosts
+	options.Dispatch.DeniedHosts = deniedHosts
+	options.Dispatch.WarnOnExternalHosts = *warnOnExternalHosts
+	options.Dispatch.InsecureSkipVerify = *dispatchInsecureSkipVerify
+	options.Dispatch.Timeout = *dispatchTimeout
+	options.Dispatch.MaxIdleConns = *dispatchMaxIdleConns
+	options.Dispatch.MaxIdleConnsPerHost = *dispatchMaxIdleConnsPerHost
+	options.Dispatch.MaxConnsPerHost = *dispatchMaxConnsPerHost
+	options.Dispatch.IdleConnTimeout = *dispatchIdleConnTimeout
+	options.Dispatch.Headers = parseDispatchHeaders(dispatchHeaders)
+	options.Dispatch.OpenIDIssuer = *openIDIssuer
+	options.Dispatch.MaxConcurrentDispatches = *maxConcurrentDispatches
+	options.Dispatch.MaxConcurrentDispatchesPerQueue = *maxConcurrentDispatchesPerQueue
+	options.Dispatch.ResumeRampUp = cloud_task_emulator.RampUp{
+		InitialRate: *resumeRampUpRate,
+		Growth:      *resumeRampUpGrowth,
+		Interval:    *resumeRampUpInterval,
+	}
+	options.Dispatch.LogLevel, err = cloud_task_emulator.ParseLogLevel(*logLevel)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -log-level: %v", err))
+	}
+	options.TaskIDFormat, err = cloud_task_emulator.ParseTaskIDFormat(*taskIDFormat)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -task-id-format: %v", err))
+	}
+	options.Dispatch.Protocol, err = cloud_task_emulator.ParseDispatchProtocol(*dispatchProtocol)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -dispatch-protocol: %v", err))
+	}
+	failures, err := cloud_task_emulator.ParseChaosFailures(*chaosFailures)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -chaos-failures: %v", err))
+	}
+	options.Dispatch.Chaos = cloud_task_emulator.Chaos{
+		Percent:  *chaosPercent,
+		Failures: failures,
+		Seed:     *chaosSeed,
+	}
+	if *openIDKey != "" {
+		keyPEM, err := os.ReadFile(*openIDKey)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -openid-key: %v", err))
+		}
+		options.Dispatch.OpenIDSigningKey, err = cloud_task_emulator.ParseOpenIDSigningKey(keyPEM)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -openid-key: %v", err))
+		}
+	}
+	if *dispatchHook != "" {
+		source, err := os.ReadFile(*dispatchHook)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -dispatch-hook: %v", err))
+		}
+		options.Dispatch.Hook, err = cloud_task_emulator.NewDispatchHook(*dispatchHook, source)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -dispatch-hook: %v", err))
+		}
+	}
+	if *dispatchCAFile != "" {
+		rootCAs, err := loadRootCAs(*dispatchCAFile)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -dispatch-ca-file: %v", err))
+		}
+		options.Dispatch.RootCAs = rootCAs
+	}
+	if *dispatchProxy != "" {
+		proxy, err := url.Parse(*dispatchProxy)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -dispatch-proxy: %v", err))
+		}
+		options.Dispatch.Proxy = proxy
+	}
+	if *defaultRetryConfig != "" {
+		options.DefaultRetryConfig = &tasks.RetryConfig{}
+		if err := protojson.Unmarshal([]byte(*defaultRetryConfig), options.DefaultRetryConfig); err != nil {
+			panic(fmt.Sprintf("Invalid -default-retry-config: %v", err))
+		}
+	}
+	if *defaultRateLimits != "" {
+		options.DefaultRateLimits = &tasks.RateLimits{}
+		if err := protojson.Unmarshal([]byte(*defaultRateLimits), options.DefaultRateLimits); err != nil {
+			panic(fmt.Sprintf("Invalid -default-rate-limits: %v", err))
+		}
+	}
+	if *defaultMaxAttempts < -1 {
+		panic(fmt.Sprintf("Invalid -default-max-attempts: %d", *defaultMaxAttempts))
+	}
+	if *defaultMinBackoff < 0 || *defaultMaxBackoff < 0 {
+		panic("Invalid -default-min-backoff or -default-max-backoff: negative")
+	}
+	if *defaultMaxDoublings < 0 {
+		panic(fmt.Sprintf("Invalid -default-max-doublings: %d", *defaultMaxDoublings))
+	}
+	if *defaultMaxDispatchesPerSecond < 0 || *defaultMaxConcurrentDispatches < 0 {
+		panic("Invalid -default-max-dispatches-per-second or -default-max-concurrent-dispatches: negative")
+	}
+	if *defaultMaxAttempts != 0 || *defaultMinBackoff != 0 || *defaultMaxBackoff != 0 || *defaultMaxDoublings != 0 {
+		if options.DefaultRetryConfig == nil {
+			options.DefaultRetryConfig = &tasks.RetryConfig{}
+		}
+		if *defaultMaxAttempts != 0 {
+			options.DefaultRetryConfig.MaxAttempts = int32(*defaultMaxAttempts)
+		}
+		if *defaultMinBackoff != 0 {
+			options.DefaultRetryConfig.MinBackoff = durationpb.New(*defaultMinBackoff)
+		}
+		if *defaultMaxBackoff != 0 {
+			options.DefaultRetryConfig.MaxBackoff = durationpb.New(*defaultMaxBackoff)
+		}
+		if *defaultMaxDoublings != 0 {
+			options.DefaultRetryConfig.MaxDoublings = int32(*defaultMaxDoublings)
+		}
+	}
+	if *defaultMaxDispatchesPerSecond != 0 || *defaultMaxConcurrentDispatches != 0 {
+		if options.DefaultRateLimits == nil {
+			options.DefaultRateLimits = &tasks.RateLimits{}
+		}
+		if *defaultMaxDispatchesPerSecond != 0 {
+			options.DefaultRateLimits.MaxDispatchesPerSecond = *defaultMaxDispatchesPerSecond
+		}
+		if *defaultMaxConcurrentDispatches != 0 {
+			options.DefaultRateLimits.MaxConcurrentDispatches = int32(*defaultMaxConcurrentDispatches)
+		}
+	}
+	serverOptions := []cloud_task_emulator.Option{cloud_task_emulator.WithOptions(options)}
+	var walFile *os.File
+	if *walPath != "" {
+		// The recovered state is logged afresh, replacing the log once recovered
+		walFile, err = os.OpenFile(*walPath+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -wal: %v", err))
+		}
+		serverOptions = append(serverOptions, cloud_task_emulator.WithWriteAheadLog(walFile))
+	}
+	emulatorServer := cloud_task_emulator.NewServer(serverOptions...)
+	if walFile != nil {
+		recoverWriteAheadLog(emulatorServer, *walPath, walFile)
+	}
+	grpcServer := emulatorServer.NewGrpcServer(grpc.ChainUnaryInterceptor(cloud_task_emulator.LoggingInterceptor(grpcLogLevel)))
+
+	if *adminPort != "" {
+		go serveAdmin(emulatorServer, *host, *adminPort)
+	}
+
+	if *openIDIssuer != "" {
+		go serveOpenID(emulatorServer, *host, *openIDIssuer)
+	}
+
+	if *recordPath != "" {
+		recordFile, err := os.OpenFile(*recordPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -record: %v", err))
+		}
+		go recordDispatches(emulatorServer.DispatchedRequests(), recordFile)
+	}
 
 	for i := 0; i < len(initialQueues); i++ {
 		createInitialQueue(emulatorServer, initialQueues[i])
 	}
 
+	if *configPath != "" {
+		flagDefaults := cloud_task_emulator.Config{
+			DefaultRetryConfig: options.DefaultRetryConfig,
+			DefaultRateLimits:  options.DefaultRateLimits,
+		}
+		config, err := loadConfig(*configPath, flagDefaults)
+		if err != nil {
+			panic(err)
+		}
+		if err := emulatorServer.ApplyConfig(context.TODO(), nil, config); err != nil {
+			panic(err)
+		}
+		go reloadConfigOnSignal(emulatorServer, *configPath, flagDefaults, config)
+	}
+
+	if *fixturePath != "" {
+		loadFixture(emulatorServer, *fixturePath)
+	}
+
+	if *replayPath != "" {
+		replayTasks(emulatorServer, *replayPath)
+	}
+
+	if *singlePort {
+		grpcLis, httpLis := cloud_task_emulator.Multiplex(lis)
+		go func() {
+			if err := cloud_task_emulator.ServeH2C(httpLis, emulatorServer.HTTPHandler()); err != nil {
+				panic(err)
+			}
+		}()
+		lis = grpcLis
+	}
+
+	go shutdownOnSignal(grpcServer, emulatorServer)
+
 	grpcServer.Serve(lis)
 }
 
+// Stops serving on SIGINT or SIGTERM, aborting in-flight dispatches rather than leaving them to the process exit
+func shutdownOnSignal(grpcServer *grpc.Server, emulatorServer *cloud_task_emulator.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	<-signals
+	logger.Println("Shutting down")
+	grpcServer.Stop()
+	emulatorServer.Shutdown()
+}
+
+// Listens on the Unix domain socket if given, on the TCP host and port otherwise
+func listen(host string, port string, unixSocket string) (net.Listener, error) {
+	if unixSocket == "" {
+		return net.Listen("tcp", hostPort(host, port))
+	}
+
+	// A socket left behind by an emulator that was killed would block the path
+	if info, err := os.Lstat(unixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(unixSocket); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", unixSocket)
+}
+
+// Joins the host and port into a listen address, bracketing IPv6 addresses, which may be given bracketed or not
+func hostPort(host string, port string) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+// Tells harnesses which port the emulator listens on, which -port 0 leaves to the system:
+// as an EMULATOR_PORT=<PORT> line on stdout and, if given, in the port file
+func announcePort(port int, portFile string) error {
+	fmt.Printf("EMULATOR_PORT=%d\n", port)
+
+	if portFile == "" {
+		return nil
+	}
+	// Written aside then renamed so that a harness polling for the file never reads it half written
+	tmpFile := portFile + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(strconv.Itoa(port)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, portFile)
+}
+
+// Serves the admin HTTP API
+func serveAdmin(emulatorServer *cloud_task_emulator.Server, host string, port string) {
+	logger.Printf("Starting admin API, listening on %v\n", hostPort(host, port))
+
+	lis, err := net.Listen("tcp", hostPort(host, port))
+	if err != nil {
+		panic(err)
+	}
+	if err := cloud_task_emulator.ServeH2C(lis, emulatorServer.AdminHandler()); err != nil {
+		panic(err)
+	}
+}
+
+// Creates the queues and tasks of the fixture file
+func loadFixture(emulatorServer *cloud_task_emulator.Server, path string) {
+	logger.Printf("Loading fixture %s\n", path)
+
+	fixtureFile, err := os.Open(path)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -fixture: %v", err))
+	}
+	defer fixtureFile.Close()
+
+	if err := emulatorServer.LoadFixture(context.TODO(), fixtureFile); err != nil {
+		panic(fmt.Sprintf("Invalid -fixture: %v", err))
+	}
+}
+
+// Restores the state of the write-ahead log, if any, and replaces it with the log of the restored state
+func recoverWriteAheadLog(emulatorServer *cloud_task_emulator.Server, path string, walFile *os.File) {
+	if previous, err := os.Open(path); err == nil {
+		logger.Printf("Recovering %s\n", path)
+		err = emulatorServer.RecoverWriteAheadLog(context.TODO(), previous)
+		previous.Close()
+		if err != nil {
+			panic(fmt.Sprintf("Invalid -wal: %v", err))
+		}
+	} else if !os.IsNotExist(err) {
+		panic(fmt.Sprintf("Invalid -wal: %v", err))
+	}
+	if err := os.Rename(walFile.Name(), path); err != nil {
+		panic(fmt.Sprintf("Invalid -wal: %v", err))
+	}
+}
+
+// Re-creates the tasks of the record file
+func replayTasks(emulatorServer *cloud_task_emulator.Server, path string) {
+	logger.Printf("Replaying %s\n", path)
+
+	recordFile, err := os.Open(path)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -replay: %v", err))
+	}
+	defer recordFile.Close()
+
+	if err := emulatorServer.Replay(context.TODO(), recordFile); err != nil {
+		panic(fmt.Sprintf("Invalid -replay: %v", err))
+	}
+}
+
+// Appends the dispatched requests to the record file for as long as it can be written
+func recordDispatches(requests <-chan cloud_task_emulator.DispatchedRequest, recordFile *os.File) {
+	defer recordFile.Close()
+	if err := cloud_task_emulator.RecordDispatches(requests, recordFile); err != nil {
+		logger.Printf("Stopped recording dispatches: %v\n", err)
+	}
+}
+
+// Serves the OpenID discovery document and signing keys on the -host address, at the issuer's port
+func serveOpenID(emulatorServer *cloud_task_emulator.Server, host string, issuer string) {
+	issuerURL, err := url.Parse(issuer)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid -openid-issuer: %v", err))
+	}
+	port := issuerURL.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	logger.Printf("Starting OpenID discovery endpoint, listening on %v\n", hostPort(host, port))
+
+	lis, err := net.Listen("tcp", hostPort(host, port))
+	if err != nil {
+		panic(err)
+	}
+	if err := cloud_task_emulator.ServeH2C(lis, emulatorServer.OpenIDHandler()); err != nil {
+		panic(err)
+	}
+}
+
+// Loads the system roots along with the CA certificates in the PEM file
+func loadRootCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return rootCAs, nil
+}
+
+// Loads the config file, falling back to the defaults given by flags
+func loadConfig(path string, flagDefaults cloud_task_emulator.Config) (*cloud_task_emulator.Config, error) {
+	config, err := cloud_task_emulator.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if config.DefaultRetryConfig == nil {
+		config.DefaultRetryConfig = flagDefaults.DefaultRetryConfig
+	}
+	if config.DefaultRateLimits == nil {
+		config.DefaultRateLimits = flagDefaults.DefaultRateLimits
+	}
+	return config, nil
+}
+
+// Reloads the config file on SIGHUP, for long-lived shared instances
+func reloadConfigOnSignal(emulatorServer *cloud_task_emulator.Server, path string, flagDefaults cloud_task_emulator.Config, current *cloud_task_emulator.Config) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		logger.Printf("Reloading config %s\n", path)
+
+		next, err := loadConfig(path, flagDefaults)
+		if err != nil {
+			// Keep running with the current config
+			logger.Printf("Could not reload config: %v\n", err)
+			continue
+		}
+		if err := emulatorServer.ApplyConfig(context.TODO(), current, next); err != nil {
+			logger.Printf("Config only partially applied: %v\n", err)
+		}
+		current = next
+	}
+}
+
 // arrayFlags used for parsing list of potentially repeated flags e.g. -queue $Q1 -queue $Q2
 type arrayFlags []string
 
@@ -55,9 +582,65 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// Parses the -iam-permissions flags into permissions per caller
+func parseIamPermissions(values []string) map[string][]string {
+	permissions := make(map[string][]string)
+	for _, value := range values {
+		caller, granted, found := strings.Cut(value, "=")
+		if !found {
+			panic(fmt.Sprintf("Invalid -iam-permissions value %q, expected <CALLER>=<PERMISSION>[,<PERMISSION>...]", value))
+		}
+		if granted != "" {
+			permissions[caller] = append(permissions[caller], strings.Split(granted, ",")...)
+		} else if _, ok := permissions[caller]; !ok {
+			permissions[caller] = []string{}
+		}
+	}
+	return permissions
+}
+
+// Parses the -rewrite-url flags into rewrite rules, in order
+func parseURLRewrites(values []string) []cloud_task_emulator.URLRewrite {
+	var rewrites []cloud_task_emulator.URLRewrite
+	for _, value := range values {
+		from, to, found := strings.Cut(value, "=")
+		if !found || from == "" {
+			panic(fmt.Sprintf("Invalid -rewrite-url value %q, expected <FROM>=<TO>", value))
+		}
+		rewrites = append(rewrites, cloud_task_emulator.URLRewrite{From: from, To: to})
+	}
+	return rewrites
+}
+
+// Parses the -queue-target flags into targets per queue
+func parseQueueTargets(values []string) map[string]string {
+	targets := make(map[string]string)
+	for _, value := range values {
+		queue, target, found := strings.Cut(value, "=")
+		if !found || queue == "" || target == "" {
+			panic(fmt.Sprintf("Invalid -queue-target value %q, expected <QUEUE>=<TARGET>", value))
+		}
+		targets[queue] = target
+	}
+	return targets
+}
+
+// Parses the -dispatch-header flags into header values by name
+func parseDispatchHeaders(values []string) map[string]string {
+	headers := make(map[string]string)
+	for _, value := range values {
+		name, headerValue, found := strings.Cut(value, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			panic(fmt.Sprintf("Invalid -dispatch-header value %q, expected '<NAME>: <VALUE>'", value))
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(headerValue)
+	}
+	return headers
+}
+
 // Creates an initial queue on the emulator
 func createInitialQueue(emulatorServer *cloud_task_emulator.Server, name string) {
-	print(fmt.Sprintf("Creating initial queue %s\n", name))
+	logger.Printf("Creating initial queue %s\n", name)
 
 	r := regexp.MustCompile("/queues/[A-Za-z0-9-]+$")
 	parentName := r.ReplaceAllString(name, "")
@@ -69,6 +652,10 @@ func createInitialQueue(emulatorServer *cloud_task_emulator.Server, name string)
 	}
 
 	_, err := emulatorServer.CreateQueue(context.TODO(), req)
+	if status.Code(err) == codes.AlreadyExists {
+		// Recovered from the write-ahead log
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
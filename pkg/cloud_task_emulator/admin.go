@@ -0,0 +1,338 @@
+package cloud_task_emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// AdminHandler returns the HTTP handler of the emulator's admin API, served under /emulator/v1/, and of its
+// expvar variables, served under /debug/vars
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/emulator/v1/audit", s.handleAudit)
+	mux.HandleFunc("/emulator/v1/tombstones", s.handleTombstones)
+	mux.HandleFunc("/emulator/v1/metrics", s.handleMetrics)
+	mux.HandleFunc("/debug/vars", s.handleVars)
+	mux.HandleFunc("/emulator/v1/fixtures", s.handleFixtures)
+	mux.HandleFunc("/emulator/v1/projects", s.handleProjects)
+	mux.HandleFunc("/emulator/v1/projects/", s.handleProjectResource)
+	return s.namespaceHandler(mux)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
+
+// writeProtoJSON writes a proto message in its JSON mapping, e.g. a task as the REST API returns it
+func writeProtoJSON(w http.ResponseWriter, statusCode int, message proto.Message) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encoded, _ := protojson.Marshal(message)
+	w.Write(encoded)
+}
+
+// writeStatusError writes a gRPC status error with the matching HTTP status code
+func writeStatusError(w http.ResponseWriter, err error) {
+	statusCode := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		statusCode = http.StatusBadRequest
+	case codes.NotFound:
+		statusCode = http.StatusNotFound
+	case codes.FailedPrecondition:
+		statusCode = http.StatusConflict
+	}
+	writeError(w, statusCode, status.Convert(err).Message())
+}
+
+// handleAudit lists (optionally filtered by ?method=) or clears the audit log
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries := s.AuditLog()
+		if method := r.URL.Query().Get("method"); method != "" {
+			filtered := make([]AuditEntry, 0, len(entries))
+			for _, entry := range entries {
+				if entry.Method == method {
+					filtered = append(filtered, entry)
+				}
+			}
+			entries = filtered
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+	case http.MethodDelete:
+		s.ClearAuditLog()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleProjectResource routes the calls on resources below /emulator/v1/projects/
+func (s *Server) handleProjectResource(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/emulator/v1/"), "/")
+	isResource := func(collections ...string) bool {
+		if len(segments) != 2*len(collections)+1 {
+			return false
+		}
+		for i, collection := range collections {
+			if segments[2*i] != collection || segments[2*i+1] == "" {
+				return false
+			}
+		}
+		return true
+	}
+	// The resource name, without the action in the last segment
+	name := strings.Join(segments[:len(segments)-1], "/")
+
+	switch {
+	case len(segments) == 2 && segments[0] == "projects" && segments[1] != "":
+		s.handleProject(w, r, segments[1])
+	case isResource("projects", "locations", "queues"):
+		switch segments[len(segments)-1] {
+		case "settings":
+			s.handleQueueSettings(w, r, name)
+		case "failNext":
+			s.handleQueueFailNext(w, r, name)
+		case "stats":
+			s.handleQueueStats(w, r, name)
+		case "tombstones":
+			s.handleQueueTombstones(w, r, name)
+		default:
+			writeError(w, http.StatusNotFound, "Not found")
+		}
+	case isResource("projects", "locations", "queues", "tasks"):
+		switch segments[len(segments)-1] {
+		case "retryNow":
+			s.handleTaskRetryNow(w, r, name)
+		case "scheduleTime":
+			s.handleTaskScheduleTime(w, r, name)
+		default:
+			writeError(w, http.StatusNotFound, "Not found")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// handleFixtures loads the YAML fixture posted
+func (s *Server) handleFixtures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := s.LoadFixture(r.Context(), r.Body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleProjects tears down every project
+func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	s.Reset()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleProject tears down a project
+func (s *Server) handleProject(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	s.DeleteProject(project)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleQueueSettings reads or replaces the emulator-only settings of a queue
+func (s *Server) handleQueueSettings(w http.ResponseWriter, r *http.Request, queueName string) {
+	queue, ok := s.fetchQueue(queueName)
+	if !ok || queue == nil {
+		writeError(w, http.StatusNotFound, "Queue does not exist.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, queue.Settings())
+	case http.MethodPut:
+		var settings QueueSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid settings: "+err.Error())
+			return
+		}
+		if err := settings.HttpTarget.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid settings: "+err.Error())
+			return
+		}
+		queue.SetSettings(settings)
+		writeJSON(w, http.StatusOK, settings)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleQueueFailNext reads or replaces the dispatches of a queue left to fail
+func (s *Server) handleQueueFailNext(w http.ResponseWriter, r *http.Request, queueName string) {
+	queue, ok := s.fetchQueue(queueName)
+	if !ok || queue == nil {
+		writeError(w, http.StatusNotFound, "Queue does not exist.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, queue.ForcedFailures())
+	case http.MethodPut:
+		var failures ForcedFailures
+		if err := json.NewDecoder(r.Body).Decode(&failures); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid failures: "+err.Error())
+			return
+		}
+		if failures.Count < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid failures: count cannot be negative")
+			return
+		}
+		if failures.Status != 0 && (failures.Status < 100 || failures.Status > 599 || (failures.Status >= 200 && failures.Status <= 299)) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid failures: %d is not an HTTP failure status", failures.Status))
+			return
+		}
+		queue.FailNextDispatches(failures)
+		writeJSON(w, http.StatusOK, failures)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleTombstones clears the reserved task names of every queue
+func (s *Server) handleTombstones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	s.ClearAllTombstones()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleQueueTombstones lists the reserved task names of a queue, or looks up the one given by ?name=,
+// either as a full task name or the task ID, or clears them
+func (s *Server) handleQueueTombstones(w http.ResponseWriter, r *http.Request, queueName string) {
+	switch r.Method {
+	case http.MethodGet:
+		entries := []Tombstone{}
+		if name := r.URL.Query().Get("name"); name != "" {
+			if !strings.Contains(name, "/") {
+				name = queueName + "/tasks/" + name
+			}
+			if tombstone, ok := s.TaskNameTombstone(name); ok && queueNameOf(name) == queueName {
+				entries = append(entries, tombstone)
+			}
+		} else {
+			entries = s.Tombstones(queueName)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+	case http.MethodDelete:
+		s.ClearTombstones(queueName)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// RetryTaskNow cuts short the backoff of a task waiting to be retried, for its queue to dispatch it as soon as
+// it can. Unlike RunTask, which dispatches straight away whatever the queue's state, the retry respects the
+// queue's rate limits and pause. The counters carry on, as for any retry.
+func (s *Server) RetryTaskNow(taskName string) (*tasks.Task, error) {
+	task, _, err := s.fetchTask(taskName)
+	if err != nil {
+		return nil, err
+	}
+	if task == nil {
+		return nil, errTaskNotFound()
+	}
+	if !task.retryNow() {
+		return nil, errTaskNotRetrying()
+	}
+	return task.snapshot(), nil
+}
+
+// handleTaskRetryNow retries a task waiting out its backoff straight away
+func (s *Server) handleTaskRetryNow(w http.ResponseWriter, r *http.Request, taskName string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	taskState, err := s.RetryTaskNow(taskName)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeProtoJSON(w, http.StatusOK, taskState)
+}
+
+// RescheduleTask changes the schedule time of a task waiting for its first attempt or to be retried, e.g. to
+// pull a far-future task forward without deleting and recreating it, which would reserve its name.
+// The dispatch and response counters are kept.
+func (s *Server) RescheduleTask(taskName string, scheduleTime time.Time) (*tasks.Task, error) {
+	task, _, err := s.fetchTask(taskName)
+	if err != nil {
+		return nil, err
+	}
+	if task == nil {
+		return nil, errTaskNotFound()
+	}
+	if err := s.validateScheduleTime(scheduleTime); err != nil {
+		return nil, err
+	}
+	if !task.moveSchedule(scheduleTime) {
+		return nil, errTaskNotScheduled()
+	}
+	return task.snapshot(), nil
+}
+
+// TaskSchedule is the body of the admin call rescheduling a task
+type TaskSchedule struct {
+	ScheduleTime time.Time `json:"scheduleTime"`
+}
+
+// handleTaskScheduleTime moves the schedule time of a task
+func (s *Server) handleTaskScheduleTime(w http.ResponseWriter, r *http.Request, taskName string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var schedule TaskSchedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid schedule: "+err.Error())
+		return
+	}
+	if schedule.ScheduleTime.IsZero() {
+		writeError(w, http.StatusBadRequest, "Invalid schedule: scheduleTime is required")
+		return
+	}
+	taskState, err := s.RescheduleTask(taskName, schedule.ScheduleTime)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	writeProtoJSON(w, http.StatusOK, taskState)
+}
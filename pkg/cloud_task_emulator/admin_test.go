@@ -0,0 +1,744 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// callThroughInterceptor invokes a server method the way the gRPC server would with the audit interceptor installed
+func callThroughInterceptor(ctx context.Context, server *Server, method string, req interface{}, handler grpc.UnaryHandler) error {
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.tasks.v2.CloudTasks/" + method}
+	_, err := server.AuditInterceptor(ctx, req, info, handler)
+	return err
+}
+
+func createQueueThroughInterceptor(t *testing.T, server *Server, name string) {
+	req := &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, name)}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(CallerMetadataKey, "user:alice@example.com"))
+	err := callThroughInterceptor(ctx, server, "CreateQueue", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.CreateQueue(ctx, req.(*taskspb.CreateQueueRequest))
+	})
+	require.NoError(t, err)
+}
+
+func getAuditLog(t *testing.T, adminUrl string) []AuditEntry {
+	resp, err := http.Get(adminUrl)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return body.Entries
+}
+
+func TestAuditLogRecordsCalls(t *testing.T) {
+	server := NewServer()
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	createQueueThroughInterceptor(t, server, "audited")
+
+	err := callThroughInterceptor(context.Background(), server, "GetQueue", &taskspb.GetQueueRequest{Name: "missing"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.GetQueue(ctx, req.(*taskspb.GetQueueRequest))
+	})
+	require.Error(t, err)
+
+	entries := getAuditLog(t, admin.URL+"/emulator/v1/audit")
+	require.Len(t, entries, 2)
+	assert.Equal(t, "CreateQueue", entries[0].Method)
+	assert.Equal(t, "parent="+formattedParent, entries[0].Request)
+	assert.Equal(t, "user:alice@example.com", entries[0].Caller)
+	assert.Equal(t, "OK", entries[0].Code)
+	assert.Equal(t, "GetQueue", entries[1].Method)
+	assert.Equal(t, "name=missing", entries[1].Request)
+	assert.Equal(t, "NotFound", entries[1].Code)
+
+	assert.Empty(t, getAuditLog(t, admin.URL+"/emulator/v1/audit?method=PurgeQueue"))
+	assert.Len(t, getAuditLog(t, admin.URL+"/emulator/v1/audit?method=GetQueue"), 1)
+
+	req, err := http.NewRequest(http.MethodDelete, admin.URL+"/emulator/v1/audit", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, server.AuditLog())
+}
+
+func TestAuditLogRecordsQueueUpdates(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	createQueueThroughInterceptor(t, server, "updated")
+	queueName := formatQueueName(formattedParent, "updated")
+
+	update := &taskspb.UpdateQueueRequest{
+		Queue:      &taskspb.Queue{Name: queueName, RetryConfig: &taskspb.RetryConfig{MaxAttempts: 2, MaxDoublings: 4}},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"retry_config.max_attempts", "retry_config.max_doublings"}},
+	}
+	err := callThroughInterceptor(context.Background(), server, "UpdateQueue", update, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.UpdateQueue(ctx, req.(*taskspb.UpdateQueueRequest))
+	})
+	require.NoError(t, err)
+
+	entries := server.AuditLog()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "UpdateQueue", entries[1].Method)
+	assert.Equal(t, "name="+queueName+" updateMask=retry_config.max_attempts,retry_config.max_doublings", entries[1].Request)
+}
+
+func TestAuditLogIsBounded(t *testing.T) {
+	server := NewServer(WithOptions(ServerOptions{AuditLogSize: 2}))
+
+	for _, name := range []string{"first", "second", "third"} {
+		callThroughInterceptor(context.Background(), server, "GetQueue", &taskspb.GetQueueRequest{Name: name}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return server.GetQueue(ctx, req.(*taskspb.GetQueueRequest))
+		})
+	}
+
+	entries := server.AuditLog()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "name=second", entries[0].Request)
+	assert.Equal(t, "name=third", entries[1].Request)
+}
+
+func TestQueueSettingsOverrideHardReset(t *testing.T) {
+	server := NewServer(WithHardReset(true))
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "production-purge")})
+	require.NoError(t, err)
+	settingsUrl := admin.URL + "/emulator/v1/" + queue.GetName() + "/settings"
+
+	req, err := http.NewRequest(http.MethodPut, settingsUrl, strings.NewReader(`{"hardResetOnPurge": false}`))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(settingsUrl)
+	require.NoError(t, err)
+	var settings QueueSettings
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&settings))
+	resp.Body.Close()
+	require.NotNil(t, settings.HardResetOnPurge)
+	assert.False(t, *settings.HardResetOnPurge)
+
+	createTaskRequest := &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			Name:         queue.GetName() + "/tasks/kept-name",
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com"},
+			},
+		},
+	}
+	_, err = server.CreateTask(context.Background(), createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = server.PurgeQueue(context.Background(), &taskspb.PurgeQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+
+	// Production semantics: the name stays reserved
+	assert.Eventually(t, func() bool {
+		_, err := server.CreateTask(context.Background(), createTaskRequest)
+		return status.Code(err) == codes.AlreadyExists
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueSettingsUnknownQueue(t *testing.T) {
+	server := NewServer()
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	resp, err := http.Get(admin.URL + "/emulator/v1/" + formatQueueName(formattedParent, "missing") + "/settings")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// putAdmin sends a PUT to the admin API, returning the response status code
+func putAdmin(t *testing.T, url string, body string) int {
+	return callAdmin(t, http.MethodPut, url, body)
+}
+
+func callAdmin(t *testing.T, method string, url string, body string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// getAdminJSON decodes the body of a successful admin call into v
+func getAdminJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestFailNextDispatches(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "failing"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 2, MinBackoff: durationpb.New(10 * time.Millisecond)},
+		},
+	})
+	require.NoError(t, err)
+	failNextUrl := admin.URL + "/emulator/v1/" + queue.GetName() + "/failNext"
+
+	assert.Equal(t, http.StatusBadRequest, putAdmin(t, failNextUrl, `{"count": -1}`))
+	assert.Equal(t, http.StatusBadRequest, putAdmin(t, failNextUrl, `{"count": 1, "status": 204}`))
+	require.Equal(t, http.StatusOK, putAdmin(t, failNextUrl, `{"count": 2, "status": 503}`))
+
+	createTask := func() string {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+			},
+		})
+		require.NoError(t, err)
+		return task.GetName()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Both attempts of the first task fail without reaching the target
+	failed := createTask()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, failed))
+	snapshot, ok := server.TaskSnapshot(failed)
+	require.True(t, ok)
+	assert.EqualValues(t, 2, snapshot.GetDispatchCount())
+	assert.EqualValues(t, codes.Unavailable, snapshot.GetLastAttempt().GetResponseStatus().GetCode())
+	assert.Empty(t, receivedRequests)
+
+	resp, err := http.Get(failNextUrl)
+	require.NoError(t, err)
+	var failures ForcedFailures
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&failures))
+	resp.Body.Close()
+	assert.Equal(t, ForcedFailures{Count: 0, Status: 503}, failures)
+
+	// The next task goes through
+	require.NoError(t, server.WaitForTaskCompletion(ctx, createTask()))
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+}
+
+func TestRetryTaskNow(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "backing-off"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 3, MinBackoff: durationpb.New(time.Hour)},
+		},
+	})
+	require.NoError(t, err)
+	createTask := func(scheduleTime time.Time) string {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: timestamppb.New(scheduleTime),
+				MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/not_found"}},
+			},
+		})
+		require.NoError(t, err)
+		return task.GetName()
+	}
+	t.Cleanup(func() {
+		server.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queue.GetName()})
+	})
+
+	// A task that has yet to run is not backing off
+	later := createTask(time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusConflict, callAdmin(t, http.MethodPost, admin.URL+"/emulator/v1/"+later+"/retryNow", ""))
+	assert.Equal(t, http.StatusNotFound, callAdmin(t, http.MethodPost, admin.URL+"/emulator/v1/"+queue.GetName()+"/tasks/missing/retryNow", ""))
+	assert.Equal(t, http.StatusMethodNotAllowed, callAdmin(t, http.MethodGet, admin.URL+"/emulator/v1/"+later+"/retryNow", ""))
+
+	failing := createTask(time.Now())
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	// Once the retry is scheduled, an hour out, it is cut short
+	retryNowUrl := admin.URL + "/emulator/v1/" + failing + "/retryNow"
+	assert.Eventually(t, func() bool {
+		return callAdmin(t, http.MethodPost, retryNowUrl, "") == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		snapshot, _ := server.TaskSnapshot(failing)
+		return snapshot.GetResponseCount() == 2
+	}, time.Second, 10*time.Millisecond)
+	snapshot, _ := server.TaskSnapshot(failing)
+	assert.EqualValues(t, 2, snapshot.GetDispatchCount())
+}
+
+// manualScheduler dispatches the tasks due by now straight away, and retries them after an hour unless the test
+// fires the waits first
+type manualScheduler struct {
+	waiting []chan time.Time
+
+	mux sync.Mutex
+}
+
+func (s *manualScheduler) Wait(due time.Time) (<-chan time.Time, func() bool) {
+	fired := make(chan time.Time, 1)
+	if !due.After(time.Now()) {
+		fired <- due
+	} else {
+		s.mux.Lock()
+		s.waiting = append(s.waiting, fired)
+		s.mux.Unlock()
+	}
+	return fired, func() bool { return false }
+}
+
+func (s *manualScheduler) Backoff(retryConfig *taskspb.RetryConfig, dispatchCount int32) time.Duration {
+	return time.Hour
+}
+
+// fire fires the waits so far, returning how many there were
+func (s *manualScheduler) fire() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	fired := len(s.waiting)
+	for _, waiting := range s.waiting {
+		waiting <- time.Now()
+	}
+	s.waiting = nil
+	return fired
+}
+
+func (s *manualScheduler) waits() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.waiting)
+}
+
+func TestRetryTaskNowWhileBackoffFires(t *testing.T) {
+	// Each task fails its first attempt and succeeds after
+	var attempts sync.Map
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, _ := attempts.LoadOrStore(r.URL.Path, new(int32))
+		if atomic.AddInt32(count.(*int32), 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(target.Close)
+	scheduler := &manualScheduler{}
+	server := NewServer(WithScheduler(scheduler))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "racing")})
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: fmt.Sprintf("%s/task-%d", target.URL, i)}},
+			},
+		})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return scheduler.waits() == 1 }, time.Second, time.Millisecond)
+
+		// The retry is cut short while its backoff fires, either way it is dispatched once
+		fired := make(chan int)
+		go func() { fired <- scheduler.fire() }()
+		_, err = server.RetryTaskNow(task.GetName())
+		if err != nil {
+			// Not backing off anymore, or done already
+			assert.Contains(t, []codes.Code{codes.FailedPrecondition, codes.NotFound}, status.Code(err))
+		}
+		assert.Equal(t, 1, <-fired)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitUntilIdle(ctx, queue.GetName()))
+	assert.Never(t, func() bool {
+		dispatchedTwice := false
+		attempts.Range(func(path, count interface{}) bool {
+			dispatchedTwice = atomic.LoadInt32(count.(*int32)) > 2
+			return !dispatchedTwice
+		})
+		return dispatchedTwice
+	}, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestRescheduleTask(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "rescheduled")})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		server.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queue.GetName()})
+	})
+	createTask := func(scheduleTime time.Time) string {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: timestamppb.New(scheduleTime),
+				MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+			},
+		})
+		require.NoError(t, err)
+		return task.GetName()
+	}
+	scheduleTimeUrl := func(taskName string) string {
+		return admin.URL + "/emulator/v1/" + taskName + "/scheduleTime"
+	}
+
+	// Pushing an imminent task back
+	imminent := createTask(time.Now().Add(200 * time.Millisecond))
+	later := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	require.Equal(t, http.StatusOK, putAdmin(t, scheduleTimeUrl(imminent), `{"scheduleTime": "`+later.Format(time.RFC3339)+`"}`))
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 400*time.Millisecond)
+	assert.Error(t, err)
+	snapshot, ok := server.TaskSnapshot(imminent)
+	require.True(t, ok)
+	assert.Equal(t, later, snapshot.GetScheduleTime().AsTime())
+
+	// Pulling it forward again
+	require.Equal(t, http.StatusOK, putAdmin(t, scheduleTimeUrl(imminent), `{"scheduleTime": "`+time.Now().Format(time.RFC3339Nano)+`"}`))
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	farFuture := createTask(time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusBadRequest, putAdmin(t, scheduleTimeUrl(farFuture), `{}`))
+	assert.Equal(t, http.StatusBadRequest, putAdmin(t, scheduleTimeUrl(farFuture), `{"scheduleTime": "`+time.Now().Add(31*24*time.Hour).Format(time.RFC3339)+`"}`))
+	assert.Equal(t, http.StatusNotFound, putAdmin(t, scheduleTimeUrl(queue.GetName()+"/tasks/missing"), `{"scheduleTime": "`+time.Now().Format(time.RFC3339)+`"}`))
+}
+
+func TestRescheduleTaskWhileScheduleFires(t *testing.T) {
+	var attempts sync.Map
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, _ := attempts.LoadOrStore(r.URL.Path, new(int32))
+		atomic.AddInt32(count.(*int32), 1)
+	}))
+	t.Cleanup(target.Close)
+	scheduler := &manualScheduler{}
+	server := NewServer(WithScheduler(scheduler))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "moving")})
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+				MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: fmt.Sprintf("%s/task-%d", target.URL, i)}},
+			},
+		})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return scheduler.waits() == 1 }, time.Second, time.Millisecond)
+
+		// The task is pulled forward while its schedule fires, either way it is dispatched once
+		fired := make(chan int)
+		go func() { fired <- scheduler.fire() }()
+		_, err = server.RescheduleTask(task.GetName(), time.Now())
+		if err != nil {
+			// Being dispatched already, or done
+			assert.Contains(t, []codes.Code{codes.FailedPrecondition, codes.NotFound}, status.Code(err))
+		}
+		assert.Equal(t, 1, <-fired)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitUntilIdle(ctx, queue.GetName()))
+	assert.Never(t, func() bool {
+		dispatchedTwice := false
+		attempts.Range(func(path, count interface{}) bool {
+			dispatchedTwice = atomic.LoadInt32(count.(*int32)) > 1
+			return !dispatchedTwice
+		})
+		return dispatchedTwice
+	}, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func getTombstones(t *testing.T, url string) []Tombstone {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body struct {
+		Entries []Tombstone `json:"entries"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return body.Entries
+}
+
+func TestQueueTombstones(t *testing.T) {
+	server := NewServer(WithOptions(ServerOptions{KeepTombstonedNames: true}))
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "tombstoned")})
+	require.NoError(t, err)
+	_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+
+	taskName := queue.GetName() + "/tasks/reused"
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			Name:        taskName,
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = server.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: taskName})
+	require.NoError(t, err)
+
+	tombstonesUrl := admin.URL + "/emulator/v1/" + queue.GetName() + "/tombstones"
+	assert.Eventually(t, func() bool {
+		return len(getTombstones(t, tombstonesUrl)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	entries := getTombstones(t, tombstonesUrl)
+	assert.Equal(t, taskName, entries[0].Name)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), entries[0].ExpireTime, time.Minute)
+
+	assert.Len(t, getTombstones(t, tombstonesUrl+"?name=reused"), 1)
+	assert.Len(t, getTombstones(t, tombstonesUrl+"?name="+taskName), 1)
+	assert.Empty(t, getTombstones(t, tombstonesUrl+"?name=other"))
+	assert.Empty(t, getTombstones(t, admin.URL+"/emulator/v1/"+formatQueueName(formattedParent, "untouched")+"/tombstones"))
+	assert.Equal(t, http.StatusMethodNotAllowed, callAdmin(t, http.MethodPost, tombstonesUrl, ""))
+}
+
+func TestClearTombstones(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	createTask := func(queueName string) error {
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				Name:        queueName + "/tasks/reused",
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+			},
+		})
+		return err
+	}
+	var queueNames []string
+	for _, name := range []string{"cleared", "kept"} {
+		queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, name)})
+		require.NoError(t, err)
+		_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+		require.NoError(t, err)
+		require.NoError(t, createTask(queue.GetName()))
+		_, err = server.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: queue.GetName() + "/tasks/reused"})
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return server.TombstoneCount(queue.GetName()) == 1
+		}, time.Second, 10*time.Millisecond)
+		queueNames = append(queueNames, queue.GetName())
+	}
+	cleared, kept := queueNames[0], queueNames[1]
+
+	assert.Equal(t, http.StatusNoContent, callAdmin(t, http.MethodDelete, admin.URL+"/emulator/v1/"+cleared+"/tombstones", ""))
+	assert.NoError(t, createTask(cleared))
+	assert.Equal(t, codes.AlreadyExists, status.Code(createTask(kept)))
+
+	// Names of existing tasks stay taken
+	assert.Equal(t, http.StatusNoContent, callAdmin(t, http.MethodDelete, admin.URL+"/emulator/v1/tombstones", ""))
+	assert.Equal(t, codes.AlreadyExists, status.Code(createTask(cleared)))
+	assert.NoError(t, createTask(kept))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, callAdmin(t, http.MethodGet, admin.URL+"/emulator/v1/tombstones", ""))
+}
+
+func TestQueueSettingsHttpTarget(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+	target, err := url.Parse(testServerUrl)
+	require.NoError(t, err)
+
+	server := NewServer()
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "http-target")})
+	require.NoError(t, err)
+	settingsUrl := admin.URL + "/emulator/v1/" + queue.GetName() + "/settings"
+
+	assert.Equal(t, http.StatusBadRequest, putAdmin(t, settingsUrl, `{"httpTarget": {"uriOverride": {"scheme": "FTP"}}}`))
+	require.Equal(t, http.StatusOK, putAdmin(t, settingsUrl, fmt.Sprintf(`{"httpTarget": {
+		"uriOverride": {"scheme": "HTTP", "host": %q, "port": %s, "pathOverride": {"path": "/success"}},
+		"headerOverrides": [{"header": {"key": "X-Team", "value": "billing"}}]
+	}}`, target.Hostname(), target.Port())))
+
+	// Tasks may leave out their URL when the queue sets the host
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Headers: map[string]string{"x-team": "sales"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "/success", receivedRequest.URL.Path)
+	assert.Equal(t, []string{"billing"}, receivedRequest.Header.Values("X-Team"))
+}
+
+func TestDeleteProject(t *testing.T) {
+	server := NewServer()
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	createTask := func(queueName string, taskID string) error {
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queueName,
+			Task: &taskspb.Task{
+				Name:         queueName + "/tasks/" + taskID,
+				ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/never"},
+				},
+			},
+		})
+		return err
+	}
+
+	workerParent := formatParent("worker-1", "here")
+	otherParent := formatParent("worker-2", "here")
+	workerQueue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: workerParent, Queue: newQueue(workerParent, "q")})
+	require.NoError(t, err)
+	otherQueue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: otherParent, Queue: newQueue(otherParent, "q")})
+	require.NoError(t, err)
+
+	require.NoError(t, createTask(workerQueue.GetName(), "pending"))
+	require.NoError(t, createTask(workerQueue.GetName(), "deleted"))
+	_, err = server.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: workerQueue.GetName() + "/tasks/deleted"})
+	require.NoError(t, err)
+	require.NoError(t, createTask(otherQueue.GetName(), "pending"))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, callAdmin(t, http.MethodGet, admin.URL+"/emulator/v1/projects/worker-1", ""))
+	require.Equal(t, http.StatusNoContent, callAdmin(t, http.MethodDelete, admin.URL+"/emulator/v1/projects/worker-1", ""))
+
+	_, err = server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: workerQueue.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: otherQueue.GetName() + "/tasks/pending"})
+	assert.NoError(t, err)
+
+	// The project starts afresh: its queue and task names are free, even once the cancelled tasks wound down
+	time.Sleep(20 * time.Millisecond)
+	assert.Zero(t, server.TombstoneCount(workerQueue.GetName()))
+	_, err = server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: workerParent, Queue: newQueue(workerParent, "q")})
+	require.NoError(t, err)
+	assert.NoError(t, createTask(workerQueue.GetName(), "pending"))
+	assert.NoError(t, createTask(workerQueue.GetName(), "deleted"))
+}
+
+func TestAdminRoutesResourcesNamedLikeActions(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	// A project, queue and task named after the actions
+	parent := formatParent("stats", "here")
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: parent, Queue: newQueue(parent, "settings")})
+	require.NoError(t, err)
+	_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+	taskName := queue.GetName() + "/tasks/retryNow"
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			Name:        taskName,
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+		},
+	})
+	require.NoError(t, err)
+
+	var stats map[string]interface{}
+	assert.Equal(t, http.StatusOK, getAdminJSON(t, admin.URL+"/emulator/v1/"+queue.GetName()+"/stats", &stats))
+	assert.Equal(t, http.StatusOK, callAdmin(t, http.MethodGet, admin.URL+"/emulator/v1/"+queue.GetName()+"/settings", ""))
+	assert.Equal(t, http.StatusOK, putAdmin(t, admin.URL+"/emulator/v1/"+taskName+"/scheduleTime", `{"scheduleTime": "`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`"}`))
+
+	// Unknown actions and partial names are not found rather than routed by their last segment
+	assert.Equal(t, http.StatusNotFound, callAdmin(t, http.MethodGet, admin.URL+"/emulator/v1/"+queue.GetName()+"/other", ""))
+	assert.Equal(t, http.StatusNotFound, callAdmin(t, http.MethodGet, admin.URL+"/emulator/v1/projects/stats/locations/here/stats", ""))
+	assert.Equal(t, http.StatusNotFound, callAdmin(t, http.MethodPost, admin.URL+"/emulator/v1/"+queue.GetName()+"/retryNow", ""))
+
+	require.Equal(t, http.StatusNoContent, callAdmin(t, http.MethodDelete, admin.URL+"/emulator/v1/projects/stats", ""))
+	_, err = server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestResetAllProjects(t *testing.T) {
+	server := NewServer()
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	for _, project := range []string{"worker-1", "worker-2"} {
+		parent := formatParent(project, "here")
+		_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: parent, Queue: newQueue(parent, "q")})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, http.StatusNoContent, callAdmin(t, http.MethodDelete, admin.URL+"/emulator/v1/projects", ""))
+	assert.Empty(t, server.ListQueuesSnapshot())
+}
@@ -0,0 +1,113 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/grpc"
+	status "google.golang.org/grpc/status"
+)
+
+// defaultAuditLogSize is the number of API calls kept in the audit log unless configured otherwise
+const defaultAuditLogSize = 1000
+
+// AuditEntry records a single API call made to the emulator
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Request string    `json:"request"`
+	Caller  string    `json:"caller"`
+	Code    string    `json:"code"`
+}
+
+// auditLog is a bounded, in-memory log of API calls, dropping the oldest calls first
+type auditLog struct {
+	mux sync.Mutex
+
+	entries []AuditEntry
+
+	// next is the position of the next entry once the log is full
+	next int
+}
+
+func (l *auditLog) record(entry AuditEntry, size int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if len(l.entries) < size {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+func (l *auditLog) list() []AuditEntry {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	entries := make([]AuditEntry, 0, len(l.entries))
+	entries = append(entries, l.entries[l.next:]...)
+	entries = append(entries, l.entries[:l.next]...)
+	return entries
+}
+
+func (l *auditLog) clear() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.entries = nil
+	l.next = 0
+}
+
+// summarizeRequest describes the resource a request targets
+func summarizeRequest(req interface{}) string {
+	switch r := req.(type) {
+	case *tasks.UpdateQueueRequest:
+		// The queue is nested, and the mask tells which of its settings changed
+		return "name=" + r.GetQueue().GetName() + " updateMask=" + strings.Join(r.GetUpdateMask().GetPaths(), ",")
+	case interface{ GetName() string }:
+		return "name=" + r.GetName()
+	case interface{ GetParent() string }:
+		return "parent=" + r.GetParent()
+	case interface{ GetResource() string }:
+		return "resource=" + r.GetResource()
+	default:
+		return fmt.Sprintf("%T", req)
+	}
+}
+
+// AuditInterceptor is a gRPC unary interceptor recording every call in the audit log
+func (s *Server) AuditInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := s.clock.Now()
+	resp, err := handler(ctx, req)
+
+	size := s.options.AuditLogSize
+	if size <= 0 {
+		size = defaultAuditLogSize
+	}
+	s.audit.record(AuditEntry{
+		Time:    start,
+		Method:  path.Base(info.FullMethod),
+		Request: summarizeRequest(req),
+		Caller:  callerIdentity(ctx),
+		Code:    status.Code(err).String(),
+	}, size)
+
+	return resp, err
+}
+
+// AuditLog returns the recorded API calls, oldest first
+func (s *Server) AuditLog() []AuditEntry {
+	return s.audit.list()
+}
+
+// ClearAuditLog forgets all recorded API calls
+func (s *Server) ClearAuditLog() {
+	s.audit.clear()
+}
@@ -0,0 +1,47 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// bearerToken returns the token of the call's "authorization: Bearer <token>" metadata, or an empty string if the
+// call is anonymous
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		scheme, token, found := strings.Cut(value, " ")
+		if found && strings.EqualFold(scheme, "Bearer") && strings.TrimSpace(token) != "" {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
+
+// AuthInterceptor is a gRPC unary interceptor rejecting anonymous calls with UNAUTHENTICATED, and calls with a
+// token other than the accepted ones if any, see ServerOptions.RequireAuthentication
+func (s *Server) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	token := bearerToken(ctx)
+	if token == "" {
+		return nil, errMissingCredentials()
+	}
+	if len(s.options.AuthTokens) > 0 && !containsString(s.options.AuthTokens, token) {
+		return nil, errInvalidCredentials()
+	}
+	return handler(ctx, req)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"testing"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcStatus "google.golang.org/grpc/status"
+)
+
+func TestRequireAuthentication(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{RequireAuthentication: true})
+	listQueues := func(ctx context.Context) error {
+		_, err := client.ListQueues(ctx, &taskspb.ListQueuesRequest{Parent: formattedParent}).Next()
+		if err == iterator.Done {
+			return nil
+		}
+		return err
+	}
+
+	err := listQueues(context.Background())
+	assert.Equal(t, grpcCodes.Unauthenticated, grpcStatus.Code(err))
+
+	err = listQueues(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic dXNlcjpwYXNz"))
+	assert.Equal(t, grpcCodes.Unauthenticated, grpcStatus.Code(err))
+
+	assert.NoError(t, listQueues(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer ya29.anything")))
+}
+
+func TestRequireAuthenticationWithTokens(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{RequireAuthentication: true, AuthTokens: []string{"emulator-token"}})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer other-token")
+	_, err := client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "missing")})
+	assert.Equal(t, grpcCodes.Unauthenticated, grpcStatus.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer emulator-token")
+	_, err = client.GetQueue(ctx, &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "missing")})
+	assert.Equal(t, grpcCodes.NotFound, grpcStatus.Code(err))
+}
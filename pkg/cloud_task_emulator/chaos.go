@@ -0,0 +1,96 @@
+package cloud_task_emulator
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChaosFailure is a way chaos fails a dispatch
+type ChaosFailure string
+
+const (
+	// ChaosServerError answers the dispatch with a 500 Internal Server Error
+	ChaosServerError ChaosFailure = "500"
+
+	// ChaosTimeout fails the dispatch as if the target did not answer within the dispatch deadline
+	ChaosTimeout ChaosFailure = "timeout"
+
+	// ChaosConnectionReset fails the dispatch as if the target reset the connection
+	ChaosConnectionReset ChaosFailure = "reset"
+)
+
+// ParseChaosFailures parses a comma separated list of chaos failures, e.g. "500,timeout,reset"
+func ParseChaosFailures(value string) ([]ChaosFailure, error) {
+	var failures []ChaosFailure
+	for _, name := range strings.Split(value, ",") {
+		failure := ChaosFailure(strings.TrimSpace(name))
+		switch failure {
+		case ChaosServerError, ChaosTimeout, ChaosConnectionReset:
+			failures = append(failures, failure)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown chaos failure %q, expected 500, timeout or reset", name)
+		}
+	}
+	return failures, nil
+}
+
+// Chaos fails a share of the dispatches at random, without sending them, to exercise the retry and
+// idempotency handling of the services creating the tasks
+type Chaos struct {
+	// Percent is the share of the dispatches failed, chaos is off if 0
+	Percent float64
+
+	// Failures are picked from at random for every failed dispatch, all of them if unset
+	Failures []ChaosFailure
+
+	// Seed makes the failures reproducible, they differ on every run if 0
+	Seed int64
+}
+
+// chaos picks the dispatches chaos fails
+type chaos struct {
+	options Chaos
+
+	random *rand.Rand
+
+	mux sync.Mutex
+}
+
+func newChaos(options Chaos) *chaos {
+	seed := options.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if len(options.Failures) == 0 {
+		options.Failures = []ChaosFailure{ChaosServerError, ChaosTimeout, ChaosConnectionReset}
+	}
+	return &chaos{options: options, random: rand.New(rand.NewSource(seed))}
+}
+
+// fail picks the failure of a dispatch, reporting false if the dispatch goes ahead
+func (c *chaos) fail() (ChaosFailure, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.random.Float64()*100 >= c.options.Percent {
+		return "", false
+	}
+	return c.options.Failures[c.random.Intn(len(c.options.Failures))], true
+}
+
+// dispatchCode returns the outcome of a dispatch failed this way, as dispatch returns it
+func (failure ChaosFailure) dispatchCode() int {
+	switch failure {
+	case ChaosServerError:
+		return http.StatusInternalServerError
+	case ChaosTimeout:
+		return dispatchTimeout
+	default:
+		return dispatchConnectionError
+	}
+}
@@ -0,0 +1,44 @@
+package cloud_task_emulator
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChaosFailures(t *testing.T) {
+	failures, err := ParseChaosFailures("500, timeout,reset")
+	require.NoError(t, err)
+	assert.Equal(t, []ChaosFailure{ChaosServerError, ChaosTimeout, ChaosConnectionReset}, failures)
+
+	_, err = ParseChaosFailures("500,teapot")
+	assert.EqualError(t, err, `unknown chaos failure "teapot", expected 500, timeout or reset`)
+}
+
+func TestChaosFailsShareOfDispatches(t *testing.T) {
+	always := newChaos(Chaos{Percent: 100, Failures: []ChaosFailure{ChaosTimeout}})
+	for i := 0; i < 10; i++ {
+		failure, failed := always.fail()
+		assert.True(t, failed)
+		assert.Equal(t, dispatchTimeout, failure.dispatchCode())
+	}
+
+	// The same seed fails the same dispatches
+	first := newChaos(Chaos{Percent: 30, Seed: 42})
+	second := newChaos(Chaos{Percent: 30, Seed: 42})
+	failedCount := 0
+	for i := 0; i < 1000; i++ {
+		firstFailure, firstFailed := first.fail()
+		secondFailure, secondFailed := second.fail()
+		assert.Equal(t, firstFailed, secondFailed)
+		assert.Equal(t, firstFailure, secondFailure)
+		if firstFailed {
+			failedCount++
+		}
+	}
+	assert.InDelta(t, 300, failedCount, 60)
+	assert.Equal(t, http.StatusInternalServerError, ChaosServerError.dispatchCode())
+	assert.Equal(t, dispatchConnectionError, ChaosConnectionReset.dispatchCode())
+}
@@ -0,0 +1,83 @@
+package cloud_task_emulator
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"github.com/golang/protobuf/proto"
+)
+
+// payloadCodec stores the payload of tasks, i.e. their HTTP or App Engine request, serialized and optionally
+// compressed rather than as proto structs. See ServerOptions.CompactTasks.
+type payloadCodec struct {
+	compress bool
+}
+
+// newPayloadCodec returns the codec the options ask for, nil if tasks are stored as they are
+func newPayloadCodec(options ServerOptions) *payloadCodec {
+	if !options.CompactTasks {
+		return nil
+	}
+	return &payloadCodec{compress: options.CompressTasks}
+}
+
+// encode takes the payload out of the task state
+func (c *payloadCodec) encode(taskState *tasks.Task) ([]byte, error) {
+	payload, err := proto.Marshal(&tasks.Task{MessageType: taskState.MessageType})
+	if err != nil {
+		return nil, err
+	}
+	if c.compress {
+		var compressed bytes.Buffer
+		w, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+		w.Write(payload)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload = compressed.Bytes()
+	}
+	taskState.MessageType = nil
+	return payload, nil
+}
+
+// decode puts the payload back into the task state
+func (c *payloadCodec) decode(payload []byte, taskState *tasks.Task) error {
+	if c.compress {
+		decompressed, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			return err
+		}
+		payload = decompressed
+	}
+	var decoded tasks.Task
+	if err := proto.Unmarshal(payload, &decoded); err != nil {
+		return err
+	}
+	taskState.MessageType = decoded.MessageType
+	return nil
+}
+
+// compact encodes the payload of the task if the server stores tasks compactly. Tasks failing to encode stay
+// as they are.
+func (task *Task) compact() {
+	codec := task.queue.dispatcher.codec
+	if codec == nil {
+		return
+	}
+	payload, err := codec.encode(task.state)
+	if err != nil {
+		task.logger().Printf("Could not compact %s: %v\n", task.state.GetName(), err)
+		return
+	}
+	task.payload = payload
+}
+
+// view returns the task state with its payload: the live state, or a copy if the task is stored compactly
+func (task *Task) view() *tasks.Task {
+	if task.payload == nil {
+		return task.state
+	}
+	return task.snapshot()
+}
@@ -0,0 +1,68 @@
+package cloud_task_emulator_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactTasks(t *testing.T) {
+	for _, options := range []ServerOptions{
+		{CompactTasks: true},
+		{CompactTasks: true, CompressTasks: true},
+	} {
+		dispatchedBodies := make(chan string, 1)
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			dispatchedBodies <- req.Header.Get("X-Custom") + " " + string(body)
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+		})}
+		server := NewServer(WithOptions(options), WithHTTPClient(client))
+		t.Cleanup(server.Shutdown)
+
+		queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "compact")})
+		require.NoError(t, err)
+		_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+		require.NoError(t, err)
+
+		created, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+					Url:     "http://localhost:1/compact",
+					Headers: map[string]string{"X-Custom": "header"},
+					Body:    []byte(`{"payload": "kept"}`),
+				}},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, `{"payload": "kept"}`, string(created.GetHttpRequest().GetBody()))
+
+		task, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: created.GetName()})
+		require.NoError(t, err)
+		assert.Equal(t, `{"payload": "kept"}`, string(task.GetHttpRequest().GetBody()))
+		assert.Equal(t, "header", task.GetHttpRequest().GetHeaders()["X-Custom"])
+
+		listed, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queue.GetName()})
+		require.NoError(t, err)
+		require.Len(t, listed.GetTasks(), 1)
+		assert.Equal(t, "http://localhost:1/compact", listed.GetTasks()[0].GetHttpRequest().GetUrl())
+
+		_, err = server.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: queue.GetName()})
+		require.NoError(t, err)
+		select {
+		case body := <-dispatchedBodies:
+			assert.Equal(t, `header {"payload": "kept"}`, body)
+		case <-time.After(time.Second):
+			t.Fatal("task was not dispatched")
+		}
+	}
+}
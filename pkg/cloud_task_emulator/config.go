@@ -0,0 +1,120 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of the emulator's configuration file, e.g.
+//
+//	queues:
+//	  - projects/dev/locations/here/queues/firstq
+//	defaults:
+//	  retryConfig: {maxAttempts: 5, minBackoff: 1s}
+//	  rateLimits: {maxDispatchesPerSecond: 10}
+type Config struct {
+	Queues []string
+
+	DefaultRetryConfig *tasks.RetryConfig
+	DefaultRateLimits  *tasks.RateLimits
+}
+
+type configFile struct {
+	Queues   []string `yaml:"queues"`
+	Defaults struct {
+		RetryConfig map[string]interface{} `yaml:"retryConfig"`
+		RateLimits  map[string]interface{} `yaml:"rateLimits"`
+	} `yaml:"defaults"`
+}
+
+// unmarshalConfigProto converts a YAML mapping to a proto message, using the proto JSON field names
+func unmarshalConfigProto(value map[string]interface{}, message protov2.Message) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(encoded, message)
+}
+
+// LoadConfig reads a YAML configuration file
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file configFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	config := &Config{Queues: file.Queues}
+	if file.Defaults.RetryConfig != nil {
+		config.DefaultRetryConfig = &tasks.RetryConfig{}
+		if err := unmarshalConfigProto(file.Defaults.RetryConfig, config.DefaultRetryConfig); err != nil {
+			return nil, fmt.Errorf("invalid defaults.retryConfig in %s: %v", path, err)
+		}
+	}
+	if file.Defaults.RateLimits != nil {
+		config.DefaultRateLimits = &tasks.RateLimits{}
+		if err := unmarshalConfigProto(file.Defaults.RateLimits, config.DefaultRateLimits); err != nil {
+			return nil, fmt.Errorf("invalid defaults.rateLimits in %s: %v", path, err)
+		}
+	}
+
+	return config, nil
+}
+
+// ApplyConfig reconciles the server with the next configuration. The defaults are replaced, queues
+// added since the previous configuration (nil at startup) are created and queues removed from it are deleted.
+// Every change is attempted; the first failure is returned.
+func (s *Server) ApplyConfig(ctx context.Context, previous *Config, next *Config) error {
+	s.SetQueueDefaults(next.DefaultRetryConfig, next.DefaultRateLimits)
+
+	var firstErr error
+	fail := func(err error) {
+		s.logger.Println(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, queueName := range next.Queues {
+		wanted[queueName] = true
+		if queue, ok := s.fetchQueue(queueName); ok && queue != nil {
+			continue
+		}
+
+		s.logger.Printf("Creating configured queue %s\n", queueName)
+		_, err := s.CreateQueue(ctx, &tasks.CreateQueueRequest{
+			Parent: queueParent(queueName),
+			Queue:  &tasks.Queue{Name: queueName},
+		})
+		if err != nil {
+			fail(fmt.Errorf("could not create queue %s: %v", queueName, err))
+		}
+	}
+
+	if previous != nil {
+		for _, queueName := range previous.Queues {
+			if wanted[queueName] {
+				continue
+			}
+
+			s.logger.Printf("Deleting unconfigured queue %s\n", queueName)
+			if _, err := s.DeleteQueue(ctx, &tasks.DeleteQueueRequest{Name: queueName}); err != nil {
+				fail(fmt.Errorf("could not delete queue %s: %v", queueName, err))
+			}
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,77 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+queues:
+  - projects/dev/locations/here/queues/firstq
+defaults:
+  retryConfig: {maxAttempts: 5, minBackoff: 1s}
+  rateLimits:
+    maxDispatchesPerSecond: 10
+`)
+
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"projects/dev/locations/here/queues/firstq"}, config.Queues)
+	assert.EqualValues(t, 5, config.DefaultRetryConfig.GetMaxAttempts())
+	assert.Equal(t, time.Second, config.DefaultRetryConfig.GetMinBackoff().AsDuration())
+	assert.EqualValues(t, 10, config.DefaultRateLimits.GetMaxDispatchesPerSecond())
+}
+
+func TestLoadConfigRejectsUnknownFields(t *testing.T) {
+	path := writeConfig(t, `
+defaults:
+  retryConfig: {maxAttempt: 5}
+`)
+
+	_, err := LoadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestApplyConfigReconcilesQueues(t *testing.T) {
+	server := NewServer()
+
+	first := &Config{
+		Queues:             []string{formatQueueName(formattedParent, "kept"), formatQueueName(formattedParent, "removed")},
+		DefaultRetryConfig: &taskspb.RetryConfig{MaxAttempts: 5},
+	}
+	require.NoError(t, server.ApplyConfig(context.Background(), nil, first))
+
+	kept, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "kept")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, kept.GetRetryConfig().GetMaxAttempts())
+
+	second := &Config{
+		Queues: []string{formatQueueName(formattedParent, "kept"), formatQueueName(formattedParent, "added")},
+	}
+	require.NoError(t, server.ApplyConfig(context.Background(), first, second))
+
+	_, err = server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "kept")})
+	assert.NoError(t, err)
+	_, err = server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "removed")})
+	assert.Error(t, err)
+
+	// The defaults were reset, so the new queue gets the production ones
+	added, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "added")})
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, added.GetRetryConfig().GetMaxAttempts())
+}
@@ -0,0 +1,446 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+)
+
+// DispatchOptions configure how tasks are delivered to their targets
+type DispatchOptions struct {
+	// URLRewrites are applied to HTTP task URLs before dispatch, the first matching rule wins.
+	// The task itself keeps its original URL.
+	URLRewrites []URLRewrite
+
+	// QueueTargets sends all the tasks of a queue, by queue name, to a target such as http://localhost:9000
+	// whatever their URL, keeping the path and query. It takes precedence over URLRewrites.
+	QueueTargets map[string]string
+
+	// AllowedHosts lists the host names or CIDR ranges tasks may be dispatched to besides loopback and
+	// private addresses, "*" allowing every host as earlier versions did. Dispatches to other hosts fail, to
+	// avoid replaying production traffic against production services by accident. Host names are checked
+	// against the address they resolve to as the connection is dialed, or before the dispatch if a proxy or the
+	// client of WithHTTPClient connects instead.
+	AllowedHosts []string
+
+	// DeniedHosts lists the host names or CIDR ranges tasks are never dispatched to, even if allowed
+	DeniedHosts []string
+
+	// WarnOnExternalHosts logs dispatches to hosts that aren't allowed instead of failing them.
+	// Denied hosts still fail.
+	WarnOnExternalHosts bool
+
+	// Proxy sends the dispatches through an HTTP(S) proxy. When unset, the HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY environment variables apply. It is read once, on the first dispatch.
+	Proxy *url.URL
+
+	// InsecureSkipVerify accepts any certificate from HTTPS targets, e.g. self-signed ones.
+	// It is read once, on the first dispatch.
+	InsecureSkipVerify bool
+
+	// RootCAs verifies the certificates of HTTPS targets instead of the system roots, e.g. to reach
+	// targets behind an internal CA. It is read once, on the first dispatch.
+	RootCAs *x509.CertPool
+
+	// MaxIdleConns and MaxIdleConnsPerHost bound the idle connections kept for reuse, in all and per target host,
+	// MaxConnsPerHost the connections per target host, and IdleConnTimeout how long idle connections are kept.
+	// Go's defaults apply if 0, which keep only 2 idle connections per host: high-rate load tests against a
+	// single worker open a connection per dispatch otherwise, exhausting ephemeral ports. They are read once, on
+	// the first dispatch.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// Protocol is the HTTP version tasks are delivered with, HTTP/2 to https:// targets offering it and HTTP/1.1
+	// otherwise by default. HTTP/2 dispatches do not go through the Proxy. It is read once, on the first dispatch.
+	Protocol DispatchProtocol
+
+	// Timeout bounds every dispatch when set, whatever the dispatch deadline of the task,
+	// so that hung targets fail fast
+	Timeout time.Duration
+
+	// Headers are added to every dispatch, e.g. to mark emulator traffic, unless the task sets them
+	Headers map[string]string
+
+	// OpenIDIssuer is the iss claim of the OIDC tokens sent with HTTP tasks, DefaultOpenIDIssuer if unset.
+	// Server.OpenIDHandler serves the discovery document and signing keys for it.
+	OpenIDIssuer string
+
+	// OpenIDSigningKey signs the OIDC tokens instead of the emulator's published key, e.g. so that a local
+	// API gateway can trust it up front
+	OpenIDSigningKey *rsa.PrivateKey
+
+	// MaxConcurrentDispatches bounds the dispatches in flight across all queues, unbounded if 0, so that a
+	// large backlog cannot exhaust file descriptors. Further dispatches wait for a slot, holding back the
+	// workers of their queue. It is read once, on the first dispatch.
+	MaxConcurrentDispatches int
+
+	// MaxConcurrentDispatchesPerQueue caps the worker pool of every queue, whatever the max concurrent
+	// dispatches of its rate limits, unbounded if 0
+	MaxConcurrentDispatchesPerQueue int
+
+	// ResumeRampUp throttles queues after they resume, rather than letting them catch up on their backlog at
+	// their full rate straight away. It is off unless its InitialRate is set.
+	ResumeRampUp RampUp
+
+	// Chaos fails a share of the dispatches at random. It is read once, on the first dispatch.
+	Chaos Chaos
+
+	// Hook decides, per dispatch, to delay, fail or rewrite it, see DispatchHook
+	Hook *DispatchHook
+
+	// LogLevel LogDebug also logs the request and the response of every attempt, with their bodies truncated,
+	// to see why a target fails tasks without instrumenting it
+	LogLevel LogLevel
+}
+
+// hasHeader reports whether the headers include the name, whatever its capitalization
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeout returns how long a dispatch of the task may take
+func (options *DispatchOptions) timeout(taskState *tasks.Task) time.Duration {
+	timeout := taskState.GetDispatchDeadline().AsDuration()
+	if options.Timeout > 0 && options.Timeout < timeout {
+		return options.Timeout
+	}
+	return timeout
+}
+
+// dispatcher delivers tasks to their targets with the server's dispatch options, and lends the queues and
+// tasks the server's clock, logger, task events and write-ahead log
+type dispatcher struct {
+	options *DispatchOptions
+
+	clock Clock
+
+	// client replaces the client built from the options, if set
+	client *http.Client
+
+	logger *log.Logger
+
+	events *taskEvents
+
+	roundTripperOnce sync.Once
+
+	roundTripper http.RoundTripper
+
+	slotsOnce sync.Once
+
+	// slots holds a token per dispatch in flight, nil if unbounded
+	slots chan struct{}
+
+	observers observers
+
+	chaosOnce sync.Once
+
+	// chaosFailures fails dispatches at random, nil if chaos is off
+	chaosFailures *chaos
+
+	counters counters
+
+	// codec encodes the payload of tasks stored compactly, nil if they are stored as they are
+	codec *payloadCodec
+
+	// wal is the server's write-ahead log, nil if there is none
+	wal *writeAheadLog
+
+	// storage is the server's storage, which the tasks write their state through to
+	storage Storage
+
+	scheduler Scheduler
+
+	// taskTransport delivers the tasks, nil to send them with the HTTP client
+	taskTransport Transport
+}
+
+func newDispatcher(options *DispatchOptions, clock Clock, client *http.Client, logger *log.Logger, events *taskEvents, codec *payloadCodec) *dispatcher {
+	return &dispatcher{options: options, clock: clock, client: client, logger: logger, events: events, codec: codec}
+}
+
+// httpClient returns a client to dispatch with, a copy the caller may set the timeout of. Like Cloud Tasks, it
+// does not follow redirects, which count as failed attempts.
+func (d *dispatcher) httpClient() *http.Client {
+	if d.client != nil {
+		client := *d.client
+		if client.CheckRedirect == nil {
+			client.CheckRedirect = doNotFollowRedirects
+		}
+		return &client
+	}
+	return &http.Client{Transport: d.transport(), CheckRedirect: doNotFollowRedirects}
+}
+
+func doNotFollowRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// transport returns the transport shared by all dispatches, built from the options on first use
+func (d *dispatcher) transport() http.RoundTripper {
+	d.roundTripperOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialChecked(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+		if d.options.Proxy != nil {
+			transport.Proxy = http.ProxyURL(d.options.Proxy)
+		}
+		if d.options.MaxIdleConns > 0 {
+			transport.MaxIdleConns = d.options.MaxIdleConns
+		}
+		if d.options.MaxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = d.options.MaxIdleConnsPerHost
+		}
+		if d.options.MaxConnsPerHost > 0 {
+			transport.MaxConnsPerHost = d.options.MaxConnsPerHost
+		}
+		if d.options.IdleConnTimeout > 0 {
+			transport.IdleConnTimeout = d.options.IdleConnTimeout
+		}
+		if d.options.InsecureSkipVerify || d.options.RootCAs != nil {
+			transport.TLSClientConfig = &tls.Config{
+				InsecureSkipVerify: d.options.InsecureSkipVerify,
+				RootCAs:            d.options.RootCAs,
+			}
+		}
+		switch d.options.Protocol {
+		case DispatchHTTP1:
+			transport.ForceAttemptHTTP2 = false
+			transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		case DispatchHTTP2:
+			d.roundTripper = newHTTP2RoundTripper(transport)
+			return
+		}
+		d.roundTripper = transport
+	})
+	return d.roundTripper
+}
+
+// acquire waits for a dispatch slot, reporting false if the context ends first. The slot is released once
+// the dispatch is done.
+func (d *dispatcher) acquire(ctx context.Context) bool {
+	d.slotsOnce.Do(func() {
+		if d.options.MaxConcurrentDispatches > 0 {
+			d.slots = make(chan struct{}, d.options.MaxConcurrentDispatches)
+		}
+	})
+	if d.slots == nil {
+		return true
+	}
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (d *dispatcher) release() {
+	if d.slots != nil {
+		<-d.slots
+	}
+}
+
+// chaos returns what fails dispatches at random, nil if chaos is off
+func (d *dispatcher) chaos() *chaos {
+	d.chaosOnce.Do(func() {
+		if d.options.Chaos.Percent > 0 {
+			d.chaosFailures = newChaos(d.options.Chaos)
+		}
+	})
+	return d.chaosFailures
+}
+
+// URLRewrite replaces the From prefix of a task URL with To, e.g. https://api.example.com
+// with http://localhost:9000. From only matches on a path, query or fragment boundary, so that
+// https://api.example.com does not match https://api.example.com.evil.
+type URLRewrite struct {
+	From string
+	To   string
+}
+
+// matches reports whether the rule applies to the URL
+func (r URLRewrite) matches(url string) bool {
+	if !strings.HasPrefix(url, r.From) {
+		return false
+	}
+	if len(url) == len(r.From) || strings.HasSuffix(r.From, "/") {
+		return true
+	}
+	return strings.ContainsRune("/?#", rune(url[len(r.From)]))
+}
+
+// retarget replaces the scheme and host of the URL with the target's, prefixing the target's path if any
+func retarget(taskURL string, target string) string {
+	parsed, err := url.Parse(taskURL)
+	if err != nil {
+		return taskURL
+	}
+	return strings.TrimSuffix(target, "/") + parsed.RequestURI()
+}
+
+// resolveURL returns the URL a task of the queue is dispatched to
+func (options *DispatchOptions) resolveURL(queueName string, taskURL string) string {
+	if target, ok := options.QueueTargets[queueName]; ok {
+		return retarget(taskURL, target)
+	}
+	return rewriteURL(taskURL, options.URLRewrites)
+}
+
+// rewriteURL applies the first matching rewrite rule to the URL
+func rewriteURL(taskURL string, rewrites []URLRewrite) string {
+	for _, rewrite := range rewrites {
+		if rewrite.matches(taskURL) {
+			return rewrite.To + taskURL[len(rewrite.From):]
+		}
+	}
+	return taskURL
+}
+
+// hostMatches reports whether the host name, or one of its addresses, is in the list of host names and CIDR ranges
+func hostMatches(host string, ips []net.IP, list []string) bool {
+	for _, entry := range list {
+		if entry == "*" || strings.EqualFold(entry, host) {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			for _, ip := range ips {
+				if cidr.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether the address is one a developer machine can reach without leaving its network
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// printfLogger is a *log.Logger, or the taskLogger of a task
+type printfLogger interface {
+	Printf(format string, v ...interface{})
+}
+
+// targetCheckKey keys the targetCheck of a dispatch in the context of its request
+type targetCheckKey struct{}
+
+// targetCheck checks the addresses the connection of a dispatch is dialed to, see dialChecked
+type targetCheck struct {
+	options *DispatchOptions
+	host    string
+	logger  printfLogger
+}
+
+// checkTarget returns an error if tasks must not be dispatched to the URL, and otherwise the context to send the
+// dispatch with. Host names are checked against the allowed and denied hosts once dialed, with the address they
+// resolved to for the connection, so that a lookup in between can't resolve them elsewhere. Unless dialed is set,
+// the emulator does not dial the host itself, a proxy or the caller's client does, and they are checked up front.
+func (options *DispatchOptions) checkTarget(ctx context.Context, target *url.URL, dialed bool, logger printfLogger) (context.Context, error) {
+	host := target.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return ctx, options.checkAddress(host, ip, logger)
+	}
+	if hostMatches(host, nil, options.DeniedHosts) {
+		return ctx, fmt.Errorf("dispatch to %s denied", host)
+	}
+	if !dialed {
+		return ctx, options.checkHost(ctx, host, logger)
+	}
+	return context.WithValue(ctx, targetCheckKey{}, &targetCheck{options: options, host: host, logger: logger}), nil
+}
+
+// checkHost returns an error if tasks must not be dispatched to the host name: unless it is allowed by name, it
+// is looked up and every address it resolves to must be allowed
+func (options *DispatchOptions) checkHost(ctx context.Context, host string, logger printfLogger) error {
+	if hostMatches(host, nil, options.AllowedHosts) {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if options.WarnOnExternalHosts {
+			logger.Printf("Warning: dispatching to unresolved host %s", host)
+			return nil
+		}
+		return fmt.Errorf("dispatch to %s not allowed, it could not be resolved to check it: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if err := options.checkAddress(host, addr.IP, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialsTarget reports whether the emulator's transport dials the host of the request itself, for dialChecked to
+// check the address it connects to, rather than a proxy or the client of WithHTTPClient
+func (d *dispatcher) dialsTarget(req *http.Request) bool {
+	if d.client != nil {
+		return false
+	}
+	// HTTP/2 dispatches don't go through the proxy
+	transport, ok := d.transport().(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return true
+	}
+	proxyURL, err := transport.Proxy(req)
+	return err != nil || proxyURL == nil
+}
+
+// checkAddress returns an error if tasks must not be dispatched to the host at the address.
+// Dispatches to external hosts allowed by WarnOnExternalHosts are logged with the logger.
+func (options *DispatchOptions) checkAddress(host string, ip net.IP, logger printfLogger) error {
+	ips := []net.IP{ip}
+	if hostMatches(host, ips, options.DeniedHosts) {
+		return fmt.Errorf("dispatch to %s denied", host)
+	}
+	if hostMatches(host, ips, options.AllowedHosts) || isLocalIP(ip) {
+		return nil
+	}
+	if options.WarnOnExternalHosts {
+		logger.Printf("Warning: dispatching to external host %s (%s)", host, ip)
+		return nil
+	}
+	return fmt.Errorf("dispatch to external host %s (%s) not allowed, see the allowed hosts option", host, ip)
+}
+
+// dialChecked dials with the dialer, checking the address a dispatch connects to from the dialer's Control hook.
+// Dials to a proxy rather than to the host of the dispatch are not checked, checkTarget checked the host before.
+func dialChecked(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		check, ok := ctx.Value(targetCheckKey{}).(*targetCheck)
+		if host, _, _ := net.SplitHostPort(addr); !ok || !strings.EqualFold(host, check.host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		checked := *dialer
+		checked.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			// Link-local addresses come with their zone
+			host, _, _ = strings.Cut(host, "%")
+			return check.options.checkAddress(check.host, net.ParseIP(host), check.logger)
+		}
+		return checked.DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,155 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteURL(t *testing.T) {
+	rewrites := []URLRewrite{
+		{From: "https://api.example.com", To: "http://localhost:9000"},
+		{From: "https://static.example.com/assets/", To: "http://localhost:9001/"},
+	}
+
+	for url, expected := range map[string]string{
+		"https://api.example.com":                     "http://localhost:9000",
+		"https://api.example.com/tasks/handle":        "http://localhost:9000/tasks/handle",
+		"https://api.example.com?key=value":           "http://localhost:9000?key=value",
+		"https://api.example.com.evil/tasks":          "https://api.example.com.evil/tasks",
+		"https://api.example.community/":              "https://api.example.community/",
+		"https://static.example.com/assets/image.png": "http://localhost:9001/image.png",
+		"http://api.example.com/tasks":                "http://api.example.com/tasks",
+	} {
+		assert.Equal(t, expected, rewriteURL(url, rewrites), url)
+	}
+}
+
+func TestResolveURLPrefersQueueTarget(t *testing.T) {
+	options := &DispatchOptions{
+		URLRewrites:  []URLRewrite{{From: "https://api.example.com", To: "http://localhost:9000"}},
+		QueueTargets: map[string]string{"projects/p/locations/l/queues/local": "http://localhost:9100/"},
+	}
+
+	assert.Equal(t, "http://localhost:9100/tasks/handle?key=value", options.resolveURL("projects/p/locations/l/queues/local", "https://api.example.com/tasks/handle?key=value"))
+	assert.Equal(t, "http://localhost:9100/", options.resolveURL("projects/p/locations/l/queues/local", "https://other.example.com"))
+	assert.Equal(t, "http://localhost:9000/tasks/handle", options.resolveURL("projects/p/locations/l/queues/other", "https://api.example.com/tasks/handle"))
+}
+
+func TestCheckTarget(t *testing.T) {
+	parse := func(rawURL string) *url.URL {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	check := func(options *DispatchOptions, rawURL string) error {
+		_, err := options.checkTarget(context.Background(), parse(rawURL), true, log.Default())
+		return err
+	}
+
+	defaults := &DispatchOptions{}
+	assert.NoError(t, check(defaults, "http://127.0.0.1:9000/task"))
+	assert.NoError(t, check(defaults, "http://10.1.2.3/task"))
+	assert.NoError(t, check(defaults, "http://[::1]:9000/task"))
+	assert.Error(t, check(defaults, "https://8.8.8.8/task"))
+
+	allowed := &DispatchOptions{AllowedHosts: []string{"8.8.8.0/24"}, DeniedHosts: []string{"10.0.0.0/8", "blocked.example.com"}}
+	assert.NoError(t, check(allowed, "https://8.8.8.8/task"))
+	assert.Error(t, check(allowed, "https://8.8.4.4/task"))
+	assert.Error(t, check(allowed, "http://10.1.2.3/task"))
+	assert.Error(t, check(allowed, "http://blocked.example.com/task"))
+
+	warned := &DispatchOptions{WarnOnExternalHosts: true, DeniedHosts: []string{"127.0.0.1/32"}}
+	assert.NoError(t, check(warned, "https://8.8.8.8/task"))
+	assert.Error(t, check(warned, "http://127.0.0.1:9000/task"))
+
+	assert.NoError(t, check(&DispatchOptions{AllowedHosts: []string{"*"}}, "https://8.8.8.8/task"))
+}
+
+func TestCheckTargetOnDial(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(target.Close)
+	_, port, err := net.SplitHostPort(target.Listener.Addr().String())
+	assert.NoError(t, err)
+	targetURL, err := url.Parse("http://localhost:" + port + "/task")
+	assert.NoError(t, err)
+
+	dispatch := func(options *DispatchOptions) error {
+		ctx, err := options.checkTarget(context.Background(), targetURL, true, log.Default())
+		if err != nil {
+			return err
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, targetURL.String(), nil)
+		resp, err := newDispatcher(options, systemClock{}, nil, log.Default(), nil, nil).httpClient().Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// The host name is let through, its address checked once dialed
+	assert.NoError(t, dispatch(&DispatchOptions{}))
+	assert.ErrorContains(t, dispatch(&DispatchOptions{DeniedHosts: []string{"127.0.0.0/8", "::1/128"}}), "denied")
+}
+
+func TestCheckTargetThroughProxy(t *testing.T) {
+	// The proxy answers every request, wherever it is for
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err)
+
+	dispatch := func(options *DispatchOptions, client *http.Client, rawURL string) error {
+		d := newDispatcher(options, systemClock{}, client, log.Default(), nil, nil)
+		req, _ := http.NewRequest(http.MethodGet, rawURL, nil)
+		ctx, err := options.checkTarget(context.Background(), req.URL, d.dialsTarget(req), log.Default())
+		if err != nil {
+			return err
+		}
+		resp, err := d.httpClient().Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	loopbackDenied := []string{"127.0.0.0/8", "::1/128"}
+
+	// Only the proxy is dialed, so the host of the dispatch is resolved and checked up front
+	proxied := &DispatchOptions{Proxy: proxyURL}
+	assert.NoError(t, dispatch(proxied, nil, "http://localhost:1/task"))
+	assert.ErrorContains(t, dispatch(&DispatchOptions{Proxy: proxyURL, DeniedHosts: loopbackDenied}, nil, "http://localhost:1/task"), "denied")
+	assert.ErrorContains(t, dispatch(proxied, nil, "http://external.invalid/task"), "not allowed")
+	assert.NoError(t, dispatch(&DispatchOptions{Proxy: proxyURL, AllowedHosts: []string{"external.invalid"}}, nil, "http://external.invalid/task"))
+
+	// As with a client of the caller's, which dials however it likes
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	assert.NoError(t, dispatch(&DispatchOptions{}, client, "http://localhost:1/task"))
+	assert.ErrorContains(t, dispatch(&DispatchOptions{DeniedHosts: loopbackDenied}, client, "http://localhost:1/task"), "denied")
+	assert.ErrorContains(t, dispatch(&DispatchOptions{}, client, "http://external.invalid/task"), "not allowed")
+}
+
+func TestTransportPooling(t *testing.T) {
+	defaults := newDispatcher(&DispatchOptions{}, systemClock{}, nil, log.Default(), nil, nil).transport().(*http.Transport)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConns, defaults.MaxIdleConns)
+	assert.Equal(t, 0, defaults.MaxIdleConnsPerHost)
+
+	pooled := newDispatcher(&DispatchOptions{
+		MaxIdleConns:        500,
+		MaxIdleConnsPerHost: 200,
+		MaxConnsPerHost:     300,
+		IdleConnTimeout:     time.Minute,
+	}, systemClock{}, nil, log.Default(), nil, nil).transport().(*http.Transport)
+	assert.Equal(t, 500, pooled.MaxIdleConns)
+	assert.Equal(t, 200, pooled.MaxIdleConnsPerHost)
+	assert.Equal(t, 300, pooled.MaxConnsPerHost)
+	assert.Equal(t, time.Minute, pooled.IdleConnTimeout)
+}
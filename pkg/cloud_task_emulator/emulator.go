@@ -2,45 +2,269 @@ package cloud_task_emulator
 
 import (
 	"context"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
 	v1 "cloud.google.com/go/iam/apiv1/iampb"
 
+	"google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	status "google.golang.org/grpc/status"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/empty"
 )
 
-// NewServer creates a new emulator server with its own task and queue bookkeeping
-func NewServer() *Server {
-	return &Server{
-		qs: make(map[string]*Queue),
-		ts: make(map[string]*Task),
-		Options: ServerOptions{
-			HardResetOnPurgeQueue: false,
-		},
+// maxScheduleDelay is how far in the future a task may be scheduled, as in production
+const maxScheduleDelay = 30 * 24 * time.Hour
+
+// NewServer creates a new emulator server with its own task and queue bookkeeping, configured by the options
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		qs:         make(map[string]*Queue),
+		ts:         make(map[string]*Task),
+		taskEvents: newTaskEvents(),
+		policies:   make(map[string]*v1.Policy),
+		clock:      systemClock{},
+		logger:     log.Default(),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.storage == nil {
+		s.storage = newMemoryStorage(s.options.KeepTombstonedNames, newPayloadCodec(s.options))
+	}
+	if s.options.ClockOffset != 0 {
+		s.clock = offsetClock{clock: s.clock, offset: s.options.ClockOffset}
+	}
+	if s.options.TimeScale > 0 && s.options.TimeScale != 1 {
+		s.clock = newScaledClock(s.clock, s.options.TimeScale)
+	}
+	if s.scheduler == nil {
+		s.scheduler = timerScheduler{clock: s.clock}
+	}
+	s.dispatcher = newDispatcher(&s.options.Dispatch, s.clock, s.httpClient, s.logger, s.taskEvents, newPayloadCodec(s.options))
+	s.dispatcher.scheduler = s.scheduler
+	s.dispatcher.taskTransport = s.transport
+	s.dispatcher.storage = s.storage
+	if s.wal != nil {
+		s.wal.clock = s.clock
+		s.wal.logger = s.logger
+		s.dispatcher.wal = s.wal
+	}
+	s.ctx, s.shutdown = context.WithCancel(context.Background())
+	if s.options.MaxFinishedTasks > 0 || s.options.MaxMemory > 0 {
+		go s.retainFinished()
+	}
+	return s
+}
+
+// Shutdown stops all the queues, aborting in-flight dispatches and dropping pending schedules, so that no
+// goroutine or connection outlives the server. Stop the gRPC server first, the emulator does not take new
+// requests afterwards.
+func (s *Server) Shutdown() {
+	s.shutdown()
+}
+
+// NewGrpcServer creates a gRPC server with the emulator registered on it.
+// The audit log interceptor runs first, then the authentication one if required, followed by any interceptors
+// passed in the options (e.g. grpc.ChainUnaryInterceptor(auth, metrics)).
+func (s *Server) NewGrpcServer(opts ...grpc.ServerOption) *grpc.Server {
+	serverOpts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(s.AuditInterceptor)}
+	if s.options.RequireAuthentication {
+		serverOpts = append(serverOpts, grpc.ChainUnaryInterceptor(s.AuthInterceptor))
+	}
+	if s.options.MaxRecvMsgSize > 0 {
+		serverOpts = append(serverOpts, grpc.MaxRecvMsgSize(s.options.MaxRecvMsgSize))
+	}
+	if s.options.MaxSendMsgSize > 0 {
+		serverOpts = append(serverOpts, grpc.MaxSendMsgSize(s.options.MaxSendMsgSize))
+	}
+	if s.options.Keepalive != nil {
+		serverOpts = append(serverOpts, grpc.KeepaliveParams(*s.options.Keepalive))
+	}
+	if s.options.KeepaliveEnforcement != nil {
+		serverOpts = append(serverOpts, grpc.KeepaliveEnforcementPolicy(*s.options.KeepaliveEnforcement))
+	}
+	opts = append(serverOpts, opts...)
+
+	grpcServer := grpc.NewServer(opts...)
+	if s.options.NamespaceMetadataKey != "" {
+		tasks.RegisterCloudTasksServer(grpcServer, namespaces{s})
+	} else {
+		tasks.RegisterCloudTasksServer(grpcServer, s)
+	}
+
+	return grpcServer
+}
+
+// Serve serves the emulator over gRPC on the listener until it fails, see NewGrpcServer for the options
+func (s *Server) Serve(lis net.Listener, opts ...grpc.ServerOption) error {
+	return s.NewGrpcServer(opts...).Serve(lis)
 }
 
 type ServerOptions struct {
 	HardResetOnPurgeQueue bool
+
+	// TaskNameTombstoneTTL is how long the names of completed or deleted tasks stay reserved, an hour as in
+	// production if 0. A TTL longer than the test run keeps the names reserved throughout.
+	TaskNameTombstoneTTL time.Duration
+
+	// IamPermissions restricts, per caller identity, the permissions TestIamPermissions grants.
+	// Callers without an entry are granted every permission they ask about.
+	IamPermissions map[string][]string
+
+	// AuditLogSize is the number of API calls kept in the audit log (defaults to 1000)
+	AuditLogSize int
+
+	// MaxQueuesPerProject limits the number of queues in a project, unlimited if 0.
+	// ProductionMaxQueuesPerProject mirrors the default production quota.
+	MaxQueuesPerProject int
+
+	// DefaultRetryConfig and DefaultRateLimits replace the production defaults for the fields
+	// they set, on queues created without those fields
+	DefaultRetryConfig *tasks.RetryConfig
+	DefaultRateLimits  *tasks.RateLimits
+
+	// AutoCreateQueues creates missing queues with default settings when a task is created on them
+	AutoCreateQueues bool
+
+	// DisableTaskNameDeduplication allows reusing the names of completed or deleted tasks straight away.
+	// Names of tasks that still exist are always rejected.
+	DisableTaskNameDeduplication bool
+
+	// MaxFinishedTasks limits the records kept of finished tasks, i.e. the tasks that ran out of attempts and
+	// the tombstoned names of completed or deleted tasks, unlimited if 0. MaxMemory, in bytes, evicts some of
+	// them while the heap is larger. See Server.EnforceRetention.
+	MaxFinishedTasks int
+	MaxMemory        uint64
+
+	// CompactTasks stores the payload of tasks, i.e. their HTTP or App Engine request, serialized rather than as
+	// proto structs, and CompressTasks compressed too, for large backlogs to take less memory. The payload is
+	// decoded on every dispatch and read.
+	CompactTasks  bool
+	CompressTasks bool
+
+	// SequentialTaskIDs names the tasks created without a name task-0001, task-0002 and so on, per queue, instead
+	// of with production's random IDs, for golden files and recorded scenarios to be stable across runs.
+	// TaskIDSeed, if not 0, generates production-like IDs from the seed instead, the same on every run. Either
+	// way, the IDs of tasks that exist or are reserved are skipped.
+	SequentialTaskIDs bool
+	TaskIDSeed        int64
+
+	// TaskIDFormat, if set, is the template of the IDs of tasks created without a name, e.g. to include the queue
+	// and creation time, for logs and dashboards to tell the tasks of test cases apart. See ParseTaskIDFormat.
+	TaskIDFormat TaskIDFormat
+
+	// KeepTombstonedNames keeps the names of completed or deleted tasks, for Tombstones and the admin API to
+	// list while they are reserved. Only a hash of each name is kept otherwise.
+	KeepTombstonedNames bool
+
+	// NamespaceMetadataKey, e.g. "x-emulator-namespace", partitions the queues, tasks and every other state of
+	// the server by the value of the gRPC metadata key, so that parallel test suites can share an emulator.
+	// Each namespace is served by a server of its own with the same options, see Server.Namespace; calls without
+	// the key go to the server itself. The admin API reads the HTTP header of the same name.
+	NamespaceMetadataKey string
+
+	// Dispatch configures how tasks are delivered to their targets
+	Dispatch DispatchOptions
+
+	// MaxRecvMsgSize and MaxSendMsgSize are the largest gRPC messages, in bytes, the server receives and sends.
+	// gRPC defaults to 4MB received and no limit on sent messages.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+
+	// Keepalive sets how the server pings idle connections and how long it keeps connections, and
+	// KeepaliveEnforcement how often clients may ping it, e.g. for long-lived connections through proxies that
+	// drop them otherwise. gRPC's defaults apply if nil, and to the zero fields of Keepalive.
+	Keepalive            *keepalive.ServerParameters
+	KeepaliveEnforcement *keepalive.EnforcementPolicy
+
+	// RequireAuthentication rejects gRPC calls without an "authorization: Bearer <token>" header with
+	// UNAUTHENTICATED, like production, to check clients attach credentials. Any token is accepted unless
+	// AuthTokens lists the accepted ones.
+	RequireAuthentication bool
+	AuthTokens            []string
+
+	// TimeScale runs the emulator's clock TimeScale times faster than the system clock, so that schedule times,
+	// retry backoffs and reserved task names come and go TimeScale times sooner, e.g. 3600 to run an hour-long
+	// retry schedule in a second. Rate limits and dispatch deadlines keep to the system clock. Real time if 0.
+	TimeScale float64
+
+	// ClockOffset moves the emulator's clock ahead of the system clock, or behind it if negative, e.g. to test
+	// that clients comparing the schedule times and ETA headers of tasks to their own clock tolerate skew
+	ClockOffset time.Duration
 }
 
+// ProductionMaxQueuesPerProject is the default production quota of queues per project
+const ProductionMaxQueuesPerProject = 1000
+
 // Server represents the emulator server
 type Server struct {
+	// qs and ts hold the running queues and tasks, by name. Deleted queues stay nil, reserving their names.
 	qs map[string]*Queue
 	ts map[string]*Task
 
-	qsMux   sync.Mutex
-	tsMux   sync.Mutex
-	Options ServerOptions
+	// storage holds the state of the queues and tasks and the reserved task names, in memory unless set by
+	// WithStorage
+	storage Storage
+
+	taskEvents *taskEvents
+
+	// policies holds the IAM policies set on queues
+	policies map[string]*v1.Policy
+
+	policyRevision uint64
+
+	audit auditLog
+
+	// wal is the write-ahead log, nil unless set by WithWriteAheadLog
+	wal *writeAheadLog
+
+	// scheduler decides when tasks are dispatched, timers on the clock unless set by WithScheduler
+	scheduler Scheduler
+
+	// transport delivers the tasks, nil unless set by WithTransport
+	transport Transport
+
+	dispatcher *dispatcher
+
+	// ctx is the parent of every queue's context, cancelled by Shutdown
+	ctx context.Context
+
+	shutdown context.CancelFunc
+
+	// options are set by NewServer. Only those with a setter change afterwards, under optionsMux.
+	options ServerOptions
+
+	clock Clock
+
+	// httpClient replaces the client built from the dispatch options, if set
+	httpClient *http.Client
+
+	logger *log.Logger
+
+	// namespaces holds the servers of the namespaces, by name, see Namespace
+	namespaces map[string]*Server
+
+	qsMux       sync.Mutex
+	tsMux       sync.Mutex
+	policiesMux sync.Mutex
+	optionsMux  sync.RWMutex
+
+	namespacesMux sync.Mutex
 }
 
 func (s *Server) setQueue(queueName string, queue *Queue) {
@@ -56,8 +280,57 @@ func (s *Server) fetchQueue(queueName string) (*Queue, bool) {
 	return queue, ok
 }
 
-func (s *Server) removeQueue(queueName string) {
+// storeQueue writes the state of the queue through to the storage
+func (s *Server) storeQueue(queueState *tasks.Queue) error {
+	if err := s.storage.PutQueue(proto.Clone(queueState).(*tasks.Queue)); err != nil {
+		return errStorage(err)
+	}
+	return nil
+}
+
+// countProjectQueues counts the existing queues of the project, with the queue lock held
+func (s *Server) countProjectQueues(project string) int {
+	prefix := "projects/" + project + "/"
+	count := 0
+	for queueName, queue := range s.qs {
+		if queue != nil && strings.HasPrefix(queueName, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// insertQueue adds the queue and stores its state unless the name is taken or the project is over its quota,
+// at once for concurrent creations not to both start a queue or exceed the quota
+func (s *Server) insertQueue(queue *Queue, queueState *tasks.Queue) error {
+	s.qsMux.Lock()
+	defer s.qsMux.Unlock()
+	if current, ok := s.qs[queue.name]; ok {
+		if current != nil {
+			return errQueueAlreadyExists()
+		}
+		return errQueueTombstoned()
+	}
+	if maxQueues := s.options.MaxQueuesPerProject; maxQueues > 0 {
+		project := strings.Split(queue.name, "/")[1]
+		if s.countProjectQueues(project) >= maxQueues {
+			return errQueueQuotaExceeded(project, maxQueues)
+		}
+	}
+	if err := s.storeQueue(queueState); err != nil {
+		return err
+	}
+	s.qs[queue.name] = queue
+	return nil
+}
+
+// removeQueue deletes the queue, keeping its name reserved
+func (s *Server) removeQueue(queueName string) error {
 	s.setQueue(queueName, nil)
+	if err := s.storage.DeleteQueue(queueName); err != nil {
+		return errStorage(err)
+	}
+	return nil
 }
 
 func (s *Server) setTask(taskName string, task *Task) {
@@ -66,21 +339,152 @@ func (s *Server) setTask(taskName string, task *Task) {
 	s.ts[taskName] = task
 }
 
-func (s *Server) fetchTask(taskName string) (*Task, bool) {
+// fetchTask returns the task, or nil if the task name is tombstoned, and whether the name is known at all
+func (s *Server) fetchTask(taskName string) (*Task, bool, error) {
 	s.tsMux.Lock()
-	defer s.tsMux.Unlock()
 	task, ok := s.ts[taskName]
-	return task, ok
+	s.tsMux.Unlock()
+	if ok {
+		return task, true, nil
+	}
+	_, ok, err := s.storage.TaskNameTombstone(taskName, s.clock.Now())
+	if err != nil {
+		return nil, false, errStorage(err)
+	}
+	return nil, ok, nil
+}
+
+// listTasks returns the running tasks whose names start with the prefix
+func (s *Server) listTasks(prefix string) []*Task {
+	s.tsMux.Lock()
+	defer s.tsMux.Unlock()
+	var matching []*Task
+	for taskName, task := range s.ts {
+		if strings.HasPrefix(taskName, prefix) {
+			matching = append(matching, task)
+		}
+	}
+	return matching
+}
+
+// removeTask removes the task, reserving its name
+func (s *Server) removeTask(taskName string) error {
+	s.tsMux.Lock()
+	defer s.tsMux.Unlock()
+	return s.removeTaskLocked(taskName)
 }
 
-func (s *Server) removeTask(taskName string) {
-	s.setTask(taskName, nil)
+// removeTaskLocked removes the task with the task lock held
+func (s *Server) removeTaskLocked(taskName string) error {
+	if task, ok := s.ts[taskName]; ok {
+		// Its state is not written anymore, not to bring it back in the storage
+		task.retire()
+		delete(s.ts, taskName)
+	}
+	err := s.storage.RemoveTask(taskName, s.clock.Now(), s.taskNameTombstoneTTL())
+	s.taskEvents.notify()
+	s.wal.event(walTaskDone, taskName)
+	if err != nil {
+		return errStorage(err)
+	}
+	return nil
+}
+
+// taskNameTombstoneTTL returns how long the names of completed or deleted tasks stay reserved
+func (s *Server) taskNameTombstoneTTL() time.Duration {
+	if s.options.TaskNameTombstoneTTL > 0 {
+		return s.options.TaskNameTombstoneTTL
+	}
+	return defaultTaskNameTombstoneTTL
 }
 
-func (s *Server) hardDeleteTask(taskName string) {
+// removeFinishedTask removes the task once it is done, unless it is gone already, e.g. with its project
+func (s *Server) removeFinishedTask(task *Task) {
 	s.tsMux.Lock()
 	defer s.tsMux.Unlock()
-	delete(s.ts, taskName)
+	taskName := task.state.GetName()
+	if current, ok := s.ts[taskName]; ok && current == task {
+		logStorageError(s.logger, "the removal of task "+taskName, s.removeTaskLocked(taskName))
+	}
+}
+
+// releaseTaskNames forgets all tombstoned task names of the queue
+func (s *Server) releaseTaskNames(queueName string) {
+	logStorageError(s.logger, "the release of the task names of "+queueName, s.storage.ReleaseTombstones(queueName+"/tasks/"))
+	s.wal.event(walNamesReleased, queueName)
+}
+
+// ClearTombstones releases the reserved task names of the queue, without the rest of a hard reset, e.g. for
+// test cases reusing task names. Tasks that still exist keep their names.
+func (s *Server) ClearTombstones(queueName string) {
+	s.releaseTaskNames(queueName)
+}
+
+// ClearAllTombstones releases the reserved task names of every queue
+func (s *Server) ClearAllTombstones() {
+	logStorageError(s.logger, "the release of the task names", s.storage.ReleaseTombstones(""))
+	s.wal.event(walNamesReleased, "")
+}
+
+// DeleteProject tears down the project: its queues, with their tasks and IAM policies, and the reserved names of
+// its tasks, for parallel tests namespacing by project to clean up after themselves. Unlike DeleteQueue, the
+// queue names are released too, for the project to start afresh. It returns the number of queues deleted.
+func (s *Server) DeleteProject(project string) int {
+	prefix := "projects/" + project + "/"
+
+	// The queues, their tasks and the reserved names go at once, for no task to be created in between.
+	// Forgotten before the queues cancel them, the tasks leave no tombstones behind.
+	var queues []*Queue
+	s.qsMux.Lock()
+	s.tsMux.Lock()
+	for queueName, queue := range s.qs {
+		if strings.HasPrefix(queueName, prefix) {
+			delete(s.qs, queueName)
+			if queue != nil {
+				queues = append(queues, queue)
+			}
+		}
+	}
+	for taskName, task := range s.ts {
+		if strings.HasPrefix(taskName, prefix) {
+			task.retire()
+			delete(s.ts, taskName)
+		}
+	}
+	logStorageError(s.logger, "the deletion of project "+project, s.storage.Forget(prefix))
+	s.tsMux.Unlock()
+	s.qsMux.Unlock()
+
+	s.policiesMux.Lock()
+	for resource := range s.policies {
+		if strings.HasPrefix(resource, prefix) {
+			delete(s.policies, resource)
+		}
+	}
+	s.policiesMux.Unlock()
+
+	for _, queue := range queues {
+		queue.Delete()
+	}
+	s.taskEvents.notify()
+	s.wal.event(walProjectDeleted, project)
+
+	return len(queues)
+}
+
+// Reset tears down every project, see DeleteProject, leaving the server as it started
+func (s *Server) Reset() {
+	projects := make(map[string]bool)
+	s.qsMux.Lock()
+	for queueName := range s.qs {
+		projects[strings.Split(queueName, "/")[1]] = true
+	}
+	s.qsMux.Unlock()
+
+	for project := range projects {
+		s.DeleteProject(project)
+	}
+	s.ClearAllTombstones()
 }
 
 // ListQueues lists the existing queues
@@ -89,12 +493,13 @@ func (s *Server) ListQueues(ctx context.Context, in *tasks.ListQueuesRequest) (*
 
 	var queueStates []*tasks.Queue
 
-	s.qsMux.Lock()
-	defer s.qsMux.Unlock()
-
-	for _, queue := range s.qs {
-		if queue != nil {
-			queueStates = append(queueStates, queue.state)
+	stored, err := s.storage.ListQueues()
+	if err != nil {
+		return nil, errStorage(err)
+	}
+	for _, queueState := range stored {
+		if queueState != nil {
+			queueStates = append(queueStates, queueState)
 		}
 	}
 
@@ -105,14 +510,17 @@ func (s *Server) ListQueues(ctx context.Context, in *tasks.ListQueuesRequest) (*
 
 // GetQueue returns the requested queue
 func (s *Server) GetQueue(ctx context.Context, in *tasks.GetQueueRequest) (*tasks.Queue, error) {
-	queue, ok := s.fetchQueue(in.GetName())
+	queueState, _, err := s.storage.GetQueue(in.GetName())
+	if err != nil {
+		return nil, errStorage(err)
+	}
 
 	// Cloud responds with the same error message whether the queue was recently deleted or never existed
-	if !ok || queue == nil {
-		return nil, status.Errorf(codes.NotFound, "Queue does not exist. If you just created the queue, wait at least a minute for the queue to initialize.")
+	if queueState == nil {
+		return nil, errQueueNotFound()
 	}
 
-	return queue.state, nil
+	return queueState, nil
 }
 
 // CreateQueue creates a new queue
@@ -122,39 +530,192 @@ func (s *Server) CreateQueue(ctx context.Context, in *tasks.CreateQueueRequest)
 	name := queueState.GetName()
 	nameMatched, _ := regexp.MatchString("projects/[A-Za-z0-9-]+/locations/[A-Za-z0-9-]+/queues/[A-Za-z0-9-]+", name)
 	if !nameMatched {
-		return nil, status.Errorf(codes.InvalidArgument, "Queue name must be formatted: \"projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>\"")
+		return nil, errInvalidQueueName()
 	}
 	parent := in.GetParent()
 	parentMatched, _ := regexp.MatchString("projects/[A-Za-z0-9-]+/locations/[A-Za-z0-9-]+", parent)
 	if !parentMatched {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource field value in the request.")
+		return nil, errInvalidResource()
+	}
+	// Queues can start out paused, but only App Engine disables them
+	switch queueState.GetState() {
+	case tasks.Queue_STATE_UNSPECIFIED, tasks.Queue_RUNNING, tasks.Queue_PAUSED:
+	default:
+		return nil, errQueueStateOnCreate(queueState.GetState())
+	}
+	if err := validateMaxAttempts(queueState.GetRetryConfig()); err != nil {
+		return nil, err
 	}
 	queue, ok := s.fetchQueue(name)
 	if ok {
 		if queue != nil {
-			return nil, status.Errorf(codes.AlreadyExists, "Queue already exists")
+			return nil, errQueueAlreadyExists()
 		}
 
-		return nil, status.Errorf(codes.FailedPrecondition, "The queue cannot be created because a queue with this name existed too recently.")
+		return nil, errQueueTombstoned()
 	}
+	paused := queueState.GetState() == tasks.Queue_PAUSED
 
 	// Make a deep copy so that the original is frozen for the http response
-	queue, queueState = NewQueue(
+	queueState = proto.Clone(queueState).(*tasks.Queue)
+	defaultRateLimits, defaultRetryConfig := s.queueDefaults()
+	applyQueueDefaults(queueState, defaultRateLimits, defaultRetryConfig)
+
+	queue, _ = NewQueue(
+		s.ctx,
 		name,
-		proto.Clone(queueState).(*tasks.Queue),
-		func(task *Task) {
-			s.removeTask(task.state.GetName())
-		},
+		queueState,
+		s.dispatcher,
+		s.removeFinishedTask,
 	)
-	s.setQueue(name, queue)
+	queue.taskIDs = s.newTaskIDs(name)
+	if hardReset, ok := hardResetOnPurgeFromMetadata(ctx); ok {
+		queue.SetSettings(QueueSettings{HardResetOnPurge: &hardReset})
+	}
 	queue.Run()
+	if paused {
+		queue.Pause()
+	}
 
+	queueState = queue.snapshot()
+	if err := s.insertQueue(queue, queueState); err != nil {
+		// A concurrent request created the queue, or the last one the quota allows, first, or the storage failed
+		queue.Delete()
+		return nil, err
+	}
+	s.wal.queue(queueState)
 	return queueState, nil
 }
 
-// UpdateQueue updates an existing queue (not implemented yet)
+// validateMaxAttempts accepts -1 for unlimited attempts besides counts, 0 leaving the default
+func validateMaxAttempts(retryConfig *tasks.RetryConfig) error {
+	if retryConfig.GetMaxAttempts() < -1 {
+		return errInvalidMaxAttempts(retryConfig.GetMaxAttempts())
+	}
+	return nil
+}
+
+var queueIDSuffix = regexp.MustCompile("/queues/[^/]+$")
+
+// queueParent returns the location a queue belongs to
+func queueParent(queueName string) string {
+	return queueIDSuffix.ReplaceAllString(queueName, "")
+}
+
+// HardResetOnPurgeMetadataKey is the CreateQueue gRPC metadata key ("true" or "false") overriding
+// ServerOptions.HardResetOnPurgeQueue for the new queue
+const HardResetOnPurgeMetadataKey = "x-emulator-hard-reset-on-purge"
+
+func hardResetOnPurgeFromMetadata(ctx context.Context) (bool, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false, false
+	}
+	values := md.Get(HardResetOnPurgeMetadataKey)
+	if len(values) == 0 {
+		return false, false
+	}
+	hardReset, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, false
+	}
+	return hardReset, true
+}
+
+// autoCreateQueue creates the queue with default settings, returning it like fetchQueue would
+func (s *Server) autoCreateQueue(ctx context.Context, queueName string) (*Queue, bool) {
+	s.logger.Printf("Automatically creating queue %s\n", queueName)
+
+	_, err := s.CreateQueue(ctx, &tasks.CreateQueueRequest{
+		Parent: queueParent(queueName),
+		Queue:  &tasks.Queue{Name: queueName},
+	})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		// Not a valid queue name, or over quota
+		s.logger.Printf("Could not create queue %s: %v\n", queueName, err)
+	}
+
+	// A concurrent request may have created the queue first
+	return s.fetchQueue(queueName)
+}
+
+// updatableQueueFields are the update mask paths UpdateQueue supports, an empty mask updates all of them
+var updatableQueueFields = []string{"rate_limits", "retry_config"}
+
+// UpdateQueue updates the rate limits and retry config of a queue, creating it if it does not exist.
+// The changes apply to the tasks already in the queue, see Queue.Update.
 func (s *Server) UpdateQueue(ctx context.Context, in *tasks.UpdateQueueRequest) (*tasks.Queue, error) {
-	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
+	queueState := in.GetQueue()
+
+	queue, ok := s.fetchQueue(queueState.GetName())
+	if !ok {
+		return s.CreateQueue(ctx, &tasks.CreateQueueRequest{
+			Parent: queueParent(queueState.GetName()),
+			Queue:  queueState,
+		})
+	}
+	if queue == nil {
+		return nil, errQueueTombstoned()
+	}
+
+	current := queue.snapshot()
+	rateLimits := current.GetRateLimits()
+	retryConfig := current.GetRetryConfig()
+
+	paths := in.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = updatableQueueFields
+	}
+	for _, path := range paths {
+		switch path {
+		case "rate_limits":
+			rateLimits.MaxDispatchesPerSecond = queueState.GetRateLimits().GetMaxDispatchesPerSecond()
+			rateLimits.MaxConcurrentDispatches = queueState.GetRateLimits().GetMaxConcurrentDispatches()
+		case "rate_limits.max_dispatches_per_second":
+			rateLimits.MaxDispatchesPerSecond = queueState.GetRateLimits().GetMaxDispatchesPerSecond()
+		case "rate_limits.max_concurrent_dispatches":
+			rateLimits.MaxConcurrentDispatches = queueState.GetRateLimits().GetMaxConcurrentDispatches()
+		case "retry_config":
+			retryConfig = proto.Clone(queueState.GetRetryConfig()).(*tasks.RetryConfig)
+			if retryConfig == nil {
+				retryConfig = &tasks.RetryConfig{}
+			}
+		case "retry_config.max_attempts":
+			retryConfig.MaxAttempts = queueState.GetRetryConfig().GetMaxAttempts()
+		case "retry_config.max_retry_duration":
+			retryConfig.MaxRetryDuration = queueState.GetRetryConfig().GetMaxRetryDuration()
+		case "retry_config.min_backoff":
+			retryConfig.MinBackoff = queueState.GetRetryConfig().GetMinBackoff()
+		case "retry_config.max_backoff":
+			retryConfig.MaxBackoff = queueState.GetRetryConfig().GetMaxBackoff()
+		case "retry_config.max_doublings":
+			retryConfig.MaxDoublings = queueState.GetRetryConfig().GetMaxDoublings()
+		default:
+			return nil, errInvalidUpdateMaskPath(path)
+		}
+	}
+	if rateLimits.GetMaxDispatchesPerSecond() < 0 || rateLimits.GetMaxConcurrentDispatches() < 0 {
+		return nil, errNegativeRateLimits()
+	}
+	if err := validateMaxAttempts(retryConfig); err != nil {
+		return nil, err
+	}
+
+	// Cleared fields go back to the defaults, as on creation
+	updated := &tasks.Queue{RateLimits: rateLimits, RetryConfig: retryConfig}
+	defaultRateLimits, defaultRetryConfig := s.queueDefaults()
+	applyQueueDefaults(updated, defaultRateLimits, defaultRetryConfig)
+	applyQueueDefaults(updated, productionRateLimits(), productionRetryConfig())
+
+	updated = proto.Clone(updated).(*tasks.Queue)
+	queue.Update(updated.GetRateLimits(), updated.GetRetryConfig())
+
+	queueState = queue.snapshot()
+	s.wal.queue(queueState)
+	if err := s.storeQueue(queueState); err != nil {
+		return nil, err
+	}
+	return queueState, nil
 }
 
 // DeleteQueue removes an existing queue.
@@ -163,21 +724,38 @@ func (s *Server) DeleteQueue(ctx context.Context, in *tasks.DeleteQueueRequest)
 
 	// Cloud responds with same error for recently deleted queue
 	if !ok || queue == nil {
-		return nil, status.Errorf(codes.NotFound, "Requested entity was not found.")
+		return nil, errEntityNotFound()
 	}
 
-	queue.Delete()
+	// Remove the queue first so that no new tasks arrive, then drop its tasks in one go. The queue is gone even
+	// if the storage failed to delete it, the error only reports that it may still be stored.
+	err := s.removeQueue(in.GetName())
+	s.removePolicy(in.GetName())
+	s.wal.event(walQueueDeleted, in.GetName())
 
-	s.removeQueue(in.GetName())
+	for _, task := range queue.Delete() {
+		s.removeFinishedTask(task)
+	}
 
+	if err != nil {
+		return nil, err
+	}
 	return &empty.Empty{}, nil
 }
 
 // PurgeQueue purges the specified queue
 func (s *Server) PurgeQueue(ctx context.Context, in *tasks.PurgeQueueRequest) (*tasks.Queue, error) {
-	queue, _ := s.fetchQueue(in.GetName())
+	queue, ok := s.fetchQueue(in.GetName())
+	if !ok || queue == nil {
+		return nil, errEntityNotFound()
+	}
+
+	hardReset := s.hardResetOnPurgeQueue()
+	if override := queue.Settings().HardResetOnPurge; override != nil {
+		hardReset = *override
+	}
 
-	if s.Options.HardResetOnPurgeQueue {
+	if hardReset {
 		// Use the development environment behaviour - synchronously purge the queue and release all task names
 		queue.HardReset(s)
 	} else {
@@ -185,82 +763,92 @@ func (s *Server) PurgeQueue(ctx context.Context, in *tasks.PurgeQueueRequest) (*
 		queue.Purge()
 	}
 
-	return queue.state, nil
+	return queue.snapshot(), nil
 }
 
 // PauseQueue pauses queue execution
 func (s *Server) PauseQueue(ctx context.Context, in *tasks.PauseQueueRequest) (*tasks.Queue, error) {
-	queue, _ := s.fetchQueue(in.GetName())
+	queue, ok := s.fetchQueue(in.GetName())
+	if !ok || queue == nil {
+		return nil, errEntityNotFound()
+	}
 
 	queue.Pause()
 
-	return queue.state, nil
+	queueState := queue.snapshot()
+	s.wal.queue(queueState)
+	if err := s.storeQueue(queueState); err != nil {
+		return nil, err
+	}
+	return queueState, nil
 }
 
 // ResumeQueue resumes a paused queue
 func (s *Server) ResumeQueue(ctx context.Context, in *tasks.ResumeQueueRequest) (*tasks.Queue, error) {
-	queue, _ := s.fetchQueue(in.GetName())
+	queue, ok := s.fetchQueue(in.GetName())
+	if !ok || queue == nil {
+		return nil, errEntityNotFound()
+	}
 
 	queue.Resume()
 
-	return queue.state, nil
-}
-
-// GetIamPolicy doesn't do anything
-func (s *Server) GetIamPolicy(ctx context.Context, in *v1.GetIamPolicyRequest) (*v1.Policy, error) {
-	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
-}
-
-// SetIamPolicy doesn't do anything
-func (s *Server) SetIamPolicy(ctx context.Context, in *v1.SetIamPolicyRequest) (*v1.Policy, error) {
-	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
-}
-
-// TestIamPermissions doesn't do anything
-func (s *Server) TestIamPermissions(ctx context.Context, in *v1.TestIamPermissionsRequest) (*v1.TestIamPermissionsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "Not yet implemented")
+	queueState := queue.snapshot()
+	s.wal.queue(queueState)
+	if err := s.storeQueue(queueState); err != nil {
+		return nil, err
+	}
+	return queueState, nil
 }
 
 // ListTasks lists the tasks in the specified queue
 func (s *Server) ListTasks(ctx context.Context, in *tasks.ListTasksRequest) (*tasks.ListTasksResponse, error) {
-	// TODO: Implement pageing of some sort
-	queue, ok := s.fetchQueue(in.GetParent())
-	if !ok || queue == nil {
-		return nil, status.Errorf(codes.NotFound, "Queue does not exist. If you just created the queue, wait at least a minute for the queue to initialize.")
+	queueState, _, err := s.storage.GetQueue(in.GetParent())
+	if err != nil {
+		return nil, errStorage(err)
+	}
+	if queueState == nil {
+		return nil, errQueueNotFound()
+	}
+	filter, err := taskFilterFromMetadata(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	queue.tsMux.Lock()
-	defer queue.tsMux.Unlock()
-
-	l := make([]*Task, 0, len(queue.ts))
-	for _, task := range queue.ts {
-		if task != nil {
-			l = append(l, task)
+	stored, err := s.storage.ListTasks(in.GetParent() + "/tasks/")
+	if err != nil {
+		return nil, errStorage(err)
+	}
+	l := make([]*tasks.Task, 0, len(stored))
+	for _, taskState := range stored {
+		if filter.matches(taskState, queueState.GetRetryConfig()) {
+			l = append(l, taskState)
 		}
 	}
 
 	sort.SliceStable(l, func(i, j int) bool {
-		return strings.Compare(l[i].state.Name, l[j].state.Name) < 0
+		return strings.Compare(l[i].Name, l[j].Name) < 0
 	})
 
-	start := 0
+	// The page token is the name of the last task listed, so that pages carry on after it whatever tasks
+	// complete or get created in the meantime
 	if in.PageToken != "" {
-		if pt, err := strconv.Atoi(in.PageToken); err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %s", in.PageToken)
-		} else {
-			start = pt
+		lastTaskName, err := decodePageToken(in.PageToken)
+		if err != nil {
+			return nil, errInvalidPageToken(in.PageToken)
 		}
+		l = l[sort.Search(len(l), func(i int) bool {
+			return l[i].Name > lastTaskName
+		}):]
 	}
-	l = l[start:]
 
 	// this is the default max
 	pageSize := 1000
 	if in.PageSize < 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid page size: %d", in.PageSize)
+		return nil, errInvalidPageSize(in.PageSize)
 	} else if in.PageSize == 0 {
 		pageSize = 1000
 	} else if in.PageSize > 1000 {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid page size: %d", in.PageSize)
+		return nil, errInvalidPageSize(in.PageSize)
 	} else {
 		pageSize = int(in.PageSize)
 	}
@@ -268,31 +856,51 @@ func (s *Server) ListTasks(ctx context.Context, in *tasks.ListTasksRequest) (*ta
 	var next string
 	if len(l) > pageSize {
 		l = l[:pageSize]
-		next = strconv.Itoa(start + pageSize)
-	}
-
-	var taskStates []*tasks.Task
-	for _, task := range l {
-		taskStates = append(taskStates, task.state)
+		next = encodePageToken(l[pageSize-1].Name)
 	}
 
 	return &tasks.ListTasksResponse{
-		Tasks:         taskStates,
+		Tasks:         l,
 		NextPageToken: next,
 	}, nil
 }
 
+func encodePageToken(lastTaskName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastTaskName))
+}
+
+func decodePageToken(pageToken string) (string, error) {
+	lastTaskName, err := base64.RawURLEncoding.DecodeString(pageToken)
+	return string(lastTaskName), err
+}
+
 // GetTask returns the specified task
 func (s *Server) GetTask(ctx context.Context, in *tasks.GetTaskRequest) (*tasks.Task, error) {
-	task, ok := s.fetchTask(in.GetName())
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+	taskState, ok, err := s.storage.GetTask(in.GetName())
+	if err != nil {
+		return nil, errStorage(err)
 	}
-	if task == nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+	if ok {
+		return taskState, nil
+	}
+	_, ok, err = s.storage.TaskNameTombstone(in.GetName(), s.clock.Now())
+	if err != nil {
+		return nil, errStorage(err)
 	}
+	if !ok {
+		return nil, errTaskNotFound()
+	}
+
+	return nil, errTaskTombstoned(codes.FailedPrecondition)
+}
 
-	return task.state, nil
+// validateScheduleTime rejects schedule times too far in the future. Times in the past are accepted and simply
+// dispatch immediately.
+func (s *Server) validateScheduleTime(scheduleTime time.Time) error {
+	if maxScheduleTime := s.clock.Now().Add(maxScheduleDelay); scheduleTime.After(maxScheduleTime) {
+		return errScheduleTimeTooFar(scheduleTime, maxScheduleTime)
+	}
+	return nil
 }
 
 // CreateTask creates a new task
@@ -300,46 +908,103 @@ func (s *Server) CreateTask(ctx context.Context, in *tasks.CreateTaskRequest) (*
 
 	queueName := in.GetParent()
 	queue, ok := s.fetchQueue(queueName)
+	if !ok && s.options.AutoCreateQueues {
+		queue, ok = s.autoCreateQueue(ctx, queueName)
+	}
 	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Queue does not exist.")
+		return nil, errParentQueueNotFound()
 	}
 	if queue == nil {
-		return nil, status.Errorf(codes.FailedPrecondition, "The queue no longer exists, though a queue with this name existed recently.")
+		return nil, errParentQueueTombstoned()
+	}
+
+	if err := validateTaskMessage(in.GetTask(), queue.Settings().HttpTarget); err != nil {
+		return nil, err
 	}
 
 	if in.Task.Name != "" {
 		// If a name is specified, it must be valid, it must be unique, and it must belong to this queue
 		if !isValidTaskName(in.Task.Name) {
-			return nil, status.Errorf(codes.InvalidArgument, `Task name must be formatted: "projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>"`)
+			return nil, errInvalidTaskName()
 		}
 		if !strings.HasPrefix(in.Task.Name, queueName+"/tasks/") {
-			return nil, status.Errorf(
-				codes.InvalidArgument,
-				"The queue name from request ('%s') must be the same as the queue name in the named task ('%s').",
-				in.Task.Name,
-				queueName,
-			)
+			return nil, errTaskQueueMismatch(queueName, queueNameOf(in.Task.Name))
 		}
-		if _, exists := s.fetchTask(in.Task.Name); exists {
-			return nil, status.Errorf(codes.AlreadyExists, "Requested entity already exists")
+		task, exists, err := s.fetchTask(in.Task.Name)
+		if err != nil {
+			return nil, err
+		}
+		if exists && (task != nil || !s.options.DisableTaskNameDeduplication) {
+			return nil, errEntityAlreadyExists()
 		}
 	}
 
-	task, taskState := queue.NewTask(in.GetTask())
+	if scheduleTime := in.Task.GetScheduleTime(); scheduleTime != nil {
+		if err := s.validateScheduleTime(scheduleTime.AsTime()); err != nil {
+			return nil, err
+		}
+	}
+
+	if oidcToken := in.Task.GetHttpRequest().GetOidcToken(); oidcToken != nil {
+		if err := validateOIDCToken(oidcToken); err != nil {
+			return nil, err
+		}
+	}
+
+	task, taskState, err := queue.newTask(in.GetTask(), traceFromContext(ctx))
+	if err != nil {
+		return nil, errStorage(err)
+	}
 
 	s.setTask(taskState.GetName(), task)
+	s.dispatcher.counters.taskCreated()
 
 	return taskState, nil
 }
 
+// validateTaskMessage rejects tasks without a target to dispatch to, which would otherwise only fail when dispatched.
+// HTTP tasks may leave out their URL if the queue's HTTP target gives them a host.
+func validateTaskMessage(task *tasks.Task, httpTarget *HttpTarget) error {
+	if task == nil {
+		return errTaskRequired()
+	}
+	switch message := task.GetMessageType().(type) {
+	case *tasks.Task_HttpRequest:
+		taskURL := message.HttpRequest.GetUrl()
+		if taskURL == "" {
+			if httpTarget.overridesHost() {
+				return nil
+			}
+			return errHttpURLRequired()
+		}
+		parsedURL, err := url.Parse(taskURL)
+		if err != nil {
+			return errInvalidHttpURL(taskURL, err)
+		}
+		if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+			return errHttpURLScheme(taskURL)
+		}
+		if parsedURL.Host == "" {
+			return errHttpURLHostMissing(taskURL)
+		}
+	case *tasks.Task_AppEngineHttpRequest:
+	default:
+		return errTaskMessageRequired()
+	}
+	return nil
+}
+
 // DeleteTask removes an existing task
 func (s *Server) DeleteTask(ctx context.Context, in *tasks.DeleteTaskRequest) (*empty.Empty, error) {
-	task, ok := s.fetchTask(in.GetName())
+	task, ok, err := s.fetchTask(in.GetName())
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+		return nil, errTaskNotFound()
 	}
 	if task == nil {
-		return nil, status.Errorf(codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+		return nil, errTaskTombstoned(codes.NotFound)
 	}
 
 	// The removal of the task from the server struct is handled in the queue callback
@@ -348,15 +1013,17 @@ func (s *Server) DeleteTask(ctx context.Context, in *tasks.DeleteTaskRequest) (*
 	return &empty.Empty{}, nil
 }
 
-// RunTask executes an existing task immediately
+// RunTask executes an existing task immediately, even if its queue is paused or rate limited
 func (s *Server) RunTask(ctx context.Context, in *tasks.RunTaskRequest) (*tasks.Task, error) {
-	task, ok := s.fetchTask(in.GetName())
-
+	task, ok, err := s.fetchTask(in.GetName())
+	if err != nil {
+		return nil, err
+	}
 	if !ok {
-		return nil, status.Errorf(codes.NotFound, "Task does not exist.")
+		return nil, errTaskNotFound()
 	}
 	if task == nil {
-		return nil, status.Errorf(codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+		return nil, errTaskTombstoned(codes.NotFound)
 	}
 
 	taskState := task.Run()
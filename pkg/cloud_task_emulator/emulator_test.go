@@ -2,23 +2,40 @@ package cloud_task_emulator_test
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "cloud.google.com/go/cloudtasks/apiv2"
 	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	iampb "cloud.google.com/go/iam/apiv1/iampb"
 	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	grpcStatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var formattedParent = formatParent("TestProject", "TestLocation")
@@ -38,6 +55,98 @@ func TestCloudTasksCreateQueue(t *testing.T) {
 	assert.Equal(t, taskspb.Queue_RUNNING, resp.State)
 }
 
+func TestCreateQueueAppliesProductionDefaults(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	assert.EqualValues(t, 500, createdQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.EqualValues(t, 100, createdQueue.GetRateLimits().GetMaxBurstSize())
+	assert.EqualValues(t, 1000, createdQueue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.EqualValues(t, 100, createdQueue.GetRetryConfig().GetMaxAttempts())
+	assert.EqualValues(t, 16, createdQueue.GetRetryConfig().GetMaxDoublings())
+	assert.Equal(t, 100*time.Millisecond, createdQueue.GetRetryConfig().GetMinBackoff().AsDuration())
+	assert.Equal(t, time.Hour, createdQueue.GetRetryConfig().GetMaxBackoff().AsDuration())
+}
+
+func TestCreateQueueAppliesConfiguredDefaults(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{
+		DefaultRetryConfig: &taskspb.RetryConfig{MaxAttempts: 5, MinBackoff: durationpb.New(time.Second)},
+		DefaultRateLimits:  &taskspb.RateLimits{MaxDispatchesPerSecond: 10},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	assert.EqualValues(t, 10, createdQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+	assert.EqualValues(t, 1000, createdQueue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.EqualValues(t, 5, createdQueue.GetRetryConfig().GetMaxAttempts())
+	assert.Equal(t, time.Second, createdQueue.GetRetryConfig().GetMinBackoff().AsDuration())
+	assert.Equal(t, time.Hour, createdQueue.GetRetryConfig().GetMaxBackoff().AsDuration())
+
+	// Settings on the queue itself take precedence
+	queue := newQueue(formattedParent, "explicit")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 2}
+	explicitQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  queue,
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, explicitQueue.GetRetryConfig().GetMaxAttempts())
+	assert.Equal(t, time.Second, explicitQueue.GetRetryConfig().GetMinBackoff().AsDuration())
+}
+
+func TestCreateQueueEnforcesMaxQueuesPerProject(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{MaxQueuesPerProject: 2})
+
+	for _, name := range []string{"first", "second"} {
+		_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, name),
+		})
+		require.NoError(t, err)
+	}
+
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "third"),
+	})
+	assertIsGrpcError(t, "^Quota exceeded", grpcCodes.ResourceExhausted, err)
+
+	// Other projects have their own quota
+	otherParent := formatParent("OtherProject", "TestLocation")
+	_, err = client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: otherParent,
+		Queue:  newQueue(otherParent, "third"),
+	})
+	assert.NoError(t, err)
+}
+
+func TestCreateQueueEnforcesMaxQueuesPerProjectConcurrently(t *testing.T) {
+	server := NewServer(WithOptions(ServerOptions{MaxQueuesPerProject: 2}))
+	t.Cleanup(server.Shutdown)
+
+	var created int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+				Parent: formattedParent,
+				Queue:  newQueue(formattedParent, fmt.Sprintf("queue-%d", i)),
+			})
+			if err == nil {
+				atomic.AddInt32(&created, 1)
+			} else {
+				assert.Equal(t, grpcCodes.ResourceExhausted, grpcStatus.Code(err))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 2, created)
+	assert.Len(t, server.ListQueuesSnapshot(), 2)
+}
+
 func TestCreateTask(t *testing.T) {
 	client := RunT(t)
 
@@ -63,6 +172,97 @@ func TestCreateTask(t *testing.T) {
 	assert.EqualValues(t, 0, createdTask.GetDispatchCount())
 }
 
+func TestCreateTaskRequiresQueueByDefault(t *testing.T) {
+	client := RunT(t)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: formatQueueName(formattedParent, "undeclared"),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	assertIsGrpcError(t, "^Queue does not exist", grpcCodes.NotFound, err)
+}
+
+func TestCreateTaskAutoCreatesQueue(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{AutoCreateQueues: true})
+
+	queueName := formatQueueName(formattedParent, "undeclared")
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+	assert.Contains(t, createdTask.GetName(), queueName+"/tasks/")
+
+	gettedQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, gettedQueue.GetState())
+	assert.EqualValues(t, 100, gettedQueue.GetRetryConfig().GetMaxAttempts())
+
+	// Invalid queue names are still rejected
+	createTaskRequest.Parent = "not-a-queue"
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	assertIsGrpcError(t, "^Queue does not exist", grpcCodes.NotFound, err)
+}
+
+func TestCreateTaskAutoCreatesQueueOnce(t *testing.T) {
+	server := NewServer(WithOptions(ServerOptions{AutoCreateQueues: true}))
+	t.Cleanup(server.Shutdown)
+	goroutines := runtime.NumGoroutine()
+
+	// Concurrent requests race to create the queue, the queues of those that lost are stopped
+	queueName := formatQueueName(formattedParent, "contended")
+	taskNames := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range taskNames {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+				Parent: queueName,
+				Task: &taskspb.Task{
+					ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+					MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://www.google.com"}},
+				},
+			})
+			if assert.NoError(t, err) {
+				taskNames[i] = task.GetName()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, err := server.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	for _, taskName := range taskNames {
+		assert.Eventually(t, func() bool {
+			_, ok := server.TaskSnapshot(taskName)
+			return !ok
+		}, time.Second, 10*time.Millisecond, taskName)
+	}
+	// Polled by hand, assert.Eventually runs goroutines of its own
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+}
+
 func TestCreateTaskRejectsDuplicateName(t *testing.T) {
 	client := RunT(t)
 
@@ -114,6 +314,46 @@ func TestCreateTaskRejectsDuplicateName(t *testing.T) {
 	assert.Error(t, err, "Should not receive any further HTTP requests within timeout")
 }
 
+func TestCreateTaskWithoutDeduplication(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{DisableTaskNameDeduplication: true})
+
+	createdQueue := createTestQueue(t, client)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/stable-name",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/success",
+				},
+			},
+		},
+	}
+
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	// The completed task's name can be reused, and the new task fires too
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	// A task that still exists cannot be duplicated
+	createTaskRequest.Task.ScheduleTime = timestamppb.New(time.Now().Add(time.Hour))
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	assertIsGrpcError(t, "^Requested entity already exists", grpcCodes.AlreadyExists, err)
+}
+
 func TestCreateTaskRejectsInvalidName(t *testing.T) {
 	client := RunT(t)
 
@@ -158,6 +398,100 @@ func TestCreateTaskRejectsNameForOtherQueue(t *testing.T) {
 
 	assert.Nil(t, createdTask)
 	assertIsGrpcError(t, "^The queue name from request", grpcCodes.InvalidArgument, err)
+	assert.Equal(t, fmt.Sprintf(
+		"The queue name from request ('%s') must be the same as the queue name in the named task ('projects/TestProject/locations/TestLocation/queues/SomeOtherQueue').",
+		createdQueue.GetName(),
+	), grpcStatus.Convert(err).Message())
+}
+
+func TestPauseAndResumeMissingQueue(t *testing.T) {
+	client := RunT(t)
+
+	_, err := client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: formatQueueName(formattedParent, "missing")})
+	assertIsGrpcError(t, "^Requested entity was not found", grpcCodes.NotFound, err)
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: formatQueueName(formattedParent, "missing")})
+	assertIsGrpcError(t, "^Requested entity was not found", grpcCodes.NotFound, err)
+}
+
+func TestCreateTaskRejectsInvalidTargets(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	httpTask := func(url string) *taskspb.Task {
+		return &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: url},
+			},
+		}
+	}
+	for _, tc := range []struct {
+		task    *taskspb.Task
+		message string
+	}{
+		{&taskspb.Task{}, "^Task.message_type is required"},
+		{httpTask(""), "^HttpRequest.url is required"},
+		{httpTask("ftp://localhost/tasks"), "^HttpRequest.url must start with 'http://' or 'https://'"},
+		{httpTask("localhost:9000/tasks"), "^HttpRequest.url must start with 'http://' or 'https://'"},
+		{httpTask("http:///tasks"), "^Invalid HttpRequest.url"},
+	} {
+		createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task:   tc.task,
+		})
+		assert.Nil(t, createdTask)
+		assertIsGrpcError(t, tc.message, grpcCodes.InvalidArgument, err)
+	}
+}
+
+func TestCreateTaskRejectsFarFutureScheduleTime(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(31 * 24 * time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+
+	assert.Nil(t, createdTask)
+	assertIsGrpcError(t, "^The Task.scheduleTime is too far in the future", grpcCodes.InvalidArgument, err)
+}
+
+func TestCreateTaskWithPastScheduleTimeDispatchesImmediately(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(-24 * time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/success",
+				},
+			},
+		},
+	}
+
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 200*time.Millisecond)
+	assert.NoError(t, err, "Task scheduled in the past should dispatch immediately")
 }
 
 func TestGetQueueExists(t *testing.T) {
@@ -212,7 +546,7 @@ func TestGetQueuePreviouslyExisted(t *testing.T) {
 	assert.Equal(t, grpcCodes.NotFound, st.Code())
 }
 
-func TestPurgeQueueDoesNotReleaseTaskNamesByDefault(t *testing.T) {
+func TestDeleteQueueCancelsPendingRetries(t *testing.T) {
 	client := RunT(t)
 
 	createdQueue := createTestQueue(t, client)
@@ -222,10 +556,8 @@ func TestPurgeQueueDoesNotReleaseTaskNamesByDefault(t *testing.T) {
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
-			Name: createdQueue.GetName() + "/tasks/any-task",
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
-					// Use the not_found handler to prove that purge stops any further retries
 					Url: testServerUrl + "/not_found",
 				},
 			},
@@ -234,32 +566,20 @@ func TestPurgeQueueDoesNotReleaseTaskNamesByDefault(t *testing.T) {
 	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
 	require.NoError(t, err)
 
-	// Task was created OK, verify that the first HTTP request was sent
 	_, err = awaitHttpRequest(receivedRequests)
 	require.NoError(t, err)
 
-	// Now purge the queue
-	purgeQueueRequest := taskspb.PurgeQueueRequest{
-		Name: createdQueue.GetName(),
-	}
-	_, err = client.PurgeQueue(context.Background(), &purgeQueueRequest)
+	err = client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
 	require.NoError(t, err)
 
-	// Wait a moment for that to work, then verify nothing in the list and cannot retrieve by name
-	time.Sleep(100 * time.Millisecond)
-	assertTaskListIsEmpty(t, client, createdQueue)
+	// The task is removed as part of the deletion, not at some later point
 	assertGetTaskFails(t, grpcCodes.FailedPrecondition, client, createdTask.GetName())
 
-	// BUT - Verify that the task name is still not available for new tasks
-	_, err = client.CreateTask(context.Background(), &createTaskRequest)
-	assertIsGrpcError(t, "^Requested entity already exists", grpcCodes.AlreadyExists, err)
-
-	// Verify that it only sent the original HTTP request, it purged before the retries
 	_, err = awaitHttpRequestWithTimeout(receivedRequests, 1*time.Second)
 	assert.Error(t, err, "Should not receive any further HTTP requests within timeout")
 }
 
-func TestPurgeQueueOptionallyPerformsHardReset(t *testing.T) {
+func TestDeleteQueueCancelsInFlightDispatch(t *testing.T) {
 	client := RunT(t)
 
 	createdQueue := createTestQueue(t, client)
@@ -269,119 +589,1481 @@ func TestPurgeQueueOptionallyPerformsHardReset(t *testing.T) {
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
-			Name: createdQueue.GetName() + "/tasks/any-task",
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
-					// Use the not_found handler to prove that purge stops any further retries
-					Url: testServerUrl + "/not_found",
+					Url: testServerUrl + "/hang",
 				},
 			},
 		},
 	}
-	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
 	require.NoError(t, err)
 
-	// Task was created OK, verify that the first HTTP request was sent
-	_, err = awaitHttpRequest(receivedRequests)
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
 	require.NoError(t, err)
 
-	// Now purge the queue
-	purgeQueueRequest := taskspb.PurgeQueueRequest{
-		Name: createdQueue.GetName(),
-	}
-	_, err = client.PurgeQueue(context.Background(), &purgeQueueRequest)
+	err = client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
 	require.NoError(t, err)
 
-	// In this mode, purging the queue is synchronous so we should be in the empty state straight away
-	time.Sleep(1 * time.Second)
-	assertTaskListIsEmpty(t, client, createdQueue)
-
-	// task id is not immediately available for re-use
-	// https://cloud.google.com/tasks/docs/reference/rest/v2beta3/projects.locations.queues.tasks/create#body.request_body.FIELDS.task
-	assertGetTaskFails(t, grpcCodes.FailedPrecondition, client, createdTask.GetName())
+	assert.Eventually(t, func() bool {
+		return receivedRequest.Context().Err() != nil
+	}, 1*time.Second, 10*time.Millisecond, "In-flight request should be cancelled")
 
-	// TODO(ricebin) what should we test here?
-	// And verify that we can now create the task with that name again and it will fire again
-	//_, err = client.CreateTask(context.Background(), &createTaskRequest)
-	//require.NoError(t, err)
-	//
-	//// Verify that it has now sent the request from the new task
-	//receivedRequest, err := awaitHttpRequest(receivedRequests)
-	//require.NotNil(t, receivedRequest, "Request was received")
-	//require.NoError(t, err)
-	//// Note that the execution count is reset to 0
-	//assertHeadersMatch(
-	//	t,
-	//	map[string]string{
-	//		"X-CloudTasks-TaskExecutionCount": "0",
-	//		"X-CloudTasks-TaskRetryCount":     "0",
-	//	},
-	//	receivedRequest,
-	//)
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	assert.Error(t, err, "Should not receive any further HTTP requests within timeout")
 }
 
-func TestListTasks(t *testing.T) {
+func TestDeleteTaskCancelsInFlightDispatch(t *testing.T) {
 	client := RunT(t)
 
 	createdQueue := createTestQueue(t, client)
 
+	testServerUrl, receivedRequests := startTestServer(t)
+
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
-					Url: "http://does.not.exist/",
+					Url: testServerUrl + "/hang",
 				},
 			},
 		},
 	}
-
-	createdTask1, err := client.CreateTask(context.Background(), &createTaskRequest)
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
 	require.NoError(t, err)
 
-	{
-		listTasksRequest := taskspb.ListTasksRequest{
-			Parent: createdQueue.GetName(),
-		}
-
-		tasksIterator := client.ListTasks(context.Background(), &listTasksRequest)
-		assert.NoError(t, err)
-
-		listedTask, err := tasksIterator.Next()
-		assert.NoError(t, err)
-		assert.Equal(t, listedTask.GetName(), createdTask1.GetName())
-		_, err = tasksIterator.Next()
-		assert.EqualError(t, err, "no more items in iterator")
-	}
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
 
-	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
 	require.NoError(t, err)
 
-	{
-		listTasksRequest := taskspb.ListTasksRequest{
-			Parent:   createdQueue.GetName(),
-			PageSize: 1,
-		}
+	assert.Eventually(t, func() bool {
+		return receivedRequest.Context().Err() != nil
+	}, 1*time.Second, 10*time.Millisecond, "In-flight request should be cancelled")
 
-		page := client.ListTasks(context.Background(), &listTasksRequest)
+	assert.Eventually(t, func() bool {
+		_, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+		return grpcStatus.Code(err) == grpcCodes.FailedPrecondition
+	}, 1*time.Second, 10*time.Millisecond, "Aborted task should be gone")
 
-		all, next := drainAsList(t, page)
-		assert.Empty(t, next)
-		assert.Len(t, all, 2)
-	}
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	assert.Error(t, err, "Deleted task should not be retried")
 }
 
-func TestSuccessTaskExecution(t *testing.T) {
+func TestDeleteTaskCancelsPendingRetry(t *testing.T) {
 	client := RunT(t)
 
 	testServerUrl, receivedRequests := startTestServer(t)
 
-	createdQueue := createTestQueue(t, client)
+	queue := newQueue(formattedParent, "retries")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(200 * time.Millisecond),
+		MaxBackoff: durationpb.New(200 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 600*time.Millisecond)
+	assert.Error(t, err, "Deleted task should not be retried")
+}
+
+func TestDeleteTaskThatRanOutOfAttempts(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "exhausted")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	createdTask, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+		return err == nil && gettedTask.GetResponseCount() == 1
+	}, 1*time.Second, 10*time.Millisecond, "Task should have run out of attempts")
+
+	err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+		return grpcStatus.Code(err) == grpcCodes.FailedPrecondition
+	}, 1*time.Second, 10*time.Millisecond, "Deleted task should be gone, its name reserved")
+}
+
+func TestShutdownAbortsInFlightDispatch(t *testing.T) {
+	emulatorServer := NewServer()
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createdQueue, err := emulatorServer.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "test"),
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/hang",
+				},
+			},
+		},
+	}
+	_, err = emulatorServer.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	emulatorServer.Shutdown()
+
+	assert.Eventually(t, func() bool {
+		return receivedRequest.Context().Err() != nil
+	}, 1*time.Second, 10*time.Millisecond, "In-flight request should be cancelled")
+
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	assert.Error(t, err, "Should not receive any further HTTP requests within timeout")
+}
+
+func TestDispatchTimeout(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{
+		DefaultRetryConfig: &taskspb.RetryConfig{MaxAttempts: 2},
+		Dispatch:           DispatchOptions{Timeout: 100 * time.Millisecond},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			// The dispatch timeout wins over the longer deadline
+			DispatchDeadline: durationpb.New(time.Minute),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/hang",
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return receivedRequest.Context().Err() != nil
+	}, 1*time.Second, 10*time.Millisecond, "Hung request should time out")
+
+	retriedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "DEADLINE_EXCEEDED", retriedRequest.Header.Get("X-CloudTasks-TaskRetryReason"))
+	assert.Empty(t, retriedRequest.Header.Get("X-CloudTasks-TaskPreviousResponse"))
+}
+
+func TestIamPolicyRoundTrip(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	emptyPolicy, err := client.GetIamPolicy(context.Background(), &iampb.GetIamPolicyRequest{Resource: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Empty(t, emptyPolicy.GetBindings())
+	assert.NotEmpty(t, emptyPolicy.GetEtag())
+
+	setPolicy, err := client.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{
+		Resource: createdQueue.GetName(),
+		Policy: &iampb.Policy{
+			Bindings: []*iampb.Binding{
+				{Role: "roles/cloudtasks.enqueuer", Members: []string{"serviceAccount:app@test.iam.gserviceaccount.com"}},
+			},
+			Etag: emptyPolicy.GetEtag(),
+		},
+	})
+	require.NoError(t, err)
+	assert.NotEqual(t, emptyPolicy.GetEtag(), setPolicy.GetEtag())
+
+	gettedPolicy, err := client.GetIamPolicy(context.Background(), &iampb.GetIamPolicyRequest{Resource: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, setPolicy.GetEtag(), gettedPolicy.GetEtag())
+	require.Len(t, gettedPolicy.GetBindings(), 1)
+	assert.Equal(t, "roles/cloudtasks.enqueuer", gettedPolicy.GetBindings()[0].GetRole())
+	assert.Equal(t, []string{"serviceAccount:app@test.iam.gserviceaccount.com"}, gettedPolicy.GetBindings()[0].GetMembers())
+
+	// Writing with the stale etag is rejected
+	_, err = client.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{
+		Resource: createdQueue.GetName(),
+		Policy:   &iampb.Policy{Etag: emptyPolicy.GetEtag()},
+	})
+	assertIsGrpcError(t, "^There were concurrent policy changes", grpcCodes.Aborted, err)
+}
+
+func TestIamPolicyRequiresQueue(t *testing.T) {
+	client := RunT(t)
+
+	_, err := client.GetIamPolicy(context.Background(), &iampb.GetIamPolicyRequest{Resource: formatQueueName(formattedParent, "missing")})
+	assertIsGrpcError(t, "^Requested entity was not found", grpcCodes.NotFound, err)
+
+	_, err = client.SetIamPolicy(context.Background(), &iampb.SetIamPolicyRequest{
+		Resource: formatQueueName(formattedParent, "missing"),
+		Policy:   &iampb.Policy{},
+	})
+	assertIsGrpcError(t, "^Requested entity was not found", grpcCodes.NotFound, err)
+}
+
+func TestIamPermissionsGrantsEverythingByDefault(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	resp, err := client.TestIamPermissions(context.Background(), &iampb.TestIamPermissionsRequest{
+		Resource:    createdQueue.GetName(),
+		Permissions: []string{"cloudtasks.tasks.create", "cloudtasks.queues.purge"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cloudtasks.tasks.create", "cloudtasks.queues.purge"}, resp.GetPermissions())
+}
+
+func TestIamPermissionsPerCaller(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{
+		IamPermissions: map[string][]string{
+			"user:restricted@example.com": {"cloudtasks.tasks.create"},
+		},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	request := iampb.TestIamPermissionsRequest{
+		Resource:    createdQueue.GetName(),
+		Permissions: []string{"cloudtasks.tasks.create", "cloudtasks.queues.purge"},
+	}
+
+	restrictedCtx := metadata.AppendToOutgoingContext(context.Background(), CallerMetadataKey, "user:restricted@example.com")
+	resp, err := client.TestIamPermissions(restrictedCtx, &request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cloudtasks.tasks.create"}, resp.GetPermissions())
+
+	otherCtx := metadata.AppendToOutgoingContext(context.Background(), CallerMetadataKey, "user:other@example.com")
+	resp, err = client.TestIamPermissions(otherCtx, &request)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cloudtasks.tasks.create", "cloudtasks.queues.purge"}, resp.GetPermissions())
+}
+
+func TestPurgeQueueDoesNotReleaseTaskNamesByDefault(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/any-task",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					// Use the not_found handler to prove that purge stops any further retries
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// Task was created OK, verify that the first HTTP request was sent
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	// Now purge the queue
+	purgeQueueRequest := taskspb.PurgeQueueRequest{
+		Name: createdQueue.GetName(),
+	}
+	_, err = client.PurgeQueue(context.Background(), &purgeQueueRequest)
+	require.NoError(t, err)
+
+	// Wait a moment for that to work, then verify nothing in the list and cannot retrieve by name
+	time.Sleep(100 * time.Millisecond)
+	assertTaskListIsEmpty(t, client, createdQueue)
+	assertGetTaskFails(t, grpcCodes.FailedPrecondition, client, createdTask.GetName())
+
+	// BUT - Verify that the task name is still not available for new tasks
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	assertIsGrpcError(t, "^Requested entity already exists", grpcCodes.AlreadyExists, err)
+
+	// Verify that it only sent the original HTTP request, it purged before the retries
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 1*time.Second)
+	assert.Error(t, err, "Should not receive any further HTTP requests within timeout")
+}
+
+func TestPurgeQueueOptionallyPerformsHardReset(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/any-task",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					// Use the not_found handler to prove that purge stops any further retries
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// Task was created OK, verify that the first HTTP request was sent
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	// Now purge the queue
+	purgeQueueRequest := taskspb.PurgeQueueRequest{
+		Name: createdQueue.GetName(),
+	}
+	_, err = client.PurgeQueue(context.Background(), &purgeQueueRequest)
+	require.NoError(t, err)
+
+	// In this mode, purging the queue is synchronous so we should be in the empty state straight away
+	time.Sleep(1 * time.Second)
+	assertTaskListIsEmpty(t, client, createdQueue)
+
+	// task id is not immediately available for re-use
+	// https://cloud.google.com/tasks/docs/reference/rest/v2beta3/projects.locations.queues.tasks/create#body.request_body.FIELDS.task
+	assertGetTaskFails(t, grpcCodes.FailedPrecondition, client, createdTask.GetName())
+
+	// TODO(ricebin) what should we test here?
+	// And verify that we can now create the task with that name again and it will fire again
+	//_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	//require.NoError(t, err)
+	//
+	//// Verify that it has now sent the request from the new task
+	//receivedRequest, err := awaitHttpRequest(receivedRequests)
+	//require.NotNil(t, receivedRequest, "Request was received")
+	//require.NoError(t, err)
+	//// Note that the execution count is reset to 0
+	//assertHeadersMatch(
+	//	t,
+	//	map[string]string{
+	//		"X-CloudTasks-TaskExecutionCount": "0",
+	//		"X-CloudTasks-TaskRetryCount":     "0",
+	//	},
+	//	receivedRequest,
+	//)
+}
+
+func TestPurgeQueueHardResetPerQueue(t *testing.T) {
+	client := RunT(t)
+
+	// Opt this queue into the hard reset behaviour at creation time
+	ctx := metadata.AppendToOutgoingContext(context.Background(), HardResetOnPurgeMetadataKey, "true")
+	createdQueue, err := client.CreateQueue(ctx, &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue:  newQueue(formattedParent, "hard-reset"),
+	})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name:         createdQueue.GetName() + "/tasks/reused-task",
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://www.google.com",
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = client.PurgeQueue(context.Background(), &taskspb.PurgeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	// The task name was released by the purge
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	assert.NoError(t, err)
+}
+
+func TestListTasks(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "http://does.not.exist/",
+				},
+			},
+		},
+	}
+
+	createdTask1, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	{
+		listTasksRequest := taskspb.ListTasksRequest{
+			Parent: createdQueue.GetName(),
+		}
+
+		tasksIterator := client.ListTasks(context.Background(), &listTasksRequest)
+		assert.NoError(t, err)
+
+		listedTask, err := tasksIterator.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, listedTask.GetName(), createdTask1.GetName())
+		_, err = tasksIterator.Next()
+		assert.EqualError(t, err, "no more items in iterator")
+	}
+
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	{
+		listTasksRequest := taskspb.ListTasksRequest{
+			Parent:   createdQueue.GetName(),
+			PageSize: 1,
+		}
+
+		page := client.ListTasks(context.Background(), &listTasksRequest)
+
+		all, next := drainAsList(t, page)
+		assert.Empty(t, next)
+		assert.Len(t, all, 2)
+	}
+}
+
+func TestSuccessTaskExecution(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/my-test-task",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/success",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	getTaskRequest := taskspb.GetTaskRequest{
+		Name: createdTask.GetName(),
+	}
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
+	assert.Error(t, err)
+	assert.Nil(t, gettedTask)
+
+	// Validate that the call was actually made properly
+	require.NotNil(t, receivedRequest, "Request was received")
+
+	// Simple predictable headers
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-CloudTasks-TaskExecutionCount": "0",
+			"X-CloudTasks-TaskRetryCount":     "0",
+			"X-CloudTasks-TaskName":           "my-test-task",
+			"X-CloudTasks-QueueName":          "test",
+		},
+		receivedRequest,
+	)
+	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-CloudTasks-TaskETA"))
+}
+
+func TestTaskUrlRewrite(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{
+			URLRewrites: []URLRewrite{{From: "https://api.example.com", To: testServerUrl}},
+		},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name:         createdQueue.GetName() + "/tasks/rewritten",
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "https://api.example.com/success?from=production",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+	// The task keeps the URL it was created with
+	assert.Equal(t, "https://api.example.com/success?from=production", createdTask.GetHttpRequest().GetUrl())
+
+	_, err = client.RunTask(context.Background(), &taskspb.RunTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "/success", receivedRequest.URL.Path)
+	assert.Equal(t, "production", receivedRequest.URL.Query().Get("from"))
+}
+
+func TestQueueDispatchTarget(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+	queueName := formatQueueName(formattedParent, "test")
+
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{
+			QueueTargets: map[string]string{queueName: testServerUrl},
+		},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: "https://production.example.com/success?id=42",
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "/success", receivedRequest.URL.Path)
+	assert.Equal(t, "42", receivedRequest.URL.Query().Get("id"))
+}
+
+func TestDispatchThroughProxy(t *testing.T) {
+	// The test server answers proxied requests as it would direct ones
+	proxyUrl, receivedRequests := startTestServer(t)
+	proxy, err := url.Parse(proxyUrl)
+	require.NoError(t, err)
+
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{Proxy: proxy},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					// Nothing listens on port 1, only the proxy can answer
+					Url: "http://127.0.0.1:1/success",
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:1", receivedRequest.Host)
+}
+
+func TestDispatchInsecureSkipVerify(t *testing.T) {
+	receivedRequests := make(chan *http.Request, 1)
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequests <- r
+	}))
+	t.Cleanup(tlsServer.Close)
+
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{InsecureSkipVerify: true},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: tlsServer.URL + "/self-signed",
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "/self-signed", receivedRequest.URL.Path)
+}
+
+func TestDispatchWithCustomRootCAs(t *testing.T) {
+	receivedRequests := make(chan *http.Request, 1)
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequests <- r
+	}))
+	t.Cleanup(tlsServer.Close)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(tlsServer.Certificate())
+
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{RootCAs: rootCAs},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: tlsServer.URL + "/internal-ca",
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "/internal-ca", receivedRequest.URL.Path)
+}
+
+func TestDispatchExtraHeaders(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{
+			Headers: map[string]string{"X-Env": "local", "X-Team": "emulator"},
+		},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:     testServerUrl + "/success",
+					Headers: map[string]string{"x-team": "payments"},
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	assert.Equal(t, "local", receivedRequest.Header.Get("X-Env"))
+	assert.Equal(t, []string{"payments"}, receivedRequest.Header.Values("X-Team"))
+}
+
+func TestSuccessAppEngineTaskExecution(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
+	os.Setenv("APP_ENGINE_EMULATOR_HOST", testServerUrl)
+
+	createdQueue := createTestQueue(t, client)
 
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
 			Name: createdQueue.GetName() + "/tasks/my-test-task",
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					RelativeUri: "/success",
+				},
+			},
+		},
+	}
+
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+	assert.NotNil(t, createdTask)
+
+	// Wait for it to perform the http request
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	require.NotNil(t, receivedRequest, "Request was received")
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-AppEngine-TaskExecutionCount": "0",
+			"X-AppEngine-TaskRetryCount":     "0",
+			"X-AppEngine-TaskName":           "my-test-task",
+			"X-AppEngine-QueueName":          "test",
+		},
+		receivedRequest,
+	)
+
+	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-AppEngine-TaskETA"))
+}
+
+func TestAppEngineTaskRetryHeaders(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
+	os.Setenv("APP_ENGINE_EMULATOR_HOST", "http://appengine.local")
+
+	client := RunTWithOptions(t, ServerOptions{
+		DefaultRetryConfig: &taskspb.RetryConfig{MaxAttempts: 2},
+		Dispatch: DispatchOptions{
+			QueueTargets: map[string]string{formatQueueName(formattedParent, "test"): testServerUrl},
+		},
+	})
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					AppEngineRouting: &taskspb.AppEngineRouting{Service: "worker"},
+					RelativeUri:      "/not_found",
+					Headers:          map[string]string{"X-AppEngine-FailFast": "true"},
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "worker.appengine.local", receivedRequest.Host)
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-AppEngine-FailFast":             "true",
+			"X-AppEngine-TaskPreviousResponse": "",
+			"X-AppEngine-TaskRetryReason":      "",
+		},
+		receivedRequest,
+	)
+
+	receivedRequest, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-AppEngine-FailFast":             "true",
+			"X-AppEngine-TaskPreviousResponse": "404",
+			"X-AppEngine-TaskRetryReason":      "NOT_FOUND",
+		},
+		receivedRequest,
+	)
+}
+
+func TestErrorTaskExecution(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	}
+
+	start := time.Now()
+
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// With the default retry backoff, we expect 4 calls within the first second:
+	// at t=0, 0.1, 0.3 (+0.2), 0.7 (+0.4) seconds (plus some buffer) ==> 4 calls
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err, "Should have received request 1")
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-CloudTasks-TaskExecutionCount":   "0",
+			"X-CloudTasks-TaskRetryCount":       "0",
+			"X-CloudTasks-TaskPreviousResponse": "",
+			"X-CloudTasks-TaskRetryReason":      "",
+		},
+		receivedRequest,
+	)
+
+	receivedRequest, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err, "Should have received request 2")
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-CloudTasks-TaskExecutionCount":   "1",
+			"X-CloudTasks-TaskRetryCount":       "1",
+			"X-CloudTasks-TaskPreviousResponse": "404",
+			"X-CloudTasks-TaskRetryReason":      "NOT_FOUND",
+		},
+		receivedRequest,
+	)
+
+	receivedRequest, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err, "Should have received request 3")
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-CloudTasks-TaskExecutionCount":   "2",
+			"X-CloudTasks-TaskRetryCount":       "2",
+			"X-CloudTasks-TaskPreviousResponse": "404",
+			"X-CloudTasks-TaskRetryReason":      "NOT_FOUND",
+		},
+		receivedRequest,
+	)
+
+	receivedRequest, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err, "Should have received request 4")
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-CloudTasks-TaskExecutionCount":   "3",
+			"X-CloudTasks-TaskRetryCount":       "3",
+			"X-CloudTasks-TaskPreviousResponse": "404",
+			"X-CloudTasks-TaskRetryReason":      "NOT_FOUND",
+		},
+		receivedRequest,
+	)
+
+	expectedCompleteBy := start.Add(700 * time.Millisecond)
+	assert.WithinDuration(
+		t,
+		expectedCompleteBy,
+		time.Now(),
+		200*time.Millisecond,
+		"4 retries should take roughly 0.7 seconds",
+	)
+
+	// Check the state of the task has been updated with the number of dispatches
+	getTaskRequest := taskspb.GetTaskRequest{
+		Name: createdTask.GetName(),
+	}
+	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, gettedTask.GetDispatchCount())
+}
+
+func TestSingleAttemptIsNotRetried(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "single-attempt")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, createdQueue.GetRetryConfig().GetMaxAttempts())
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-CloudTasks-TaskExecutionCount": "0",
+			"X-CloudTasks-TaskRetryCount":     "0",
+		},
+		receivedRequest,
+	)
+
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	assert.Error(t, err, "A single attempt should not be retried")
+
+	gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, gettedTask.GetDispatchCount())
+	assert.EqualValues(t, 1, gettedTask.GetResponseCount())
+}
+
+func TestUnlimitedAttempts(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "unlimited-attempts")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MaxAttempts: -1,
+		MinBackoff:  durationpb.New(10 * time.Millisecond),
+		MaxBackoff:  durationpb.New(10 * time.Millisecond),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+	assert.EqualValues(t, -1, createdQueue.GetRetryConfig().GetMaxAttempts())
+	// Deleting the queue stops the retries, and draining the requests lets the test server shut down
+	t.Cleanup(func() {
+		client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+		for {
+			if _, err := awaitHttpRequestWithTimeout(receivedRequests, 100*time.Millisecond); err != nil {
+				return
+			}
+		}
+	})
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		receivedRequest, err := awaitHttpRequest(receivedRequests)
+		require.NoError(t, err, "Should have received request %d", i+1)
+		assertHeadersMatch(
+			t,
+			map[string]string{
+				"X-CloudTasks-TaskExecutionCount": strconv.Itoa(i),
+				"X-CloudTasks-TaskRetryCount":     strconv.Itoa(i),
+			},
+			receivedRequest,
+		)
+	}
+}
+
+func TestCreateQueueRejectsInvalidMaxAttempts(t *testing.T) {
+	client := RunT(t)
+
+	queue := newQueue(formattedParent, "invalid-attempts")
+	queue.RetryConfig = &taskspb.RetryConfig{MaxAttempts: -2}
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	assertIsGrpcError(t, "^RetryConfig.max_attempts must be -1", grpcCodes.InvalidArgument, err)
+}
+
+func TestCreatePausedQueue(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "paused")
+	queue.State = taskspb.Queue_PAUSED
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, createdQueue.GetState())
+
+	gettedQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, gettedQueue.GetState())
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/success",
+				},
+			},
+		},
+	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	assert.Error(t, err, "Paused queue should not dispatch")
+}
+
+func TestCreateDisabledQueueFails(t *testing.T) {
+	client := RunT(t)
+
+	queue := newQueue(formattedParent, "disabled")
+	queue.State = taskspb.Queue_DISABLED
+	_, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	assertIsGrpcError(t, "^Queue.state DISABLED cannot be set", grpcCodes.InvalidArgument, err)
+
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	assertIsGrpcError(t, "^Queue does not exist", grpcCodes.NotFound, err)
+}
+
+func TestUpdateQueueReschedulesPendingRetries(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "slow-retries")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(time.Hour),
+		MaxBackoff: durationpb.New(time.Hour),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/not_found",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	updatedQueue, err := client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name: createdQueue.GetName(),
+			RetryConfig: &taskspb.RetryConfig{
+				MinBackoff: durationpb.New(100 * time.Millisecond),
+				MaxBackoff: durationpb.New(100 * time.Millisecond),
+			},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"retry_config.min_backoff", "retry_config.max_backoff"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, updatedQueue.GetRetryConfig().GetMaxBackoff().AsDuration())
+	assert.EqualValues(t, 100, updatedQueue.GetRetryConfig().GetMaxAttempts(), "Fields outside the mask are kept")
+
+	// The retry an hour away is brought forward to the new backoff
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, gettedTask.GetDispatchCount())
+}
+
+func TestUpdateQueueWhileRetryFires(t *testing.T) {
+	// Each task fails its first attempt and succeeds after
+	var attempts sync.Map
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, _ := attempts.LoadOrStore(r.URL.Path, new(int32))
+		if atomic.AddInt32(count.(*int32), 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(target.Close)
+	scheduler := &manualScheduler{}
+	server := NewServer(WithScheduler(scheduler))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "updated")})
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: fmt.Sprintf("%s/task-%d", target.URL, i)}},
+			},
+		})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return scheduler.waits() == 1 }, time.Second, time.Millisecond)
+
+		// The retry config changes while the retry fires, either way the task is retried once
+		fired := make(chan int)
+		go func() { fired <- scheduler.fire() }()
+		_, err = server.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+			Queue:      &taskspb.Queue{Name: queue.GetName(), RetryConfig: &taskspb.RetryConfig{MaxAttempts: int32(50 + i)}},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"retry_config.max_attempts"}},
+		})
+		require.NoError(t, err)
+		<-fired
+		// Fire the retry rescheduled by the update, if any
+		assert.Eventually(t, func() bool {
+			scheduler.fire()
+			_, ok := server.TaskSnapshot(task.GetName())
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	scheduler.fire()
+	assert.Never(t, func() bool {
+		dispatchedThrice := false
+		attempts.Range(func(path, count interface{}) bool {
+			dispatchedThrice = atomic.LoadInt32(count.(*int32)) > 2
+			return !dispatchedThrice
+		})
+		return dispatchedThrice
+	}, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestUpdateQueueRaisesConcurrency(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "serial")
+	queue.RateLimits = &taskspb.RateLimits{MaxConcurrentDispatches: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+	// Deleting the queue aborts the hung dispatches, so that the test server can shut down
+	t.Cleanup(func() {
+		client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+	})
+
+	for i := 0; i < 2; i++ {
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: testServerUrl + "/hang",
+					},
+				},
+			},
+		}
+		_, err = client.CreateTask(context.Background(), &createTaskRequest)
+		require.NoError(t, err)
+	}
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	require.Error(t, err, "Second task waits for the only worker")
+
+	updatedQueue, err := client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue: &taskspb.Queue{
+			Name:       createdQueue.GetName(),
+			RateLimits: &taskspb.RateLimits{MaxConcurrentDispatches: 2},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"rate_limits.max_concurrent_dispatches"}},
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, updatedQueue.GetRateLimits().GetMaxConcurrentDispatches())
+	assert.EqualValues(t, 500, updatedQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+
+	_, err = awaitHttpRequest(receivedRequests)
+	assert.NoError(t, err, "Second task dispatched once the queue allows it")
+}
+
+func TestRateLimitPacesDispatches(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "paced")
+	queue.RateLimits = &taskspb.RateLimits{MaxDispatchesPerSecond: 10, MaxBurstSize: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: testServerUrl + "/success",
+					},
+				},
+			},
+		}
+		_, err = client.CreateTask(context.Background(), &createTaskRequest)
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 6; i++ {
+		_, err = awaitHttpRequest(receivedRequests)
+		require.NoError(t, err)
+	}
+	// The first task goes straight away, the others every 100ms
+	assert.WithinDuration(t, start.Add(500*time.Millisecond), time.Now(), 150*time.Millisecond)
+}
+
+func TestMaxConcurrentDispatchesAcrossQueues(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{MaxConcurrentDispatches: 1},
+	})
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	var taskNames []string
+	for _, queueID := range []string{"first", "second"} {
+		createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+			Parent: formattedParent,
+			Queue:  newQueue(formattedParent, queueID),
+		})
+		require.NoError(t, err)
+		// Deleting the queue aborts the hung dispatches, so that the test server can shut down
+		t.Cleanup(func() {
+			client.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: createdQueue.GetName()})
+		})
+
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: testServerUrl + "/hang",
+					},
+				},
+			},
+		}
+		createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+		require.NoError(t, err)
+		taskNames = append(taskNames, createdTask.GetName())
+	}
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	require.Error(t, err, "Second dispatch waits for the only slot")
+
+	// Free the slot by deleting the task holding it
+	for _, taskName := range taskNames {
+		if strings.HasSuffix(taskName, receivedRequest.Header.Get("X-CloudTasks-TaskName")) {
+			err = client.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: taskName})
+			require.NoError(t, err)
+		}
+	}
+
+	_, err = awaitHttpRequest(receivedRequests)
+	assert.NoError(t, err, "Second dispatch takes the freed slot")
+}
+
+func TestUpdateQueueCreatesMissingQueue(t *testing.T) {
+	client := RunT(t)
+
+	queue := newQueue(formattedParent, "upserted")
+	queue.RateLimits = &taskspb.RateLimits{MaxDispatchesPerSecond: 5}
+	updatedQueue, err := client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{Queue: queue})
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, updatedQueue.GetRateLimits().GetMaxDispatchesPerSecond())
+
+	gettedQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, gettedQueue.GetState())
+}
+
+func TestUpdateQueueRejectsUnknownMaskPath(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	_, err := client.UpdateQueue(context.Background(), &taskspb.UpdateQueueRequest{
+		Queue:      &taskspb.Queue{Name: createdQueue.GetName()},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"rate_limits.max_burst_size"}},
+	})
+	assertIsGrpcError(t, "^Invalid update mask path", grpcCodes.InvalidArgument, err)
+}
+
+func TestGrpcMessageSizeLimits(t *testing.T) {
+	createTaskWithBody := func(client *Client, size int) error {
+		createdQueue, err := client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "test")})
+		if err != nil {
+			return err
+		}
+		_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url:  "http://localhost:9000/large",
+						Body: make([]byte, size),
+					},
+				},
+			},
+		})
+		return err
+	}
+
+	smallClient := RunTWithOptions(t, ServerOptions{MaxRecvMsgSize: 1024})
+	createTestQueue(t, smallClient)
+	err := createTaskWithBody(smallClient, 2048)
+	assert.Equal(t, grpcCodes.ResourceExhausted, grpcStatus.Code(err))
+
+	largeClient := RunTWithOptions(t, ServerOptions{MaxRecvMsgSize: 8 << 20, MaxSendMsgSize: 8 << 20})
+	createTestQueue(t, largeClient)
+	assert.NoError(t, createTaskWithBody(largeClient, 5<<20))
+}
+
+func TestKeepaliveClosesIdleConnections(t *testing.T) {
+	emulatorServer := NewServer(WithOptions(ServerOptions{
+		Keepalive: &keepalive.ServerParameters{MaxConnectionIdle: 100 * time.Millisecond},
+	}))
+	grpcServer := emulatorServer.NewGrpcServer()
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(lis)
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		emulatorServer.Shutdown()
+	})
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = taskspb.NewCloudTasksClient(conn).ListQueues(context.Background(), &taskspb.ListQueuesRequest{Parent: formattedParent})
+	require.NoError(t, err)
+	require.Equal(t, connectivity.Ready, conn.GetState())
+
+	// The server closes the connection once idle, which the client sees going idle too
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for state := conn.GetState(); state == connectivity.Ready; state = conn.GetState() {
+		require.True(t, conn.WaitForStateChange(ctx, state), "connection still ready")
+	}
+}
+
+func TestRunTaskOnPausedQueue(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	_, err := client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			Name: createdQueue.GetName() + "/tasks/paused-task",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/success",
+				},
+			},
+		},
+	}
+	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	// The paused queue should not dispatch the task by itself
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 300*time.Millisecond)
+	assert.Error(t, err, "Paused queue should not dispatch")
+
+	runTaskRequest := taskspb.RunTaskRequest{
+		Name: createdTask.GetName(),
+	}
+	runTask, err := client.RunTask(context.Background(), &runTaskRequest)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, runTask.GetDispatchCount())
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err, "RunTask should dispatch on a paused queue")
+	assertHeadersMatch(
+		t,
+		map[string]string{
+			"X-CloudTasks-TaskName": "paused-task",
+		},
+		receivedRequest,
+	)
+
+	// The task succeeded, so it is gone and resuming the queue must not dispatch it again
+	assertGetTaskFails(t, grpcCodes.FailedPrecondition, client, createdTask.GetName())
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	assert.Error(t, err, "Should not receive any further HTTP requests within timeout")
+}
+
+func TestResumeQueueDispatchesHeldTasks(t *testing.T) {
+	client := RunT(t)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	_, err := client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
 					Url: testServerUrl + "/success",
@@ -389,83 +2071,148 @@ func TestSuccessTaskExecution(t *testing.T) {
 			},
 		},
 	}
-	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
 	require.NoError(t, err)
 
-	getTaskRequest := taskspb.GetTaskRequest{
-		Name: createdTask.GetName(),
-	}
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 300*time.Millisecond)
+	require.Error(t, err, "Paused queue should not dispatch")
 
-	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	resumedQueue, err := client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
 	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_RUNNING, resumedQueue.GetState())
 
-	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
-	assert.Error(t, err)
-	assert.Nil(t, gettedTask)
+	_, err = awaitHttpRequest(receivedRequests)
+	assert.NoError(t, err, "Task held while paused is dispatched on resume")
+}
 
-	// Validate that the call was actually made properly
-	require.NotNil(t, receivedRequest, "Request was received")
+func TestDispatchInScheduleTimeOrder(t *testing.T) {
+	client := RunT(t)
 
-	// Simple predictable headers
-	assertHeadersMatch(
-		t,
-		map[string]string{
-			"X-CloudTasks-TaskExecutionCount": "0",
-			"X-CloudTasks-TaskRetryCount":     "0",
-			"X-CloudTasks-TaskName":           "my-test-task",
-			"X-CloudTasks-QueueName":          "test",
-		},
-		receivedRequest,
-	)
-	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-CloudTasks-TaskETA"))
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue := newQueue(formattedParent, "ordered")
+	queue.RateLimits = &taskspb.RateLimits{MaxConcurrentDispatches: 1}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	// Created latest first, so that creation order and schedule time order differ
+	now := time.Now()
+	for i := 4; i >= 0; i-- {
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				Name:         fmt.Sprintf("%s/tasks/task-%d", createdQueue.GetName(), i),
+				ScheduleTime: timestamppb.New(now.Add(time.Duration(i-5) * time.Second)),
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: testServerUrl + "/success",
+					},
+				},
+			},
+		}
+		_, err = client.CreateTask(context.Background(), &createTaskRequest)
+		require.NoError(t, err)
+	}
+
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		receivedRequest, err := awaitHttpRequest(receivedRequests)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("task-%d", i), receivedRequest.Header.Get("X-CloudTasks-TaskName"))
+	}
 }
 
-func TestSuccessAppEngineTaskExecution(t *testing.T) {
+func TestPauseQueueFreezesPendingRetries(t *testing.T) {
 	client := RunT(t)
 
 	testServerUrl, receivedRequests := startTestServer(t)
 
-	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
-	os.Setenv("APP_ENGINE_EMULATOR_HOST", testServerUrl)
-
-	createdQueue := createTestQueue(t, client)
+	queue := newQueue(formattedParent, "frozen-retries")
+	queue.RetryConfig = &taskspb.RetryConfig{
+		MinBackoff: durationpb.New(time.Second),
+		MaxBackoff: durationpb.New(time.Second),
+	}
+	createdQueue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
 
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
-			Name: createdQueue.GetName() + "/tasks/my-test-task",
-			MessageType: &taskspb.Task_AppEngineHttpRequest{
-				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
-					RelativeUri: "/success",
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url: testServerUrl + "/not_found",
 				},
 			},
 		},
 	}
+	_, err = client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
 
-	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
+	_, err = awaitHttpRequest(receivedRequests)
 	require.NoError(t, err)
-	assert.NotNil(t, createdTask)
 
-	// Wait for it to perform the http request
-	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	_, err = client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
 	require.NoError(t, err)
 
-	require.NotNil(t, receivedRequest, "Request was received")
-	assertHeadersMatch(
-		t,
-		map[string]string{
-			"X-AppEngine-TaskExecutionCount": "0",
-			"X-AppEngine-TaskRetryCount":     "0",
-			"X-AppEngine-TaskName":           "my-test-task",
-			"X-AppEngine-QueueName":          "test",
-		},
-		receivedRequest,
-	)
+	// The retry would be due during the pause
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 1500*time.Millisecond)
+	require.Error(t, err, "Paused queue should not retry")
 
-	assertIsRecentTimestamp(t, receivedRequest.Header.Get("X-AppEngine-TaskETA"))
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	// The backoff picks up where it left off rather than firing straight away
+	_, err = awaitHttpRequestWithTimeout(receivedRequests, 500*time.Millisecond)
+	require.Error(t, err, "Retry should wait for the rest of its backoff")
+	_, err = awaitHttpRequest(receivedRequests)
+	assert.NoError(t, err)
 }
 
-func TestErrorTaskExecution(t *testing.T) {
+func TestResumeQueueRampsUp(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{
+		Dispatch: DispatchOptions{ResumeRampUp: RampUp{InitialRate: 5, Interval: time.Hour}},
+	})
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	_, err := client.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: testServerUrl + "/success",
+					},
+				},
+			},
+		}
+		_, err = client.CreateTask(context.Background(), &createTaskRequest)
+		require.NoError(t, err)
+	}
+
+	resumed := time.Now()
+	_, err = client.ResumeQueue(context.Background(), &taskspb.ResumeQueueRequest{Name: createdQueue.GetName()})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = awaitHttpRequestWithTimeout(receivedRequests, 2*time.Second)
+		require.NoError(t, err)
+	}
+	// Five dispatches a second rather than the queue's burst of 100 at once
+	assert.GreaterOrEqual(t, time.Since(resumed), 800*time.Millisecond)
+}
+
+func TestRunTaskResetsScheduleTime(t *testing.T) {
 	client := RunT(t)
 
 	testServerUrl, receivedRequests := startTestServer(t)
@@ -475,6 +2222,7 @@ func TestErrorTaskExecution(t *testing.T) {
 	createTaskRequest := taskspb.CreateTaskRequest{
 		Parent: createdQueue.GetName(),
 		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
 					Url: testServerUrl + "/not_found",
@@ -482,27 +2230,23 @@ func TestErrorTaskExecution(t *testing.T) {
 			},
 		},
 	}
-
-	start := time.Now()
-
 	createdTask, err := client.CreateTask(context.Background(), &createTaskRequest)
 	require.NoError(t, err)
 
-	// With the default retry backoff, we expect 4 calls within the first second:
-	// at t=0, 0.1, 0.3 (+0.2), 0.7 (+0.4) seconds (plus some buffer) ==> 4 calls
-	receivedRequest, err := awaitHttpRequest(receivedRequests)
-	require.NoError(t, err, "Should have received request 1")
-	assertHeadersMatch(
-		t,
-		map[string]string{
-			"X-CloudTasks-TaskExecutionCount": "0",
-			"X-CloudTasks-TaskRetryCount":     "0",
-		},
-		receivedRequest,
-	)
+	runTaskRequest := taskspb.RunTaskRequest{
+		Name: createdTask.GetName(),
+	}
+	runTask, err := client.RunTask(context.Background(), &runTaskRequest)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, runTask.GetDispatchCount())
+	assert.WithinDuration(t, time.Now(), runTask.GetScheduleTime().AsTime(), time.Second)
 
-	receivedRequest, err = awaitHttpRequest(receivedRequests)
-	require.NoError(t, err, "Should have received request 2")
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err, "RunTask should dispatch immediately")
+
+	// The failed forced run is retried after the minimum backoff rather than at the original schedule time
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err, "Should have received the retry")
 	assertHeadersMatch(
 		t,
 		map[string]string{
@@ -512,44 +2256,55 @@ func TestErrorTaskExecution(t *testing.T) {
 		receivedRequest,
 	)
 
-	receivedRequest, err = awaitHttpRequest(receivedRequests)
-	require.NoError(t, err, "Should have received request 3")
-	assertHeadersMatch(
-		t,
-		map[string]string{
-			"X-CloudTasks-TaskExecutionCount": "2",
-			"X-CloudTasks-TaskRetryCount":     "2",
-		},
-		receivedRequest,
-	)
-
-	receivedRequest, err = awaitHttpRequest(receivedRequests)
-	require.NoError(t, err, "Should have received request 4")
-	assertHeadersMatch(
-		t,
-		map[string]string{
-			"X-CloudTasks-TaskExecutionCount": "3",
-			"X-CloudTasks-TaskRetryCount":     "3",
-		},
-		receivedRequest,
-	)
+	gettedTask, err := client.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: createdTask.GetName()})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, gettedTask.GetDispatchCount())
+}
 
-	expectedCompleteBy := start.Add(700 * time.Millisecond)
-	assert.WithinDuration(
-		t,
-		expectedCompleteBy,
-		time.Now(),
-		200*time.Millisecond,
-		"4 retries should take roughly 0.7 seconds",
-	)
+func TestNewGrpcServerAcceptsInterceptors(t *testing.T) {
+	emulatorServer := NewServer()
 
-	// Check the state of the task has been updated with the number of dispatches
-	getTaskRequest := taskspb.GetTaskRequest{
-		Name: createdTask.GetName(),
+	denyAll := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return nil, grpcStatus.Error(grpcCodes.PermissionDenied, "denied by test interceptor")
 	}
-	gettedTask, err := client.GetTask(context.Background(), &getTaskRequest)
+	grpcServer := emulatorServer.NewGrpcServer(grpc.ChainUnaryInterceptor(denyAll))
+	t.Cleanup(grpcServer.Stop)
+
+	lis, err := net.Listen("tcp", "localhost:0")
 	require.NoError(t, err)
-	assert.EqualValues(t, 4, gettedTask.GetDispatchCount())
+	go grpcServer.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "test")})
+	assertIsGrpcError(t, "^denied by test interceptor", grpcCodes.PermissionDenied, err)
+
+	// The audit log still sees calls rejected by the caller's interceptors
+	entries := emulatorServer.AuditLog()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "GetQueue", entries[0].Method)
+	assert.Equal(t, "PermissionDenied", entries[0].Code)
+}
+
+func TestServeOnUnixSocket(t *testing.T) {
+	emulatorServer := NewServer()
+
+	socket := filepath.Join(t.TempDir(), "emulator.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	grpcServer := emulatorServer.NewGrpcServer()
+	t.Cleanup(grpcServer.Stop)
+	go grpcServer.Serve(lis)
+
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithInsecure())
+	require.NoError(t, err)
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	createTestQueue(t, client)
 }
 
 func newQueue(formattedParent, name string) *taskspb.Queue {
@@ -651,6 +2406,155 @@ func awaitHttpRequestWithTimeout(receivedRequests <-chan *http.Request, timeout
 	}
 }
 
+func TestChaosFailsWithoutDispatching(t *testing.T) {
+	server := NewServer(WithOptions(ServerOptions{
+		Dispatch: DispatchOptions{Chaos: Chaos{Percent: 100, Failures: []ChaosFailure{ChaosServerError}}},
+	}))
+	t.Cleanup(server.Shutdown)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "chaotic"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 2, MinBackoff: durationpb.New(10 * time.Millisecond)},
+		},
+	})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+	assert.Empty(t, receivedRequests)
+}
+
+func TestRedirectsAreNotFollowed(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	server := NewServer()
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "redirected"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 1},
+		},
+	})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/redirect"}},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "/redirect", receivedRequest.URL.Path)
+	assert.Empty(t, receivedRequests)
+
+	// The redirect is a failed attempt
+	task, err = server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: task.GetName()})
+	require.NoError(t, err)
+	assert.Contains(t, task.GetLastAttempt().GetResponseStatus().GetMessage(), "HTTP status code 302")
+}
+
+func TestUnreachableTargetsFailAsUnavailable(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	// Nothing listens on the port once the listener is closed
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	unreachableUrl := "http://" + lis.Addr().String()
+	lis.Close()
+
+	// The second attempt reaches the test server
+	hook, err := NewDispatchHook("hook.star", []byte(fmt.Sprintf(`
+def dispatch(task):
+    if task.attempt > 1:
+        return {"url": %q}
+`, testServerUrl+"/success")))
+	require.NoError(t, err)
+	server := NewServer(WithOptions(ServerOptions{Dispatch: DispatchOptions{Hook: hook}}))
+	t.Cleanup(server.Shutdown)
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "unreachable"),
+			RetryConfig: &taskspb.RetryConfig{MinBackoff: durationpb.New(50 * time.Millisecond)},
+		},
+	})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: unreachableUrl}},
+		},
+	})
+	require.NoError(t, err)
+
+	// The failed attempt has no HTTP status
+	require.Eventually(t, func() bool {
+		task, err = server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: task.GetName()})
+		return err == nil && task.GetResponseCount() == 1
+	}, time.Second, 5*time.Millisecond)
+	status := task.GetLastAttempt().GetResponseStatus()
+	assert.EqualValues(t, grpcCodes.Unavailable, status.GetCode())
+	assert.Regexp(t, `^UNAVAILABLE\(14\): The target could not be reached: .*connection refused`, status.GetMessage())
+
+	// The retry tells so too, with no previous response
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "UNAVAILABLE", receivedRequest.Header.Get("X-CloudTasks-TaskRetryReason"))
+	assert.Empty(t, receivedRequest.Header.Values("X-CloudTasks-TaskPreviousResponse"))
+}
+
+func TestUnresolvableHostsFailAsUnavailable(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name: formatQueueName(formattedParent, "unresolvable"),
+			RetryConfig: &taskspb.RetryConfig{
+				MaxAttempts: 2,
+				MinBackoff:  durationpb.New(10 * time.Millisecond),
+			},
+		},
+	})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://no-such-host.invalid/work"}},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+
+	// Retried as configured, failing with the reason
+	task, err = server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: task.GetName()})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, task.GetDispatchCount())
+	status := task.GetLastAttempt().GetResponseStatus()
+	assert.EqualValues(t, grpcCodes.Unavailable, status.GetCode())
+	assert.True(t, strings.HasPrefix(status.GetMessage(), "UNAVAILABLE(14): The target could not be reached: could not resolve host no-such-host.invalid"), status.GetMessage())
+}
+
 func startTestServer(t *testing.T) (string, <-chan *http.Request) {
 	mux := http.NewServeMux()
 	requestChannel := make(chan *http.Request, 1)
@@ -662,6 +2566,15 @@ func startTestServer(t *testing.T) (string, <-chan *http.Request) {
 		w.WriteHeader(404)
 		requestChannel <- r
 	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/success", http.StatusFound)
+		requestChannel <- r
+	})
+	mux.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		requestChannel <- r
+		// Only returns once the emulator gives up on the request
+		<-r.Context().Done()
+	})
 
 	s := httptest.NewServer(mux)
 	t.Cleanup(func() {
@@ -0,0 +1,198 @@
+package cloud_task_emulator
+
+import (
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// The errors of the API, in one place so that their codes and messages stay those of production for clients
+// matching on them. Messages ending in a period are production's word for word; the others describe failures
+// production words differently or only the emulator has.
+
+// errEntityNotFound is production's generic NotFound, e.g. of DeleteQueue, PurgeQueue, PauseQueue and the IAM
+// calls, whether the resource never existed or was deleted recently
+func errEntityNotFound() error {
+	return status.Errorf(codes.NotFound, "Requested entity was not found.")
+}
+
+// errEntityAlreadyExists is production's generic AlreadyExists, e.g. of CreateTask with a used name
+func errEntityAlreadyExists() error {
+	return status.Errorf(codes.AlreadyExists, "Requested entity already exists")
+}
+
+// errInvalidArgument is production's generic InvalidArgument
+func errInvalidArgument() error {
+	return status.Errorf(codes.InvalidArgument, "Request contains an invalid argument.")
+}
+
+// errInvalidResource is production's InvalidArgument for a malformed parent
+func errInvalidResource() error {
+	return status.Errorf(codes.InvalidArgument, "Invalid resource field value in the request.")
+}
+
+func errInvalidUpdateMaskPath(path string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid update mask path: %s", path)
+}
+
+func errInvalidPageToken(pageToken string) error {
+	return status.Errorf(codes.InvalidArgument, "invalid page token: %s", pageToken)
+}
+
+func errInvalidPageSize(pageSize int32) error {
+	return status.Errorf(codes.InvalidArgument, "invalid page size: %d", pageSize)
+}
+
+// errQueueNotFound is the NotFound of GetQueue and ListTasks, whether the queue never existed or was deleted
+// recently
+func errQueueNotFound() error {
+	return status.Errorf(codes.NotFound, "Queue does not exist. If you just created the queue, wait at least a minute for the queue to initialize.")
+}
+
+// errParentQueueNotFound is the NotFound of CreateTask on a queue that never existed
+func errParentQueueNotFound() error {
+	return status.Errorf(codes.NotFound, "Queue does not exist.")
+}
+
+// errParentQueueTombstoned is the FailedPrecondition of CreateTask on a queue deleted recently
+func errParentQueueTombstoned() error {
+	return status.Errorf(codes.FailedPrecondition, "The queue no longer exists, though a queue with this name existed recently.")
+}
+
+func errInvalidQueueName() error {
+	return status.Errorf(codes.InvalidArgument, "Queue name must be formatted: \"projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>\"")
+}
+
+func errQueueStateOnCreate(state tasks.Queue_State) error {
+	return status.Errorf(codes.InvalidArgument, "Queue.state %s cannot be set when creating a queue.", state)
+}
+
+func errQueueAlreadyExists() error {
+	return status.Errorf(codes.AlreadyExists, "Queue already exists")
+}
+
+// errQueueTombstoned is the FailedPrecondition of CreateQueue and UpdateQueue on a queue deleted recently
+func errQueueTombstoned() error {
+	return status.Errorf(codes.FailedPrecondition, "The queue cannot be created because a queue with this name existed too recently.")
+}
+
+func errQueueQuotaExceeded(project string, maxQueues int) error {
+	return status.Errorf(codes.ResourceExhausted, "Quota exceeded: project %s already has the maximum of %d queues.", project, maxQueues)
+}
+
+func errInvalidMaxAttempts(maxAttempts int32) error {
+	return status.Errorf(codes.InvalidArgument, "RetryConfig.max_attempts must be -1 (unlimited) or greater, got %d.", maxAttempts)
+}
+
+func errNegativeRateLimits() error {
+	return status.Errorf(codes.InvalidArgument, "Queue.rate_limits cannot be negative.")
+}
+
+// errTaskNotFound is the NotFound of the task calls on a task that never existed
+func errTaskNotFound() error {
+	return status.Errorf(codes.NotFound, "Task does not exist.")
+}
+
+// errTaskTombstoned is the error of the task calls on a task that completed or was deleted recently:
+// FailedPrecondition for GetTask, NotFound for DeleteTask and RunTask
+func errTaskTombstoned(code codes.Code) error {
+	return status.Errorf(code, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted.")
+}
+
+func errInvalidTaskName() error {
+	return status.Errorf(codes.InvalidArgument, `Task name must be formatted: "projects/<PROJECT_ID>/locations/<LOCATION_ID>/queues/<QUEUE_ID>/tasks/<TASK_ID>"`)
+}
+
+// errTaskQueueMismatch is the InvalidArgument of CreateTask naming a task of another queue than the parent
+func errTaskQueueMismatch(parent string, taskQueue string) error {
+	return status.Errorf(codes.InvalidArgument, "The queue name from request ('%s') must be the same as the queue name in the named task ('%s').", parent, taskQueue)
+}
+
+func errScheduleTimeTooFar(scheduleTime time.Time, maxScheduleTime time.Time) error {
+	return status.Errorf(
+		codes.InvalidArgument,
+		"The Task.scheduleTime is too far in the future. Specified time: %s, maximum allowed time: %s.",
+		scheduleTime.Format(time.RFC3339),
+		maxScheduleTime.Format(time.RFC3339),
+	)
+}
+
+func errTaskRequired() error {
+	return status.Errorf(codes.InvalidArgument, "Task is required.")
+}
+
+func errTaskMessageRequired() error {
+	return status.Errorf(codes.InvalidArgument, "Task.message_type is required: set either Task.http_request or Task.app_engine_http_request.")
+}
+
+func errHttpURLRequired() error {
+	return status.Errorf(codes.InvalidArgument, "HttpRequest.url is required.")
+}
+
+func errInvalidHttpURL(taskURL string, err error) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid HttpRequest.url %q: %v", taskURL, err)
+}
+
+func errHttpURLScheme(taskURL string) error {
+	return status.Errorf(codes.InvalidArgument, "HttpRequest.url must start with 'http://' or 'https://', got %q.", taskURL)
+}
+
+func errHttpURLHostMissing(taskURL string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid HttpRequest.url %q: the host is missing.", taskURL)
+}
+
+func errInvalidAudienceCharacters(audience string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid OidcToken.audience %q: it must not contain whitespace or control characters.", audience)
+}
+
+func errInvalidAudienceURL(audience string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid OidcToken.audience %q: URL audiences must be absolute URLs.", audience)
+}
+
+// errConcurrentPolicyChange is the Aborted of SetIamPolicy with a stale etag
+func errConcurrentPolicyChange() error {
+	return status.Errorf(codes.Aborted, "There were concurrent policy changes. Please retry the whole read-modify-write with exponential backoff.")
+}
+
+// errMissingCredentials and errInvalidCredentials are the Unauthenticated of calls without or with a rejected
+// token
+func errMissingCredentials() error {
+	return status.Errorf(codes.Unauthenticated, "Request is missing required authentication credential. Expected OAuth 2 access token, login cookie or other valid authentication credential.")
+}
+
+func errInvalidCredentials() error {
+	return status.Errorf(codes.Unauthenticated, "Request had invalid authentication credentials. Expected OAuth 2 access token, login cookie or other valid authentication credential.")
+}
+
+// errTaskNotRetrying and errTaskNotScheduled are the FailedPrecondition of the admin API retrying or
+// rescheduling a task that isn't waiting for it
+func errTaskNotRetrying() error {
+	return status.Errorf(codes.FailedPrecondition, "Task is not waiting to be retried.")
+}
+
+func errTaskNotScheduled() error {
+	return status.Errorf(codes.FailedPrecondition, "Task is not waiting to be dispatched.")
+}
+
+func errInvalidTaskFilter(term string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid task filter condition %q, expected a field, an operator and a value.", term)
+}
+
+func errInvalidTaskFilterState(value string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid task filter state %q, expected PENDING, DISPATCHING, RETRYING or FAILED.", value)
+}
+
+func errInvalidTaskFilterTime(value string, err error) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid task filter schedule time %q: %v", value, err)
+}
+
+func errUnsupportedTaskFilter(field string, operator string, value string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid task filter condition %s %s %s, expected state =, scheduleTime with =, <, <=, > or >=, or name : or =.", field, operator, value)
+}
+
+// errStorage is the Internal of a call the storage failed, see WithStorage
+func errStorage(err error) error {
+	return status.Errorf(codes.Internal, "The storage failed: %v", err)
+}
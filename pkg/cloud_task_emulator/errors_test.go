@@ -0,0 +1,43 @@
+package cloud_task_emulator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// TestErrorCatalogMatchesProduction pins the errors clients are known to match on to the codes and messages the
+// Cloud Tasks API responds with
+func TestErrorCatalogMatchesProduction(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		code    codes.Code
+		message string
+	}{
+		{errEntityNotFound(), codes.NotFound, "Requested entity was not found."},
+		{errEntityAlreadyExists(), codes.AlreadyExists, "Requested entity already exists"},
+		{errInvalidArgument(), codes.InvalidArgument, "Request contains an invalid argument."},
+		{errInvalidResource(), codes.InvalidArgument, "Invalid resource field value in the request."},
+		{errQueueNotFound(), codes.NotFound, "Queue does not exist. If you just created the queue, wait at least a minute for the queue to initialize."},
+		{errParentQueueNotFound(), codes.NotFound, "Queue does not exist."},
+		{errParentQueueTombstoned(), codes.FailedPrecondition, "The queue no longer exists, though a queue with this name existed recently."},
+		{errQueueTombstoned(), codes.FailedPrecondition, "The queue cannot be created because a queue with this name existed too recently."},
+		{errTaskNotFound(), codes.NotFound, "Task does not exist."},
+		{errTaskTombstoned(codes.FailedPrecondition), codes.FailedPrecondition, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted."},
+		{errTaskTombstoned(codes.NotFound), codes.NotFound, "The task no longer exists, though a task with this name existed recently. The task either successfully completed or was deleted."},
+		{
+			errTaskQueueMismatch("projects/p/locations/l/queues/a", "projects/p/locations/l/queues/b"),
+			codes.InvalidArgument,
+			"The queue name from request ('projects/p/locations/l/queues/a') must be the same as the queue name in the named task ('projects/p/locations/l/queues/b').",
+		},
+		{errConcurrentPolicyChange(), codes.Aborted, "There were concurrent policy changes. Please retry the whole read-modify-write with exponential backoff."},
+		{errMissingCredentials(), codes.Unauthenticated, "Request is missing required authentication credential. Expected OAuth 2 access token, login cookie or other valid authentication credential."},
+		{errInvalidCredentials(), codes.Unauthenticated, "Request had invalid authentication credentials. Expected OAuth 2 access token, login cookie or other valid authentication credential."},
+	} {
+		s := status.Convert(tc.err)
+		assert.Equal(t, tc.code, s.Code(), tc.message)
+		assert.Equal(t, tc.message, s.Message())
+	}
+}
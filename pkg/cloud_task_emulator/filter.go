@@ -0,0 +1,138 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/metadata"
+)
+
+// TaskFilterMetadataKey is the ListTasks gRPC metadata key filtering the tasks listed, which the Cloud Tasks API
+// has no field for. The filter ANDs conditions on the dispatch state, the schedule time or the task ID, e.g.
+//
+//	state = RETRYING AND scheduleTime < 2024-01-02T03:04:05Z AND name : order-
+//
+// The states are PENDING (not dispatched yet), DISPATCHING (waiting for the response), RETRYING (waiting out
+// the backoff) and FAILED (out of attempts). Schedule times are RFC 3339 and compared with =, <, <=, > or >=.
+// "name : prefix" matches the task IDs starting with the prefix, "name = id" a single ID.
+const TaskFilterMetadataKey = "x-emulator-task-filter"
+
+// Dispatch states of the tasks, as filtered on by TaskFilterMetadataKey
+const (
+	taskPending     = "PENDING"
+	taskDispatching = "DISPATCHING"
+	taskRetrying    = "RETRYING"
+	taskFailed      = "FAILED"
+)
+
+var taskFilterCondition = regexp.MustCompile(`^(\w+)\s*(<=|>=|=|<|>|:)\s*(\S+)$`)
+
+// taskFilter holds the conditions a task has to meet, all of them, given the retry config of its queue
+type taskFilter []func(taskState *tasks.Task, retryConfig *tasks.RetryConfig) bool
+
+// taskFilterFromMetadata parses the filter set on the request, matching every task if there is none
+func taskFilterFromMetadata(ctx context.Context) (taskFilter, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	values := md.Get(TaskFilterMetadataKey)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return parseTaskFilter(values[0])
+}
+
+func parseTaskFilter(filter string) (taskFilter, error) {
+	var conditions taskFilter
+	for _, term := range strings.Split(filter, " AND ") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		parts := taskFilterCondition.FindStringSubmatch(term)
+		if parts == nil {
+			return nil, errInvalidTaskFilter(term)
+		}
+		condition, err := parseTaskFilterCondition(parts[1], parts[2], strings.Trim(parts[3], `"`))
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+func parseTaskFilterCondition(field string, operator string, value string) (func(taskState *tasks.Task, retryConfig *tasks.RetryConfig) bool, error) {
+	switch {
+	case field == "state" && operator == "=":
+		switch value {
+		case taskPending, taskDispatching, taskRetrying, taskFailed:
+		default:
+			return nil, errInvalidTaskFilterState(value)
+		}
+		return func(taskState *tasks.Task, retryConfig *tasks.RetryConfig) bool {
+			return dispatchState(taskState, retryConfig) == value
+		}, nil
+	case field == "scheduleTime" && operator != ":":
+		scheduleTime, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, errInvalidTaskFilterTime(value, err)
+		}
+		return func(taskState *tasks.Task, retryConfig *tasks.RetryConfig) bool {
+			return compareTimes(taskState.GetScheduleTime().AsTime(), operator, scheduleTime)
+		}, nil
+	case field == "name" && (operator == ":" || operator == "="):
+		return func(taskState *tasks.Task, retryConfig *tasks.RetryConfig) bool {
+			taskID := taskState.GetName()[strings.LastIndex(taskState.GetName(), "/")+1:]
+			if operator == ":" {
+				return strings.HasPrefix(taskID, value)
+			}
+			return taskID == value
+		}, nil
+	}
+	return nil, errUnsupportedTaskFilter(field, operator, value)
+}
+
+func compareTimes(t time.Time, operator string, other time.Time) bool {
+	switch operator {
+	case "<":
+		return t.Before(other)
+	case "<=":
+		return !t.After(other)
+	case ">":
+		return t.After(other)
+	case ">=":
+		return !t.Before(other)
+	default:
+		return t.Equal(other)
+	}
+}
+
+func (f taskFilter) matches(taskState *tasks.Task, retryConfig *tasks.RetryConfig) bool {
+	for _, condition := range f {
+		if !condition(taskState, retryConfig) {
+			return false
+		}
+	}
+	return true
+}
+
+// dispatchState tells where the task is in its dispatch cycle, as filtered on
+func dispatchState(taskState *tasks.Task, retryConfig *tasks.RetryConfig) string {
+	lastAttempt := taskState.GetLastAttempt()
+	switch {
+	case taskState.GetDispatchCount() == 0:
+		return taskPending
+	case lastAttempt.GetResponseTime() == nil:
+		return taskDispatching
+	case lastAttempt.GetResponseStatus().GetCode() != int32(rpccode.Code_OK) && outOfAttempts(retryConfig, taskState.GetDispatchCount()):
+		return taskFailed
+	default:
+		return taskRetrying
+	}
+}
@@ -0,0 +1,141 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func listFilteredTaskIds(t *testing.T, server *Server, queueName string, filter string) []string {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(TaskFilterMetadataKey, filter))
+	resp, err := server.ListTasks(ctx, &taskspb.ListTasksRequest{Parent: queueName})
+	require.NoError(t, err)
+
+	taskIds := []string{}
+	for _, task := range resp.GetTasks() {
+		taskIds = append(taskIds, task.GetName()[len(queueName)+len("/tasks/"):])
+	}
+	return taskIds
+}
+
+func TestListTasksFilter(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "filtered"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 1},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		server.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queue.GetName()})
+	})
+	now := time.Now().UTC().Truncate(time.Second)
+	createTask := func(taskId string, scheduleTime time.Time) string {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				Name:         queue.GetName() + "/tasks/" + taskId,
+				ScheduleTime: timestamppb.New(scheduleTime),
+				MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+			},
+		})
+		require.NoError(t, err)
+		return task.GetName()
+	}
+
+	require.Equal(t, http.StatusOK, putAdmin(t, admin.URL+"/emulator/v1/"+queue.GetName()+"/failNext", `{"count": 1}`))
+	failed := createTask("order-0", now)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, failed))
+	createTask("order-1", now.Add(time.Hour))
+	createTask("order-2", now.Add(2*time.Hour))
+	createTask("invoice-1", now.Add(time.Hour))
+
+	assert.Equal(t, []string{"invoice-1", "order-0", "order-1", "order-2"}, listFilteredTaskIds(t, server, queue.GetName(), ""))
+	assert.Equal(t, []string{"order-0"}, listFilteredTaskIds(t, server, queue.GetName(), "state = FAILED"))
+	assert.Equal(t, []string{"invoice-1", "order-1", "order-2"}, listFilteredTaskIds(t, server, queue.GetName(), "state = PENDING"))
+	assert.Equal(t, []string{"order-0", "order-1", "order-2"}, listFilteredTaskIds(t, server, queue.GetName(), "name : order-"))
+	assert.Equal(t, []string{"invoice-1"}, listFilteredTaskIds(t, server, queue.GetName(), "name = invoice-1"))
+	assert.Equal(t, []string{"order-1"}, listFilteredTaskIds(t, server, queue.GetName(),
+		`state = PENDING AND scheduleTime <= "`+now.Add(time.Hour).Format(time.RFC3339)+`" AND name : order-`))
+	assert.Equal(t, []string{"order-2"}, listFilteredTaskIds(t, server, queue.GetName(), "scheduleTime > "+now.Add(time.Hour).Format(time.RFC3339)))
+
+	for _, filter := range []string{"state = DONE", "scheduleTime < tomorrow", "name < order-", "createTime > 2024-01-01T00:00:00Z", "state"} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(TaskFilterMetadataKey, filter))
+		_, err := server.ListTasks(ctx, &taskspb.ListTasksRequest{Parent: queue.GetName()})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), filter)
+	}
+}
+
+func TestListTasksPagesStayStable(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "paged")})
+	require.NoError(t, err)
+	_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+	createTask := func(taskId string) {
+		_, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				Name:        queue.GetName() + "/tasks/" + taskId,
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+			},
+		})
+		require.NoError(t, err)
+	}
+	for _, taskId := range []string{"t-1", "t-2", "t-3", "t-4", "t-5"} {
+		createTask(taskId)
+	}
+	listTaskIds := func(pageToken string) ([]string, string) {
+		resp, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queue.GetName(), PageSize: 2, PageToken: pageToken})
+		require.NoError(t, err)
+		var taskIds []string
+		for _, task := range resp.GetTasks() {
+			taskIds = append(taskIds, task.GetName()[len(queue.GetName())+len("/tasks/"):])
+		}
+		return taskIds, resp.GetNextPageToken()
+	}
+
+	taskIds, next := listTaskIds("")
+	assert.Equal(t, []string{"t-1", "t-2"}, taskIds)
+
+	// Tasks listed already complete and new ones come in before the next page
+	for _, taskId := range []string{"t-1", "t-2"} {
+		_, err = server.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: queue.GetName() + "/tasks/" + taskId})
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		resp, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queue.GetName()})
+		return err == nil && len(resp.GetTasks()) == 3
+	}, time.Second, 10*time.Millisecond)
+	createTask("t-0")
+
+	taskIds, next = listTaskIds(next)
+	assert.Equal(t, []string{"t-3", "t-4"}, taskIds)
+	taskIds, next = listTaskIds(next)
+	assert.Equal(t, []string{"t-5"}, taskIds)
+	assert.Empty(t, next)
+
+	_, err = server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queue.GetName(), PageToken: "%%%"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
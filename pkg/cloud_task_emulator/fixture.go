@@ -0,0 +1,181 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/yaml.v3"
+)
+
+// fixtureFile is the content of a fixture, see LoadFixture
+type fixtureFile struct {
+	Queues []fixtureQueue `yaml:"queues"`
+}
+
+type fixtureQueue struct {
+	Name        string                 `yaml:"name"`
+	RetryConfig map[string]interface{} `yaml:"retryConfig"`
+	RateLimits  map[string]interface{} `yaml:"rateLimits"`
+	Paused      bool                   `yaml:"paused"`
+	Tasks       []fixtureTask          `yaml:"tasks"`
+}
+
+type fixtureTask struct {
+	// Name is the task ID, suffixed with -1, -2... if the task is repeated. The ID is generated if left out.
+	Name string `yaml:"name"`
+
+	// In is how long after the fixture is loaded the task is due, straight away if left out
+	In time.Duration `yaml:"in"`
+
+	// Count repeats the task, due Every apart
+	Count int           `yaml:"count"`
+	Every time.Duration `yaml:"every"`
+
+	URL       string            `yaml:"url"`
+	AppEngine *fixtureAppEngine `yaml:"appEngine"`
+	Method    string            `yaml:"method"`
+	Headers   map[string]string `yaml:"headers"`
+	Body      string            `yaml:"body"`
+}
+
+type fixtureAppEngine struct {
+	Service     string `yaml:"service"`
+	Version     string `yaml:"version"`
+	RelativeURI string `yaml:"relativeUri"`
+}
+
+// LoadFixture creates the queues and tasks of a YAML fixture, for version-controlled scenarios such as a backlog
+// of tasks due over the next hour, e.g.
+//
+//	queues:
+//	  - name: projects/dev/locations/here/queues/backlog
+//	    rateLimits: {maxDispatchesPerSecond: 5}
+//	    tasks:
+//	      - name: order
+//	        count: 50
+//	        every: 72s
+//	        url: http://localhost:9000/orders
+//	        headers: {Content-Type: application/json}
+//	        body: '{"status": "new"}'
+//	      - in: 10m
+//	        appEngine: {service: worker, relativeUri: /cleanup}
+//
+// Queues are created unless they exist, with their retry config and rate limits in the proto JSON field names.
+// Tasks are due "in" a duration after the fixture is loaded, "count" of them "every" duration apart. Loading
+// stops at the first failure, which is returned.
+func (s *Server) LoadFixture(ctx context.Context, r io.Reader) error {
+	var file fixtureFile
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid fixture: %v", err)
+	}
+
+	start := s.clock.Now()
+	for _, fixture := range file.Queues {
+		if err := s.loadFixtureQueue(ctx, fixture); err != nil {
+			return err
+		}
+		for _, task := range fixture.Tasks {
+			if err := s.loadFixtureTask(ctx, fixture.Name, task, start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) loadFixtureQueue(ctx context.Context, fixture fixtureQueue) error {
+	if queue, ok := s.fetchQueue(fixture.Name); ok && queue != nil {
+		return nil
+	}
+
+	queueState := &tasks.Queue{Name: fixture.Name}
+	if fixture.RetryConfig != nil {
+		queueState.RetryConfig = &tasks.RetryConfig{}
+		if err := unmarshalConfigProto(fixture.RetryConfig, queueState.RetryConfig); err != nil {
+			return fmt.Errorf("invalid retryConfig of queue %s: %v", fixture.Name, err)
+		}
+	}
+	if fixture.RateLimits != nil {
+		queueState.RateLimits = &tasks.RateLimits{}
+		if err := unmarshalConfigProto(fixture.RateLimits, queueState.RateLimits); err != nil {
+			return fmt.Errorf("invalid rateLimits of queue %s: %v", fixture.Name, err)
+		}
+	}
+	if fixture.Paused {
+		queueState.State = tasks.Queue_PAUSED
+	}
+
+	s.logger.Printf("Creating fixture queue %s\n", fixture.Name)
+	if _, err := s.CreateQueue(ctx, &tasks.CreateQueueRequest{Parent: queueParent(fixture.Name), Queue: queueState}); err != nil {
+		return fmt.Errorf("could not create queue %s: %v", fixture.Name, err)
+	}
+	return nil
+}
+
+func (s *Server) loadFixtureTask(ctx context.Context, queueName string, fixture fixtureTask, start time.Time) error {
+	method := tasks.HttpMethod_POST
+	if fixture.Method != "" {
+		value, ok := tasks.HttpMethod_value[strings.ToUpper(fixture.Method)]
+		if !ok {
+			return fmt.Errorf("invalid task of queue %s: unknown method %s", queueName, fixture.Method)
+		}
+		method = tasks.HttpMethod(value)
+	}
+
+	count := fixture.Count
+	if count == 0 {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		taskState := &tasks.Task{
+			ScheduleTime: timestamppb.New(start.Add(fixture.In + time.Duration(i)*fixture.Every)),
+		}
+		if fixture.Name != "" {
+			taskState.Name = queueName + "/tasks/" + fixture.Name
+			if fixture.Count > 0 {
+				taskState.Name += "-" + strconv.Itoa(i+1)
+			}
+		}
+
+		headers := make(map[string]string, len(fixture.Headers))
+		for name, value := range fixture.Headers {
+			headers[name] = value
+		}
+		if fixture.AppEngine != nil {
+			taskState.MessageType = &tasks.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &tasks.AppEngineHttpRequest{
+					HttpMethod: method,
+					AppEngineRouting: &tasks.AppEngineRouting{
+						Service: fixture.AppEngine.Service,
+						Version: fixture.AppEngine.Version,
+					},
+					RelativeUri: fixture.AppEngine.RelativeURI,
+					Headers:     headers,
+					Body:        []byte(fixture.Body),
+				},
+			}
+		} else {
+			taskState.MessageType = &tasks.Task_HttpRequest{
+				HttpRequest: &tasks.HttpRequest{
+					Url:        fixture.URL,
+					HttpMethod: method,
+					Headers:    headers,
+					Body:       []byte(fixture.Body),
+				},
+			}
+		}
+
+		if _, err := s.CreateTask(ctx, &tasks.CreateTaskRequest{Parent: queueName, Task: taskState}); err != nil {
+			return fmt.Errorf("could not create a task on queue %s: %v", queueName, err)
+		}
+	}
+	return nil
+}
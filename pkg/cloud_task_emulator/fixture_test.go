@@ -0,0 +1,82 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFixture(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := NewServer(WithClock(fixedClock(now)))
+	t.Cleanup(server.Shutdown)
+
+	queueName := formatQueueName(formattedParent, "backlog")
+	fixture := `
+queues:
+  - name: ` + queueName + `
+    paused: true
+    retryConfig: {maxAttempts: 3}
+    tasks:
+      - name: order
+        in: 1m
+        count: 3
+        every: 20m
+        url: http://localhost:9000/orders
+        method: put
+        headers: {Content-Type: application/json}
+        body: '{"status": "new"}'
+      - in: 2h
+        appEngine: {service: worker, relativeUri: /cleanup}
+`
+	require.NoError(t, server.LoadFixture(context.Background(), strings.NewReader(fixture)))
+
+	queue, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, queue.GetState())
+	assert.Equal(t, int32(3), queue.GetRetryConfig().GetMaxAttempts())
+
+	listed, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queueName})
+	require.NoError(t, err)
+	require.Len(t, listed.GetTasks(), 4)
+
+	scheduled := make(map[string]time.Time)
+	for _, task := range listed.GetTasks() {
+		scheduled[task.GetName()] = task.GetScheduleTime().AsTime()
+	}
+	assert.Equal(t, now.Add(time.Minute), scheduled[queueName+"/tasks/order-1"])
+	assert.Equal(t, now.Add(21*time.Minute), scheduled[queueName+"/tasks/order-2"])
+	assert.Equal(t, now.Add(41*time.Minute), scheduled[queueName+"/tasks/order-3"])
+
+	task, ok := server.TaskSnapshot(queueName + "/tasks/order-2")
+	require.True(t, ok)
+	assert.Equal(t, taskspb.HttpMethod_PUT, task.GetHttpRequest().GetHttpMethod())
+	assert.Equal(t, "application/json", task.GetHttpRequest().GetHeaders()["Content-Type"])
+	assert.Equal(t, []byte(`{"status": "new"}`), task.GetHttpRequest().GetBody())
+
+	// Loading again adds tasks to the existing queue, where names collide
+	err = server.LoadFixture(context.Background(), strings.NewReader(fixture))
+	assert.ErrorContains(t, err, "could not create a task on queue "+queueName)
+}
+
+func TestLoadFixtureThroughAdminAPI(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	queueName := formatQueueName(formattedParent, "posted")
+	assert.Equal(t, http.StatusBadRequest, callAdmin(t, http.MethodPost, admin.URL+"/emulator/v1/fixtures", "queues: [{name: q, unknown: 1}]"))
+	require.Equal(t, http.StatusNoContent, callAdmin(t, http.MethodPost, admin.URL+"/emulator/v1/fixtures", "queues: [{name: "+queueName+"}]"))
+
+	_, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queueName})
+	assert.NoError(t, err)
+}
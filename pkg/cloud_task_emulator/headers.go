@@ -0,0 +1,89 @@
+package cloud_task_emulator
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	httpUserAgent      = "Google-Cloud-Tasks"
+	appEngineUserAgent = "AppEngine-Google; (+http://code.google.com/appengine)"
+	defaultContentType = "application/octet-stream"
+)
+
+// mergeHeaders sets the headers of a task to what production keeps of them when the task is created: names in
+// canonical form, the values of names differing only in case joined with commas, the headers Cloud Tasks
+// computes or reserves dropped (X-CloudTasks-* are set on dispatch), the User-Agent set, and the Content-Type
+// defaulted if the task has a body. App Engine tasks keep their User-Agent in front of Cloud Tasks', and may
+// set X-AppEngine-FailFast.
+func mergeHeaders(headers map[string]string, hasBody bool, appEngine bool) map[string]string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := make(map[string]string, len(headers)+2)
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if reservedHeader(canonical) {
+			continue
+		}
+		if value, ok := merged[canonical]; ok {
+			merged[canonical] = value + ", " + headers[name]
+		} else {
+			merged[canonical] = headers[name]
+		}
+	}
+
+	if !appEngine {
+		merged["User-Agent"] = httpUserAgent
+	} else if userAgent := merged["User-Agent"]; userAgent != "" {
+		merged["User-Agent"] = userAgent + " " + appEngineUserAgent
+	} else {
+		merged["User-Agent"] = appEngineUserAgent
+	}
+
+	if hasBody && merged["Content-Type"] == "" {
+		merged["Content-Type"] = defaultContentType
+	}
+	return merged
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	copied := make(map[string]string, len(headers)+8)
+	for name, value := range headers {
+		copied[name] = value
+	}
+	return copied
+}
+
+// reservedHeader reports whether Cloud Tasks ignores the canonical header name when set by a task
+func reservedHeader(name string) bool {
+	switch {
+	case name == "Host", name == "Content-Length":
+		return true
+	case name == "X-Appengine-Failfast":
+		return false
+	}
+	return strings.HasPrefix(name, "X-Google-") || strings.HasPrefix(name, "X-Appengine-") || strings.HasPrefix(name, "X-Cloudtasks-")
+}
+
+// hostHeader returns the Host header production sends to the URL: its host, with the port only if it is not
+// the default port of the scheme
+func hostHeader(u *url.URL) string {
+	hostname, port := u.Hostname(), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		return net.JoinHostPort(hostname, port)
+	}
+	if strings.Contains(hostname, ":") {
+		return "[" + hostname + "]"
+	}
+	return hostname
+}
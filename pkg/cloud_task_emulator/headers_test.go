@@ -0,0 +1,78 @@
+package cloud_task_emulator
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		headers   map[string]string
+		hasBody   bool
+		appEngine bool
+		expected  map[string]string
+	}{
+		{
+			name:     "no body",
+			expected: map[string]string{"User-Agent": httpUserAgent},
+		},
+		{
+			name:     "body",
+			hasBody:  true,
+			expected: map[string]string{"User-Agent": httpUserAgent, "Content-Type": "application/octet-stream"},
+		},
+		{
+			name:     "content type set",
+			headers:  map[string]string{"content-type": "application/json"},
+			hasBody:  true,
+			expected: map[string]string{"User-Agent": httpUserAgent, "Content-Type": "application/json"},
+		},
+		{
+			name: "canonical names",
+			headers: map[string]string{
+				"x-request-id":          "1",
+				"X-REQUEST-ID":          "2",
+				"user-agent":            "mine",
+				"host":                  "example.com",
+				"X-Google-Foo":          "bar",
+				"X-AppEngine-QueueName": "q",
+				"x-cloudtasks-taskname": "t",
+			},
+			expected: map[string]string{"User-Agent": httpUserAgent, "X-Request-Id": "2, 1"},
+		},
+		{
+			name:      "app engine",
+			headers:   map[string]string{"user-agent": "mine", "X-AppEngine-FailFast": "true"},
+			appEngine: true,
+			expected: map[string]string{
+				"User-Agent":           "mine " + appEngineUserAgent,
+				"X-Appengine-Failfast": "true",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, mergeHeaders(tc.headers, tc.hasBody, tc.appEngine))
+		})
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"https://example.com/task":     "example.com",
+		"https://example.com:443/task": "example.com",
+		"http://example.com:80/task":   "example.com",
+		"https://example.com:80/task":  "example.com:80",
+		"http://localhost:8080/task":   "localhost:8080",
+		"http://worker.localhost:8080": "worker.localhost:8080",
+		"http://[::1]:8080/task":       "[::1]:8080",
+		"http://[::1]:80/task":         "[::1]",
+	} {
+		u, err := url.Parse(rawURL)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, hostHeader(u), rawURL)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package cloud_task_emulator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// hookMaxSteps bounds the Starlark steps of a hook call, so that a looping script fails the call rather than the
+// dispatch hanging
+const hookMaxSteps = 1_000_000
+
+// DispatchHook is a Starlark script deciding, per dispatch, to delay, fail or rewrite it, for scenarios such as
+// failing every third attempt of the tasks of a path. The script defines a dispatch function, called with the
+// request about to be sent and returning None to send it as is, or a dict of changes, e.g.
+//
+//	def dispatch(task):
+//	    if task.url.endswith("/orders") and task.attempt % 3 == 0:
+//	        return {"fail": 503}
+//	    return {"delay": 0.5, "headers": {"X-Scenario": "slow"}}
+//
+// The task has the name, queue, url, method, headers (a dict), body and attempt (1 for the first) of the
+// dispatch. The changes are "fail" (a status code answering the dispatch without sending it, or "timeout" or
+// "reset"), "delay" (seconds to wait before sending), "url", "method", "headers" (set, or removed if None) and
+// "body". Dispatches whose hook call fails go ahead unchanged.
+type DispatchHook struct {
+	dispatch starlark.Callable
+}
+
+// NewDispatchHook runs the script, named filename in errors, for the dispatch function it defines
+func NewDispatchHook(filename string, source []byte) (*DispatchHook, error) {
+	thread := &starlark.Thread{Name: filename}
+	globals, err := starlark.ExecFile(thread, filename, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	dispatch, ok := globals["dispatch"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s does not define a dispatch function", filename)
+	}
+	return &DispatchHook{dispatch: dispatch}, nil
+}
+
+// hookDecision is what the hook decided for a dispatch
+type hookDecision struct {
+	// failCode is the outcome of the dispatch failed without sending it, as dispatch returns it, 0 if sent
+	failCode int
+
+	delay time.Duration
+
+	url    *url.URL
+	method string
+
+	// headers are set, or removed if nil
+	headers map[string]*string
+
+	body *string
+}
+
+// call passes the request about to be sent on to the script for its decision
+func (h *DispatchHook) call(taskName string, attempt int32, req *http.Request, body []byte) (hookDecision, error) {
+	headers := starlark.NewDict(len(req.Header))
+	for name, values := range req.Header {
+		headers.SetKey(starlark.String(name), starlark.String(strings.Join(values, ", ")))
+	}
+	task := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"name":    starlark.String(taskName),
+		"queue":   starlark.String(queueNameOf(taskName)),
+		"url":     starlark.String(req.URL.String()),
+		"method":  starlark.String(req.Method),
+		"headers": headers,
+		"body":    starlark.String(body),
+		"attempt": starlark.MakeInt(int(attempt)),
+	})
+
+	thread := &starlark.Thread{Name: taskName}
+	thread.SetMaxExecutionSteps(hookMaxSteps)
+	result, err := starlark.Call(thread, h.dispatch, starlark.Tuple{task}, nil)
+	if err != nil {
+		return hookDecision{}, err
+	}
+	if result == starlark.None {
+		return hookDecision{}, nil
+	}
+	changes, ok := result.(*starlark.Dict)
+	if !ok {
+		return hookDecision{}, fmt.Errorf("dispatch returned a %s, expected None or a dict", result.Type())
+	}
+
+	var decision hookDecision
+	for _, item := range changes.Items() {
+		key, _ := starlark.AsString(item[0])
+		value := item[1]
+		switch key {
+		case "fail":
+			if code, err := starlark.AsInt32(value); err == nil {
+				decision.failCode = code
+			} else if failure, ok := starlark.AsString(value); ok && (ChaosFailure(failure) == ChaosTimeout || ChaosFailure(failure) == ChaosConnectionReset) {
+				decision.failCode = ChaosFailure(failure).dispatchCode()
+			} else {
+				return hookDecision{}, fmt.Errorf("invalid fail %s, expected a status code, \"timeout\" or \"reset\"", value)
+			}
+		case "delay":
+			seconds, ok := starlark.AsFloat(value)
+			if !ok {
+				return hookDecision{}, fmt.Errorf("invalid delay %s, expected seconds", value)
+			}
+			decision.delay = time.Duration(seconds * float64(time.Second))
+		case "url":
+			rawURL, _ := starlark.AsString(value)
+			u, err := url.Parse(rawURL)
+			if err != nil || u.Host == "" {
+				return hookDecision{}, fmt.Errorf("invalid url %s", value)
+			}
+			decision.url = u
+		case "method":
+			method, _ := starlark.AsString(value)
+			decision.method = strings.ToUpper(method)
+		case "headers":
+			headerChanges, ok := value.(*starlark.Dict)
+			if !ok {
+				return hookDecision{}, fmt.Errorf("invalid headers %s, expected a dict", value)
+			}
+			decision.headers = make(map[string]*string)
+			for _, header := range headerChanges.Items() {
+				name, _ := starlark.AsString(header[0])
+				if header[1] == starlark.None {
+					decision.headers[name] = nil
+				} else {
+					headerValue, _ := starlark.AsString(header[1])
+					decision.headers[name] = &headerValue
+				}
+			}
+		case "body":
+			newBody, _ := starlark.AsString(value)
+			decision.body = &newBody
+		default:
+			return hookDecision{}, fmt.Errorf("unknown change %q, expected fail, delay, url, method, headers or body", key)
+		}
+	}
+	return decision, nil
+}
+
+// apply rewrites the request as decided, returning its body
+func (decision hookDecision) apply(req *http.Request, body []byte) []byte {
+	if decision.url != nil {
+		req.URL = decision.url
+		req.Host = hostHeader(decision.url)
+	}
+	if decision.method != "" {
+		req.Method = decision.method
+	}
+	for name, value := range decision.headers {
+		if value == nil {
+			req.Header.Del(name)
+		} else {
+			req.Header.Set(name, *value)
+		}
+	}
+	if decision.body != nil {
+		body = []byte(*decision.body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	return body
+}
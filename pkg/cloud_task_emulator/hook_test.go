@@ -0,0 +1,67 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestDispatchHook(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	hook, err := NewDispatchHook("hook.star", []byte(`
+def dispatch(task):
+    if task.attempt == 1:
+        return {"fail": 503}
+    return {
+        "url": task.url.replace("/missing", "/success"),
+        "headers": {"X-Scenario": "retried", "User-Agent": None},
+        "body": task.body.upper(),
+    }
+`))
+	require.NoError(t, err)
+
+	server := NewServer(WithOptions(ServerOptions{Dispatch: DispatchOptions{Hook: hook}}))
+	t.Cleanup(server.Shutdown)
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "hooked"),
+			RetryConfig: &taskspb.RetryConfig{MinBackoff: durationpb.New(10 * time.Millisecond)},
+		},
+	})
+	require.NoError(t, err)
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/missing", Body: []byte("payload")},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// The first attempt failed without reaching the target, the second was rewritten
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "/success", receivedRequest.URL.Path)
+	assert.Equal(t, "1", receivedRequest.Header.Get("X-CloudTasks-TaskRetryCount"))
+	assert.Equal(t, "503", receivedRequest.Header.Get("X-CloudTasks-TaskPreviousResponse"))
+	assert.Equal(t, "retried", receivedRequest.Header.Get("X-Scenario"))
+	assert.NotEqual(t, "Google-Cloud-Tasks", receivedRequest.Header.Get("User-Agent"))
+	assert.Equal(t, int64(len("PAYLOAD")), receivedRequest.ContentLength)
+}
+
+func TestNewDispatchHookRequiresDispatchFunction(t *testing.T) {
+	_, err := NewDispatchHook("hook.star", []byte("x = 1\n"))
+	assert.EqualError(t, err, "hook.star does not define a dispatch function")
+
+	_, err = NewDispatchHook("hook.star", []byte("def dispatch(task)\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,175 @@
+package cloud_task_emulator
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+)
+
+// HttpTarget is the queue-level HTTP target of Cloud Tasks, which the version of the API the emulator serves
+// lacks, so it is set with the emulator-only settings of the queue. It applies to the HTTP tasks of the queue
+// when they are dispatched. The JSON mirrors the REST API's, e.g.
+//
+//	{"uriOverride": {"host": "localhost", "port": 9000, "pathOverride": {"path": "/work"}},
+//	 "headerOverrides": [{"header": {"key": "X-Team", "value": "billing"}}],
+//	 "oidcToken": {"serviceAccountEmail": "tasks@dev.iam.gserviceaccount.com"}}
+type HttpTarget struct {
+	UriOverride *UriOverride `json:"uriOverride,omitempty"`
+
+	// HeaderOverrides replace the headers of the same name set by the tasks
+	HeaderOverrides []HeaderOverride `json:"headerOverrides,omitempty"`
+
+	// OidcToken has a token minted for every task, in place of the task's own
+	OidcToken *HttpTargetOidcToken `json:"oidcToken,omitempty"`
+}
+
+// UriOverride changes the parts of the task URLs it sets
+type UriOverride struct {
+	// Scheme is HTTP or HTTPS
+	Scheme string `json:"scheme,omitempty"`
+
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port,omitempty"`
+
+	PathOverride  *PathOverride  `json:"pathOverride,omitempty"`
+	QueryOverride *QueryOverride `json:"queryOverride,omitempty"`
+
+	// UriOverrideEnforceMode is IF_NOT_EXISTS, the default, which only sets the parts the task URL lacks
+	// (tasks may then leave out the URL altogether), or ALWAYS, which replaces them
+	UriOverrideEnforceMode string `json:"uriOverrideEnforceMode,omitempty"`
+}
+
+// PathOverride replaces the path of the task URLs
+type PathOverride struct {
+	Path string `json:"path"`
+}
+
+// QueryOverride replaces the query of the task URLs
+type QueryOverride struct {
+	QueryParams string `json:"queryParams"`
+}
+
+// HeaderOverride sets a header on every task
+type HeaderOverride struct {
+	Header struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"header"`
+}
+
+// HttpTargetOidcToken describes the OIDC token minted for every task of the queue
+type HttpTargetOidcToken struct {
+	ServiceAccountEmail string `json:"serviceAccountEmail"`
+	Audience            string `json:"audience,omitempty"`
+}
+
+// validate rejects the targets production would
+func (target *HttpTarget) validate() error {
+	if target == nil {
+		return nil
+	}
+	if override := target.UriOverride; override != nil {
+		switch override.Scheme {
+		case "", "HTTP", "HTTPS":
+		default:
+			return fmt.Errorf("unknown scheme %q, expected HTTP or HTTPS", override.Scheme)
+		}
+		switch override.UriOverrideEnforceMode {
+		case "", "IF_NOT_EXISTS", "ALWAYS":
+		default:
+			return fmt.Errorf("unknown uriOverrideEnforceMode %q, expected IF_NOT_EXISTS or ALWAYS", override.UriOverrideEnforceMode)
+		}
+		if override.Port < 0 || override.Port > 65535 {
+			return fmt.Errorf("invalid port %d", override.Port)
+		}
+	}
+	for _, header := range target.HeaderOverrides {
+		if header.Header.Key == "" {
+			return fmt.Errorf("header overrides need a key")
+		}
+	}
+	if target.OidcToken != nil && target.OidcToken.ServiceAccountEmail == "" {
+		return fmt.Errorf("the OIDC token needs a serviceAccountEmail")
+	}
+	return nil
+}
+
+// overridesHost reports whether the target gives the tasks a host, so that they may leave out their URL
+func (target *HttpTarget) overridesHost() bool {
+	return target != nil && target.UriOverride != nil && target.UriOverride.Host != ""
+}
+
+// overrideURL applies the URI override to the task URL
+func (target *HttpTarget) overrideURL(taskURL string) string {
+	if target == nil || target.UriOverride == nil {
+		return taskURL
+	}
+	override := target.UriOverride
+	parsed, err := url.Parse(taskURL)
+	if err != nil {
+		return taskURL
+	}
+	always := override.UriOverrideEnforceMode == "ALWAYS"
+
+	if override.Scheme != "" && (always || parsed.Scheme == "") {
+		parsed.Scheme = strings.ToLower(override.Scheme)
+	} else if parsed.Scheme == "" {
+		parsed.Scheme = "https"
+	}
+
+	hostname, port := parsed.Hostname(), parsed.Port()
+	if override.Host != "" && (always || hostname == "") {
+		hostname = override.Host
+	}
+	if override.Port != 0 && (always || port == "") {
+		port = strconv.Itoa(override.Port)
+	}
+	if port == "" {
+		if strings.Contains(hostname, ":") {
+			hostname = "[" + hostname + "]"
+		}
+		parsed.Host = hostname
+	} else {
+		parsed.Host = net.JoinHostPort(hostname, port)
+	}
+
+	if override.PathOverride != nil && (always || parsed.Path == "" || parsed.Path == "/") {
+		parsed.Path = override.PathOverride.Path
+		parsed.RawPath = ""
+	}
+	if override.QueryOverride != nil && (always || parsed.RawQuery == "") {
+		parsed.RawQuery = override.QueryOverride.QueryParams
+	}
+	return parsed.String()
+}
+
+// overrideHeaders replaces the headers of the request the target overrides, whatever their case
+func (target *HttpTarget) overrideHeaders(header http.Header) {
+	if target == nil {
+		return
+	}
+	for _, override := range target.HeaderOverrides {
+		for name := range header {
+			if strings.EqualFold(name, override.Header.Key) {
+				delete(header, name)
+			}
+		}
+		header[override.Header.Key] = []string{override.Header.Value}
+	}
+}
+
+// oidcToken returns the token to mint for the HTTP task, the target's if it has one
+func (target *HttpTarget) oidcToken(httpRequest *tasks.HttpRequest) *tasks.OidcToken {
+	if httpRequest != nil && target != nil && target.OidcToken != nil {
+		return &tasks.OidcToken{
+			ServiceAccountEmail: target.OidcToken.ServiceAccountEmail,
+			Audience:            target.OidcToken.Audience,
+		}
+	}
+	return httpRequest.GetOidcToken()
+}
@@ -0,0 +1,60 @@
+package cloud_task_emulator
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpTargetOverrideURL(t *testing.T) {
+	ifNotExists := &HttpTarget{UriOverride: &UriOverride{
+		Scheme:        "HTTP",
+		Host:          "localhost",
+		Port:          9000,
+		PathOverride:  &PathOverride{Path: "/work"},
+		QueryOverride: &QueryOverride{QueryParams: "team=billing"},
+	}}
+	always := &HttpTarget{UriOverride: &UriOverride{
+		Scheme:                 "HTTP",
+		Host:                   "localhost",
+		Port:                   9000,
+		PathOverride:           &PathOverride{Path: "/work"},
+		UriOverrideEnforceMode: "ALWAYS",
+	}}
+
+	for _, tc := range []struct {
+		target   *HttpTarget
+		taskURL  string
+		expected string
+	}{
+		{nil, "https://example.com/task", "https://example.com/task"},
+		{ifNotExists, "", "http://localhost:9000/work?team=billing"},
+		{ifNotExists, "https://example.com/task?id=1", "https://example.com:9000/task?id=1"},
+		{ifNotExists, "https://example.com:8443/", "https://example.com:8443/work?team=billing"},
+		{always, "https://example.com:8443/task?id=1", "http://localhost:9000/work?id=1"},
+		{&HttpTarget{UriOverride: &UriOverride{Host: "::1", UriOverrideEnforceMode: "ALWAYS"}}, "https://example.com/task", "https://[::1]/task"},
+	} {
+		assert.Equal(t, tc.expected, tc.target.overrideURL(tc.taskURL), tc.taskURL)
+	}
+}
+
+func TestHttpTargetOverrideHeaders(t *testing.T) {
+	target := &HttpTarget{HeaderOverrides: []HeaderOverride{{}}}
+	target.HeaderOverrides[0].Header.Key = "X-Team"
+	target.HeaderOverrides[0].Header.Value = "billing"
+
+	header := http.Header{"x-team": {"sales"}, "Content-Type": {"application/json"}}
+	target.overrideHeaders(header)
+
+	assert.Equal(t, http.Header{"X-Team": {"billing"}, "Content-Type": {"application/json"}}, header)
+}
+
+func TestHttpTargetValidate(t *testing.T) {
+	assert.NoError(t, (*HttpTarget)(nil).validate())
+	assert.NoError(t, (&HttpTarget{UriOverride: &UriOverride{Scheme: "HTTPS", Port: 443, UriOverrideEnforceMode: "ALWAYS"}}).validate())
+	assert.Error(t, (&HttpTarget{UriOverride: &UriOverride{Scheme: "FTP"}}).validate())
+	assert.Error(t, (&HttpTarget{UriOverride: &UriOverride{UriOverrideEnforceMode: "SOMETIMES"}}).validate())
+	assert.Error(t, (&HttpTarget{UriOverride: &UriOverride{Port: 70000}}).validate())
+	assert.Error(t, (&HttpTarget{OidcToken: &HttpTargetOidcToken{}}).validate())
+}
@@ -0,0 +1,141 @@
+package cloud_task_emulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	v1 "cloud.google.com/go/iam/apiv1/iampb"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// CallerMetadataKey is the gRPC metadata key identifying the caller, e.g. "user:alice@example.com"
+const CallerMetadataKey = "x-emulator-caller"
+
+// callerIdentity returns the identity the caller claims, or an empty string for anonymous callers
+func callerIdentity(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(CallerMetadataKey); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// policyEtag derives the etag of a policy from its revision
+func policyEtag(revision uint64) []byte {
+	etag := make([]byte, 8)
+	binary.BigEndian.PutUint64(etag, revision)
+	return etag
+}
+
+// fetchPolicy returns a copy of the resource's policy, or an empty policy if none was set
+func (s *Server) fetchPolicy(resource string) *v1.Policy {
+	s.policiesMux.Lock()
+	defer s.policiesMux.Unlock()
+
+	policy, ok := s.policies[resource]
+	if !ok {
+		return &v1.Policy{Etag: policyEtag(0)}
+	}
+	return proto.Clone(policy).(*v1.Policy)
+}
+
+func (s *Server) removePolicy(resource string) {
+	s.policiesMux.Lock()
+	defer s.policiesMux.Unlock()
+	delete(s.policies, resource)
+}
+
+// checkIamResource verifies that the IAM resource is an existing queue
+func (s *Server) checkIamResource(resource string) error {
+	queue, ok := s.fetchQueue(resource)
+	if !ok || queue == nil {
+		return errEntityNotFound()
+	}
+	return nil
+}
+
+// GetIamPolicy returns the IAM policy of a queue, which is empty until one is set
+func (s *Server) GetIamPolicy(ctx context.Context, in *v1.GetIamPolicyRequest) (*v1.Policy, error) {
+	if err := s.checkIamResource(in.GetResource()); err != nil {
+		return nil, err
+	}
+
+	return s.fetchPolicy(in.GetResource()), nil
+}
+
+// SetIamPolicy replaces the IAM policy of a queue, honouring the etag for read-modify-write cycles
+func (s *Server) SetIamPolicy(ctx context.Context, in *v1.SetIamPolicyRequest) (*v1.Policy, error) {
+	if err := s.checkIamResource(in.GetResource()); err != nil {
+		return nil, err
+	}
+	if in.GetPolicy() == nil {
+		return nil, errInvalidArgument()
+	}
+
+	s.policiesMux.Lock()
+	defer s.policiesMux.Unlock()
+
+	policy, ok := s.policies[in.GetResource()]
+	if !ok {
+		policy = &v1.Policy{Etag: policyEtag(0)}
+	}
+
+	if etag := in.GetPolicy().GetEtag(); len(etag) > 0 && !bytes.Equal(etag, policy.GetEtag()) {
+		return nil, errConcurrentPolicyChange()
+	}
+
+	// The default update mask is "bindings, etag"
+	paths := in.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"bindings", "etag"}
+	}
+
+	updated := proto.Clone(policy).(*v1.Policy)
+	updated.Version = in.GetPolicy().GetVersion()
+	for _, path := range paths {
+		switch path {
+		case "bindings":
+			updated.Bindings = proto.Clone(in.GetPolicy()).(*v1.Policy).GetBindings()
+		case "audit_configs", "auditConfigs":
+			updated.AuditConfigs = proto.Clone(in.GetPolicy()).(*v1.Policy).GetAuditConfigs()
+		case "etag":
+			// Always regenerated below
+		default:
+			return nil, errInvalidUpdateMaskPath(path)
+		}
+	}
+
+	s.policyRevision++
+	updated.Etag = policyEtag(s.policyRevision)
+	s.policies[in.GetResource()] = updated
+
+	return proto.Clone(updated).(*v1.Policy), nil
+}
+
+// TestIamPermissions returns the requested permissions the caller holds, see ServerOptions.IamPermissions
+func (s *Server) TestIamPermissions(ctx context.Context, in *v1.TestIamPermissionsRequest) (*v1.TestIamPermissionsResponse, error) {
+	if err := s.checkIamResource(in.GetResource()); err != nil {
+		return nil, err
+	}
+
+	granted, restricted := s.options.IamPermissions[callerIdentity(ctx)]
+	if !restricted {
+		return &v1.TestIamPermissionsResponse{Permissions: in.GetPermissions()}, nil
+	}
+
+	var permissions []string
+	for _, permission := range in.GetPermissions() {
+		for _, grantedPermission := range granted {
+			if permission == grantedPermission {
+				permissions = append(permissions, permission)
+				break
+			}
+		}
+	}
+
+	return &v1.TestIamPermissionsResponse{Permissions: permissions}, nil
+}
@@ -0,0 +1,66 @@
+package cloud_task_emulator
+
+import (
+	"sort"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+)
+
+// The inspector methods below give embedding tests read-only access to the emulator's state. They return
+// copies, which the emulator does not change afterwards.
+
+// ListQueuesSnapshot returns the existing queues of every project, ordered by name
+func (s *Server) ListQueuesSnapshot() []*tasks.Queue {
+	stored, err := s.storage.ListQueues()
+	s.logReadError(err)
+	queueStates := make([]*tasks.Queue, 0, len(stored))
+	for _, queueState := range stored {
+		if queueState != nil {
+			queueStates = append(queueStates, queueState)
+		}
+	}
+	sort.Slice(queueStates, func(i, j int) bool {
+		return queueStates[i].GetName() < queueStates[j].GetName()
+	})
+	return queueStates
+}
+
+// TaskSnapshot returns the task, reporting false if it does not exist (anymore)
+func (s *Server) TaskSnapshot(taskName string) (*tasks.Task, bool) {
+	taskState, ok, err := s.storage.GetTask(taskName)
+	s.logReadError(err)
+	return taskState, ok
+}
+
+// TombstoneCount returns the number of task names of the queue that are reserved because their tasks
+// completed or were deleted recently
+func (s *Server) TombstoneCount(queueName string) int {
+	count, err := s.storage.CountTombstones(queueName, s.clock.Now())
+	s.logReadError(err)
+	return count
+}
+
+// Tombstones returns the reserved task names of the queue, soonest to expire first. Their names are only
+// known with ServerOptions.KeepTombstonedNames set, see TaskNameTombstone otherwise.
+func (s *Server) Tombstones(queueName string) []Tombstone {
+	entries, err := s.storage.ListTombstones(queueName, s.clock.Now())
+	s.logReadError(err)
+	if entries == nil {
+		entries = []Tombstone{}
+	}
+	return entries
+}
+
+// TaskNameTombstone returns the tombstone of the task name, reporting false if the name is not reserved
+func (s *Server) TaskNameTombstone(taskName string) (Tombstone, bool) {
+	tombstone, ok, err := s.storage.TaskNameTombstone(taskName, s.clock.Now())
+	s.logReadError(err)
+	return tombstone, ok
+}
+
+// logReadError logs a failed read of the storage, the inspector methods returning nothing instead
+func (s *Server) logReadError(err error) {
+	if err != nil {
+		s.logger.Printf("Could not read the storage: %v\n", err)
+	}
+}
@@ -0,0 +1,52 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectorSnapshots(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	ctx := context.Background()
+
+	for _, name := range []string{"second", "first"} {
+		_, err := server.CreateQueue(ctx, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, name)})
+		require.NoError(t, err)
+	}
+	queues := server.ListQueuesSnapshot()
+	require.Len(t, queues, 2)
+	assert.Equal(t, formatQueueName(formattedParent, "first"), queues[0].GetName())
+	assert.Equal(t, formatQueueName(formattedParent, "second"), queues[1].GetName())
+
+	queueName := queues[0].GetName()
+	_, err := server.PauseQueue(ctx, &taskspb.PauseQueueRequest{Name: queueName})
+	require.NoError(t, err)
+	task, err := server.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: queueName,
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+		},
+	})
+	require.NoError(t, err)
+
+	snapshot, ok := server.TaskSnapshot(task.GetName())
+	require.True(t, ok)
+	assert.Equal(t, task.GetName(), snapshot.GetName())
+	assert.Equal(t, 0, server.TombstoneCount(queueName))
+
+	_, err = server.DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: task.GetName()})
+	require.NoError(t, err)
+
+	// The deleted task is let go of asynchronously
+	assert.Eventually(t, func() bool {
+		_, ok := server.TaskSnapshot(task.GetName())
+		return !ok && server.TombstoneCount(queueName) == 1
+	}, time.Second, 10*time.Millisecond)
+}
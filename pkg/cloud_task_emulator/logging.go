@@ -0,0 +1,225 @@
+package cloud_task_emulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+// GrpcLogLevel controls what LoggingInterceptor logs
+type GrpcLogLevel int
+
+const (
+	// GrpcLogOff logs nothing
+	GrpcLogOff GrpcLogLevel = iota
+	// GrpcLogInfo logs the method, caller, result code and duration of every call
+	GrpcLogInfo
+	// GrpcLogDebug additionally logs the request and response payloads
+	GrpcLogDebug
+)
+
+// ParseGrpcLogLevel parses "off", "info" or "debug"
+func ParseGrpcLogLevel(level string) (GrpcLogLevel, error) {
+	switch level {
+	case "", "off":
+		return GrpcLogOff, nil
+	case "info":
+		return GrpcLogInfo, nil
+	case "debug":
+		return GrpcLogDebug, nil
+	default:
+		return GrpcLogOff, fmt.Errorf("invalid gRPC log level %q, expected off, info or debug", level)
+	}
+}
+
+// LogLevel controls how much the emulator logs about the dispatches
+type LogLevel int
+
+const (
+	// LogInfo logs the outcome of every attempt
+	LogInfo LogLevel = iota
+	// LogDebug additionally logs the request and response of every attempt, see logDispatchRequest
+	LogDebug
+)
+
+// ParseLogLevel parses "info" or "debug"
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch level {
+	case "", "info":
+		return LogInfo, nil
+	case "debug":
+		return LogDebug, nil
+	default:
+		return LogInfo, fmt.Errorf("invalid log level %q, expected info or debug", level)
+	}
+}
+
+// maxLoggedBody is the largest part of a request or response body logged at LogDebug
+const maxLoggedBody = 512
+
+// logDispatchRequest logs the method, URL, headers and body of a request about to be sent, with its credentials
+// left out
+func logDispatchRequest(logger printfLogger, req *http.Request, body []byte) {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		value := strings.Join(req.Header[name], ", ")
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			scheme, _, _ := strings.Cut(value, " ")
+			value = scheme + " [redacted]"
+		}
+		fmt.Fprintf(&headers, " %s=%q", name, value)
+	}
+	logger.Printf("Debug: sending %s %s headers:%s body=%s\n", req.Method, req.URL, headers.String(), bodySnippet(body, false))
+}
+
+// logDispatchResponse logs the status and the start of the body of a response, leaving the body to be read
+// again in full
+func logDispatchResponse(logger printfLogger, req *http.Request, resp *http.Response) {
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedBody+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(snippet), resp.Body), resp.Body}
+
+	truncated := len(snippet) > maxLoggedBody
+	if truncated {
+		snippet = snippet[:maxLoggedBody]
+	}
+	logger.Printf("Debug: received %s from %s %s body=%s\n", resp.Status, req.Method, req.URL, bodySnippet(snippet, truncated))
+}
+
+// bodySnippet quotes up to maxLoggedBody bytes of the body, marking it truncated if it is longer or known to be
+func bodySnippet(body []byte, truncated bool) string {
+	if len(body) > maxLoggedBody {
+		return fmt.Sprintf("%q... (%d bytes)", body[:maxLoggedBody], len(body))
+	}
+	if truncated {
+		return fmt.Sprintf("%q...", body)
+	}
+	return fmt.Sprintf("%q", body)
+}
+
+// LogFormat is how the emulator writes its log lines
+type LogFormat string
+
+const (
+	// LogText writes plain lines
+	LogText LogFormat = "text"
+
+	// LogJSON writes a JSON object per line, see NewJSONLogWriter
+	LogJSON LogFormat = "json"
+)
+
+// ParseLogFormat parses "text" or "json"
+func ParseLogFormat(value string) (LogFormat, error) {
+	switch value {
+	case "", "text":
+		return LogText, nil
+	case "json":
+		return LogJSON, nil
+	default:
+		return LogText, fmt.Errorf("invalid log format %q, expected text or json", value)
+	}
+}
+
+// jsonLogEntry is a log line as NewJSONLogWriter writes it
+type jsonLogEntry struct {
+	Time          string `json:"time"`
+	Message       string `json:"message"`
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// correlationIDPrefix matches the prefix of the log lines about a task, see taskLogger
+var correlationIDPrefix = regexp.MustCompile(`^\[([0-9a-f]{8})\] `)
+
+// jsonLogWriter writes the log lines it is given as JSON objects
+type jsonLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogWriter returns a writer for loggers, with no flags or prefix, writing each line as a JSON object on a
+// line of its own to w, e.g. {"time":"2024-05-01T10:00:00.123Z","message":"Task done","correlationId":"3f9a0c1e"}.
+// The time is the host's, in RFC 3339, and the correlation ID is that of the task the line is about, if any.
+func NewJSONLogWriter(w io.Writer) io.Writer {
+	return &jsonLogWriter{w: w}
+}
+
+func (jw *jsonLogWriter) Write(p []byte) (int, error) {
+	entry := jsonLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Message: strings.TrimSuffix(string(p), "\n"),
+	}
+	if match := correlationIDPrefix.FindStringSubmatch(entry.Message); match != nil {
+		entry.CorrelationID = match[1]
+		entry.Message = entry.Message[len(match[0]):]
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if _, err := jw.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// formatPayload renders a request or response for the logs
+func formatPayload(payload interface{}) string {
+	if message, ok := payload.(protov2.Message); ok {
+		if formatted, err := protojson.Marshal(message); err == nil {
+			return string(formatted)
+		}
+	}
+	return fmt.Sprintf("%v", payload)
+}
+
+// LoggingInterceptor returns a gRPC unary interceptor logging incoming calls at the given level
+func LoggingInterceptor(level GrpcLogLevel) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if level == GrpcLogOff {
+			return handler(ctx, req)
+		}
+
+		if level >= GrpcLogDebug {
+			log.Printf("gRPC %s request: %s", info.FullMethod, formatPayload(req))
+		}
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		log.Printf("gRPC %s caller=%q code=%s duration=%s", info.FullMethod, callerIdentity(ctx), status.Code(err), time.Since(start))
+		if level >= GrpcLogDebug {
+			if err != nil {
+				log.Printf("gRPC %s error: %v", info.FullMethod, err)
+			} else {
+				log.Printf("gRPC %s response: %s", info.FullMethod, formatPayload(resp))
+			}
+		}
+
+		return resp, err
+	}
+}
@@ -0,0 +1,176 @@
+package cloud_task_emulator_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func captureGrpcLogs(t *testing.T, level GrpcLogLevel) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	server := NewServer()
+	interceptor := LoggingInterceptor(level)
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.tasks.v2.CloudTasks/GetQueue"}
+	_, err := interceptor(context.Background(), &taskspb.GetQueueRequest{Name: "missing-queue"}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.GetQueue(ctx, req.(*taskspb.GetQueueRequest))
+	})
+	require.Error(t, err)
+
+	return buf.String()
+}
+
+func TestLoggingInterceptorLevels(t *testing.T) {
+	assert.Empty(t, captureGrpcLogs(t, GrpcLogOff))
+
+	infoLogs := captureGrpcLogs(t, GrpcLogInfo)
+	assert.Contains(t, infoLogs, "/google.cloud.tasks.v2.CloudTasks/GetQueue")
+	assert.Contains(t, infoLogs, "code=NotFound")
+	assert.NotContains(t, infoLogs, "missing-queue")
+
+	debugLogs := captureGrpcLogs(t, GrpcLogDebug)
+	assert.Contains(t, debugLogs, "code=NotFound")
+	assert.Contains(t, debugLogs, "missing-queue")
+}
+
+func TestParseGrpcLogLevel(t *testing.T) {
+	level, err := ParseGrpcLogLevel("debug")
+	require.NoError(t, err)
+	assert.Equal(t, GrpcLogDebug, level)
+
+	_, err = ParseGrpcLogLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(NewJSONLogWriter(&buf), "", 0)
+	logger.Println("Stopping queue")
+	logger.Printf("[3f9a0c1e] Task exec error with status %d\n", 404)
+	logger.Printf(`Could not dispatch "a\b"`)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	var entries []map[string]string
+	for _, line := range lines {
+		var entry map[string]string
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		_, err := time.Parse(time.RFC3339Nano, entry["time"])
+		assert.NoError(t, err)
+		delete(entry, "time")
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, []map[string]string{
+		{"message": "Stopping queue"},
+		{"message": "Task exec error with status 404", "correlationId": "3f9a0c1e"},
+		{"message": `Could not dispatch "a\b"`},
+	}, entries)
+}
+
+func TestParseLogFormat(t *testing.T) {
+	format, err := ParseLogFormat("json")
+	require.NoError(t, err)
+	assert.Equal(t, LogJSON, format)
+
+	format, err = ParseLogFormat("")
+	require.NoError(t, err)
+	assert.Equal(t, LogText, format)
+
+	_, err = ParseLogFormat("logfmt")
+	assert.Error(t, err)
+}
+
+func TestDebugLogsDispatches(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing field: id" + strings.Repeat(".", 1000)))
+	}))
+	t.Cleanup(target.Close)
+
+	var logs lockedBuffer
+	server := NewServer(WithLogger(log.New(&logs, "", 0)), WithOptions(ServerOptions{Dispatch: DispatchOptions{LogLevel: LogDebug}}))
+	t.Cleanup(server.Shutdown)
+	dispatched := server.DispatchedRequests()
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "debug")})
+	require.NoError(t, err)
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url:        target.URL + "/orders",
+				Headers:    map[string]string{"Content-Type": "application/json", "Authorization": "Bearer secret"},
+				Body:       []byte(`{"items": "` + strings.Repeat("x", 600) + `"}`),
+				HttpMethod: taskspb.HttpMethod_PUT,
+			}},
+		},
+	})
+	require.NoError(t, err)
+
+	// The response body is still recorded in full
+	select {
+	case request := <-dispatched:
+		assert.Len(t, request.ResponseBody, 1017)
+	case <-time.After(time.Second):
+		t.Fatal("task was not dispatched")
+	}
+
+	output := logs.String()
+	assert.Contains(t, output, "Debug: sending PUT "+target.URL+"/orders headers:")
+	assert.Contains(t, output, ` Authorization="Bearer [redacted]" Content-Type="application/json"`)
+	assert.NotContains(t, output, "secret")
+	assert.Contains(t, output, `body="{\"items\": \"xxx`)
+	assert.Contains(t, output, `xxx"... (613 bytes)`)
+	assert.Contains(t, output, `Debug: received 400 Bad Request from PUT `+target.URL+`/orders body="missing field: id...`)
+	assert.Contains(t, output, `..."...`)
+}
+
+func TestInfoDoesNotLogDispatches(t *testing.T) {
+	var logs lockedBuffer
+	server := NewServer(WithLogger(log.New(&logs, "", 0)))
+	t.Cleanup(server.Shutdown)
+	testServerUrl, requests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "info")})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = awaitHttpRequest(requests)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+	assert.NotContains(t, logs.String(), "Debug:")
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("debug")
+	require.NoError(t, err)
+	assert.Equal(t, LogDebug, level)
+
+	_, err = ParseLogLevel("trace")
+	assert.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package cloud_task_emulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// queueMetric is a histogram of the QueueStats exposed by the metrics endpoint
+type queueMetric struct {
+	name string
+	help string
+	of   func(stats QueueStats) Histogram
+}
+
+var queueMetrics = []queueMetric{
+	{
+		name: "cloud_tasks_emulator_time_to_first_dispatch_seconds",
+		help: "How long tasks waited past their schedule time for their first dispatch.",
+		of:   func(stats QueueStats) Histogram { return stats.TimeToFirstDispatch },
+	},
+	{
+		name: "cloud_tasks_emulator_attempt_latency_seconds",
+		help: "How long attempts took from their dispatch to the response, or the failure.",
+		of:   func(stats QueueStats) Histogram { return stats.AttemptLatency },
+	},
+	{
+		name: "cloud_tasks_emulator_attempts_to_success",
+		help: "How many attempts tasks took to succeed.",
+		of:   func(stats QueueStats) Histogram { return stats.AttemptsToSuccess },
+	},
+	{
+		name: "cloud_tasks_emulator_attempts_to_failure",
+		help: "How many attempts tasks made before they ran out of attempts.",
+		of:   func(stats QueueStats) Histogram { return stats.AttemptsToFailure },
+	},
+}
+
+// QueueStats returns the dispatch statistics of the queue, reporting false if it does not exist
+func (s *Server) QueueStats(queueName string) (QueueStats, bool) {
+	queue, ok := s.fetchQueue(queueName)
+	if !ok || queue == nil {
+		return QueueStats{}, false
+	}
+	return queue.Stats(), true
+}
+
+// queuesByName returns the existing queues of every project, ordered by name
+func (s *Server) queuesByName() []*Queue {
+	s.qsMux.Lock()
+	queues := make([]*Queue, 0, len(s.qs))
+	for _, queue := range s.qs {
+		if queue != nil {
+			queues = append(queues, queue)
+		}
+	}
+	s.qsMux.Unlock()
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].name < queues[j].name
+	})
+	return queues
+}
+
+// writeMetrics writes the statistics of every queue in the Prometheus text format
+func (s *Server) writeMetrics(w io.Writer) error {
+	queues := s.queuesByName()
+	stats := make([]QueueStats, len(queues))
+	for i, queue := range queues {
+		stats[i] = queue.Stats()
+	}
+
+	out := bufio.NewWriter(w)
+	for _, metric := range queueMetrics {
+		fmt.Fprintf(out, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(out, "# TYPE %s histogram\n", metric.name)
+		for i, queue := range queues {
+			histogram := metric.of(stats[i])
+			for _, bucket := range histogram.Buckets {
+				fmt.Fprintf(out, "%s_bucket{queue=%q,le=%q} %d\n", metric.name, queue.name, formatFloat(bucket.UpperBound), bucket.Count)
+			}
+			fmt.Fprintf(out, "%s_bucket{queue=%q,le=\"+Inf\"} %d\n", metric.name, queue.name, histogram.Count)
+			fmt.Fprintf(out, "%s_sum{queue=%q} %s\n", metric.name, queue.name, formatFloat(histogram.Sum))
+			fmt.Fprintf(out, "%s_count{queue=%q} %d\n", metric.name, queue.name, histogram.Count)
+		}
+	}
+	return out.Flush()
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// handleMetrics serves the statistics of every queue to Prometheus
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
+
+// handleQueueStats reads the dispatch statistics of a queue
+func (s *Server) handleQueueStats(w http.ResponseWriter, r *http.Request, queueName string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	stats, ok := s.QueueStats(queueName)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Queue does not exist.")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,109 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestQueueStats(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "measured")})
+	require.NoError(t, err)
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stats, _ := server.QueueStats(queue.GetName())
+		return stats.AttemptLatency.Count == 1
+	}, time.Second, 10*time.Millisecond)
+	stats, ok := server.QueueStats(queue.GetName())
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), stats.TimeToFirstDispatch.Count)
+	assert.Less(t, stats.TimeToFirstDispatch.Sum, 1.0)
+	assert.Equal(t, uint64(1), stats.AttemptLatency.Buckets[len(stats.AttemptLatency.Buckets)-1].Count)
+
+	var body QueueStats
+	require.Equal(t, http.StatusOK, getAdminJSON(t, admin.URL+"/emulator/v1/"+queue.GetName()+"/stats", &body))
+	assert.Equal(t, stats, body)
+	assert.Equal(t, http.StatusNotFound, callAdmin(t, http.MethodGet, admin.URL+"/emulator/v1/"+formatQueueName(formattedParent, "missing")+"/stats", ""))
+
+	resp, err := http.Get(admin.URL + "/emulator/v1/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	metrics, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(metrics), "# TYPE cloud_tasks_emulator_attempt_latency_seconds histogram\n")
+	assert.Contains(t, string(metrics), `cloud_tasks_emulator_attempt_latency_seconds_bucket{queue="`+queue.GetName()+`",le="+Inf"} 1`)
+	assert.Contains(t, string(metrics), `cloud_tasks_emulator_time_to_first_dispatch_seconds_count{queue="`+queue.GetName()+`"} 1`)
+}
+
+func TestQueueAttemptStats(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "retried"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 2, MinBackoff: durationpb.New(10 * time.Millisecond)},
+		},
+	})
+	require.NoError(t, err)
+	failNextUrl := admin.URL + "/emulator/v1/" + queue.GetName() + "/failNext"
+	runTask := func() {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+			},
+		})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+	}
+
+	// Runs out of attempts
+	require.Equal(t, http.StatusOK, putAdmin(t, failNextUrl, `{"count": 2}`))
+	runTask()
+
+	// Succeeds on the retry
+	require.Equal(t, http.StatusOK, putAdmin(t, failNextUrl, `{"count": 1}`))
+	runTask()
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	stats, ok := server.QueueStats(queue.GetName())
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), stats.AttemptsToFailure.Count)
+	assert.Equal(t, 2.0, stats.AttemptsToFailure.Sum)
+	assert.Equal(t, uint64(1), stats.AttemptsToSuccess.Count)
+	assert.Equal(t, 2.0, stats.AttemptsToSuccess.Sum)
+	assert.Equal(t, HistogramBucket{UpperBound: 1, Count: 0}, stats.AttemptsToSuccess.Buckets[0])
+	assert.Equal(t, HistogramBucket{UpperBound: 2, Count: 1}, stats.AttemptsToSuccess.Buckets[1])
+}
@@ -0,0 +1,148 @@
+package cloud_task_emulator
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// http2Preface starts every HTTP/2 connection, which gRPC clients open straight away
+var http2Preface = []byte("PRI")
+
+// sniffTimeout bounds how long a new connection may take to send its first bytes
+const sniffTimeout = 10 * time.Second
+
+// Multiplex splits the connections of a listener by protocol, so that gRPC and HTTP/1 can share one port.
+// HTTP/2 connections, which gRPC uses, are accepted from the first listener returned and the others from the
+// second. Closing the listener passed in stops both.
+func Multiplex(lis net.Listener) (grpcLis net.Listener, httpLis net.Listener) {
+	grpcChild := newChildListener(lis)
+	httpChild := newChildListener(lis)
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				grpcChild.closeWithError(err)
+				httpChild.closeWithError(err)
+				return
+			}
+			go func() {
+				prefix := make([]byte, len(http2Preface))
+				conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+				n, err := io.ReadFull(conn, prefix)
+				conn.SetReadDeadline(time.Time{})
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				sniffed := &prefixedConn{Conn: conn, prefix: prefix[:n]}
+				if bytes.Equal(prefix, http2Preface) {
+					grpcChild.deliver(sniffed)
+				} else {
+					httpChild.deliver(sniffed)
+				}
+			}()
+		}
+	}()
+
+	return grpcChild, httpChild
+}
+
+// HTTPHandler serves all the HTTP endpoints of the emulator: the admin API, expvar and the OpenID discovery endpoints
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	admin := s.AdminHandler()
+	mux.Handle("/emulator/", admin)
+	mux.Handle("/debug/vars", admin)
+	openID := s.OpenIDHandler()
+	mux.Handle("/.well-known/openid-configuration", openID)
+	mux.Handle("/jwks", openID)
+	return mux
+}
+
+// ServeH2C serves the handler on the listener over HTTP/1.1 and h2c, HTTP/2 without TLS, for HTTP/2-only
+// clients and proxies that connect without TLS termination in front of the emulator
+func ServeH2C(lis net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	return server.Serve(lis)
+}
+
+// prefixedConn replays the bytes read to sniff the protocol before the rest of the connection
+type prefixedConn struct {
+	net.Conn
+
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// childListener accepts the connections Multiplex delivers to it
+type childListener struct {
+	parent net.Listener
+
+	conns chan net.Conn
+
+	done chan struct{}
+
+	closeOnce sync.Once
+
+	err error
+}
+
+func newChildListener(parent net.Listener) *childListener {
+	return &childListener{
+		parent: parent,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+		err:    net.ErrClosed,
+	}
+}
+
+func (l *childListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *childListener) closeWithError(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *childListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close stops accepting connections of this protocol, the parent listener keeps running
+func (l *childListener) Close() error {
+	l.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (l *childListener) Addr() net.Addr {
+	return l.parent.Addr()
+}
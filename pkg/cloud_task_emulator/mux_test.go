@@ -0,0 +1,79 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	. "cloud.google.com/go/cloudtasks/apiv2"
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestMultiplexGrpcAndHttpOnOnePort(t *testing.T) {
+	emulatorServer := NewServer()
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	grpcLis, httpLis := Multiplex(lis)
+	grpcServer := emulatorServer.NewGrpcServer()
+	t.Cleanup(grpcServer.Stop)
+	go grpcServer.Serve(grpcLis)
+	go http.Serve(httpLis, emulatorServer.HTTPHandler())
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	createTestQueue(t, client)
+
+	for _, path := range []string{"/emulator/v1/audit", "/jwks", "/.well-known/openid-configuration"} {
+		resp, err := http.Get("http://" + lis.Addr().String() + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formatQueueName(formattedParent, "test")})
+	assert.NoError(t, err, "gRPC keeps working alongside HTTP")
+}
+
+func TestServeH2C(t *testing.T) {
+	emulatorServer := NewServer()
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+	go ServeH2C(lis, emulatorServer.HTTPHandler())
+
+	// An HTTP/2-only client, with prior knowledge that the server speaks h2c
+	h2cClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	resp, err := h2cClient.Get("http://" + lis.Addr().String() + "/emulator/v1/audit")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	resp, err = http.Get("http://" + lis.Addr().String() + "/emulator/v1/audit")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, resp.ProtoMajor)
+}
@@ -0,0 +1,175 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"net/http"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	v1 "cloud.google.com/go/iam/apiv1/iampb"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/metadata"
+)
+
+// Namespace returns the server holding the queues and tasks of the namespace, creating it on first use, or the
+// server itself for the empty namespace. See ServerOptions.NamespaceMetadataKey.
+func (s *Server) Namespace(name string) *Server {
+	if name == "" {
+		return s
+	}
+
+	s.namespacesMux.Lock()
+	defer s.namespacesMux.Unlock()
+
+	if namespace, ok := s.namespaces[name]; ok {
+		return namespace
+	}
+
+	options := s.Options()
+	options.NamespaceMetadataKey = ""
+	// The namespace tells the time on the server's clock, already scaled and offset
+	options.TimeScale = 0
+	options.ClockOffset = 0
+	namespace := NewServer(WithOptions(options), WithClock(s.clock), WithLogger(s.logger), WithHTTPClient(s.httpClient), WithScheduler(s.scheduler), WithTransport(s.transport))
+	// Shutting down the server shuts down its namespaces
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			namespace.Shutdown()
+		case <-namespace.ctx.Done():
+		}
+	}()
+
+	if s.namespaces == nil {
+		s.namespaces = make(map[string]*Server)
+	}
+	s.namespaces[name] = namespace
+	return namespace
+}
+
+// DeleteNamespace shuts down the server of the namespace and forgets it, with its queues, tasks, reserved task
+// names and IAM policies, for the next call naming it to start afresh. It reports whether the namespace existed.
+func (s *Server) DeleteNamespace(name string) bool {
+	s.namespacesMux.Lock()
+	namespace, ok := s.namespaces[name]
+	delete(s.namespaces, name)
+	s.namespacesMux.Unlock()
+
+	if ok {
+		namespace.Shutdown()
+	}
+	return ok
+}
+
+// namespaceOf returns the server of the namespace the call names in its metadata
+func (s *Server) namespaceOf(ctx context.Context) *Server {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return s
+	}
+	values := md.Get(s.options.NamespaceMetadataKey)
+	if len(values) == 0 {
+		return s
+	}
+	return s.Namespace(values[0])
+}
+
+// namespaceHandler serves the admin API of the namespace named by the request header of the same name as the
+// namespace metadata key, if any, and /emulator/v1/namespace, which deletes it
+func (s *Server) namespaceHandler(handler http.Handler) http.Handler {
+	if s.options.NamespaceMetadataKey == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := r.Header.Get(s.options.NamespaceMetadataKey); name != "" {
+			if r.URL.Path == "/emulator/v1/namespace" {
+				s.handleNamespace(w, r, name)
+				return
+			}
+			s.Namespace(name).AdminHandler().ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// handleNamespace deletes the namespace
+func (s *Server) handleNamespace(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !s.DeleteNamespace(name) {
+		writeError(w, http.StatusNotFound, "Namespace does not exist.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// namespaces serves the Cloud Tasks API, passing every call on to the server of its namespace
+type namespaces struct {
+	server *Server
+}
+
+func (n namespaces) ListQueues(ctx context.Context, in *tasks.ListQueuesRequest) (*tasks.ListQueuesResponse, error) {
+	return n.server.namespaceOf(ctx).ListQueues(ctx, in)
+}
+
+func (n namespaces) GetQueue(ctx context.Context, in *tasks.GetQueueRequest) (*tasks.Queue, error) {
+	return n.server.namespaceOf(ctx).GetQueue(ctx, in)
+}
+
+func (n namespaces) CreateQueue(ctx context.Context, in *tasks.CreateQueueRequest) (*tasks.Queue, error) {
+	return n.server.namespaceOf(ctx).CreateQueue(ctx, in)
+}
+
+func (n namespaces) UpdateQueue(ctx context.Context, in *tasks.UpdateQueueRequest) (*tasks.Queue, error) {
+	return n.server.namespaceOf(ctx).UpdateQueue(ctx, in)
+}
+
+func (n namespaces) DeleteQueue(ctx context.Context, in *tasks.DeleteQueueRequest) (*empty.Empty, error) {
+	return n.server.namespaceOf(ctx).DeleteQueue(ctx, in)
+}
+
+func (n namespaces) PurgeQueue(ctx context.Context, in *tasks.PurgeQueueRequest) (*tasks.Queue, error) {
+	return n.server.namespaceOf(ctx).PurgeQueue(ctx, in)
+}
+
+func (n namespaces) PauseQueue(ctx context.Context, in *tasks.PauseQueueRequest) (*tasks.Queue, error) {
+	return n.server.namespaceOf(ctx).PauseQueue(ctx, in)
+}
+
+func (n namespaces) ResumeQueue(ctx context.Context, in *tasks.ResumeQueueRequest) (*tasks.Queue, error) {
+	return n.server.namespaceOf(ctx).ResumeQueue(ctx, in)
+}
+
+func (n namespaces) GetIamPolicy(ctx context.Context, in *v1.GetIamPolicyRequest) (*v1.Policy, error) {
+	return n.server.namespaceOf(ctx).GetIamPolicy(ctx, in)
+}
+
+func (n namespaces) SetIamPolicy(ctx context.Context, in *v1.SetIamPolicyRequest) (*v1.Policy, error) {
+	return n.server.namespaceOf(ctx).SetIamPolicy(ctx, in)
+}
+
+func (n namespaces) TestIamPermissions(ctx context.Context, in *v1.TestIamPermissionsRequest) (*v1.TestIamPermissionsResponse, error) {
+	return n.server.namespaceOf(ctx).TestIamPermissions(ctx, in)
+}
+
+func (n namespaces) ListTasks(ctx context.Context, in *tasks.ListTasksRequest) (*tasks.ListTasksResponse, error) {
+	return n.server.namespaceOf(ctx).ListTasks(ctx, in)
+}
+
+func (n namespaces) GetTask(ctx context.Context, in *tasks.GetTaskRequest) (*tasks.Task, error) {
+	return n.server.namespaceOf(ctx).GetTask(ctx, in)
+}
+
+func (n namespaces) CreateTask(ctx context.Context, in *tasks.CreateTaskRequest) (*tasks.Task, error) {
+	return n.server.namespaceOf(ctx).CreateTask(ctx, in)
+}
+
+func (n namespaces) DeleteTask(ctx context.Context, in *tasks.DeleteTaskRequest) (*empty.Empty, error) {
+	return n.server.namespaceOf(ctx).DeleteTask(ctx, in)
+}
+
+func (n namespaces) RunTask(ctx context.Context, in *tasks.RunTaskRequest) (*tasks.Task, error) {
+	return n.server.namespaceOf(ctx).RunTask(ctx, in)
+}
@@ -0,0 +1,139 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "cloud.google.com/go/cloudtasks/apiv2"
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestNamespacesPartitionState(t *testing.T) {
+	server := NewServer(WithOptions(ServerOptions{NamespaceMetadataKey: "x-emulator-namespace"}))
+	grpcServer := server.NewGrpcServer()
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		server.Shutdown()
+	})
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	client, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+
+	suiteA := metadata.AppendToOutgoingContext(context.Background(), "x-emulator-namespace", "suite-a")
+	suiteB := metadata.AppendToOutgoingContext(context.Background(), "x-emulator-namespace", "suite-b")
+
+	// The same queue can be created in every namespace
+	queue := newQueue(formattedParent, "shared")
+	_, err = client.CreateQueue(suiteA, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+	_, err = client.CreateQueue(suiteB, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queue})
+	require.NoError(t, err)
+
+	_, err = client.CreateTask(suiteA, &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			Name:         queue.GetName() + "/tasks/only-in-a",
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/never"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = client.GetTask(suiteA, &taskspb.GetTaskRequest{Name: queue.GetName() + "/tasks/only-in-a"})
+	assert.NoError(t, err)
+	_, err = client.GetTask(suiteB, &taskspb.GetTaskRequest{Name: queue.GetName() + "/tasks/only-in-a"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Calls without a namespace see none of them
+	_, err = client.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Empty(t, server.ListQueuesSnapshot())
+	assert.Len(t, server.Namespace("suite-a").ListQueuesSnapshot(), 1)
+
+	// The admin API reads the namespace from the header of the same name
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+	settingsUrl := admin.URL + "/emulator/v1/" + queue.GetName() + "/settings"
+
+	req, err := http.NewRequest(http.MethodGet, settingsUrl, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Emulator-Namespace", "suite-b")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(settingsUrl)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeleteNamespace(t *testing.T) {
+	server := NewServer(WithOptions(ServerOptions{NamespaceMetadataKey: "x-emulator-namespace"}))
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	namespace := server.Namespace("suite-a")
+	queue, err := namespace.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "doomed")})
+	require.NoError(t, err)
+	_, err = namespace.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/hang"}},
+		},
+	})
+	require.NoError(t, err)
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	deleteNamespace := func(name string) int {
+		req, err := http.NewRequest(http.MethodDelete, admin.URL+"/emulator/v1/namespace", nil)
+		require.NoError(t, err)
+		if name != "" {
+			req.Header.Set("X-Emulator-Namespace", name)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNotFound, deleteNamespace(""))
+	assert.Equal(t, http.StatusNoContent, deleteNamespace("suite-a"))
+
+	// The server of the namespace is shut down, aborting its dispatches
+	assert.Eventually(t, func() bool {
+		return receivedRequest.Context().Err() != nil
+	}, time.Second, 10*time.Millisecond, "In-flight request should be cancelled")
+
+	// Gone, the namespace starts afresh on the next call naming it
+	assert.Equal(t, http.StatusNotFound, deleteNamespace("suite-a"))
+	assert.NotSame(t, namespace, server.Namespace("suite-a"))
+	assert.Empty(t, server.Namespace("suite-a").ListQueuesSnapshot())
+	_, err = server.Namespace("suite-a").CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "doomed")})
+	assert.NoError(t, err)
+}
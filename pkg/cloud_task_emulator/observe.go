@@ -0,0 +1,96 @@
+package cloud_task_emulator
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dispatchedRequestsBuffer is the number of dispatched requests a channel of DispatchedRequests holds
+const dispatchedRequestsBuffer = 1024
+
+// maxRecordedResponseBody is the largest part of a response body kept in a DispatchedRequest
+const maxRecordedResponseBody = 1 << 20
+
+// DispatchedRequest is a request the emulator sent to the target of a task, with the response it got
+type DispatchedRequest struct {
+	TaskName string
+
+	// Time is when the response, or the error, came in, Duration how long it took
+	Time     time.Time
+	Duration time.Duration
+
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+
+	// StatusCode is the status of the response, 0 if there was none, see Error
+	StatusCode int
+
+	// ResponseBody holds up to the first MB of the response body
+	ResponseBody []byte
+
+	// Error describes why the target did not respond, e.g. a connection error or a timeout
+	Error string
+}
+
+// observers holds the channels receiving the dispatched requests
+type observers struct {
+	channels []chan DispatchedRequest
+
+	mux sync.Mutex
+}
+
+// DispatchedRequests returns a channel receiving the requests dispatched from now on, to verify what the
+// emulator sent without running a target. The channel buffers up to 1024 requests, further requests are
+// dropped while it is full, so keep receiving. Every call returns a new channel.
+func (s *Server) DispatchedRequests() <-chan DispatchedRequest {
+	return s.dispatcher.observe()
+}
+
+func (d *dispatcher) observe() <-chan DispatchedRequest {
+	d.observers.mux.Lock()
+	defer d.observers.mux.Unlock()
+
+	channel := make(chan DispatchedRequest, dispatchedRequestsBuffer)
+	d.observers.channels = append(d.observers.channels, channel)
+	return channel
+}
+
+// observed reports whether the dispatched requests are to be recorded
+func (d *dispatcher) observed() bool {
+	d.observers.mux.Lock()
+	defer d.observers.mux.Unlock()
+	return len(d.observers.channels) > 0
+}
+
+// record sends the dispatched request to the observers. It reads the response body, which the caller still closes.
+func (d *dispatcher) record(taskName string, req *http.Request, body []byte, resp *http.Response, err error, duration time.Duration) {
+	dispatched := DispatchedRequest{
+		TaskName: taskName,
+		Time:     d.clock.Now(),
+		Duration: duration,
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Header:   req.Header.Clone(),
+		Body:     body,
+	}
+	if err != nil {
+		dispatched.Error = err.Error()
+	} else {
+		dispatched.StatusCode = resp.StatusCode
+		dispatched.ResponseBody, _ = io.ReadAll(io.LimitReader(resp.Body, maxRecordedResponseBody))
+	}
+
+	d.observers.mux.Lock()
+	defer d.observers.mux.Unlock()
+	for _, channel := range d.observers.channels {
+		select {
+		case channel <- dispatched:
+		default:
+			d.logger.Printf("Dropped the dispatch of %s, the channel of DispatchedRequests is full\n", taskName)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package cloud_task_emulator_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatchedRequests(t *testing.T) {
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/refused" {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusAccepted, Body: io.NopCloser(bytes.NewBufferString("accepted")), Request: req}, nil
+	})}
+	server := NewServer(WithHTTPClient(client))
+	t.Cleanup(server.Shutdown)
+	dispatched := server.DispatchedRequests()
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "observed"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	createdTasks := make(map[string]string)
+	for _, path := range []string{"/accepted", "/refused"} {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+					HttpMethod: taskspb.HttpMethod_POST,
+					Url:        "http://localhost:1" + path,
+					Body:       []byte("payload"),
+				}},
+			},
+		})
+		require.NoError(t, err)
+		createdTasks[task.GetName()] = path
+	}
+
+	received := make(map[string]DispatchedRequest)
+	for len(received) < len(createdTasks) {
+		select {
+		case request := <-dispatched:
+			received[createdTasks[request.TaskName]] = request
+		case <-time.After(time.Second):
+			t.Fatal("tasks were not dispatched")
+		}
+	}
+
+	accepted := received["/accepted"]
+	assert.Equal(t, http.MethodPost, accepted.Method)
+	assert.Equal(t, "http://localhost:1/accepted", accepted.URL)
+	assert.Equal(t, []string{"observed"}, accepted.Header["X-CloudTasks-QueueName"])
+	assert.Equal(t, []byte("payload"), accepted.Body)
+	assert.Equal(t, http.StatusAccepted, accepted.StatusCode)
+	assert.Equal(t, []byte("accepted"), accepted.ResponseBody)
+	assert.Empty(t, accepted.Error)
+
+	refused := received["/refused"]
+	assert.Equal(t, 0, refused.StatusCode)
+	assert.Contains(t, refused.Error, "connection refused")
+}
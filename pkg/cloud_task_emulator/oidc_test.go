@@ -0,0 +1,201 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	grpcCodes "google.golang.org/grpc/codes"
+)
+
+func getJSON(t *testing.T, url string, body interface{}) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(body))
+}
+
+func decodeSegment(t *testing.T, segment string, value interface{}) {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(decoded, value))
+}
+
+// verifyOIDCToken checks the token's signature the way a target would, with the keys the issuer
+// publishes, and returns its claims
+func verifyOIDCToken(t *testing.T, openIDUrl string, token string) map[string]interface{} {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JwksUri string `json:"jwks_uri"`
+	}
+	getJSON(t, openIDUrl+"/.well-known/openid-configuration", &discovery)
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	// The jwks_uri names the issuer, which the test server stands in for
+	getJSON(t, openIDUrl+strings.TrimPrefix(discovery.JwksUri, discovery.Issuer), &jwks)
+	require.Len(t, jwks.Keys, 1)
+
+	segments := strings.Split(token, ".")
+	require.Len(t, segments, 3)
+
+	var header map[string]string
+	decodeSegment(t, segments[0], &header)
+	assert.Equal(t, "RS256", header["alg"])
+	assert.Equal(t, jwks.Keys[0].Kid, header["kid"])
+
+	n, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+	require.NoError(t, err)
+	e, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].E)
+	require.NoError(t, err)
+	publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature))
+
+	var claims map[string]interface{}
+	decodeSegment(t, segments[1], &claims)
+	assert.Equal(t, discovery.Issuer, claims["iss"])
+	return claims
+}
+
+// dispatchOIDCTask dispatches a task with an OIDC token, returning the token along with the URLs of the
+// OpenID endpoints and of the target
+func dispatchOIDCTask(t *testing.T, options ServerOptions, oidcToken *taskspb.OidcToken) (string, string, string) {
+	openIDServer := NewServer(WithOptions(options))
+	openID := httptest.NewServer(openIDServer.OpenIDHandler())
+	t.Cleanup(openID.Close)
+
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	client := RunTWithOptions(t, options)
+
+	createdQueue := createTestQueue(t, client)
+
+	createTaskRequest := taskspb.CreateTaskRequest{
+		Parent: createdQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{
+				HttpRequest: &taskspb.HttpRequest{
+					Url:                 testServerUrl + "/success",
+					AuthorizationHeader: &taskspb.HttpRequest_OidcToken{OidcToken: oidcToken},
+				},
+			},
+		},
+	}
+	_, err := client.CreateTask(context.Background(), &createTaskRequest)
+	require.NoError(t, err)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	authorization := receivedRequest.Header.Get("Authorization")
+	require.True(t, strings.HasPrefix(authorization, "Bearer "), authorization)
+
+	return strings.TrimPrefix(authorization, "Bearer "), openID.URL, testServerUrl
+}
+
+func TestOIDCTokenVerifiesAgainstJWKS(t *testing.T) {
+	options := ServerOptions{
+		Dispatch: DispatchOptions{OpenIDIssuer: "http://localhost:8980"},
+	}
+	token, openIDUrl, testServerUrl := dispatchOIDCTask(t, options, &taskspb.OidcToken{ServiceAccountEmail: "emulator@test-project.iam.gserviceaccount.com"})
+
+	claims := verifyOIDCToken(t, openIDUrl, token)
+	assert.Equal(t, "http://localhost:8980", claims["iss"])
+	assert.Equal(t, testServerUrl+"/success", claims["aud"])
+	assert.Equal(t, "emulator@test-project.iam.gserviceaccount.com", claims["email"])
+	assert.Equal(t, true, claims["email_verified"])
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), claims["exp"], 5)
+}
+
+func TestOIDCTokenSignedWithConfiguredKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	signingKey, err := ParseOpenIDSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	require.NoError(t, err)
+
+	options := ServerOptions{
+		Dispatch: DispatchOptions{OpenIDIssuer: "https://gateway.example.com", OpenIDSigningKey: signingKey},
+	}
+	token, openIDUrl, _ := dispatchOIDCTask(t, options, &taskspb.OidcToken{ServiceAccountEmail: "emulator@test-project.iam.gserviceaccount.com"})
+
+	claims := verifyOIDCToken(t, openIDUrl, token)
+	assert.Equal(t, "https://gateway.example.com", claims["iss"])
+
+	// A gateway trusting the key up front verifies the token too
+	segments := strings.Split(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+}
+
+func TestParseOpenIDSigningKeyRejectsInvalidKeys(t *testing.T) {
+	_, err := ParseOpenIDSigningKey([]byte("not a key"))
+	assert.Error(t, err)
+
+	_, err = ParseOpenIDSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}))
+	assert.Error(t, err)
+}
+
+func TestOIDCTokenAudience(t *testing.T) {
+	token, openIDUrl, _ := dispatchOIDCTask(t, ServerOptions{}, &taskspb.OidcToken{
+		ServiceAccountEmail: "emulator@test-project.iam.gserviceaccount.com",
+		Audience:            "https://api.example.com",
+	})
+
+	claims := verifyOIDCToken(t, openIDUrl, token)
+	assert.Equal(t, DefaultOpenIDIssuer, claims["iss"])
+	assert.Equal(t, "https://api.example.com", claims["aud"])
+}
+
+func TestCreateTaskRejectsMalformedOIDCAudience(t *testing.T) {
+	client := RunT(t)
+
+	createdQueue := createTestQueue(t, client)
+
+	for _, audience := range []string{"https://api.example.com /tasks", "https://", "client\tid"} {
+		createTaskRequest := taskspb.CreateTaskRequest{
+			Parent: createdQueue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{
+					HttpRequest: &taskspb.HttpRequest{
+						Url: "http://localhost:9000/tasks",
+						AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
+							OidcToken: &taskspb.OidcToken{ServiceAccountEmail: "emulator@test-project.iam.gserviceaccount.com", Audience: audience},
+						},
+					},
+				},
+			},
+		}
+		_, err := client.CreateTask(context.Background(), &createTaskRequest)
+		assertIsGrpcError(t, "^Invalid OidcToken.audience", grpcCodes.InvalidArgument, err)
+	}
+}
@@ -0,0 +1,138 @@
+package cloud_task_emulator
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+)
+
+// Option configures a server created by NewServer
+type Option func(s *Server)
+
+// WithOptions replaces all the server options, e.g. as parsed from command line flags.
+// Options given after it refine the result.
+func WithOptions(options ServerOptions) Option {
+	return func(s *Server) {
+		s.options = options
+	}
+}
+
+// WithHardReset makes PurgeQueue remove the tasks synchronously and release their names, as the
+// development environment does, instead of purging asynchronously like production
+func WithHardReset(hardReset bool) Option {
+	return func(s *Server) {
+		s.options.HardResetOnPurgeQueue = hardReset
+	}
+}
+
+// WithClock makes the emulator tell the time with the clock instead of the system clock
+func WithClock(clock Clock) Option {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
+// WithHTTPClient dispatches tasks with the client, e.g. to record or stub the requests.
+// The Proxy, InsecureSkipVerify and RootCAs dispatch options do not apply to it, and the allowed and denied
+// hosts are checked before the dispatch, against the host names of the task URLs and the addresses they resolve
+// to, rather than as the client connects. Unless it has a CheckRedirect policy of its own, it does not follow
+// redirects.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Server) {
+		s.httpClient = client
+	}
+}
+
+// WithLogger makes the emulator log with the logger instead of the standard logger
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// Clock tells the time the emulator schedules and stamps tasks with
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// offsetClock tells the time of the clock it wraps moved by the offset, see ServerOptions.ClockOffset
+type offsetClock struct {
+	clock  Clock
+	offset time.Duration
+}
+
+func (c offsetClock) Now() time.Time {
+	return c.clock.Now().Add(c.offset)
+}
+
+// scaledClock runs scale times faster than the clock it wraps from the time it was created, see
+// ServerOptions.TimeScale
+type scaledClock struct {
+	clock Clock
+	start time.Time
+	scale float64
+}
+
+func newScaledClock(clock Clock, scale float64) scaledClock {
+	return scaledClock{clock: clock, start: time.Now(), scale: scale}
+}
+
+func (c scaledClock) Now() time.Time {
+	return c.clock.Now().Add(time.Duration(float64(time.Since(c.start)) * (c.scale - 1)))
+}
+
+// wallDuration returns how long to wait on the system clock for the duration to pass on the clock
+func wallDuration(clock Clock, d time.Duration) time.Duration {
+	if c, ok := clock.(scaledClock); ok {
+		return time.Duration(float64(d) / c.scale)
+	}
+	return d
+}
+
+// Now tells the time on the emulator's clock, which runs ahead of the system clock under a TimeScale
+func (s *Server) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Options returns a copy of the server options
+func (s *Server) Options() ServerOptions {
+	s.optionsMux.RLock()
+	defer s.optionsMux.RUnlock()
+	return s.options
+}
+
+// SetHardResetOnPurgeQueue changes whether PurgeQueue hard resets queues without their own setting,
+// see WithHardReset
+func (s *Server) SetHardResetOnPurgeQueue(hardReset bool) {
+	s.optionsMux.Lock()
+	defer s.optionsMux.Unlock()
+	s.options.HardResetOnPurgeQueue = hardReset
+}
+
+// SetQueueDefaults replaces the defaults applied to queues created or updated from now on
+func (s *Server) SetQueueDefaults(retryConfig *tasks.RetryConfig, rateLimits *tasks.RateLimits) {
+	s.optionsMux.Lock()
+	defer s.optionsMux.Unlock()
+	s.options.DefaultRetryConfig = retryConfig
+	s.options.DefaultRateLimits = rateLimits
+}
+
+func (s *Server) hardResetOnPurgeQueue() bool {
+	s.optionsMux.RLock()
+	defer s.optionsMux.RUnlock()
+	return s.options.HardResetOnPurgeQueue
+}
+
+func (s *Server) queueDefaults() (*tasks.RateLimits, *tasks.RetryConfig) {
+	s.optionsMux.RLock()
+	defer s.optionsMux.RUnlock()
+	return s.options.DefaultRateLimits, s.options.DefaultRetryConfig
+}
@@ -0,0 +1,247 @@
+package cloud_task_emulator_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// lockedBuffer is a buffer the emulator logs to while the test reads it
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mux sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func TestWithClockStampsTasks(t *testing.T) {
+	now := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC)
+	server := NewServer(WithClock(fixedClock(now)))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "clocked")})
+	require.NoError(t, err)
+	_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, now, task.GetCreateTime().AsTime())
+	assert.Equal(t, now, task.GetScheduleTime().AsTime())
+}
+
+func TestTimeScaleAcceleratesBackoffsAndSchedules(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	server := NewServer(WithOptions(ServerOptions{TimeScale: 36000}))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name: formatQueueName(formattedParent, "scaled"),
+			RetryConfig: &taskspb.RetryConfig{
+				MinBackoff: durationpb.New(time.Hour),
+				MaxBackoff: durationpb.New(time.Hour),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Due in an hour, which takes a tenth of a second
+	start := server.Now()
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(start.Add(time.Hour)),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/not_found"}},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.True(t, !server.Now().Before(start.Add(time.Hour)))
+
+	// Retried after an hour's backoff
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, "1", receivedRequest.Header.Get("X-CloudTasks-TaskRetryCount"))
+	assert.True(t, !server.Now().Before(start.Add(2*time.Hour)))
+}
+
+func TestClockOffsetSkewsTasks(t *testing.T) {
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	server := NewServer(WithOptions(ServerOptions{ClockOffset: 5 * time.Minute}))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "skewed")})
+	require.NoError(t, err)
+
+	// Due in a minute on the host's clock, which the emulator's clock is already past
+	before := time.Now()
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(before.Add(time.Minute)),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(5*time.Minute), task.GetCreateTime().AsTime(), time.Second)
+
+	receivedRequest, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(before.Add(time.Minute).Unix(), 10), strings.Split(receivedRequest.Header.Get("X-CloudTasks-TaskETA"), ".")[0])
+}
+
+func TestWithHTTPClientDispatches(t *testing.T) {
+	dispatched := make(chan *http.Request, 1)
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		dispatched <- req
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(nil)), Request: req}, nil
+	})}
+
+	var logs lockedBuffer
+	server := NewServer(WithHTTPClient(client), WithLogger(log.New(&logs, "", 0)))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "stubbed")})
+	require.NoError(t, err)
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/stubbed"}},
+		},
+	})
+	require.NoError(t, err)
+
+	select {
+	case req := <-dispatched:
+		assert.Equal(t, "/stubbed", req.URL.Path)
+	case <-time.After(time.Second):
+		t.Fatal("task was not dispatched through the client")
+	}
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "Task done")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTaskLogLinesCarryCorrelationID(t *testing.T) {
+	target := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(target.Close)
+	var logs lockedBuffer
+	server := NewServer(WithLogger(log.New(&logs, "", 0)))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name: formatQueueName(formattedParent, "correlated"),
+			RetryConfig: &taskspb.RetryConfig{
+				MaxAttempts: 2,
+				MinBackoff:  durationpb.New(10 * time.Millisecond),
+			},
+		},
+	})
+	require.NoError(t, err)
+	newTask := func() *taskspb.Task {
+		task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: target.URL + "/not_found"}},
+			},
+		})
+		require.NoError(t, err)
+		return task
+	}
+	task, other := newTask(), newTask()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+	require.NoError(t, server.WaitForTaskCompletion(ctx, other.GetName()))
+
+	// The lines about the task, from its creation to running out of attempts, share its ID
+	linePattern := regexp.MustCompile(`^\[([0-9a-f]{8})\] (.*)$`)
+	var correlationID, otherCorrelationID string
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		match := linePattern.FindStringSubmatch(line)
+		require.NotNil(t, match, line)
+		if strings.HasPrefix(match[2], "Created "+task.GetName()) {
+			correlationID = match[1]
+		} else if strings.HasPrefix(match[2], "Created "+other.GetName()) {
+			otherCorrelationID = match[1]
+		}
+		if match[1] == correlationID {
+			messages = append(messages, match[2])
+		}
+	}
+	require.NotEmpty(t, correlationID)
+	assert.NotEqual(t, correlationID, otherCorrelationID)
+	assert.Equal(t, []string{
+		"Created " + task.GetName() + ", due " + task.GetScheduleTime().AsTime().Format(time.RFC3339Nano),
+		"Dispatching " + task.GetName() + ", attempt 1",
+		"Task exec error with status 404",
+		"Dispatching " + task.GetName() + ", attempt 2",
+		"Task exec error with status 404",
+		"Ran out of attempts",
+	}, messages)
+}
+
+func TestSetHardResetOnPurgeQueue(t *testing.T) {
+	server := NewServer()
+	assert.False(t, server.Options().HardResetOnPurgeQueue)
+
+	server.SetHardResetOnPurgeQueue(true)
+	assert.True(t, server.Options().HardResetOnPurgeQueue)
+}
@@ -0,0 +1,391 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// The tables of the Postgres storage, with the state of the queues and tasks as JSONB
+const (
+	// postgresQueues holds a row per queue, with a NULL state once it is deleted and its name reserved
+	postgresQueues = "cloud_tasks_emulator_queues"
+
+	// postgresTasks holds a row per task
+	postgresTasks = "cloud_tasks_emulator_tasks"
+
+	// postgresTombstones holds a row per reserved task name, until it expires
+	postgresTombstones = "cloud_tasks_emulator_tombstones"
+)
+
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS ` + postgresQueues + ` (
+	name TEXT PRIMARY KEY,
+	state JSONB
+)`,
+	`CREATE TABLE IF NOT EXISTS ` + postgresTasks + ` (
+	name TEXT PRIMARY KEY,
+	state JSONB NOT NULL
+)`,
+	`CREATE TABLE IF NOT EXISTS ` + postgresTombstones + ` (
+	name TEXT PRIMARY KEY,
+	queue TEXT NOT NULL,
+	expire_time TIMESTAMPTZ NOT NULL
+)`,
+}
+
+// postgresStorage keeps the queues, tasks and reserved task names in the tables of a PostgreSQL database, each
+// write a statement or transaction of its own
+type postgresStorage struct {
+	db *sql.DB
+}
+
+// WithPostgresStorage keeps the state of the queues and tasks and the reserved task names in the
+// cloud_tasks_emulator_queues, cloud_tasks_emulator_tasks and cloud_tasks_emulator_tombstones tables of a
+// PostgreSQL database, the states as JSONB, so that they can be queried while the emulator runs and survive a
+// restart. The caller opens db with the driver of its choice, e.g. github.com/jackc/pgx/v5/stdlib, and calls
+// RecoverPostgres on startup, which creates the tables.
+func WithPostgresStorage(db *sql.DB) Option {
+	return WithStorage(&postgresStorage{db: db})
+}
+
+func (p *postgresStorage) GetQueue(queueName string) (*tasks.Queue, bool, error) {
+	var state sql.NullString
+	err := p.db.QueryRow(`SELECT state::text FROM `+postgresQueues+` WHERE name = $1`, queueName).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil || !state.Valid {
+		return nil, err == nil, err
+	}
+	queueState := &tasks.Queue{}
+	if err := protojson.Unmarshal([]byte(state.String), queueState); err != nil {
+		return nil, false, err
+	}
+	return queueState, true, nil
+}
+
+func (p *postgresStorage) PutQueue(queueState *tasks.Queue) error {
+	state, err := protojson.Marshal(queueState)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
+		`INSERT INTO `+postgresQueues+` (name, state) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET state = EXCLUDED.state`,
+		queueState.GetName(), string(state),
+	)
+	return err
+}
+
+func (p *postgresStorage) DeleteQueue(queueName string) error {
+	_, err := p.db.Exec(
+		`INSERT INTO `+postgresQueues+` (name, state) VALUES ($1, NULL) ON CONFLICT (name) DO UPDATE SET state = NULL`,
+		queueName,
+	)
+	return err
+}
+
+func (p *postgresStorage) ListQueues() (map[string]*tasks.Queue, error) {
+	rows, err := p.db.Query(`SELECT name, state::text FROM ` + postgresQueues)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queueStates := make(map[string]*tasks.Queue)
+	for rows.Next() {
+		var queueName string
+		var state sql.NullString
+		if err := rows.Scan(&queueName, &state); err != nil {
+			return nil, err
+		}
+		if !state.Valid {
+			queueStates[queueName] = nil
+			continue
+		}
+		queueState := &tasks.Queue{}
+		if err := protojson.Unmarshal([]byte(state.String), queueState); err != nil {
+			return nil, err
+		}
+		queueStates[queueName] = queueState
+	}
+	return queueStates, rows.Err()
+}
+
+func (p *postgresStorage) GetTask(taskName string) (*tasks.Task, bool, error) {
+	var state string
+	err := p.db.QueryRow(`SELECT state::text FROM `+postgresTasks+` WHERE name = $1`, taskName).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	taskState := &tasks.Task{}
+	if err := protojson.Unmarshal([]byte(state), taskState); err != nil {
+		return nil, false, err
+	}
+	return taskState, true, nil
+}
+
+func (p *postgresStorage) PutTask(taskState *tasks.Task) error {
+	state, err := protojson.Marshal(taskState)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(
+		`INSERT INTO `+postgresTasks+` (name, state) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET state = EXCLUDED.state`,
+		taskState.GetName(), string(state),
+	)
+	return err
+}
+
+func (p *postgresStorage) DeleteTask(taskName string) error {
+	_, err := p.db.Exec(`DELETE FROM `+postgresTasks+` WHERE name = $1`, taskName)
+	return err
+}
+
+func (p *postgresStorage) RemoveTask(taskName string, at time.Time, ttl time.Duration) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if err := tombstonePostgres(tx, taskName, at.Add(ttl)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM `+postgresTasks+` WHERE name = $1`, taskName)
+		return err
+	})
+}
+
+func (p *postgresStorage) ListTasks(prefix string) ([]*tasks.Task, error) {
+	return queryPostgresTasks(context.Background(), p.db, `SELECT state::text FROM `+postgresTasks+` WHERE starts_with(name, $1)`, prefix)
+}
+
+// postgresQuerier is a database or a transaction
+type postgresQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryPostgresTasks returns the task states the query selects
+func queryPostgresTasks(ctx context.Context, db postgresQuerier, query string, args ...interface{}) ([]*tasks.Task, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var taskStates []*tasks.Task
+	for rows.Next() {
+		var state string
+		if err := rows.Scan(&state); err != nil {
+			return nil, err
+		}
+		taskState := &tasks.Task{}
+		if err := protojson.Unmarshal([]byte(state), taskState); err != nil {
+			return nil, err
+		}
+		taskStates = append(taskStates, taskState)
+	}
+	return taskStates, rows.Err()
+}
+
+func (p *postgresStorage) Tombstone(taskName string, at time.Time, ttl time.Duration) error {
+	return tombstonePostgres(p.db, taskName, at.Add(ttl))
+}
+
+// postgresExecer is a database or a transaction
+type postgresExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// tombstonePostgres reserves the task name until the expire time
+func tombstonePostgres(db postgresExecer, taskName string, expireTime time.Time) error {
+	_, err := db.Exec(
+		`INSERT INTO `+postgresTombstones+` (name, queue, expire_time) VALUES ($1, $2, $3) ON CONFLICT (name) DO UPDATE SET queue = EXCLUDED.queue, expire_time = EXCLUDED.expire_time`,
+		taskName, queueNameOf(taskName), expireTime,
+	)
+	return err
+}
+
+func (p *postgresStorage) TaskNameTombstone(taskName string, now time.Time) (Tombstone, bool, error) {
+	var expireTime time.Time
+	err := p.db.QueryRow(
+		`SELECT expire_time FROM `+postgresTombstones+` WHERE name = $1 AND expire_time > $2`,
+		taskName, now,
+	).Scan(&expireTime)
+	if err == sql.ErrNoRows {
+		return Tombstone{}, false, nil
+	}
+	if err != nil {
+		return Tombstone{}, false, err
+	}
+	return Tombstone{Name: taskName, ExpireTime: expireTime}, true, nil
+}
+
+func (p *postgresStorage) ListTombstones(queueName string, now time.Time) ([]Tombstone, error) {
+	rows, err := p.db.Query(
+		`SELECT name, expire_time FROM `+postgresTombstones+` WHERE queue = $1 AND expire_time > $2 ORDER BY expire_time, name`,
+		queueName, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Tombstone{}
+	for rows.Next() {
+		var entry Tombstone
+		if err := rows.Scan(&entry.Name, &entry.ExpireTime); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (p *postgresStorage) CountTombstones(queueName string, now time.Time) (int, error) {
+	var count int
+	err := p.db.QueryRow(
+		`SELECT count(*) FROM `+postgresTombstones+` WHERE queue = $1 AND expire_time > $2`,
+		queueName, now,
+	).Scan(&count)
+	return count, err
+}
+
+func (p *postgresStorage) ReleaseTombstones(prefix string) error {
+	_, err := p.db.Exec(`DELETE FROM `+postgresTombstones+` WHERE starts_with(name, $1)`, prefix)
+	return err
+}
+
+func (p *postgresStorage) Forget(prefix string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		for _, table := range []string{postgresQueues, postgresTasks, postgresTombstones} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE starts_with(name, $1)`, prefix); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// inTx runs the statements of a write in a transaction, for them to apply together or not at all
+func (p *postgresStorage) inTx(write func(tx *sql.Tx) error) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := write(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecoverPostgres creates the tables of WithPostgresStorage if they don't exist and restores the queues, tasks
+// and reserved task names they hold, like RecoverWriteAheadLog. The tasks whose queue is gone and the expired
+// names are first deleted in a transaction; the rows left are then written again as the state is restored, each
+// in place, so that if the emulator stops in between they are restored on the next start. Unlike the other tasks,
+// which are created again, those that ran out of attempts are restored as they were, staying until deleted.
+func (s *Server) RecoverPostgres(ctx context.Context) error {
+	storage, ok := s.storage.(*postgresStorage)
+	if !ok {
+		return errors.New("the server has no Postgres storage, see WithPostgresStorage")
+	}
+
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range postgresSchema {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("could not create the Postgres tables: %v", err)
+		}
+	}
+	state, err := prunePostgres(ctx, tx, s.clock.Now(), s.taskNameTombstoneTTL())
+	if err != nil {
+		return fmt.Errorf("could not read the Postgres tables: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.restore(ctx, state)
+}
+
+// prunePostgres reads the state to restore from the tables, deleting the rows it leaves out. The names were
+// reserved for the TTL.
+func prunePostgres(ctx context.Context, tx *sql.Tx, now time.Time, ttl time.Duration) (*recoveredState, error) {
+	state := newRecoveredState()
+
+	rows, err := tx.QueryContext(ctx, `SELECT name, state::text FROM `+postgresQueues+` ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var queueName string
+		var queueJSON sql.NullString
+		if err := rows.Scan(&queueName, &queueJSON); err != nil {
+			return nil, err
+		}
+		var queueState *tasks.Queue
+		if queueJSON.Valid {
+			queueState = &tasks.Queue{}
+			if err := protojson.Unmarshal([]byte(queueJSON.String), queueState); err != nil {
+				return nil, fmt.Errorf("invalid state of queue %s: %v", queueName, err)
+			}
+		}
+		state.queues[queueName] = queueState
+		state.queueNames = append(state.queueNames, queueName)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	taskStates, err := queryPostgresTasks(ctx, tx, `SELECT state::text FROM `+postgresTasks)
+	if err != nil {
+		return nil, err
+	}
+	// The tasks are created again in the order they were first
+	sort.Slice(taskStates, func(i, j int) bool {
+		if !taskStates[i].GetCreateTime().AsTime().Equal(taskStates[j].GetCreateTime().AsTime()) {
+			return taskStates[i].GetCreateTime().AsTime().Before(taskStates[j].GetCreateTime().AsTime())
+		}
+		return taskStates[i].GetName() < taskStates[j].GetName()
+	})
+	for _, taskState := range taskStates {
+		taskName := taskState.GetName()
+		queueState := state.queues[queueNameOf(taskName)]
+		if queueState == nil {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+postgresTasks+` WHERE name = $1`, taskName); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		state.taskStates[taskName] = taskState
+		state.taskNames = append(state.taskNames, taskName)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM `+postgresTombstones+` WHERE expire_time <= $1`, now); err != nil {
+		return nil, err
+	}
+	tombstones, err := tx.QueryContext(ctx, `SELECT name, expire_time FROM `+postgresTombstones)
+	if err != nil {
+		return nil, err
+	}
+	defer tombstones.Close()
+	for tombstones.Next() {
+		var taskName string
+		var expireTime time.Time
+		if err := tombstones.Scan(&taskName, &expireTime); err != nil {
+			return nil, err
+		}
+		state.doneTimes[taskName] = expireTime.Add(-ttl)
+	}
+	return state, tombstones.Err()
+}
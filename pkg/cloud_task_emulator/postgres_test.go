@@ -0,0 +1,419 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakePostgres stands in for a database, understanding just the statements of the Postgres storage
+type fakePostgres struct {
+	mux        sync.Mutex
+	tables     map[string]bool
+	queues     map[string]driver.Value
+	tasks      map[string]driver.Value
+	tombstones map[string]fakeTombstone
+}
+
+type fakeTombstone struct {
+	queue      string
+	expireTime time.Time
+}
+
+var fakePostgresDatabases sync.Map
+
+var fakePostgresTable = regexp.MustCompile(`cloud_tasks_emulator_\w+`)
+
+func init() {
+	sql.Register("fakepostgres", fakePostgresDriver{})
+}
+
+// openFakePostgres opens a database of its own for the test
+func openFakePostgres(t *testing.T) (*sql.DB, *fakePostgres) {
+	database := &fakePostgres{
+		tables:     make(map[string]bool),
+		queues:     make(map[string]driver.Value),
+		tasks:      make(map[string]driver.Value),
+		tombstones: make(map[string]fakeTombstone),
+	}
+	fakePostgresDatabases.Store(t.Name(), database)
+	db, err := sql.Open("fakepostgres", t.Name())
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db, database
+}
+
+// rowCounts counts the rows of the queues, tasks and tombstones tables
+func (database *fakePostgres) rowCounts() (queues, tasks, tombstones int) {
+	database.mux.Lock()
+	defer database.mux.Unlock()
+	return len(database.queues), len(database.tasks), len(database.tombstones)
+}
+
+type fakePostgresDriver struct{}
+
+func (fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	database, ok := fakePostgresDatabases.Load(name)
+	if !ok {
+		return nil, errors.New("no database " + name)
+	}
+	return &fakePostgresConn{database: database.(*fakePostgres)}, nil
+}
+
+type fakePostgresConn struct {
+	database *fakePostgres
+}
+
+func (conn *fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakePostgresStmt{database: conn.database, query: strings.TrimSpace(query)}, nil
+}
+
+func (conn *fakePostgresConn) Close() error { return nil }
+
+func (conn *fakePostgresConn) Begin() (driver.Tx, error) { return fakePostgresTx{}, nil }
+
+type fakePostgresTx struct{}
+
+func (fakePostgresTx) Commit() error   { return nil }
+func (fakePostgresTx) Rollback() error { return nil }
+
+type fakePostgresStmt struct {
+	database *fakePostgres
+	query    string
+}
+
+func (stmt *fakePostgresStmt) Close() error  { return nil }
+func (stmt *fakePostgresStmt) NumInput() int { return -1 }
+
+func (stmt *fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	database := stmt.database
+	database.mux.Lock()
+	defer database.mux.Unlock()
+	table := fakePostgresTable.FindString(stmt.query)
+	if strings.HasPrefix(stmt.query, "CREATE TABLE IF NOT EXISTS ") {
+		database.tables[table] = true
+		return driver.RowsAffected(0), nil
+	}
+	if !database.tables[table] {
+		return nil, errors.New(`relation "` + table + `" does not exist`)
+	}
+	switch {
+	case strings.HasPrefix(stmt.query, "INSERT INTO cloud_tasks_emulator_queues (name, state) VALUES ($1, NULL)"):
+		database.queues[args[0].(string)] = nil
+	case strings.HasPrefix(stmt.query, "INSERT INTO cloud_tasks_emulator_queues (name, state) VALUES ($1, $2)"):
+		database.queues[args[0].(string)] = args[1]
+	case stmt.query == "DELETE FROM cloud_tasks_emulator_queues WHERE starts_with(name, $1)":
+		for name := range database.queues {
+			if strings.HasPrefix(name, args[0].(string)) {
+				delete(database.queues, name)
+			}
+		}
+	case strings.HasPrefix(stmt.query, "INSERT INTO cloud_tasks_emulator_tasks (name, state) VALUES ($1, $2)"):
+		database.tasks[args[0].(string)] = args[1]
+	case stmt.query == "DELETE FROM cloud_tasks_emulator_tasks WHERE name = $1":
+		delete(database.tasks, args[0].(string))
+	case stmt.query == "DELETE FROM cloud_tasks_emulator_tasks WHERE starts_with(name, $1)":
+		for name := range database.tasks {
+			if strings.HasPrefix(name, args[0].(string)) {
+				delete(database.tasks, name)
+			}
+		}
+	case strings.HasPrefix(stmt.query, "INSERT INTO cloud_tasks_emulator_tombstones (name, queue, expire_time) VALUES ($1, $2, $3)"):
+		database.tombstones[args[0].(string)] = fakeTombstone{queue: args[1].(string), expireTime: args[2].(time.Time)}
+	case stmt.query == "DELETE FROM cloud_tasks_emulator_tombstones WHERE starts_with(name, $1)":
+		for name := range database.tombstones {
+			if strings.HasPrefix(name, args[0].(string)) {
+				delete(database.tombstones, name)
+			}
+		}
+	case stmt.query == "DELETE FROM cloud_tasks_emulator_tombstones WHERE expire_time <= $1":
+		for name, tombstone := range database.tombstones {
+			if !tombstone.expireTime.After(args[0].(time.Time)) {
+				delete(database.tombstones, name)
+			}
+		}
+	default:
+		return nil, errors.New("unexpected statement " + stmt.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	database := stmt.database
+	database.mux.Lock()
+	defer database.mux.Unlock()
+	table := fakePostgresTable.FindString(stmt.query)
+	if !database.tables[table] {
+		return nil, errors.New(`relation "` + table + `" does not exist`)
+	}
+	rows := &fakePostgresRows{columns: []string{"value"}}
+	if strings.HasPrefix(stmt.query, "SELECT name, ") {
+		rows.columns = []string{"name", "value"}
+	}
+	switch {
+	case stmt.query == "SELECT state::text FROM cloud_tasks_emulator_queues WHERE name = $1":
+		if state, ok := database.queues[args[0].(string)]; ok {
+			rows.add(state)
+		}
+	case strings.HasPrefix(stmt.query, "SELECT name, state::text FROM cloud_tasks_emulator_queues"):
+		for name, state := range database.queues {
+			rows.add(name, state)
+		}
+	case stmt.query == "SELECT state::text FROM cloud_tasks_emulator_tasks WHERE name = $1":
+		if state, ok := database.tasks[args[0].(string)]; ok {
+			rows.add(state)
+		}
+	case stmt.query == "SELECT state::text FROM cloud_tasks_emulator_tasks WHERE starts_with(name, $1)":
+		for name, state := range database.tasks {
+			if strings.HasPrefix(name, args[0].(string)) {
+				rows.add(state)
+			}
+		}
+	case stmt.query == "SELECT state::text FROM cloud_tasks_emulator_tasks":
+		for _, state := range database.tasks {
+			rows.add(state)
+		}
+	case stmt.query == "SELECT expire_time FROM cloud_tasks_emulator_tombstones WHERE name = $1 AND expire_time > $2":
+		if tombstone, ok := database.tombstones[args[0].(string)]; ok && tombstone.expireTime.After(args[1].(time.Time)) {
+			rows.add(tombstone.expireTime)
+		}
+	case strings.HasPrefix(stmt.query, "SELECT name, expire_time FROM cloud_tasks_emulator_tombstones WHERE queue = $1 AND expire_time > $2"):
+		for name, tombstone := range database.tombstones {
+			if tombstone.queue == args[0].(string) && tombstone.expireTime.After(args[1].(time.Time)) {
+				rows.add(name, tombstone.expireTime)
+			}
+		}
+		sort.Slice(rows.rows, func(i, j int) bool { return rows.rows[i][1].(time.Time).Before(rows.rows[j][1].(time.Time)) })
+	case stmt.query == "SELECT count(*) FROM cloud_tasks_emulator_tombstones WHERE queue = $1 AND expire_time > $2":
+		count := int64(0)
+		for _, tombstone := range database.tombstones {
+			if tombstone.queue == args[0].(string) && tombstone.expireTime.After(args[1].(time.Time)) {
+				count++
+			}
+		}
+		rows.add(count)
+	case stmt.query == "SELECT name, expire_time FROM cloud_tasks_emulator_tombstones":
+		for name, tombstone := range database.tombstones {
+			rows.add(name, tombstone.expireTime)
+		}
+	default:
+		return nil, errors.New("unexpected query " + stmt.query)
+	}
+	return rows, nil
+}
+
+type fakePostgresRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (rows *fakePostgresRows) add(values ...driver.Value) {
+	rows.rows = append(rows.rows, values)
+}
+
+func (rows *fakePostgresRows) Columns() []string { return rows.columns }
+
+func (rows *fakePostgresRows) Close() error { return nil }
+
+func (rows *fakePostgresRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
+
+// openPostgres opens the database of CLOUD_TASKS_EMULATOR_POSTGRES_DSN with the driver named by
+// CLOUD_TASKS_EMULATOR_POSTGRES_DRIVER, pgx by default, emptying the tables of the storage. The test is skipped
+// unless the DSN is set and the driver registered, e.g. by a blank import of github.com/jackc/pgx/v5/stdlib.
+func openPostgres(t *testing.T) *sql.DB {
+	dsn := os.Getenv("CLOUD_TASKS_EMULATOR_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CLOUD_TASKS_EMULATOR_POSTGRES_DSN is not set")
+	}
+	driverName := os.Getenv("CLOUD_TASKS_EMULATOR_POSTGRES_DRIVER")
+	if driverName == "" {
+		driverName = "pgx"
+	}
+	registered := false
+	for _, name := range sql.Drivers() {
+		registered = registered || name == driverName
+	}
+	if !registered {
+		t.Skipf("the %s driver is not registered", driverName)
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	truncate := func() {
+		for _, table := range []string{"cloud_tasks_emulator_queues", "cloud_tasks_emulator_tasks", "cloud_tasks_emulator_tombstones"} {
+			_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (name TEXT PRIMARY KEY)`)
+			require.NoError(t, err)
+			_, err = db.Exec(`DROP TABLE ` + table)
+			require.NoError(t, err)
+		}
+	}
+	truncate()
+	t.Cleanup(truncate)
+	return db
+}
+
+// postgresRowCounts counts the rows of the queues, tasks and tombstones tables of a database
+func postgresRowCounts(t *testing.T, db *sql.DB) func() (queues, tasks, tombstones int) {
+	return func() (queues, tasks, tombstones int) {
+		counts := make([]int, 3)
+		for i, table := range []string{"cloud_tasks_emulator_queues", "cloud_tasks_emulator_tasks", "cloud_tasks_emulator_tombstones"} {
+			require.NoError(t, db.QueryRow(`SELECT count(*) FROM `+table).Scan(&counts[i]))
+		}
+		return counts[0], counts[1], counts[2]
+	}
+}
+
+func TestRecoverPostgres(t *testing.T) {
+	db, database := openFakePostgres(t)
+	testRecoverPostgres(t, db, database.rowCounts)
+}
+
+func TestRecoverPostgresWithDatabase(t *testing.T) {
+	db := openPostgres(t)
+	testRecoverPostgres(t, db, postgresRowCounts(t, db))
+}
+
+// testRecoverPostgres restores the queues, tasks and reserved names of the database after a crash
+func testRecoverPostgres(t *testing.T, db *sql.DB, rowCounts func() (queues, tasks, tombstones int)) {
+	testServerUrl, _ := startTestServer(t)
+
+	server := NewServer(WithPostgresStorage(db))
+	require.NoError(t, server.RecoverPostgres(context.Background()))
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "postgres")})
+	require.NoError(t, err)
+	_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			// Due after the test, so that it stays pending however quickly the pause takes effect
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	removed, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = server.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: removed.GetName()})
+	require.NoError(t, err)
+	// A target of its own, not to block on the requests of the other
+	failingTarget := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(failingTarget.Close)
+	failingQueueState := newQueue(formattedParent, "postgres-failing")
+	failingQueueState.RetryConfig = &taskspb.RetryConfig{MaxAttempts: 1}
+	failingQueue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: failingQueueState})
+	require.NoError(t, err)
+	failed, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: failingQueue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: failingTarget.URL + "/task"}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		failedState, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: failed.GetName()})
+		return err == nil && failedState.GetResponseCount() == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		queues, tasks, tombstones := rowCounts()
+		return queues == 2 && tasks == 2 && tombstones == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The crash
+	server.Shutdown()
+
+	recovered := NewServer(WithPostgresStorage(db))
+	t.Cleanup(recovered.Shutdown)
+	require.NoError(t, recovered.RecoverPostgres(context.Background()))
+
+	recoveredQueue, err := recovered.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	require.NoError(t, err)
+	assert.Equal(t, taskspb.Queue_PAUSED, recoveredQueue.GetState())
+	_, err = recovered.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: task.GetName()})
+	assert.NoError(t, err)
+	_, err = recovered.CreateTask(context.Background(), &taskspb.CreateTaskRequest{Parent: queue.GetName(), Task: &taskspb.Task{
+		Name:        removed.GetName(),
+		MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+	}})
+	assert.Error(t, err)
+
+	// The task that ran out of attempts stays as it was until deleted, the rest are written again in place
+	failedState, err := recovered.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: failed.GetName()})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, failedState.GetResponseCount())
+	queues, tasks, tombstones := rowCounts()
+	assert.Equal(t, 2, queues)
+	assert.Equal(t, 2, tasks)
+	assert.Equal(t, 1, tombstones)
+
+	_, err = recovered.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: failed.GetName()})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		queues, tasks, tombstones := rowCounts()
+		return queues == 2 && tasks == 1 && tombstones == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPostgresStorageFailure(t *testing.T) {
+	db, _ := openFakePostgres(t)
+
+	server := NewServer(WithPostgresStorage(db))
+	t.Cleanup(server.Shutdown)
+	require.NoError(t, server.RecoverPostgres(context.Background()))
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "postgres-down")})
+	require.NoError(t, err)
+
+	// The database goes away, which the calls report rather than pretending they stored anything
+	db.Close()
+	_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: queue.GetName()})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task:   &taskspb.Task{MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost/task"}}},
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "postgres-unstored")})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: formattedParent + "/queues/postgres-unstored"})
+	assert.Error(t, err)
+	_, err = server.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: queue.GetName()})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestRecoverPostgresWithoutPostgresStorage(t *testing.T) {
+	assert.Error(t, NewServer().RecoverPostgres(context.Background()))
+	assert.Error(t, NewServer(WithWriteAheadLog(io.Discard)).RecoverPostgres(context.Background()))
+}
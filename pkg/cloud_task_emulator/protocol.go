@@ -0,0 +1,83 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// DispatchProtocol is the HTTP version tasks are delivered with
+type DispatchProtocol string
+
+const (
+	// DispatchAuto sends HTTP/1.1 to http:// targets, and HTTP/2 to https:// targets that offer it
+	DispatchAuto DispatchProtocol = ""
+
+	// DispatchHTTP1 always sends HTTP/1.1
+	DispatchHTTP1 DispatchProtocol = "http1"
+
+	// DispatchHTTP2 always sends HTTP/2: h2c, with prior knowledge, to http:// targets and h2 to https://
+	// targets, failing the dispatches to targets that don't speak it
+	DispatchHTTP2 DispatchProtocol = "http2"
+)
+
+// ParseDispatchProtocol parses "auto", "http1" or "http2"
+func ParseDispatchProtocol(value string) (DispatchProtocol, error) {
+	switch value {
+	case "", "auto":
+		return DispatchAuto, nil
+	case "http1":
+		return DispatchHTTP1, nil
+	case "http2":
+		return DispatchHTTP2, nil
+	default:
+		return DispatchAuto, fmt.Errorf("invalid dispatch protocol %q, expected auto, http1 or http2", value)
+	}
+}
+
+// http2RoundTripper sends h2c to http:// targets and h2 to https:// targets
+type http2RoundTripper struct {
+	h2c *http2.Transport
+	h2  *http2.Transport
+}
+
+func newHTTP2RoundTripper(transport *http.Transport) *http2RoundTripper {
+	tlsConfig := transport.TLSClientConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return &http2RoundTripper{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return transport.DialContext(ctx, network, addr)
+			},
+		},
+		h2: &http2.Transport{
+			TLSClientConfig: tlsConfig.Clone(),
+			DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+				conn, err := transport.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, config)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		},
+	}
+}
+
+func (rt *http2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return rt.h2c.RoundTrip(req)
+	}
+	return rt.h2.RoundTrip(req)
+}
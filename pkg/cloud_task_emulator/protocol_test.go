@@ -0,0 +1,62 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// dispatchProto returns the protocol a task is dispatched to the server with
+func dispatchProto(t *testing.T, protocol DispatchProtocol, server *httptest.Server, protos <-chan string) string {
+	emulator := NewServer(WithOptions(ServerOptions{Dispatch: DispatchOptions{Protocol: protocol, InsecureSkipVerify: true}}))
+	t.Cleanup(emulator.Shutdown)
+
+	queue, err := emulator.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "protocol")})
+	require.NoError(t, err)
+	_, err = emulator.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: server.URL + "/task"}},
+		},
+	})
+	require.NoError(t, err)
+	return <-protos
+}
+
+func TestDispatchProtocol(t *testing.T) {
+	protos := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto
+	})
+
+	cleartext := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(cleartext.Close)
+	tls := httptest.NewUnstartedServer(handler)
+	tls.EnableHTTP2 = true
+	tls.StartTLS()
+	t.Cleanup(tls.Close)
+
+	assert.Equal(t, "HTTP/1.1", dispatchProto(t, DispatchAuto, cleartext, protos))
+	assert.Equal(t, "HTTP/2.0", dispatchProto(t, DispatchAuto, tls, protos))
+	assert.Equal(t, "HTTP/1.1", dispatchProto(t, DispatchHTTP1, tls, protos))
+	assert.Equal(t, "HTTP/2.0", dispatchProto(t, DispatchHTTP2, cleartext, protos))
+	assert.Equal(t, "HTTP/2.0", dispatchProto(t, DispatchHTTP2, tls, protos))
+}
+
+func TestParseDispatchProtocol(t *testing.T) {
+	for value, expected := range map[string]DispatchProtocol{"": DispatchAuto, "auto": DispatchAuto, "http1": DispatchHTTP1, "http2": DispatchHTTP2} {
+		protocol, err := ParseDispatchProtocol(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, protocol)
+	}
+	_, err := ParseDispatchProtocol("spdy")
+	assert.Error(t, err)
+}
@@ -1,7 +1,9 @@
 package cloud_task_emulator
 
 import (
-	"log"
+	"context"
+	"math"
+	"net/http"
 	"sync"
 	"time"
 
@@ -9,15 +11,64 @@ import (
 	pduration "github.com/golang/protobuf/ptypes/duration"
 
 	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"golang.org/x/time/rate"
 )
 
+// QueueSettings holds the emulator-only settings of a queue
+type QueueSettings struct {
+	// HardResetOnPurge overrides ServerOptions.HardResetOnPurgeQueue for the queue when set
+	HardResetOnPurge *bool `json:"hardResetOnPurge"`
+
+	// HttpTarget applies to the HTTP tasks of the queue, as the queue-level HTTP target of newer API versions
+	HttpTarget *HttpTarget `json:"httpTarget,omitempty"`
+}
+
+// ForcedFailures fails the next dispatches of a queue without sending them, to drive tasks into their retry path
+type ForcedFailures struct {
+	// Count is the number of dispatches left to fail
+	Count int `json:"count"`
+
+	// Status is the HTTP status code the dispatches fail with, 500 if unset
+	Status int `json:"status,omitempty"`
+}
+
+// RampUp paces a queue that resumes with a backlog the way production recommends ramping up traffic, the
+// "500/50/5" pattern: start at 500 dispatches per second and grow by 50% every 5 minutes
+type RampUp struct {
+	// InitialRate is the dispatch rate per second when the queue resumes, the ramp-up is off if 0
+	InitialRate float64
+
+	// Growth is the factor the rate grows by every Interval, 1.5 if unset
+	Growth float64
+
+	// Interval is how long each rate lasts, 5 minutes if unset
+	Interval time.Duration
+}
+
+// rate returns the dispatch rate the ramp-up allows the given time after resuming
+func (rampUp RampUp) rate(elapsed time.Duration) float64 {
+	growth := rampUp.Growth
+	if growth <= 1 {
+		growth = 1.5
+	}
+	interval := rampUp.Interval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	return rampUp.InitialRate * math.Pow(growth, float64(elapsed/interval))
+}
+
 // Queue holds all internals for a task queue
 type Queue struct {
 	name string
 
 	state *tasks.Queue
 
-	fire chan *Task
+	// stateMux guards the queue state, which UpdateQueue changes while the queue runs
+	stateMux sync.Mutex
+
+	// ready holds the due tasks until the dispatcher takes them
+	ready *readyQueue
 
 	work chan *Task
 
@@ -25,99 +76,309 @@ type Queue struct {
 
 	tsMux sync.Mutex
 
-	tokenBucket chan bool
+	// limiter paces the dispatches by the max dispatches per second and max burst size of the queue.
+	// It starts full, allowing a burst straight away.
+	limiter *rate.Limiter
 
-	maxDispatchesPerSecond float64
-
-	cancelTokenGenerator chan bool
+	// rateChanged tells the dispatcher to pick up new rate limits
+	rateChanged chan bool
 
 	cancelDispatcher chan bool
 
 	cancelWorkers chan bool
 
+	// retireWorkers wakes idle workers to check whether there are more of them than the queue allows
+	retireWorkers chan bool
+
+	// workers counts the running workers, guarded by stateMux
+	workers int
+
+	// resumedAt is when the queue last resumed while ramping up, zero otherwise. It is guarded by stateMux.
+	resumedAt time.Time
+
+	// ctx is cancelled when the queue is deleted or the server shuts down, aborting in-flight dispatches
+	ctx context.Context
+
+	cancelDispatches context.CancelFunc
+
 	cancelled bool
 
 	paused bool
 
+	settings QueueSettings
+
+	forcedFailures ForcedFailures
+
+	settingsMux sync.Mutex
+
+	stats *queueStats
+
+	// dispatcher is shared with the server and delivers the tasks of all queues
+	dispatcher *dispatcher
+
 	onTaskDone func(task *Task)
+
+	// taskIDs generates the IDs of the tasks created without a name, nil for production's random IDs
+	taskIDs func() string
 }
 
-// NewQueue creates a new task queue
-func NewQueue(name string, state *tasks.Queue, onTaskDone func(task *Task)) (*Queue, *tasks.Queue) {
+// NewQueue creates a new task queue, which stops along with the context
+func NewQueue(ctx context.Context, name string, state *tasks.Queue, dispatcher *dispatcher, onTaskDone func(task *Task)) (*Queue, *tasks.Queue) {
 	setInitialQueueState(state)
 
+	ctx, cancelDispatches := context.WithCancel(ctx)
+
 	queue := &Queue{
-		name:                   name,
-		state:                  state,
-		fire:                   make(chan *Task),
-		work:                   make(chan *Task),
-		ts:                     make(map[string]*Task),
-		onTaskDone:             onTaskDone,
-		tokenBucket:            make(chan bool, state.GetRateLimits().GetMaxBurstSize()),
-		maxDispatchesPerSecond: state.GetRateLimits().GetMaxDispatchesPerSecond(),
-		cancelTokenGenerator:   make(chan bool, 1),
-		cancelDispatcher:       make(chan bool, 1),
-		cancelWorkers:          make(chan bool, 1),
-	}
-	// Fill the token bucket
-	for i := 0; i < int(state.GetRateLimits().GetMaxBurstSize()); i++ {
-		queue.tokenBucket <- true
+		name:             name,
+		state:            state,
+		ready:            newReadyQueue(),
+		work:             make(chan *Task),
+		ts:               make(map[string]*Task),
+		dispatcher:       dispatcher,
+		onTaskDone:       onTaskDone,
+		limiter:          rate.NewLimiter(rate.Limit(state.GetRateLimits().GetMaxDispatchesPerSecond()), int(state.GetRateLimits().GetMaxBurstSize())),
+		rateChanged:      make(chan bool, 1),
+		cancelDispatcher: make(chan bool, 1),
+		cancelWorkers:    make(chan bool, 1),
+		retireWorkers:    make(chan bool, 1),
+		ctx:              ctx,
+		cancelDispatches: cancelDispatches,
+		stats:            newQueueStats(),
 	}
 
 	return queue, state
 }
 
+// snapshot returns a copy of the queue state that is safe to hand out
+func (queue *Queue) snapshot() *tasks.Queue {
+	queue.stateMux.Lock()
+	defer queue.stateMux.Unlock()
+	return proto.Clone(queue.state).(*tasks.Queue)
+}
+
+// retryConfig returns the current retry config of the queue. Updates replace it rather than modify it.
+func (queue *Queue) retryConfig() *tasks.RetryConfig {
+	queue.stateMux.Lock()
+	defer queue.stateMux.Unlock()
+	return queue.state.GetRetryConfig()
+}
+
+// dispatchRate returns how many tasks per second the queue may dispatch at the moment
+func (queue *Queue) dispatchRate() rate.Limit {
+	queue.stateMux.Lock()
+	defer queue.stateMux.Unlock()
+
+	dispatchesPerSecond := queue.state.GetRateLimits().GetMaxDispatchesPerSecond()
+	if !queue.resumedAt.IsZero() {
+		rampUpRate := queue.dispatcher.options.ResumeRampUp.rate(time.Since(queue.resumedAt))
+		if rampUpRate < dispatchesPerSecond {
+			dispatchesPerSecond = rampUpRate
+		} else {
+			// Ramped up to the full rate
+			queue.resumedAt = time.Time{}
+		}
+	}
+	return rate.Limit(dispatchesPerSecond)
+}
+
+// Update replaces the rate limits and retry config of the queue. As in production the changes apply to the
+// tasks already in the queue: the dispatch rate and concurrency change straight away and pending retries are
+// rescheduled with the new backoff.
+func (queue *Queue) Update(rateLimits *tasks.RateLimits, retryConfig *tasks.RetryConfig) {
+	queue.stateMux.Lock()
+	queue.state.RateLimits = rateLimits
+	queue.state.RetryConfig = retryConfig
+	queue.stateMux.Unlock()
+
+	select {
+	case queue.rateChanged <- true:
+	default:
+	}
+	queue.resizeWorkers()
+
+	queue.tsMux.Lock()
+	defer queue.tsMux.Unlock()
+	for _, task := range queue.ts {
+		task.reevaluateBackoff()
+	}
+}
+
 func (queue *Queue) setTask(taskName string, task *Task) {
 	queue.tsMux.Lock()
 	defer queue.tsMux.Unlock()
 	queue.ts[taskName] = task
 }
 
-func (queue *Queue) removeTask(taskName string) {
-	queue.setTask(taskName, nil)
+// Settings returns the emulator-only settings of the queue
+func (queue *Queue) Settings() QueueSettings {
+	queue.settingsMux.Lock()
+	defer queue.settingsMux.Unlock()
+	return queue.settings
 }
 
-func setInitialQueueState(queueState *tasks.Queue) {
-	if queueState.GetRateLimits() == nil {
-		queueState.RateLimits = &tasks.RateLimits{}
-	}
-	if queueState.GetRateLimits().GetMaxDispatchesPerSecond() == 0 {
-		queueState.RateLimits.MaxDispatchesPerSecond = 500.0
-	}
-	if queueState.GetRateLimits().GetMaxBurstSize() == 0 {
-		queueState.RateLimits.MaxBurstSize = 100
+// SetSettings replaces the emulator-only settings of the queue
+func (queue *Queue) SetSettings(settings QueueSettings) {
+	queue.settingsMux.Lock()
+	defer queue.settingsMux.Unlock()
+	queue.settings = settings
+}
+
+// ForcedFailures returns the dispatches of the queue left to fail
+func (queue *Queue) ForcedFailures() ForcedFailures {
+	queue.settingsMux.Lock()
+	defer queue.settingsMux.Unlock()
+	return queue.forcedFailures
+}
+
+// Stats returns the dispatch statistics of the queue
+func (queue *Queue) Stats() QueueStats {
+	return queue.stats.snapshot()
+}
+
+// FailNextDispatches fails the next dispatches of the queue as given, replacing any failures left
+func (queue *Queue) FailNextDispatches(failures ForcedFailures) {
+	queue.settingsMux.Lock()
+	defer queue.settingsMux.Unlock()
+	queue.forcedFailures = failures
+}
+
+// takeForcedFailure returns the status a dispatch is forced to fail with, reporting false if it goes ahead
+func (queue *Queue) takeForcedFailure() (int, bool) {
+	queue.settingsMux.Lock()
+	defer queue.settingsMux.Unlock()
+
+	if queue.forcedFailures.Count <= 0 {
+		return 0, false
 	}
-	if queueState.GetRateLimits().GetMaxConcurrentDispatches() == 0 {
-		queueState.RateLimits.MaxConcurrentDispatches = 1000
+	queue.forcedFailures.Count--
+	if queue.forcedFailures.Status == 0 {
+		return http.StatusInternalServerError, true
 	}
+	return queue.forcedFailures.Status, true
+}
+
+func (queue *Queue) removeTask(taskName string) {
+	queue.tsMux.Lock()
+	defer queue.tsMux.Unlock()
+	delete(queue.ts, taskName)
+}
 
-	if queueState.GetRetryConfig() == nil {
-		queueState.RetryConfig = &tasks.RetryConfig{}
+// applyQueueDefaults fills the rate limits and retry config fields the queue leaves unset from the given defaults
+func applyQueueDefaults(queueState *tasks.Queue, rateLimits *tasks.RateLimits, retryConfig *tasks.RetryConfig) {
+	if rateLimits != nil {
+		if queueState.GetRateLimits() == nil {
+			queueState.RateLimits = &tasks.RateLimits{}
+		}
+		if queueState.GetRateLimits().GetMaxDispatchesPerSecond() == 0 {
+			queueState.RateLimits.MaxDispatchesPerSecond = rateLimits.GetMaxDispatchesPerSecond()
+		}
+		if queueState.GetRateLimits().GetMaxBurstSize() == 0 {
+			queueState.RateLimits.MaxBurstSize = rateLimits.GetMaxBurstSize()
+		}
+		if queueState.GetRateLimits().GetMaxConcurrentDispatches() == 0 {
+			queueState.RateLimits.MaxConcurrentDispatches = rateLimits.GetMaxConcurrentDispatches()
+		}
 	}
-	if queueState.GetRetryConfig().GetMaxAttempts() == 0 {
-		queueState.RetryConfig.MaxAttempts = 100
+
+	if retryConfig != nil {
+		if queueState.GetRetryConfig() == nil {
+			queueState.RetryConfig = &tasks.RetryConfig{}
+		}
+		if queueState.GetRetryConfig().GetMaxAttempts() == 0 {
+			queueState.RetryConfig.MaxAttempts = retryConfig.GetMaxAttempts()
+		}
+		if queueState.GetRetryConfig().GetMaxRetryDuration() == nil && retryConfig.GetMaxRetryDuration() != nil {
+			queueState.RetryConfig.MaxRetryDuration = proto.Clone(retryConfig.GetMaxRetryDuration()).(*pduration.Duration)
+		}
+		if queueState.GetRetryConfig().GetMaxDoublings() == 0 {
+			queueState.RetryConfig.MaxDoublings = retryConfig.GetMaxDoublings()
+		}
+		if queueState.GetRetryConfig().GetMinBackoff() == nil && retryConfig.GetMinBackoff() != nil {
+			queueState.RetryConfig.MinBackoff = proto.Clone(retryConfig.GetMinBackoff()).(*pduration.Duration)
+		}
+		if queueState.GetRetryConfig().GetMaxBackoff() == nil && retryConfig.GetMaxBackoff() != nil {
+			queueState.RetryConfig.MaxBackoff = proto.Clone(retryConfig.GetMaxBackoff()).(*pduration.Duration)
+		}
 	}
-	if queueState.GetRetryConfig().GetMaxDoublings() == 0 {
-		queueState.RetryConfig.MaxDoublings = 16
+}
+
+// productionRateLimits are the rate limits production applies to queues created without them
+func productionRateLimits() *tasks.RateLimits {
+	return &tasks.RateLimits{
+		MaxDispatchesPerSecond:  500.0,
+		MaxBurstSize:            100,
+		MaxConcurrentDispatches: 1000,
 	}
-	if queueState.GetRetryConfig().GetMinBackoff() == nil {
-		queueState.RetryConfig.MinBackoff = &pduration.Duration{
+}
+
+// productionRetryConfig is the retry config production applies to queues created without one
+func productionRetryConfig() *tasks.RetryConfig {
+	return &tasks.RetryConfig{
+		MaxAttempts:  100,
+		MaxDoublings: 16,
+		MinBackoff: &pduration.Duration{
 			Nanos: 100000000,
-		}
-	}
-	if queueState.GetRetryConfig().GetMaxBackoff() == nil {
-		queueState.RetryConfig.MaxBackoff = &pduration.Duration{
+		},
+		MaxBackoff: &pduration.Duration{
 			Seconds: 3600,
-		}
+		},
 	}
+}
+
+func setInitialQueueState(queueState *tasks.Queue) {
+	applyQueueDefaults(queueState, productionRateLimits(), productionRetryConfig())
 
 	queueState.State = tasks.Queue_RUNNING
 }
 
 func (queue *Queue) runWorkers() {
-	for i := 0; i < int(queue.state.GetRateLimits().GetMaxConcurrentDispatches()); i++ {
+	queue.resizeWorkers()
+}
+
+// resizeWorkers starts or retires workers to match the max concurrent dispatches of the queue
+func (queue *Queue) resizeWorkers() {
+	queue.stateMux.Lock()
+	defer queue.stateMux.Unlock()
+
+	maxConcurrent := queue.maxWorkers()
+	for ; queue.workers < maxConcurrent; queue.workers++ {
 		go queue.runWorker()
 	}
+	if queue.workers > maxConcurrent {
+		queue.nudgeWorkers()
+	}
+}
+
+// maxWorkers returns the size of the worker pool: the max concurrent dispatches of the queue, within the cap
+// of the dispatch options. The caller holds stateMux.
+func (queue *Queue) maxWorkers() int {
+	maxConcurrent := int(queue.state.GetRateLimits().GetMaxConcurrentDispatches())
+	if maxPerQueue := queue.dispatcher.options.MaxConcurrentDispatchesPerQueue; maxPerQueue > 0 && maxPerQueue < maxConcurrent {
+		return maxPerQueue
+	}
+	return maxConcurrent
+}
+
+// nudgeWorkers wakes an idle worker to check whether it should retire
+func (queue *Queue) nudgeWorkers() {
+	select {
+	case queue.retireWorkers <- true:
+	default:
+	}
+}
+
+// retireWorker reports whether the calling worker is surplus to the max concurrent dispatches and should exit
+func (queue *Queue) retireWorker() bool {
+	queue.stateMux.Lock()
+	defer queue.stateMux.Unlock()
+
+	if queue.workers <= queue.maxWorkers() {
+		return false
+	}
+	queue.workers--
+	// Pass it on in case there are more surplus workers
+	queue.nudgeWorkers()
+	return true
 }
 
 func (queue *Queue) runWorker() {
@@ -125,7 +386,19 @@ func (queue *Queue) runWorker() {
 		select {
 		case task := <-queue.work:
 			task.Attempt()
+			if queue.retireWorker() {
+				return
+			}
+		case <-queue.retireWorkers:
+			if queue.retireWorker() {
+				return
+			}
+		case <-queue.ctx.Done():
+			return
 		case <-queue.cancelWorkers:
+			queue.stateMux.Lock()
+			queue.workers--
+			queue.stateMux.Unlock()
 			// Forward for next worker
 			queue.cancelWorkers <- true
 			return
@@ -133,83 +406,140 @@ func (queue *Queue) runWorker() {
 	}
 }
 
-func (queue *Queue) runTokenGenerator() {
-	period := time.Second / time.Duration(queue.maxDispatchesPerSecond)
-	// Use Timer with Reset() in place of time.Ticker as the latter was causing high CPU usage in Docker
-	t := time.NewTimer(period)
-
+// awaitToken waits until the limiter lets the queue dispatch a task, reporting false if the dispatcher stops
+func (queue *Queue) awaitToken() bool {
 	for {
+		// The rate changes as the queue ramps up
+		if dispatchRate := queue.dispatchRate(); dispatchRate != queue.limiter.Limit() {
+			queue.limiter.SetLimit(dispatchRate)
+		}
+
+		reservation := queue.limiter.Reserve()
+		timer := time.NewTimer(reservation.Delay())
 		select {
-		case <-t.C:
-			select {
-			case queue.tokenBucket <- true:
-				// Added token
-				t.Reset(period)
-			case <-queue.cancelTokenGenerator:
-				return
-			}
-		case <-queue.cancelTokenGenerator:
-			if !t.Stop() {
-				<-t.C
-			}
-			return
+		case <-timer.C:
+			return true
+		case <-queue.rateChanged:
+			// Wait again, at the new rate
+			timer.Stop()
+			reservation.Cancel()
+		case <-queue.cancelDispatcher:
+			timer.Stop()
+			reservation.Cancel()
+			return false
+		case <-queue.ctx.Done():
+			timer.Stop()
+			return false
 		}
 	}
 }
 
 func (queue *Queue) runDispatcher() {
-	for {
-		select {
-		// Consume a token
-		case <-queue.tokenBucket:
+	for queue.awaitToken() {
+		// Wait for task
+		task := queue.ready.pop()
+		for task == nil {
 			select {
-			// Wait for task
-			case task := <-queue.fire:
-				// Pass on to workers
-				queue.work <- task
+			case <-queue.ready.signal:
+				task = queue.ready.pop()
 			case <-queue.cancelDispatcher:
 				return
+			case <-queue.ctx.Done():
+				return
 			}
+		}
+		// Pass on to workers
+		select {
+		case queue.work <- task:
 		case <-queue.cancelDispatcher:
+			// Hand the task back, it is due again once the queue resumes
+			task.Schedule()
+			return
+		case <-queue.ctx.Done():
 			return
 		}
 	}
 }
 
-// Run starts the queue (workers, token generator and dispatcher)
+// Run starts the queue (workers and dispatcher)
 func (queue *Queue) Run() {
 	go queue.runWorkers()
-	go queue.runTokenGenerator()
 	go queue.runDispatcher()
 }
 
-// NewTask creates a new task on the queue
-func (queue *Queue) NewTask(newTaskState *tasks.Task) (*Task, *tasks.Task) {
-	task := NewTask(queue, newTaskState, func(task *Task) {
-		queue.removeTask(task.state.GetName())
-		queue.onTaskDone(task)
-	})
+// NewTask creates a new task on the queue, failing if the storage does
+func (queue *Queue) NewTask(newTaskState *tasks.Task) (*Task, *tasks.Task, error) {
+	return queue.newTask(newTaskState, newTraceContext())
+}
+
+// newTask creates and schedules a task dispatched in the trace
+func (queue *Queue) newTask(newTaskState *tasks.Task, trace traceContext) (*Task, *tasks.Task, error) {
+	task := NewTask(queue, newTaskState, queue.finishTask)
+	task.trace = trace
 
 	taskState := proto.Clone(task.state).(*tasks.Task)
+	task.compact()
+	// Stored before it is scheduled, which changes its state
+	if err := queue.dispatcher.storage.PutTask(proto.Clone(taskState).(*tasks.Task)); err != nil {
+		return nil, nil, err
+	}
 
 	queue.setTask(taskState.GetName(), task)
+	// Logged before the task can complete
+	queue.dispatcher.wal.taskCreated(taskState)
+	task.logger().Printf("Created %s, due %s\n", taskState.GetName(), taskState.GetScheduleTime().AsTime().Format(time.RFC3339Nano))
 
 	task.Schedule()
 
-	return task, taskState
+	return task, taskState, nil
 }
 
-// Delete stops, purges and removes the queue
-func (queue *Queue) Delete() {
-	if !queue.cancelled {
-		queue.cancelled = true
-		log.Println("Stopping queue")
-		queue.cancelTokenGenerator <- true
-		queue.cancelDispatcher <- true
-		queue.cancelWorkers <- true
+// restoreExhaustedTask adds a task that ran out of attempts before the server restarted, as it was stored,
+// without scheduling it
+func (queue *Queue) restoreExhaustedTask(taskState *tasks.Task) *Task {
+	task := restoredTask(queue, taskState, queue.finishTask)
+	task.compact()
+	queue.setTask(taskState.GetName(), task)
+	return task
+}
+
+// finishTask forgets the task once it is done, for the server to remove it
+func (queue *Queue) finishTask(task *Task) {
+	queue.removeTask(task.state.GetName())
+	queue.onTaskDone(task)
+}
+
+// Delete stops the queue and cancels all of its tasks, including in-flight dispatches and pending retries.
+// It returns the cancelled tasks, which are no longer tracked by the queue.
+func (queue *Queue) Delete() []*Task {
+	queue.tsMux.Lock()
+	defer queue.tsMux.Unlock()
+
+	if queue.cancelled {
+		return nil
+	}
+
+	queue.cancelled = true
+	queue.dispatcher.logger.Println("Stopping queue")
+	// A paused queue has already stopped its dispatcher
+	select {
+	case queue.cancelDispatcher <- true:
+	default:
+	}
+	select {
+	case queue.cancelWorkers <- true:
+	default:
+	}
+	queue.cancelDispatches()
 
-		queue.Purge()
+	cancelled := make([]*Task, 0, len(queue.ts))
+	for _, task := range queue.ts {
+		task.Delete()
+		cancelled = append(cancelled, task)
 	}
+	queue.ts = make(map[string]*Task)
+
+	return cancelled
 }
 
 // Purge purges all tasks from the queue
@@ -226,9 +556,7 @@ func (queue *Queue) Purge() *sync.WaitGroup {
 
 		for _, task := range queue.ts {
 			// Avoid task firing
-			if task != nil {
-				task.Delete()
-			}
+			task.Delete()
 		}
 	}()
 
@@ -244,44 +572,85 @@ func (queue *Queue) HardReset(s *Server) {
 	// - Purge() calls task.Delete()
 	// - task.Delete() writes to a buffered `cancel` channel
 	// - task.Schedule() reads from that buffered channel in a separate goroutine
-	// - When that goroutine sees the task is cancelled, it sets the task value to nil in the tasks map
+	// - When that goroutine sees the task is cancelled, it removes the task and tombstones its name
 	//
-	// We need to be certain that we only remove the task from map *after* that completes, otherwise the task name will
-	// be reinserted with the nil value. At the moment the only easy way I can think of is to sleep for a very short
+	// We need to be certain that we only release the task names *after* that completes, otherwise the task name will
+	// be tombstoned again. At the moment the only easy way I can think of is to sleep for a very short
 	// period to allow the tasks' internal goroutines to fire first.
 	time.Sleep(10 * time.Millisecond)
 
 	queue.tsMux.Lock()
 	defer queue.tsMux.Unlock()
-	for taskName, task := range queue.ts {
-		if task != nil {
-			// The naive "sleep till it deletes" approach described above is too naive...
-			panic("Expected task to be deleted by now!")
-		}
-
-		delete(queue.ts, taskName)
-		s.hardDeleteTask(taskName)
+	if len(queue.ts) > 0 {
+		// The naive "sleep till it deletes" approach described above is too naive...
+		panic("Expected task to be deleted by now!")
 	}
+
+	s.releaseTaskNames(queue.name)
 }
 
-// Pause pauses the queue
+// Pause pauses the queue. Dispatches in flight complete, but pending retries are frozen with the remaining
+// backoff, which only starts counting down again once the queue resumes.
 func (queue *Queue) Pause() {
-	if !queue.paused {
-		queue.paused = true
-		queue.state.State = tasks.Queue_PAUSED
+	queue.stateMux.Lock()
+	if queue.paused {
+		queue.stateMux.Unlock()
+		return
+	}
+	queue.paused = true
+	queue.state.State = tasks.Queue_PAUSED
+	queue.stateMux.Unlock()
 
-		queue.cancelDispatcher <- true
-		queue.cancelWorkers <- true
+	// The workers stay, idle, as nothing reaches them without the dispatcher
+	queue.cancelDispatcher <- true
+
+	queue.tsMux.Lock()
+	defer queue.tsMux.Unlock()
+	for _, task := range queue.ts {
+		if task.pendingRetry() && task.unschedule() {
+			task.freeze()
+		}
 	}
 }
 
-// Resume resumes a paused queue
+// Resume resumes a paused queue, rescheduling the frozen retries with their remaining backoff
 func (queue *Queue) Resume() {
-	if queue.paused {
-		queue.paused = false
-		queue.state.State = tasks.Queue_RUNNING
+	queue.stateMux.Lock()
+	if !queue.paused {
+		queue.stateMux.Unlock()
+		return
+	}
+	queue.paused = false
+	queue.state.State = tasks.Queue_RUNNING
+	rampUp := queue.dispatcher.options.ResumeRampUp.InitialRate > 0
+	if rampUp {
+		queue.resumedAt = time.Now()
+	}
+	queue.stateMux.Unlock()
 
-		go queue.runDispatcher()
-		go queue.runWorkers()
+	if rampUp {
+		// The burst built up during the pause would defeat the ramp-up
+		now := time.Now()
+		queue.limiter.AllowN(now, int(queue.limiter.TokensAt(now)))
 	}
+	go queue.runDispatcher()
+
+	queue.tsMux.Lock()
+	defer queue.tsMux.Unlock()
+	for _, task := range queue.ts {
+		task.thaw()
+	}
+}
+
+// scheduleRetry schedules the next attempt of a task, or freezes it with its backoff while the queue is paused
+func (queue *Queue) scheduleRetry(task *Task) {
+	// Holding the lock means Resume, which thaws after unpausing, cannot miss the task
+	queue.stateMux.Lock()
+	defer queue.stateMux.Unlock()
+
+	if queue.paused {
+		task.freeze()
+		return
+	}
+	task.Schedule()
 }
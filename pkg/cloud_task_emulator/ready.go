@@ -0,0 +1,113 @@
+package cloud_task_emulator
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// readyTask is a due task waiting in the ready queue. Its taken channel closes when the dispatcher takes it.
+type readyTask struct {
+	task *Task
+
+	scheduleTime time.Time
+
+	// seq keeps tasks with the same schedule time in the order they became due
+	seq uint64
+
+	index int
+
+	taken chan struct{}
+}
+
+type readyHeap []*readyTask
+
+func (h readyHeap) Len() int { return len(h) }
+
+func (h readyHeap) Less(i, j int) bool {
+	if !h[i].scheduleTime.Equal(h[j].scheduleTime) {
+		return h[i].scheduleTime.Before(h[j].scheduleTime)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h readyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *readyHeap) Push(x interface{}) {
+	entry := x.(*readyTask)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *readyHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// readyQueue holds the due tasks of a queue, for the dispatcher to take in schedule time order as the
+// rate limits allow. Like production the order is best effort: a task only joins once its timer fires.
+type readyQueue struct {
+	tasks readyHeap
+
+	seq uint64
+
+	// signal wakes the dispatcher waiting for a task
+	signal chan bool
+
+	mux sync.Mutex
+}
+
+func newReadyQueue() *readyQueue {
+	return &readyQueue{
+		signal: make(chan bool, 1),
+	}
+}
+
+// push adds a due task, returning its entry to withdraw it with
+func (q *readyQueue) push(task *Task, scheduleTime time.Time) *readyTask {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.seq++
+	entry := &readyTask{task: task, scheduleTime: scheduleTime, seq: q.seq, taken: make(chan struct{})}
+	heap.Push(&q.tasks, entry)
+
+	select {
+	case q.signal <- true:
+	default:
+	}
+	return entry
+}
+
+// pop takes the task with the earliest schedule time, nil if there are none
+func (q *readyQueue) pop() *Task {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.tasks) == 0 {
+		return nil
+	}
+	entry := heap.Pop(&q.tasks).(*readyTask)
+	close(entry.taken)
+	return entry.task
+}
+
+// remove withdraws the entry, reporting false if the dispatcher took it already
+func (q *readyQueue) remove(entry *readyTask) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if entry.index < 0 {
+		return false
+	}
+	heap.Remove(&q.tasks, entry.index)
+	return true
+}
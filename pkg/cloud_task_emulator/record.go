@@ -0,0 +1,55 @@
+package cloud_task_emulator
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// dispatchRecord is a line of a record file, e.g.
+//
+//	{"time":"2024-01-02T03:04:05.6Z","task":"projects/dev/locations/here/queues/firstq/tasks/1",
+//	 "durationMs":12.5,"method":"POST","url":"http://localhost:9000/work","headers":{"Content-Type":["application/json"]},
+//	 "body":"{}","status":200,"responseBody":"ok"}
+//
+// Bodies are recorded as text. Hand-written scenarios for Replay may name a queue instead of a task.
+type dispatchRecord struct {
+	Time         time.Time           `json:"time"`
+	Task         string              `json:"task,omitempty"`
+	Queue        string              `json:"queue,omitempty"`
+	DurationMs   float64             `json:"durationMs"`
+	Method       string              `json:"method"`
+	URL          string              `json:"url"`
+	Headers      map[string][]string `json:"headers,omitempty"`
+	Body         string              `json:"body,omitempty"`
+	Status       int                 `json:"status,omitempty"`
+	ResponseBody string              `json:"responseBody,omitempty"`
+	Error        string              `json:"error,omitempty"`
+}
+
+func newDispatchRecord(dispatched DispatchedRequest) dispatchRecord {
+	return dispatchRecord{
+		Time:         dispatched.Time,
+		Task:         dispatched.TaskName,
+		DurationMs:   float64(dispatched.Duration) / float64(time.Millisecond),
+		Method:       dispatched.Method,
+		URL:          dispatched.URL,
+		Headers:      dispatched.Header,
+		Body:         string(dispatched.Body),
+		Status:       dispatched.StatusCode,
+		ResponseBody: string(dispatched.ResponseBody),
+		Error:        dispatched.Error,
+	}
+}
+
+// RecordDispatches writes the dispatched requests to w as JSON lines, for tools other than Go tests to
+// inspect, until the channel closes or writing fails. See DispatchedRequests.
+func RecordDispatches(requests <-chan DispatchedRequest, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	for dispatched := range requests {
+		if err := encoder.Encode(newDispatchRecord(dispatched)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package cloud_task_emulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordDispatches(t *testing.T) {
+	requests := make(chan DispatchedRequest, 2)
+	requests <- DispatchedRequest{
+		TaskName:     "projects/dev/locations/here/queues/firstq/tasks/1",
+		Time:         time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC),
+		Duration:     12500 * time.Microsecond,
+		Method:       http.MethodPost,
+		URL:          "http://localhost:9000/work",
+		Header:       http.Header{"X-CloudTasks-TaskName": {"1"}},
+		Body:         []byte("{}"),
+		StatusCode:   http.StatusOK,
+		ResponseBody: []byte("ok"),
+	}
+	requests <- DispatchedRequest{
+		TaskName: "projects/dev/locations/here/queues/firstq/tasks/2",
+		Method:   http.MethodGet,
+		URL:      "http://localhost:9001/down",
+		Error:    "connection refused",
+	}
+	close(requests)
+
+	var file bytes.Buffer
+	require.NoError(t, RecordDispatches(requests, &file))
+
+	lines := bytes.Split(bytes.TrimSpace(file.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var first map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[0], &first))
+	assert.Equal(t, "2024-01-02T03:04:05Z", first["time"])
+	assert.Equal(t, "projects/dev/locations/here/queues/firstq/tasks/1", first["task"])
+	assert.Equal(t, 12.5, first["durationMs"])
+	assert.Equal(t, "POST", first["method"])
+	assert.Equal(t, "http://localhost:9000/work", first["url"])
+	assert.Equal(t, map[string]interface{}{"X-CloudTasks-TaskName": []interface{}{"1"}}, first["headers"])
+	assert.Equal(t, "{}", first["body"])
+	assert.Equal(t, 200.0, first["status"])
+	assert.Equal(t, "ok", first["responseBody"])
+
+	var second map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[1], &second))
+	assert.Equal(t, "connection refused", second["error"])
+	assert.NotContains(t, second, "status")
+}
@@ -0,0 +1,146 @@
+package cloud_task_emulator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxRecordLine is the longest line of a record file Replay reads
+const maxRecordLine = 64 << 20
+
+// dispatchHeaderPrefixes are the (canonical) headers set on dispatch, which replayed tasks get afresh
+var dispatchHeaderPrefixes = []string{"X-Cloudtasks-", "X-Appengine-", "Authorization"}
+
+// Replay re-creates the tasks of a record file (see RecordDispatches) or of a hand-written scenario in the
+// same format, e.g. to reproduce a bug report or run a deterministic CI scenario. Each task is created once,
+// from its first dispatch, as an HTTP task scheduled as long after the start of the replay as it was
+// dispatched after the first one. Missing queues are created with default settings.
+//
+// Scenarios may name a "queue" rather than a "task", and leave out the "time" to dispatch straight away.
+// The tasks get new names, and the headers set on dispatch (X-CloudTasks-*, X-AppEngine-*, Authorization)
+// afresh. Every task is attempted; the first failure is returned.
+func (s *Server) Replay(ctx context.Context, r io.Reader) error {
+	var records []dispatchRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxRecordLine)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record dispatchRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("invalid record on line %d: %v", line, err)
+		}
+		if record.Task == "" && record.Queue == "" {
+			return fmt.Errorf("invalid record on line %d: a task or queue is required", line)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Offsets are relative to the earliest dispatch, from when each dispatch started
+	var first time.Time
+	for _, record := range records {
+		if started := record.started(); !started.IsZero() && (first.IsZero() || started.Before(first)) {
+			first = started
+		}
+	}
+
+	var firstErr error
+	replayed := make(map[string]bool)
+	start := s.clock.Now()
+	for _, record := range records {
+		if record.Task != "" {
+			if replayed[record.Task] {
+				// A retry, which the replayed task makes on its own
+				continue
+			}
+			replayed[record.Task] = true
+		}
+
+		scheduleTime := start
+		if started := record.started(); !started.IsZero() {
+			scheduleTime = start.Add(started.Sub(first))
+		}
+		if err := s.replayTask(ctx, record, scheduleTime); err != nil {
+			s.logger.Println(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (record dispatchRecord) started() time.Time {
+	if record.Time.IsZero() {
+		return record.Time
+	}
+	return record.Time.Add(-time.Duration(record.DurationMs * float64(time.Millisecond)))
+}
+
+func (s *Server) replayTask(ctx context.Context, record dispatchRecord, scheduleTime time.Time) error {
+	queueName := record.Queue
+	if queueName == "" {
+		queueName = queueNameOf(record.Task)
+	}
+	if _, ok := s.fetchQueue(queueName); !ok {
+		s.autoCreateQueue(ctx, queueName)
+	}
+
+	method := tasks.HttpMethod_POST
+	if record.Method != "" {
+		value, ok := tasks.HttpMethod_value[strings.ToUpper(record.Method)]
+		if !ok {
+			return fmt.Errorf("could not replay a task on %s: unknown method %s", queueName, record.Method)
+		}
+		method = tasks.HttpMethod(value)
+	}
+
+	headers := make(map[string]string)
+	for name, values := range record.Headers {
+		if len(values) == 0 || isDispatchHeader(http.CanonicalHeaderKey(name)) {
+			continue
+		}
+		headers[name] = values[0]
+	}
+
+	_, err := s.CreateTask(ctx, &tasks.CreateTaskRequest{
+		Parent: queueName,
+		Task: &tasks.Task{
+			ScheduleTime: timestamppb.New(scheduleTime),
+			MessageType: &tasks.Task_HttpRequest{
+				HttpRequest: &tasks.HttpRequest{
+					HttpMethod: method,
+					Url:        record.URL,
+					Headers:    headers,
+					Body:       []byte(record.Body),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not replay a task on %s: %v", queueName, err)
+	}
+	return nil
+}
+
+func isDispatchHeader(name string) bool {
+	for _, prefix := range dispatchHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	dispatched := server.DispatchedRequests()
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queueName := formatQueueName(formattedParent, "replayed")
+	scenario := strings.Join([]string{
+		// A recorded dispatch, with a retry of it
+		`{"time":"2024-01-02T03:04:05.5Z","durationMs":500,"task":"` + queueName + `/tasks/1","method":"PUT","url":"` + testServerUrl + `/success",` +
+			`"headers":{"X-CloudTasks-TaskName":["1"],"X-Custom":["kept"]},"body":"payload","status":200}`,
+		`{"time":"2024-01-02T03:04:06Z","task":"` + queueName + `/tasks/1","method":"PUT","url":"` + testServerUrl + `/success"}`,
+		"",
+		// A hand-written task, an hour after the first one
+		`{"time":"2024-01-02T04:04:05Z","queue":"` + queueName + `","url":"` + testServerUrl + `/success"}`,
+	}, "\n")
+
+	start := time.Now()
+	require.NoError(t, server.Replay(context.Background(), strings.NewReader(scenario)))
+
+	select {
+	case request := <-dispatched:
+		assert.Equal(t, "PUT", request.Method)
+		assert.Equal(t, []string{"kept"}, request.Header["X-Custom"])
+		assert.Equal(t, []byte("payload"), request.Body)
+		assert.NotEqual(t, []string{"1"}, request.Header["X-CloudTasks-TaskName"])
+	case <-time.After(time.Second):
+		t.Fatal("replayed task was not dispatched")
+	}
+	_, err := awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	tasks, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queueName})
+	require.NoError(t, err)
+	require.Len(t, tasks.GetTasks(), 1)
+	assert.Equal(t, taskspb.HttpMethod_POST, tasks.GetTasks()[0].GetHttpRequest().GetHttpMethod())
+	assert.WithinDuration(t, start.Add(time.Hour), tasks.GetTasks()[0].GetScheduleTime().AsTime(), time.Second)
+}
+
+func TestReplayRejectsInvalidRecords(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+
+	err := server.Replay(context.Background(), strings.NewReader(`{"url":"http://localhost:1/task"}`))
+	assert.EqualError(t, err, "invalid record on line 1: a task or queue is required")
+
+	err = server.Replay(context.Background(), strings.NewReader("\n{"))
+	assert.ErrorContains(t, err, "invalid record on line 2")
+	assert.Empty(t, server.ListQueuesSnapshot())
+}
@@ -0,0 +1,151 @@
+package cloud_task_emulator
+
+import (
+	"runtime"
+	"sort"
+	"time"
+)
+
+// retentionInterval is how often the limits on the records of finished tasks are enforced
+const retentionInterval = time.Second
+
+// memoryEvictionShare is the share of the records of finished tasks evicted, as a divisor, while the heap is
+// larger than ServerOptions.MaxMemory
+const memoryEvictionShare = 4
+
+// finishedRecord is an evictable record of a finished task: a tombstone, or a task that ran out of attempts
+type finishedRecord struct {
+	finished time.Time
+
+	queueName string
+
+	// hash identifies a tombstone of the queue, as long as it has this expiry
+	hash   uint64
+	expiry int64
+
+	// task ran out of attempts, nil for a tombstone
+	task *Task
+}
+
+func (s *Server) retainFinished() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.EnforceRetention()
+		}
+	}
+}
+
+// EnforceRetention evicts the oldest records of finished tasks beyond ServerOptions.MaxFinishedTasks, and a
+// quarter of them while the heap is larger than ServerOptions.MaxMemory. Tasks that ran out of attempts are
+// forgotten, and the names of the evicted tasks can be reused straight away.
+// The server enforces the limits every second; tests may call it to do so straight away. The tombstones are
+// only evicted from the in-memory storage.
+func (s *Server) EnforceRetention() {
+	if maxFinished := s.options.MaxFinishedTasks; maxFinished > 0 {
+		if records := s.finishedRecords(); len(records) > maxFinished {
+			s.evictFinished(records[:len(records)-maxFinished])
+		}
+	}
+	if s.options.MaxMemory > 0 {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		if memStats.HeapAlloc > s.options.MaxMemory {
+			records := s.finishedRecords()
+			s.evictFinished(records[:(len(records)+memoryEvictionShare-1)/memoryEvictionShare])
+		}
+	}
+}
+
+// finishedRecords returns the records of finished tasks, oldest first
+func (s *Server) finishedRecords() []finishedRecord {
+	var records []finishedRecord
+	if storage, ok := s.storage.(*memoryStorage); ok {
+		records = storage.tombstoneRecords(s.clock.Now(), s.taskNameTombstoneTTL())
+	}
+
+	s.tsMux.Lock()
+	for _, task := range s.ts {
+		if task == nil {
+			continue
+		}
+		if finished, ok := task.exhaustedAt(); ok {
+			records = append(records, finishedRecord{finished: finished, queueName: task.queue.name, task: task})
+		}
+	}
+	s.tsMux.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].finished.Before(records[j].finished)
+	})
+	return records
+}
+
+// tombstoneRecords returns the records of the tombstones, reserved for the TTL
+func (m *memoryStorage) tombstoneRecords(now time.Time, ttl time.Duration) []finishedRecord {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+
+	var records []finishedRecord
+	for queueName, queueTombstones := range m.tombstones {
+		queueTombstones.sweep(now)
+		for hash, expiry := range queueTombstones.expiries {
+			records = append(records, finishedRecord{
+				finished:  time.Unix(0, expiry).Add(-ttl),
+				queueName: queueName,
+				hash:      hash,
+				expiry:    expiry,
+			})
+		}
+	}
+	return records
+}
+
+// evictFinished evicts the records, unless they changed in the meantime
+func (s *Server) evictFinished(records []finishedRecord) {
+	if len(records) == 0 {
+		return
+	}
+
+	var evictedTasks []*Task
+	var evictedTombstones []finishedRecord
+	s.tsMux.Lock()
+	for _, record := range records {
+		if record.task == nil {
+			evictedTombstones = append(evictedTombstones, record)
+			continue
+		}
+		taskName := record.task.state.GetName()
+		if s.ts[taskName] == record.task {
+			record.task.retire()
+			delete(s.ts, taskName)
+			logStorageError(s.logger, "task "+taskName, s.storage.DeleteTask(taskName))
+			evictedTasks = append(evictedTasks, record.task)
+		}
+	}
+	s.tsMux.Unlock()
+
+	if storage, ok := s.storage.(*memoryStorage); ok && len(evictedTombstones) > 0 {
+		storage.evictTombstones(evictedTombstones)
+	}
+	for _, task := range evictedTasks {
+		task.queue.removeTask(task.state.GetName())
+	}
+	s.logger.Printf("Evicted %d records of finished tasks\n", len(records))
+}
+
+// evictTombstones removes the tombstones of the records
+func (m *memoryStorage) evictTombstones(records []finishedRecord) {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	for _, record := range records {
+		if queueTombstones, ok := m.tombstones[record.queueName]; ok && queueTombstones.expiries[record.hash] == record.expiry {
+			queueTombstones.remove(record.hash)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// steppedClock only moves when the test says so
+type steppedClock struct {
+	now time.Time
+	mux sync.Mutex
+}
+
+func (c *steppedClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *steppedClock) step() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(time.Second)
+}
+
+func TestEnforceRetentionEvictsOldest(t *testing.T) {
+	clock := &steppedClock{now: time.Now()}
+	s := NewServer(WithOptions(ServerOptions{MaxFinishedTasks: 2}), WithClock(clock))
+	t.Cleanup(s.Shutdown)
+
+	queueName := "projects/p/locations/l/queues/retained"
+	_, err := s.CreateQueue(context.Background(), &tasks.CreateQueueRequest{
+		Parent: "projects/p/locations/l",
+		Queue:  &tasks.Queue{Name: queueName, RetryConfig: &tasks.RetryConfig{MaxAttempts: 1}},
+	})
+	require.NoError(t, err)
+	queue, _ := s.fetchQueue(queueName)
+	queue.FailNextDispatches(ForcedFailures{Count: 1})
+
+	exhausted, err := s.CreateTask(context.Background(), &tasks.CreateTaskRequest{
+		Parent: queueName,
+		Task: &tasks.Task{
+			MessageType: &tasks.Task_HttpRequest{HttpRequest: &tasks.HttpRequest{Url: "http://localhost:1/task"}},
+		},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.WaitForTaskCompletion(ctx, exhausted.GetName()))
+
+	clock.step()
+	s.removeTask(queueName + "/tasks/first")
+	clock.step()
+	s.removeTask(queueName + "/tasks/second")
+
+	// The task that ran out of attempts is the oldest, and forgotten along with its name
+	s.EnforceRetention()
+	_, ok := s.TaskSnapshot(exhausted.GetName())
+	assert.False(t, ok)
+	_, ok = s.TaskNameTombstone(exhausted.GetName())
+	assert.False(t, ok)
+	assert.Empty(t, queue.ts)
+	assert.Equal(t, 2, s.TombstoneCount(queueName))
+
+	clock.step()
+	s.removeTask(queueName + "/tasks/third")
+	s.EnforceRetention()
+	_, ok = s.TaskNameTombstone(queueName + "/tasks/first")
+	assert.False(t, ok)
+	_, ok = s.TaskNameTombstone(queueName + "/tasks/second")
+	assert.True(t, ok)
+	assert.Equal(t, 2, s.TombstoneCount(queueName))
+}
+
+func TestEnforceRetentionEvictsOverMemory(t *testing.T) {
+	s := NewServer(WithOptions(ServerOptions{MaxMemory: 1}))
+	t.Cleanup(s.Shutdown)
+
+	queueName := "projects/p/locations/l/queues/retained"
+	for _, taskId := range []string{"first", "second", "third"} {
+		s.removeTask(queueName + "/tasks/" + taskId)
+	}
+
+	// A quarter, rounded up
+	s.EnforceRetention()
+	assert.Equal(t, 2, s.TombstoneCount(queueName))
+}
@@ -0,0 +1,42 @@
+package cloud_task_emulator
+
+import (
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+)
+
+// Scheduler decides when tasks are dispatched: when a task is due, and how long it waits to be retried after a
+// failed attempt, see WithScheduler. Implementations are safe for concurrent use.
+type Scheduler interface {
+	// Wait returns a channel that receives once a task due at the time is, and a function to stop waiting
+	// early, which reports whether it stopped the wait before the channel received
+	Wait(due time.Time) (<-chan time.Time, func() bool)
+
+	// Backoff returns how long to wait before dispatching a task again after its given number of attempts
+	Backoff(retryConfig *tasks.RetryConfig, dispatchCount int32) time.Duration
+}
+
+// timerScheduler is the default scheduler: a timer per task on the server's clock, and the exponential backoff
+// of the queue's retry config, as in production
+type timerScheduler struct {
+	clock Clock
+}
+
+func (s timerScheduler) Wait(due time.Time) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(wallDuration(s.clock, due.Sub(s.clock.Now())))
+	return timer.C, timer.Stop
+}
+
+func (s timerScheduler) Backoff(retryConfig *tasks.RetryConfig, dispatchCount int32) time.Duration {
+	return retryBackoff(retryConfig, dispatchCount)
+}
+
+// WithScheduler makes the scheduler decide when tasks are dispatched instead of the server's clock and the retry
+// config of their queue, e.g. for tests to dispatch tasks deterministically or straight away. The rate limits
+// of queues and the schedule times tasks report are unchanged.
+func WithScheduler(scheduler Scheduler) Option {
+	return func(s *Server) {
+		s.scheduler = scheduler
+	}
+}
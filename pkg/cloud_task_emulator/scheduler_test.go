@@ -0,0 +1,71 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// immediateScheduler dispatches tasks straight away and retries them without backoff, recording the attempts
+// the backoffs were asked for
+type immediateScheduler struct {
+	backoffs []int32
+
+	mux sync.Mutex
+}
+
+func (s *immediateScheduler) Wait(due time.Time) (<-chan time.Time, func() bool) {
+	fired := make(chan time.Time, 1)
+	fired <- due
+	return fired, func() bool { return false }
+}
+
+func (s *immediateScheduler) Backoff(retryConfig *taskspb.RetryConfig, dispatchCount int32) time.Duration {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.backoffs = append(s.backoffs, dispatchCount)
+	return 0
+}
+
+func TestWithScheduler(t *testing.T) {
+	serverURL, requests := startTestServer(t)
+	scheduler := &immediateScheduler{}
+	server := NewServer(WithScheduler(scheduler))
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "scheduled"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 3, MinBackoff: durationpb.New(time.Hour)},
+		},
+	})
+	require.NoError(t, err)
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: serverURL + "/not_found"}},
+		},
+	})
+	require.NoError(t, err)
+
+	// Due straight away, and retried without waiting an hour in between
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err := awaitHttpRequest(requests)
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		scheduler.mux.Lock()
+		defer scheduler.mux.Unlock()
+		return assert.ObjectsAreEqual([]int32{1, 2}, scheduler.backoffs)
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,133 @@
+package cloud_task_emulator
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+// attemptBuckets are the upper bounds of the buckets of the attempt count histograms
+var attemptBuckets = []float64{1, 2, 3, 4, 5, 10, 20, 50, 100}
+
+// Histogram is a distribution of observed values, bucketed as Prometheus does
+type Histogram struct {
+	// Buckets count the values up to their upper bound, including those counted by the smaller buckets
+	Buckets []HistogramBucket `json:"buckets"`
+
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+}
+
+// HistogramBucket counts the values of a histogram up to the upper bound
+type HistogramBucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// histogram accumulates a Histogram. Callers are responsible for synchronisation.
+type histogram struct {
+	bounds []float64
+
+	// counts holds the values per bucket, values above the largest bound are only in count
+	counts []uint64
+
+	count uint64
+	sum   float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	if i := sort.SearchFloat64s(h.bounds, value); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) snapshot() Histogram {
+	snapshot := Histogram{Buckets: make([]HistogramBucket, len(h.bounds)), Count: h.count, Sum: h.sum}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		snapshot.Buckets[i] = HistogramBucket{UpperBound: bound, Count: cumulative}
+	}
+	return snapshot
+}
+
+// QueueStats are the dispatch statistics of a queue since it was created, latencies in seconds
+type QueueStats struct {
+	// TimeToFirstDispatch is how long tasks waited past their schedule time for their first dispatch,
+	// e.g. held up by the rate limits of the queue
+	TimeToFirstDispatch Histogram `json:"timeToFirstDispatch"`
+
+	// AttemptLatency is how long attempts took from their dispatch to the response, or the failure
+	AttemptLatency Histogram `json:"attemptLatency"`
+
+	// AttemptsToSuccess is how many attempts tasks took to succeed, AttemptsToFailure how many tasks made
+	// before they ran out of attempts. Deleted tasks count in neither.
+	AttemptsToSuccess Histogram `json:"attemptsToSuccess"`
+	AttemptsToFailure Histogram `json:"attemptsToFailure"`
+}
+
+// queueStats accumulates the QueueStats of a queue
+type queueStats struct {
+	timeToFirstDispatch *histogram
+	attemptLatency      *histogram
+	attemptsToSuccess   *histogram
+	attemptsToFailure   *histogram
+
+	mux sync.Mutex
+}
+
+func newQueueStats() *queueStats {
+	return &queueStats{
+		timeToFirstDispatch: newHistogram(latencyBuckets),
+		attemptLatency:      newHistogram(latencyBuckets),
+		attemptsToSuccess:   newHistogram(attemptBuckets),
+		attemptsToFailure:   newHistogram(attemptBuckets),
+	}
+}
+
+func (s *queueStats) observeFirstDispatch(delay time.Duration) {
+	if delay < 0 {
+		// Run ahead of schedule
+		delay = 0
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.timeToFirstDispatch.observe(delay.Seconds())
+}
+
+func (s *queueStats) observeAttempt(latency time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.attemptLatency.observe(latency.Seconds())
+}
+
+// observeOutcome records the attempts a task made until it succeeded or ran out of attempts
+func (s *queueStats) observeOutcome(succeeded bool, attempts int32) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if succeeded {
+		s.attemptsToSuccess.observe(float64(attempts))
+	} else {
+		s.attemptsToFailure.observe(float64(attempts))
+	}
+}
+
+func (s *queueStats) snapshot() QueueStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return QueueStats{
+		TimeToFirstDispatch: s.timeToFirstDispatch.snapshot(),
+		AttemptLatency:      s.attemptLatency.snapshot(),
+		AttemptsToSuccess:   s.attemptsToSuccess.snapshot(),
+		AttemptsToFailure:   s.attemptsToFailure.snapshot(),
+	}
+}
@@ -0,0 +1,20 @@
+package cloud_task_emulator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramBucketsCumulatively(t *testing.T) {
+	h := newHistogram([]float64{1, 2, 5})
+	for _, value := range []float64{0.5, 1, 1.5, 3, 10} {
+		h.observe(value)
+	}
+
+	assert.Equal(t, Histogram{
+		Buckets: []HistogramBucket{{UpperBound: 1, Count: 2}, {UpperBound: 2, Count: 3}, {UpperBound: 5, Count: 4}},
+		Count:   5,
+		Sum:     16,
+	}, h.snapshot())
+}
@@ -0,0 +1,319 @@
+package cloud_task_emulator
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"github.com/golang/protobuf/proto"
+)
+
+// Storage holds the state of the queues and tasks of a server and the reserved task names, see WithStorage.
+// The server runs the queues and tasks in memory, writing their state through to the storage whenever it
+// changes, and serves GetQueue, ListQueues, GetTask and ListTasks from it. The states are protos, for the
+// storage to keep them however it likes, e.g. serialized in a database. Implementations are safe for concurrent
+// use; the states passed to them are theirs to keep, and those they return the caller's.
+type Storage interface {
+	// GetQueue returns the state of the queue, nil if its name is reserved after it was deleted, and whether the
+	// name is known at all
+	GetQueue(queueName string) (*tasks.Queue, bool, error)
+
+	PutQueue(queueState *tasks.Queue) error
+
+	// DeleteQueue deletes the queue, keeping its name reserved
+	DeleteQueue(queueName string) error
+
+	// ListQueues returns the state of the known queues by name, nil for those deleted
+	ListQueues() (map[string]*tasks.Queue, error)
+
+	// GetTask returns the state of the task, reporting false if it does not exist
+	GetTask(taskName string) (*tasks.Task, bool, error)
+
+	PutTask(taskState *tasks.Task) error
+
+	DeleteTask(taskName string) error
+
+	// RemoveTask deletes the task and reserves its name as Tombstone does, in one go, for the name to be known
+	// throughout
+	RemoveTask(taskName string, at time.Time, ttl time.Duration) error
+
+	// ListTasks returns the state of the tasks whose names start with the prefix, e.g. a queue name and
+	// "/tasks/", in no particular order
+	ListTasks(prefix string) ([]*tasks.Task, error)
+
+	// Tombstone reserves the name of a task that completed or was deleted at the time, for the TTL
+	Tombstone(taskName string, at time.Time, ttl time.Duration) error
+
+	// TaskNameTombstone returns the tombstone of the task name, reporting false if the name is not reserved
+	TaskNameTombstone(taskName string, now time.Time) (Tombstone, bool, error)
+
+	// ListTombstones returns the reserved task names of the queue, soonest to expire first
+	ListTombstones(queueName string, now time.Time) ([]Tombstone, error)
+
+	CountTombstones(queueName string, now time.Time) (int, error)
+
+	// ReleaseTombstones releases the reserved task names starting with the prefix: those of a queue for its name
+	// and "/tasks/", of a project for "projects/", its ID and "/", or every one of them for the empty prefix
+	ReleaseTombstones(prefix string) error
+
+	// Forget deletes the queues and tasks whose names start with the prefix, e.g. "projects/", a project ID and
+	// "/", and releases their names and the reserved task names, in one go
+	Forget(prefix string) error
+}
+
+// WithStorage keeps the state of the queues and tasks and the reserved task names in the storage instead of in
+// memory. ServerOptions.MaxMemory and the tombstones evicted by ServerOptions.MaxFinishedTasks only apply to the
+// in-memory storage.
+func WithStorage(storage Storage) Option {
+	return func(s *Server) {
+		s.storage = storage
+	}
+}
+
+// logStorageError logs a failed write to the storage, which the emulator carries on from, as from a failed write
+// to the write-ahead log
+func logStorageError(logger *log.Logger, what string, err error) {
+	if err != nil {
+		logger.Printf("Could not store %s: %v\n", what, err)
+	}
+}
+
+// storeTask writes the state of a task through to the storage
+func (d *dispatcher) storeTask(taskState *tasks.Task) {
+	logStorageError(d.logger, "task "+taskState.GetName(), d.storage.PutTask(taskState))
+}
+
+// storedTask is a task state in the in-memory storage, its payload encoded if the server stores tasks compactly
+type storedTask struct {
+	state   *tasks.Task
+	payload []byte
+}
+
+// memoryStorage is the default storage, maps in memory
+type memoryStorage struct {
+	qs map[string]*tasks.Queue
+	ts map[string]storedTask
+
+	// tombstones holds the recently used task names, per queue
+	tombstones map[string]*tombstones
+
+	keepTombstonedNames bool
+
+	// codec encodes the payload of the tasks stored, nil unless ServerOptions.CompactTasks is set
+	codec *payloadCodec
+
+	qsMux sync.Mutex
+	tsMux sync.Mutex
+}
+
+func newMemoryStorage(keepTombstonedNames bool, codec *payloadCodec) *memoryStorage {
+	return &memoryStorage{
+		qs:                  make(map[string]*tasks.Queue),
+		ts:                  make(map[string]storedTask),
+		tombstones:          make(map[string]*tombstones),
+		keepTombstonedNames: keepTombstonedNames,
+		codec:               codec,
+	}
+}
+
+func (m *memoryStorage) GetQueue(queueName string) (*tasks.Queue, bool, error) {
+	m.qsMux.Lock()
+	defer m.qsMux.Unlock()
+	queueState, ok := m.qs[queueName]
+	if queueState == nil {
+		return nil, ok, nil
+	}
+	return proto.Clone(queueState).(*tasks.Queue), true, nil
+}
+
+func (m *memoryStorage) PutQueue(queueState *tasks.Queue) error {
+	m.qsMux.Lock()
+	defer m.qsMux.Unlock()
+	m.qs[queueState.GetName()] = queueState
+	return nil
+}
+
+func (m *memoryStorage) DeleteQueue(queueName string) error {
+	m.qsMux.Lock()
+	defer m.qsMux.Unlock()
+	m.qs[queueName] = nil
+	return nil
+}
+
+func (m *memoryStorage) ListQueues() (map[string]*tasks.Queue, error) {
+	m.qsMux.Lock()
+	defer m.qsMux.Unlock()
+	queueStates := make(map[string]*tasks.Queue, len(m.qs))
+	for queueName, queueState := range m.qs {
+		if queueState != nil {
+			queueState = proto.Clone(queueState).(*tasks.Queue)
+		}
+		queueStates[queueName] = queueState
+	}
+	return queueStates, nil
+}
+
+func (m *memoryStorage) GetTask(taskName string) (*tasks.Task, bool, error) {
+	m.tsMux.Lock()
+	stored, ok := m.ts[taskName]
+	m.tsMux.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	taskState, err := m.decode(stored)
+	return taskState, err == nil, err
+}
+
+func (m *memoryStorage) PutTask(taskState *tasks.Task) error {
+	stored := storedTask{state: taskState}
+	if m.codec != nil {
+		payload, err := m.codec.encode(taskState)
+		if err != nil {
+			return err
+		}
+		stored.payload = payload
+	}
+
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	m.ts[taskState.GetName()] = stored
+	return nil
+}
+
+func (m *memoryStorage) DeleteTask(taskName string) error {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	delete(m.ts, taskName)
+	return nil
+}
+
+func (m *memoryStorage) RemoveTask(taskName string, at time.Time, ttl time.Duration) error {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	m.tombstoneLocked(taskName, at, ttl)
+	delete(m.ts, taskName)
+	return nil
+}
+
+func (m *memoryStorage) ListTasks(prefix string) ([]*tasks.Task, error) {
+	m.tsMux.Lock()
+	var matching []storedTask
+	for taskName, stored := range m.ts {
+		if strings.HasPrefix(taskName, prefix) {
+			matching = append(matching, stored)
+		}
+	}
+	m.tsMux.Unlock()
+
+	taskStates := make([]*tasks.Task, 0, len(matching))
+	for _, stored := range matching {
+		taskState, err := m.decode(stored)
+		if err != nil {
+			return nil, err
+		}
+		taskStates = append(taskStates, taskState)
+	}
+	return taskStates, nil
+}
+
+// decode returns a copy of the stored task state, with its payload
+func (m *memoryStorage) decode(stored storedTask) (*tasks.Task, error) {
+	taskState := proto.Clone(stored.state).(*tasks.Task)
+	if stored.payload != nil {
+		if err := m.codec.decode(stored.payload, taskState); err != nil {
+			return nil, err
+		}
+	}
+	return taskState, nil
+}
+
+func (m *memoryStorage) Tombstone(taskName string, at time.Time, ttl time.Duration) error {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	m.tombstoneLocked(taskName, at, ttl)
+	return nil
+}
+
+// tombstoneLocked reserves the task name with the task lock held
+func (m *memoryStorage) tombstoneLocked(taskName string, at time.Time, ttl time.Duration) {
+	queueName := queueNameOf(taskName)
+	queueTombstones, ok := m.tombstones[queueName]
+	if !ok {
+		queueTombstones = newTombstones(m.keepTombstonedNames)
+		m.tombstones[queueName] = queueTombstones
+	}
+	queueTombstones.add(taskName, at, ttl)
+}
+
+func (m *memoryStorage) TaskNameTombstone(taskName string, now time.Time) (Tombstone, bool, error) {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	queueTombstones, ok := m.tombstones[queueNameOf(taskName)]
+	if !ok {
+		return Tombstone{}, false, nil
+	}
+	expireTime, ok := queueTombstones.expiry(taskName, now)
+	if !ok {
+		return Tombstone{}, false, nil
+	}
+	return Tombstone{Name: taskName, ExpireTime: expireTime}, true, nil
+}
+
+func (m *memoryStorage) ListTombstones(queueName string, now time.Time) ([]Tombstone, error) {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	queueTombstones, ok := m.tombstones[queueName]
+	if !ok {
+		return []Tombstone{}, nil
+	}
+	return queueTombstones.list(now), nil
+}
+
+func (m *memoryStorage) CountTombstones(queueName string, now time.Time) (int, error) {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	queueTombstones, ok := m.tombstones[queueName]
+	if !ok {
+		return 0, nil
+	}
+	queueTombstones.sweep(now)
+	return queueTombstones.len(), nil
+}
+
+func (m *memoryStorage) ReleaseTombstones(prefix string) error {
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	m.releaseTombstonesLocked(prefix)
+	return nil
+}
+
+// releaseTombstonesLocked releases the reserved task names starting with the prefix with the task lock held
+func (m *memoryStorage) releaseTombstonesLocked(prefix string) {
+	for queueName := range m.tombstones {
+		// The tombstones are per queue, holding the names starting with the queue name and "/tasks/"
+		if strings.HasPrefix(queueName+"/tasks/", prefix) {
+			delete(m.tombstones, queueName)
+		}
+	}
+}
+
+func (m *memoryStorage) Forget(prefix string) error {
+	m.qsMux.Lock()
+	defer m.qsMux.Unlock()
+	m.tsMux.Lock()
+	defer m.tsMux.Unlock()
+	for queueName := range m.qs {
+		if strings.HasPrefix(queueName, prefix) {
+			delete(m.qs, queueName)
+		}
+	}
+	for taskName := range m.ts {
+		if strings.HasPrefix(taskName, prefix) {
+			delete(m.ts, taskName)
+		}
+	}
+	m.releaseTombstonesLocked(prefix)
+	return nil
+}
@@ -0,0 +1,261 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeStorage is a storage backend of its own, keeping the states in maps and counting the task reads
+type fakeStorage struct {
+	queues     map[string]*taskspb.Queue
+	tasks      map[string]*taskspb.Task
+	tombstones map[string]time.Time
+
+	taskReads int
+
+	mux sync.Mutex
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		queues:     make(map[string]*taskspb.Queue),
+		tasks:      make(map[string]*taskspb.Task),
+		tombstones: make(map[string]time.Time),
+	}
+}
+
+func (f *fakeStorage) GetQueue(queueName string) (*taskspb.Queue, bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	queueState, ok := f.queues[queueName]
+	if queueState == nil {
+		return nil, ok, nil
+	}
+	return proto.Clone(queueState).(*taskspb.Queue), true, nil
+}
+
+func (f *fakeStorage) PutQueue(queueState *taskspb.Queue) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.queues[queueState.GetName()] = queueState
+	return nil
+}
+
+func (f *fakeStorage) DeleteQueue(queueName string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.queues[queueName] = nil
+	return nil
+}
+
+func (f *fakeStorage) ListQueues() (map[string]*taskspb.Queue, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	queueStates := make(map[string]*taskspb.Queue, len(f.queues))
+	for queueName, queueState := range f.queues {
+		if queueState != nil {
+			queueState = proto.Clone(queueState).(*taskspb.Queue)
+		}
+		queueStates[queueName] = queueState
+	}
+	return queueStates, nil
+}
+
+func (f *fakeStorage) GetTask(taskName string) (*taskspb.Task, bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.taskReads++
+	taskState, ok := f.tasks[taskName]
+	if !ok {
+		return nil, false, nil
+	}
+	return proto.Clone(taskState).(*taskspb.Task), true, nil
+}
+
+func (f *fakeStorage) PutTask(taskState *taskspb.Task) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.tasks[taskState.GetName()] = taskState
+	return nil
+}
+
+func (f *fakeStorage) DeleteTask(taskName string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.tasks, taskName)
+	return nil
+}
+
+func (f *fakeStorage) RemoveTask(taskName string, at time.Time, ttl time.Duration) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.tombstones[taskName] = at.Add(ttl)
+	delete(f.tasks, taskName)
+	return nil
+}
+
+func (f *fakeStorage) ListTasks(prefix string) ([]*taskspb.Task, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.taskReads++
+	var taskStates []*taskspb.Task
+	for taskName, taskState := range f.tasks {
+		if strings.HasPrefix(taskName, prefix) {
+			taskStates = append(taskStates, proto.Clone(taskState).(*taskspb.Task))
+		}
+	}
+	return taskStates, nil
+}
+
+func (f *fakeStorage) Tombstone(taskName string, at time.Time, ttl time.Duration) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.tombstones[taskName] = at.Add(ttl)
+	return nil
+}
+
+func (f *fakeStorage) TaskNameTombstone(taskName string, now time.Time) (Tombstone, bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	expireTime, ok := f.tombstones[taskName]
+	if !ok || !expireTime.After(now) {
+		return Tombstone{}, false, nil
+	}
+	return Tombstone{Name: taskName, ExpireTime: expireTime}, true, nil
+}
+
+func (f *fakeStorage) ListTombstones(queueName string, now time.Time) ([]Tombstone, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	entries := []Tombstone{}
+	for taskName, expireTime := range f.tombstones {
+		if strings.HasPrefix(taskName, queueName+"/tasks/") && expireTime.After(now) {
+			entries = append(entries, Tombstone{Name: taskName, ExpireTime: expireTime})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ExpireTime.Before(entries[j].ExpireTime)
+	})
+	return entries, nil
+}
+
+func (f *fakeStorage) CountTombstones(queueName string, now time.Time) (int, error) {
+	entries, err := f.ListTombstones(queueName, now)
+	return len(entries), err
+}
+
+func (f *fakeStorage) ReleaseTombstones(prefix string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for taskName := range f.tombstones {
+		if strings.HasPrefix(taskName, prefix) {
+			delete(f.tombstones, taskName)
+		}
+	}
+	return nil
+}
+
+func (f *fakeStorage) Forget(prefix string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for queueName := range f.queues {
+		if strings.HasPrefix(queueName, prefix) {
+			delete(f.queues, queueName)
+		}
+	}
+	for taskName := range f.tasks {
+		if strings.HasPrefix(taskName, prefix) {
+			delete(f.tasks, taskName)
+		}
+	}
+	for taskName := range f.tombstones {
+		if strings.HasPrefix(taskName, prefix) {
+			delete(f.tombstones, taskName)
+		}
+	}
+	return nil
+}
+
+func (f *fakeStorage) counts() (queues, tasks, tombstones int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return len(f.queues), len(f.tasks), len(f.tombstones)
+}
+
+func TestWithStorage(t *testing.T) {
+	storage := newFakeStorage()
+	server := NewServer(WithStorage(storage))
+	t.Cleanup(server.Shutdown)
+	ctx := context.Background()
+
+	queueState := newQueue(formattedParent, "stored")
+	queueState.State = taskspb.Queue_PAUSED
+	queue, err := server.CreateQueue(ctx, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queueState})
+	require.NoError(t, err)
+	storedQueue, ok, err := storage.GetQueue(queue.GetName())
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, taskspb.Queue_PAUSED, storedQueue.GetState())
+
+	taskName := queue.GetName() + "/tasks/stored"
+	createTask := func() error {
+		_, err := server.CreateTask(ctx, &taskspb.CreateTaskRequest{
+			Parent: queue.GetName(),
+			Task: &taskspb.Task{
+				Name:        taskName,
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+			},
+		})
+		return err
+	}
+	require.NoError(t, createTask())
+	storedTask, ok, err := storage.GetTask(taskName)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "http://localhost:1/task", storedTask.GetHttpRequest().GetUrl())
+
+	// The reads are served from the storage
+	storage.mux.Lock()
+	storage.taskReads = 0
+	storage.mux.Unlock()
+	gotTask, err := server.GetTask(ctx, &taskspb.GetTaskRequest{Name: taskName})
+	require.NoError(t, err)
+	assert.Equal(t, taskName, gotTask.GetName())
+	listed, err := server.ListTasks(ctx, &taskspb.ListTasksRequest{Parent: queue.GetName()})
+	require.NoError(t, err)
+	assert.Len(t, listed.GetTasks(), 1)
+	storage.mux.Lock()
+	assert.Equal(t, 2, storage.taskReads)
+	storage.mux.Unlock()
+
+	_, err = server.DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: taskName})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, tasks, tombstones := storage.counts()
+		return tasks == 0 && tombstones == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, codes.AlreadyExists, status.Code(createTask()))
+	_, err = server.GetTask(ctx, &taskspb.GetTaskRequest{Name: taskName})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Deleting the project forgets its queues and releases its task names
+	assert.Equal(t, 1, server.DeleteProject(strings.Split(formattedParent, "/")[1]))
+	queues, _, tombstones := storage.counts()
+	assert.Equal(t, 0, queues)
+	assert.Equal(t, 0, tombstones)
+	_, err = server.CreateQueue(ctx, &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queueState})
+	require.NoError(t, err)
+	require.NoError(t, createTask())
+}
@@ -2,14 +2,21 @@ package cloud_task_emulator
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +24,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	pduration "github.com/golang/protobuf/ptypes/duration"
 	ptimestamp "github.com/golang/protobuf/ptypes/timestamp"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
 	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -43,6 +51,40 @@ func isValidTaskName(name string) bool {
 	return r.MatchString(name)
 }
 
+// queueNameOf returns the name of the queue the task belongs to
+func queueNameOf(taskName string) string {
+	if i := strings.LastIndex(taskName, "/tasks/"); i >= 0 {
+		return taskName[:i]
+	}
+	return ""
+}
+
+// minTaskID keeps generated IDs at the 19 to 20 decimal digits production uses
+const minTaskID = 1000000000000000000
+
+// newTaskID generates a task ID in the format production uses for unnamed tasks
+func newTaskID() string {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return productionTaskID(binary.BigEndian.Uint64(b[:]))
+}
+
+// productionTaskID maps a random number to a task ID in the format production uses
+func productionTaskID(n uint64) string {
+	return strconv.FormatUint(minTaskID+n%(math.MaxUint64-minTaskID+1), 10)
+}
+
+// newCorrelationID generates the ID the log lines about a task are prefixed with
+func newCorrelationID() string {
+	var b [4]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
 type TaskNameParts struct {
 	project  string
 	location string
@@ -56,10 +98,41 @@ type Task struct {
 
 	state *tasks.Task
 
+	// ctx is cancelled when the task or its queue is deleted, aborting an in-flight dispatch
+	ctx context.Context
+
+	cancelDispatch context.CancelFunc
+
 	cancel chan bool
 
+	// pending is the schedule waiting for the task to be due, nil once it fired or was withdrawn
+	pending *schedule
+
 	onDone func(*Task)
 
+	// lastDispatchCode is the outcome of the previous dispatch as returned by dispatch, 0 before the first one
+	lastDispatchCode int
+
+	// frozen is set while the queue is paused during the retry backoff, which has frozenBackoff left to run
+	frozen bool
+
+	frozenBackoff time.Duration
+
+	// exhausted is set once the task ran out of attempts, until it is dispatched again
+	exhausted bool
+
+	// retired is set once the task is removed from the server, whose storage its state is not written to anymore
+	retired bool
+
+	// payload holds the HTTP or App Engine request of the task, encoded, while it is stored compactly
+	payload []byte
+
+	// trace is the trace the dispatches of the task are in, see setTraceHeaders
+	trace traceContext
+
+	// correlationID prefixes the log lines about the task, for following it in the logs
+	correlationID string
+
 	stateMutex sync.Mutex
 
 	cancelOnce sync.Once
@@ -67,30 +140,59 @@ type Task struct {
 
 // NewTask creates a new task for the specified queue
 func NewTask(queue *Queue, taskState *tasks.Task, onDone func(task *Task)) *Task {
-	SetInitialTaskState(taskState, queue.name)
+	if taskState.GetName() == "" && queue.taskIDs != nil {
+		taskState.Name = queue.name + "/tasks/" + queue.taskIDs()
+	}
+	setInitialTaskState(taskState, queue.name, queue.dispatcher.clock.Now())
+
+	ctx, cancelDispatch := context.WithCancel(queue.ctx)
 
 	task := &Task{
-		queue:  queue,
-		state:  taskState,
-		onDone: onDone,
-		cancel: make(chan bool, 1), // Buffered in case cancel comes when task is not scheduled
+		queue:          queue,
+		state:          taskState,
+		ctx:            ctx,
+		cancelDispatch: cancelDispatch,
+		onDone:         onDone,
+		correlationID:  newCorrelationID(),
+		cancel:         make(chan bool, 1), // Buffered in case cancel comes when task is not scheduled
 	}
 
 	return task
 }
 
+// restoredTask returns a task that ran out of attempts before the server restarted, with the state it was
+// stored with, for the server to restore without scheduling it
+func restoredTask(queue *Queue, taskState *tasks.Task, onDone func(task *Task)) *Task {
+	ctx, cancelDispatch := context.WithCancel(queue.ctx)
+
+	return &Task{
+		queue:            queue,
+		state:            taskState,
+		ctx:              ctx,
+		cancelDispatch:   cancelDispatch,
+		onDone:           onDone,
+		correlationID:    newCorrelationID(),
+		cancel:           make(chan bool, 1),
+		lastDispatchCode: restoredDispatchCode(taskState.GetLastAttempt().GetResponseStatus()),
+		exhausted:        true,
+	}
+}
+
 func SetInitialTaskState(taskState *tasks.Task, queueName string) {
+	setInitialTaskState(taskState, queueName, time.Now())
+}
+
+func setInitialTaskState(taskState *tasks.Task, queueName string, now time.Time) {
 	if taskState.GetName() == "" {
-		taskID := strconv.FormatUint(uint64(rand.Uint64()), 10)
-		taskState.Name = queueName + "/tasks/" + taskID
+		taskState.Name = queueName + "/tasks/" + newTaskID()
 	}
 
-	taskState.CreateTime = timestamppb.Now()
+	taskState.CreateTime = timestamppb.New(now)
 	// For some reason the cloud does not set nanos
 	taskState.CreateTime.Nanos = 0
 
 	if taskState.GetScheduleTime() == nil {
-		taskState.ScheduleTime = timestamppb.Now()
+		taskState.ScheduleTime = timestamppb.New(now)
 	}
 	if taskState.GetDispatchDeadline() == nil {
 		taskState.DispatchDeadline = &pduration.Duration{Seconds: 600}
@@ -105,11 +207,7 @@ func SetInitialTaskState(taskState *tasks.Task, queueName string) {
 		if httpRequest.GetHttpMethod() == tasks.HttpMethod_HTTP_METHOD_UNSPECIFIED {
 			httpRequest.HttpMethod = tasks.HttpMethod_POST
 		}
-		if httpRequest.GetHeaders() == nil {
-			httpRequest.Headers = make(map[string]string)
-		}
-		// Override
-		httpRequest.Headers["User-Agent"] = "Google-Cloud-Tasks"
+		httpRequest.Headers = mergeHeaders(httpRequest.GetHeaders(), len(httpRequest.GetBody()) > 0, false)
 	}
 
 	appEngineHTTPRequest := taskState.GetAppEngineHttpRequest()
@@ -118,17 +216,7 @@ func SetInitialTaskState(taskState *tasks.Task, queueName string) {
 		if appEngineHTTPRequest.GetHttpMethod() == tasks.HttpMethod_HTTP_METHOD_UNSPECIFIED {
 			appEngineHTTPRequest.HttpMethod = tasks.HttpMethod_POST
 		}
-		if appEngineHTTPRequest.GetHeaders() == nil {
-			appEngineHTTPRequest.Headers = make(map[string]string)
-		}
-
-		appEngineHTTPRequest.Headers["User-Agent"] = "AppEngine-Google; (+http://code.google.com/appengine)"
-
-		if appEngineHTTPRequest.GetBody() != nil {
-			if _, ok := appEngineHTTPRequest.GetHeaders()["Content-Type"]; !ok {
-				appEngineHTTPRequest.Headers["Content-Type"] = "application/octet-stream"
-			}
-		}
+		appEngineHTTPRequest.Headers = mergeHeaders(appEngineHTTPRequest.GetHeaders(), len(appEngineHTTPRequest.GetBody()) > 0, true)
 
 		if appEngineHTTPRequest.GetAppEngineRouting() == nil {
 			appEngineHTTPRequest.AppEngineRouting = &tasks.AppEngineRouting{}
@@ -147,6 +235,9 @@ func SetInitialTaskState(taskState *tasks.Task, queueName string) {
 				domainSeparator = "-dot-"
 			} else {
 				host = emulatorHost
+				if !strings.Contains(host, "://") {
+					host = "http://" + host
+				}
 				domainSeparator = "."
 			}
 
@@ -154,6 +245,8 @@ func SetInitialTaskState(taskState *tasks.Task, queueName string) {
 			if err != nil {
 				panic(err)
 			}
+			// The relative URI of the task follows the host
+			hostURL.Path = ""
 
 			if appEngineHTTPRequest.GetAppEngineRouting().GetService() != "" {
 				hostURL.Host = appEngineHTTPRequest.GetAppEngineRouting().GetService() + domainSeparator + hostURL.Host
@@ -174,18 +267,19 @@ func SetInitialTaskState(taskState *tasks.Task, queueName string) {
 	}
 }
 
-func updateStateForReschedule(task *Task) *tasks.Task {
-	// The lock is to ensure a consistent state when updating
-	task.stateMutex.Lock()
-	taskState := task.state
-	queueState := task.queue.state
-
-	retryConfig := queueState.GetRetryConfig()
+// outOfAttempts reports whether a task dispatched the given number of times cannot be retried.
+// Max attempts of -1 means unlimited attempts, and 1 no retries.
+func outOfAttempts(retryConfig *tasks.RetryConfig, dispatchCount int32) bool {
+	maxAttempts := retryConfig.GetMaxAttempts()
+	return maxAttempts != -1 && dispatchCount >= maxAttempts
+}
 
+// retryBackoff returns how long to wait before dispatching a task again after its given number of attempts
+func retryBackoff(retryConfig *tasks.RetryConfig, dispatchCount int32) time.Duration {
 	minBackoff := retryConfig.GetMinBackoff().AsDuration()
 	maxBackoff := retryConfig.GetMaxBackoff().AsDuration()
 
-	doubling := taskState.GetDispatchCount() - 1
+	doubling := dispatchCount - 1
 	if doubling > retryConfig.MaxDoublings {
 		doubling = retryConfig.MaxDoublings
 	}
@@ -193,21 +287,74 @@ func updateStateForReschedule(task *Task) *tasks.Task {
 	if backoff > maxBackoff {
 		backoff = maxBackoff
 	}
+	return backoff
+}
+
+// addBackoff returns the time the backoff after the given schedule time
+func addBackoff(scheduleTime *ptimestamp.Timestamp, backoff time.Duration) *ptimestamp.Timestamp {
 	protoBackoff := durationpb.New(backoff)
-	prevScheduleTime := taskState.GetScheduleTime()
 
 	// Avoid int32 nanos overflow
-	scheduleNanos := int64(prevScheduleTime.GetNanos()) + int64(protoBackoff.GetNanos())
-	scheduleSeconds := prevScheduleTime.GetSeconds() + protoBackoff.GetSeconds()
+	scheduleNanos := int64(scheduleTime.GetNanos()) + int64(protoBackoff.GetNanos())
+	scheduleSeconds := scheduleTime.GetSeconds() + protoBackoff.GetSeconds()
 	if scheduleNanos >= 1e9 {
 		scheduleSeconds++
 		scheduleNanos -= 1e9
 	}
 
-	taskState.ScheduleTime = &ptimestamp.Timestamp{
+	return &ptimestamp.Timestamp{
 		Nanos:   int32(scheduleNanos),
 		Seconds: scheduleSeconds,
 	}
+}
+
+// snapshot returns a copy of the task state, safe to read while the task runs
+func (task *Task) snapshot() *tasks.Task {
+	task.stateMutex.Lock()
+	taskState := proto.Clone(task.state).(*tasks.Task)
+	task.stateMutex.Unlock()
+
+	if task.payload != nil {
+		if err := task.queue.dispatcher.codec.decode(task.payload, taskState); err != nil {
+			task.logger().Printf("Could not decode %s: %v\n", taskState.GetName(), err)
+		}
+	}
+	return taskState
+}
+
+// store writes the state of the task through to the server's storage, unless the task is retired. The caller
+// holds the state lock, so that the writes are in the order of the changes.
+func (task *Task) store() {
+	if task.retired {
+		return
+	}
+	taskState := proto.Clone(task.state).(*tasks.Task)
+	if task.payload != nil {
+		if err := task.queue.dispatcher.codec.decode(task.payload, taskState); err != nil {
+			task.logger().Printf("Could not decode %s: %v\n", taskState.GetName(), err)
+			return
+		}
+	}
+	task.queue.dispatcher.storeTask(taskState)
+}
+
+// retire stops writing the state of the task to the storage, once the server removed it
+func (task *Task) retire() {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+	task.retired = true
+}
+
+func updateStateForReschedule(task *Task) *tasks.Task {
+	retryConfig := task.queue.retryConfig()
+
+	// The lock is to ensure a consistent state when updating
+	task.stateMutex.Lock()
+	taskState := task.state
+
+	backoff := task.queue.dispatcher.scheduler.Backoff(retryConfig, taskState.GetDispatchCount())
+	taskState.ScheduleTime = addBackoff(taskState.GetScheduleTime(), backoff)
+	task.store()
 
 	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
 	task.stateMutex.Unlock()
@@ -215,11 +362,74 @@ func updateStateForReschedule(task *Task) *tasks.Task {
 	return frozenTaskState
 }
 
+// updateStateForRetryConfig recomputes the schedule time of a task to be retried from its last attempt, with
+// the queue's current retry config
+func updateStateForRetryConfig(task *Task) {
+	retryConfig := task.queue.retryConfig()
+
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	taskState := task.state
+	lastAttempt := taskState.GetLastAttempt()
+	taskState.ScheduleTime = addBackoff(lastAttempt.GetScheduleTime(), task.queue.dispatcher.scheduler.Backoff(retryConfig, taskState.GetDispatchCount()))
+	task.store()
+}
+
+// failedLastAttempt reports whether the task got an error response from its last dispatch, as opposed to having
+// yet to run or being dispatched. The caller holds the state lock.
+func (task *Task) failedLastAttempt() bool {
+	if task.state.GetLastAttempt().GetResponseTime() == nil || task.lastDispatchCode == 0 {
+		return false
+	}
+	return task.lastDispatchCode < 200 || task.lastDispatchCode > 299
+}
+
+// ranOutOfAttempts reports whether the task failed its last attempt and is not retried anymore. Such tasks
+// stay until deleted, unless a queue update allows them more attempts.
+func (task *Task) ranOutOfAttempts() bool {
+	retryConfig := task.queue.retryConfig()
+
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	return task.failedLastAttempt() && outOfAttempts(retryConfig, task.state.GetDispatchCount())
+}
+
+// exhaustedAt returns when the task got the response of its last attempt, reporting false unless it ran
+// out of attempts
+func (task *Task) exhaustedAt() (time.Time, bool) {
+	if !task.ranOutOfAttempts() {
+		return time.Time{}, false
+	}
+
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+	return task.state.GetLastAttempt().GetResponseTime().AsTime(), true
+}
+
+// pendingRetry reports whether the task is scheduled to be retried
+func (task *Task) pendingRetry() bool {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	return task.pending != nil && task.failedLastAttempt()
+}
+
+func updateStateForRun(task *Task) {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	// A forced run replaces the pending schedule (including any retry backoff) with the current time
+	task.state.ScheduleTime = timestamppb.New(task.now())
+	task.store()
+}
+
 func updateStateForDispatch(task *Task) *tasks.Task {
 	task.stateMutex.Lock()
 	taskState := task.state
 
-	dispatchTime := timestamppb.Now()
+	dispatchTime := timestamppb.New(task.now())
 
 	taskState.LastAttempt = &tasks.Attempt{
 		ScheduleTime: &ptimestamp.Timestamp{
@@ -230,36 +440,43 @@ func updateStateForDispatch(task *Task) *tasks.Task {
 	}
 
 	taskState.DispatchCount++
+	task.exhausted = false
+	task.queue.dispatcher.counters.dispatched()
 
-	if taskState.GetFirstAttempt() == nil {
+	firstAttempt := taskState.GetFirstAttempt() == nil
+	if firstAttempt {
 		taskState.FirstAttempt = &tasks.Attempt{
 			DispatchTime: dispatchTime,
 		}
 	}
 
+	task.store()
 	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
 	task.stateMutex.Unlock()
 
+	if firstAttempt {
+		task.queue.stats.observeFirstDispatch(dispatchTime.AsTime().Sub(frozenTaskState.GetScheduleTime().AsTime()))
+	}
+
 	return frozenTaskState
 }
 
-func updateStateAfterDispatch(task *Task, statusCode int) *tasks.Task {
+// updateStateAfterDispatch records the outcome of the attempt, and the reason the target sent no response if it
+// didn't
+func updateStateAfterDispatch(task *Task, statusCode int, reason error) *tasks.Task {
 	task.stateMutex.Lock()
 
 	taskState := task.state
 
-	rpcCode := toRPCStatusCode(statusCode)
-	rpcCodeName := toCodeName(rpcCode)
-
 	lastAttempt := taskState.GetLastAttempt()
 
-	lastAttempt.ResponseTime = timestamppb.Now()
-	lastAttempt.ResponseStatus = &rpcstatus.Status{
-		Code:    rpcCode,
-		Message: fmt.Sprintf("%s(%d): HTTP status code %d", rpcCodeName, rpcCode, statusCode),
-	}
+	lastAttempt.ResponseTime = timestamppb.New(task.now())
+	task.queue.stats.observeAttempt(lastAttempt.GetResponseTime().AsTime().Sub(lastAttempt.GetDispatchTime().AsTime()))
+	lastAttempt.ResponseStatus = attemptStatus(statusCode, reason)
 
 	taskState.ResponseCount++
+	task.lastDispatchCode = statusCode
+	task.store()
 
 	frozenTaskState := proto.Clone(taskState).(*tasks.Task)
 	task.stateMutex.Unlock()
@@ -267,31 +484,136 @@ func updateStateAfterDispatch(task *Task, statusCode int) *tasks.Task {
 	return frozenTaskState
 }
 
-func (task *Task) reschedule(retry bool, statusCode int) {
+func (task *Task) reschedule(statusCode int) {
 	if statusCode >= 200 && statusCode <= 299 {
-		log.Println("Task done")
+		task.logger().Println("Task done")
+		task.queue.stats.observeOutcome(true, task.state.DispatchCount)
 		task.onDone(task)
 	} else {
-		log.Println("Task exec error with status " + strconv.Itoa(statusCode))
-		if retry {
-			retryConfig := task.queue.state.GetRetryConfig()
+		if statusCode < 0 {
+			task.logger().Println("Task exec error: " + task.state.GetLastAttempt().GetResponseStatus().GetMessage())
+		} else {
+			task.logger().Println("Task exec error with status " + strconv.Itoa(statusCode))
+		}
+		task.queue.dispatcher.counters.dispatchFailed()
+		// Forced runs are retried too, with the backoff counted from the time RunTask was called
+		retryConfig := task.queue.retryConfig()
+
+		if outOfAttempts(retryConfig, task.state.DispatchCount) {
+			task.logger().Println("Ran out of attempts")
+			task.stateMutex.Lock()
+			task.exhausted = true
+			task.stateMutex.Unlock()
+			task.queue.dispatcher.wal.event(walTaskFailed, task.state.GetName())
+			task.queue.stats.observeOutcome(false, task.state.DispatchCount)
+			task.queue.dispatcher.counters.ranOutOfAttempts()
+			task.queue.dispatcher.events.notify()
+		} else {
+			updateStateForReschedule(task)
+			task.queue.scheduleRetry(task)
+		}
+	}
+}
 
-			if task.state.DispatchCount >= retryConfig.GetMaxAttempts() {
-				log.Println("Ran out of attempts")
-			} else {
-				updateStateForReschedule(task)
-				task.Schedule()
-			}
+// restoredDispatchCode returns the outcome of an attempt as dispatch returned it, from the status attemptStatus
+// recorded
+func restoredDispatchCode(status *rpcstatus.Status) int {
+	message := status.GetMessage()
+	if i := strings.LastIndex(message, "HTTP status code "); i >= 0 {
+		if statusCode, err := strconv.Atoi(message[i+len("HTTP status code "):]); err == nil {
+			return statusCode
 		}
 	}
+	if status.GetCode() == int32(rpccode.Code_DEADLINE_EXCEEDED) {
+		return dispatchTimeout
+	}
+	return dispatchConnectionError
+}
+
+// dispatchConnectionError and dispatchTimeout are returned by dispatch when the target sent no response
+const (
+	dispatchConnectionError = -1
+	dispatchTimeout         = -2
+)
+
+// attemptStatus describes the outcome of an attempt: the RPC code matching the status code of the response, or
+// UNAVAILABLE or DEADLINE_EXCEEDED, like production, if the target could not be reached or did not respond in
+// time, with the reason
+func attemptStatus(statusCode int, reason error) *rpcstatus.Status {
+	var rpcCode int32
+	var description string
+	switch statusCode {
+	case dispatchConnectionError:
+		rpcCode = int32(rpccode.Code_UNAVAILABLE)
+		description = "The target could not be reached"
+	case dispatchTimeout:
+		rpcCode = int32(rpccode.Code_DEADLINE_EXCEEDED)
+		description = "The target did not respond in time"
+	default:
+		rpcCode = toRPCStatusCode(statusCode)
+		return &rpcstatus.Status{
+			Code:    rpcCode,
+			Message: fmt.Sprintf("%s(%d): HTTP status code %d", toCodeName(rpcCode), rpcCode, statusCode),
+		}
+	}
+	if reason != nil {
+		description += ": " + reason.Error()
+	}
+	return &rpcstatus.Status{
+		Code:    rpcCode,
+		Message: fmt.Sprintf("%s(%d): %s", toCodeName(rpcCode), rpcCode, description),
+	}
+}
+
+// simulatedFailure is the reason of a dispatch failed with the outcome without sending it, nil if the outcome is
+// a status code
+func simulatedFailure(code int, by string) error {
+	if code > 0 {
+		return nil
+	}
+	return fmt.Errorf("failed by %s without sending the request", by)
 }
 
-func dispatch(retry bool, taskState *tasks.Task) int {
-	client := &http.Client{}
-	client.Timeout = taskState.GetDispatchDeadline().AsDuration()
+// retryReason describes why a task is dispatched again after the given outcome, using the RPC code names
+func retryReason(previousDispatchCode int) string {
+	switch previousDispatchCode {
+	case 0:
+		return ""
+	case dispatchTimeout:
+		return rpccode.Code_DEADLINE_EXCEEDED.String()
+	case dispatchConnectionError:
+		return rpccode.Code_UNAVAILABLE.String()
+	default:
+		return toCodeName(toRPCStatusCode(previousDispatchCode))
+	}
+}
+
+// setRetryHeaders sets the TaskPreviousResponse and TaskRetryReason headers of a retried dispatch,
+// removing any left over from a previous dispatch otherwise
+func setRetryHeaders(headers map[string]string, prefix string, previousDispatchCode int) {
+	if previousDispatchCode > 0 {
+		headers[prefix+"TaskPreviousResponse"] = strconv.Itoa(previousDispatchCode)
+	} else {
+		delete(headers, prefix+"TaskPreviousResponse")
+	}
+	if reason := retryReason(previousDispatchCode); reason != "" {
+		headers[prefix+"TaskRetryReason"] = reason
+	} else {
+		delete(headers, prefix+"TaskRetryReason")
+	}
+}
+
+// dispatch sends the request of the task, in the trace, returning the status code of the response, or
+// dispatchConnectionError or dispatchTimeout with the reason the target sent no response
+func dispatch(ctx context.Context, dispatcher *dispatcher, logger taskLogger, taskState *tasks.Task, trace traceContext, previousDispatchCode int, httpTarget *HttpTarget) (int, error) {
+	options := dispatcher.options
+	client := dispatcher.httpClient()
+	client.Timeout = options.timeout(taskState)
 
 	var req *http.Request
 	var headers map[string]string
+	var body []byte
+	var taskURL string
 
 	httpRequest := taskState.GetHttpRequest()
 	appEngineHTTPRequest := taskState.GetAppEngineHttpRequest()
@@ -308,35 +630,51 @@ func dispatch(retry bool, taskState *tasks.Task) int {
 	if httpRequest != nil {
 		method := toHTTPMethod(httpRequest.GetHttpMethod())
 
-		req, _ = http.NewRequest(method, httpRequest.GetUrl(), bytes.NewBuffer(httpRequest.GetBody()))
+		body = httpRequest.GetBody()
+		taskURL = httpTarget.overrideURL(httpRequest.GetUrl())
+		req, _ = http.NewRequestWithContext(ctx, method, options.resolveURL(queueNameOf(taskState.GetName()), taskURL), bytes.NewBuffer(body))
+		req.Host = hostHeader(req.URL)
 
-		headers = httpRequest.GetHeaders()
+		// A copy, the dispatch headers are not part of the task
+		headers = copyHeaders(httpRequest.GetHeaders())
 
 		// Headers as per https://cloud.google.com/tasks/docs/creating-http-target-tasks#handler
-		// TODO: optional headers
 		headers["X-CloudTasks-QueueName"] = headerQueueName
 		headers["X-CloudTasks-TaskName"] = headerTaskName
 		headers["X-CloudTasks-TaskExecutionCount"] = headerTaskExecutionCount
 		headers["X-CloudTasks-TaskRetryCount"] = headerTaskRetryCount
 		headers["X-CloudTasks-TaskETA"] = headerTaskETA
+		setRetryHeaders(headers, "X-CloudTasks-", previousDispatchCode)
+		trace.setTraceHeaders(headers)
 	} else if appEngineHTTPRequest != nil {
 		method := toHTTPMethod(appEngineHTTPRequest.GetHttpMethod())
 
 		host := appEngineHTTPRequest.GetAppEngineRouting().GetHost()
 
-		url := host + appEngineHTTPRequest.GetRelativeUri()
+		targetURL := host + appEngineHTTPRequest.GetRelativeUri()
+		if target, ok := options.QueueTargets[queueNameOf(taskState.GetName())]; ok {
+			targetURL = retarget(targetURL, target)
+		}
 
-		req, _ = http.NewRequest(method, url, bytes.NewBuffer(appEngineHTTPRequest.GetBody()))
+		body = appEngineHTTPRequest.GetBody()
+		req, _ = http.NewRequestWithContext(ctx, method, targetURL, bytes.NewBuffer(body))
+		// The Host header names the targeted service and version, even when the queue sends its tasks elsewhere
+		if hostURL, err := url.Parse(host); err == nil {
+			req.Host = hostHeader(hostURL)
+		}
 
-		headers = appEngineHTTPRequest.GetHeaders()
+		headers = copyHeaders(appEngineHTTPRequest.GetHeaders())
 
 		// These headers are only set on dispatch, see https://cloud.google.com/tasks/docs/reference/rpc/google.cloud.tasks.v2#google.cloud.tasks.v2.AppEngineHttpRequest
-		// TODO: optional headers
+		// and https://cloud.google.com/tasks/docs/creating-appengine-handlers#reading_task_request_headers.
+		// X-AppEngine-FailFast is passed on as set by the task, there being no instances to fail fast on.
 		headers["X-AppEngine-QueueName"] = headerQueueName
 		headers["X-AppEngine-TaskName"] = headerTaskName
 		headers["X-AppEngine-TaskRetryCount"] = headerTaskRetryCount
 		headers["X-AppEngine-TaskExecutionCount"] = headerTaskExecutionCount
 		headers["X-AppEngine-TaskETA"] = headerTaskETA
+		setRetryHeaders(headers, "X-AppEngine-", previousDispatchCode)
+		trace.setTraceHeaders(headers)
 	}
 
 	for k, v := range headers {
@@ -344,47 +682,210 @@ func dispatch(retry bool, taskState *tasks.Task) int {
 		// TODO: figure out a way to test these, as the Go net/http client lib overrides the incoming header capitalization
 		req.Header[k] = []string{v}
 	}
+	for k, v := range options.Headers {
+		// The task's own headers win
+		if !hasHeader(headers, k) {
+			req.Header[k] = []string{v}
+		}
+	}
+	if httpRequest != nil {
+		httpTarget.overrideHeaders(req.Header)
+	}
+	if options.Hook != nil {
+		decision, err := options.Hook.call(taskState.GetName(), taskState.GetDispatchCount(), req, body)
+		if err != nil {
+			logger.Printf("The dispatch hook failed on %s, dispatching it unchanged: %v\n", taskState.GetName(), err)
+		} else {
+			if decision.failCode != 0 {
+				logger.Printf("The dispatch hook failed the dispatch of %s with %d\n", taskState.GetName(), decision.failCode)
+				return decision.failCode, simulatedFailure(decision.failCode, "the dispatch hook")
+			}
+			body = decision.apply(req, body)
+			if decision.delay > 0 {
+				timer := time.NewTimer(decision.delay)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return dispatchConnectionError, ctx.Err()
+				}
+			}
+		}
+	}
+	if oidcToken := httpTarget.oidcToken(httpRequest); oidcToken != nil {
+		token, err := options.mintOIDCToken(oidcToken, taskURL, dispatcher.clock.Now())
+		if err != nil {
+			logger.Println(err)
+			return dispatchConnectionError, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if dispatcher.taskTransport == nil {
+		checked, err := options.checkTarget(ctx, req.URL, dispatcher.dialsTarget(req), logger)
+		if err != nil {
+			logger.Println(err)
+			return dispatchConnectionError, err
+		}
+		req = req.WithContext(checked)
+	}
 
-	resp, err := client.Do(req)
+	if chaos := dispatcher.chaos(); chaos != nil {
+		if failure, failed := chaos.fail(); failed {
+			logger.Printf("Chaos failed the dispatch of %s with %s\n", taskState.GetName(), failure)
+			return failure.dispatchCode(), simulatedFailure(failure.dispatchCode(), "chaos")
+		}
+	}
+
+	if !dispatcher.acquire(ctx) {
+		return dispatchConnectionError, ctx.Err()
+	}
+	defer dispatcher.release()
+
+	if options.LogLevel >= LogDebug {
+		logDispatchRequest(logger, req, body)
+	}
+	start := time.Now()
+	resp, err := dispatcher.deliver(ctx, client, taskState, req)
+	if err == nil && options.LogLevel >= LogDebug {
+		logDispatchResponse(logger, req, resp)
+	}
+	if dispatcher.observed() {
+		dispatcher.record(taskState.GetName(), req, body, resp, err, time.Since(start))
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		return -1
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.Timeout() {
+			// The host doesn't resolve, as unreachable as a refused connection
+			err = fmt.Errorf("could not resolve host %s: %s", dnsErr.Name, dnsErr.Err)
+			logger.Printf("Could not dispatch %s: %v\n", taskState.GetName(), err)
+			return dispatchConnectionError, err
+		}
+		logger.Println(err)
+		var timeoutErr interface{ Timeout() bool }
+		if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+			return dispatchTimeout, err
+		}
+		return dispatchConnectionError, err
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode
+	if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
+		logger.Printf("Not following the redirect of %s to %q\n", taskState.GetName(), resp.Header.Get("Location"))
+	}
+	return resp.StatusCode, nil
 }
 
-func (task *Task) doDispatch(retry bool) {
-	respCode := dispatch(retry, task.state)
+func (task *Task) doDispatch() {
+	task.stateMutex.Lock()
+	previousDispatchCode := task.lastDispatchCode
+	task.stateMutex.Unlock()
 
-	updateStateAfterDispatch(task, respCode)
-	task.reschedule(retry, respCode)
+	taskState := task.view()
+	task.logger().Printf("Dispatching %s, attempt %d\n", taskState.GetName(), taskState.GetDispatchCount())
+
+	var reason error
+	respCode, forced := task.queue.takeForcedFailure()
+	if forced {
+		task.logger().Printf("Forced the dispatch of %s to fail with %d\n", taskState.GetName(), respCode)
+	} else {
+		respCode, reason = dispatch(task.ctx, task.queue.dispatcher, task.logger(), taskState, task.trace, previousDispatchCode, task.queue.Settings().HttpTarget)
+	}
+	if task.ctx.Err() != nil {
+		// Deleted during the dispatch, the attempt is abandoned without a response
+		task.abandon()
+		return
+	}
+
+	updateStateAfterDispatch(task, respCode, reason)
+	task.reschedule(respCode)
 }
 
 // Attempt tries to execute a task
 func (task *Task) Attempt() {
+	if task.ctx.Err() != nil {
+		// Deleted on its way to the worker
+		task.abandon()
+		return
+	}
 	updateStateForDispatch(task)
 
-	task.doDispatch(true)
+	task.doDispatch()
 }
 
 // Run runs the task outside of the normal queueing mechanism.
+// As in production, the dispatch ignores the queue's rate limits and happens even if the queue is paused.
+// Any pending schedule or retry backoff is withdrawn and the schedule time is reset to now.
 // This method is called directly by request.
 func (task *Task) Run() *tasks.Task {
+	task.unschedule()
+	updateStateForRun(task)
 	taskState := updateStateForDispatch(task)
 
-	go task.doDispatch(false)
+	go task.doDispatch()
 
 	return taskState
 }
 
-// Delete cancels the task if it is queued for execution.
-// This method is called directly by request.
+// abandon removes a task deleted while it was not scheduled, i.e. with nothing listening for its cancellation.
+// Tasks of a deleted queue are left to the queue.
+func (task *Task) abandon() {
+	if task.queue.ctx.Err() == nil {
+		task.onDone(task)
+	}
+}
+
+// Delete cancels the task, whether it is queued for execution, waiting to be retried, being dispatched or out
+// of attempts. An in-flight dispatch is aborted: the target sees its request cancelled and the task is not
+// retried. This method is called directly by request.
 func (task *Task) Delete() {
 	task.cancelOnce.Do(func() {
 		task.cancel <- true
+		task.cancelDispatch()
 	})
+	if task.unfreeze() || task.takeExhausted() {
+		// No schedule is waiting for the cancellation. The caller may hold the queue's task lock.
+		go task.onDone(task)
+	}
+}
+
+// now tells the time on the server's clock
+func (task *Task) now() time.Time {
+	return task.queue.dispatcher.clock.Now()
+}
+
+func (task *Task) logger() taskLogger {
+	return taskLogger{logger: task.queue.dispatcher.logger, correlationID: task.correlationID}
+}
+
+// taskLogger logs the lines about a task, prefixed with its correlation ID
+type taskLogger struct {
+	logger        *log.Logger
+	correlationID string
+}
+
+func (l taskLogger) Printf(format string, v ...interface{}) {
+	l.logger.Printf("[%s] "+format, append([]interface{}{l.correlationID}, v...)...)
+}
+
+func (l taskLogger) Println(v ...interface{}) {
+	l.logger.Println(append([]interface{}{"[" + l.correlationID + "]"}, v...)...)
+}
+
+// schedule is a pending schedule of a task, see Task.Schedule
+type schedule struct {
+	// withdraw is closed to withdraw the schedule
+	withdraw chan struct{}
+
+	// done is closed once the schedule is over, withdrawn reporting whether it was withdrawn before the task
+	// was dispatched
+	done      chan struct{}
+	withdrawn bool
+}
+
+func (pending *schedule) finish(withdrawn bool) {
+	pending.withdrawn = withdrawn
+	close(pending.done)
 }
 
 // Schedule schedules the task for execution.
@@ -392,16 +893,181 @@ func (task *Task) Delete() {
 func (task *Task) Schedule() {
 	scheduled := task.state.GetScheduleTime().AsTime()
 
-	fromNow := time.Until(scheduled)
+	pending := &schedule{withdraw: make(chan struct{}), done: make(chan struct{})}
+	task.stateMutex.Lock()
+	task.pending = pending
+	task.stateMutex.Unlock()
 
+	counters := &task.queue.dispatcher.counters
+	counters.scheduling(1)
 	go func() {
+		defer counters.scheduling(-1)
+
+		due, stop := task.queue.dispatcher.scheduler.Wait(scheduled)
+		defer stop()
+
+		// The schedule finishes before the task is removed, for unschedule not to wait on the callers' locks
 		select {
-		case <-time.After(fromNow):
-			task.queue.fire <- task
+		case <-due:
+		case <-pending.withdraw:
+			pending.finish(true)
 			return
 		case <-task.cancel:
+			pending.finish(false)
 			task.onDone(task)
 			return
+		case <-task.ctx.Done():
+			pending.finish(false)
+			task.abandon()
+			return
+		}
+		// The task waits in the ready queue while the queue is paused or rate limited, so keep listening
+		// for cancellation. Once the dispatcher took it, it is too late to withdraw.
+		entry := task.queue.ready.push(task, scheduled)
+		select {
+		case <-entry.taken:
+			task.stateMutex.Lock()
+			if task.pending == pending {
+				// Fired, there is nothing left to withdraw
+				task.pending = nil
+			}
+			task.stateMutex.Unlock()
+			pending.finish(false)
+		case <-pending.withdraw:
+			pending.finish(task.queue.ready.remove(entry))
+		case <-task.cancel:
+			removed := task.queue.ready.remove(entry)
+			pending.finish(false)
+			if removed {
+				task.onDone(task)
+			}
+		case <-task.ctx.Done():
+			removed := task.queue.ready.remove(entry)
+			pending.finish(false)
+			if removed {
+				task.abandon()
+			}
 		}
 	}()
 }
+
+// retryNow cuts short the backoff of a task waiting to be retried, for its queue to dispatch it as soon as its
+// rate limits allow, or it resumes. Unlike Run, the attempt goes through the queue. It reports false if the task
+// is not waiting to be retried.
+func (task *Task) retryNow() bool {
+	task.stateMutex.Lock()
+	backingOff := task.failedLastAttempt()
+	task.stateMutex.Unlock()
+	// The retry may have fired in the meantime, it is only rescheduled if it was still waiting
+	if !backingOff || !task.unschedule() {
+		return false
+	}
+
+	updateStateForRun(task)
+	task.queue.scheduleRetry(task)
+	return true
+}
+
+// moveSchedule changes the schedule time of a task waiting for its first attempt or to be retried, reporting
+// false if the task is being dispatched or not scheduled at all
+func (task *Task) moveSchedule(scheduleTime time.Time) bool {
+	// The schedule may have fired in the meantime, it is only moved if it was still waiting
+	if !task.unschedule() {
+		return false
+	}
+
+	task.stateMutex.Lock()
+	retry := task.failedLastAttempt()
+	task.state.ScheduleTime = timestamppb.New(scheduleTime)
+	task.store()
+	task.stateMutex.Unlock()
+
+	if retry {
+		task.queue.scheduleRetry(task)
+	} else {
+		task.Schedule()
+	}
+	return true
+}
+
+// reevaluateBackoff reschedules a task waiting to be retried after the retry config of its queue changed.
+// Tasks that had run out of attempts are retried again if the new config allows more.
+func (task *Task) reevaluateBackoff() {
+	retryConfig := task.queue.retryConfig()
+	task.stateMutex.Lock()
+	retrying := task.failedLastAttempt() && !outOfAttempts(retryConfig, task.state.GetDispatchCount())
+	task.stateMutex.Unlock()
+	// The retry may have fired in the meantime, it is only rescheduled if it was still waiting
+	if !retrying || !(task.unschedule() || task.takeExhausted()) {
+		return
+	}
+
+	updateStateForRetryConfig(task)
+	task.queue.scheduleRetry(task)
+}
+
+// takeExhausted clears the exhausted flag of a task, reporting whether it had run out of attempts
+func (task *Task) takeExhausted() bool {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	exhausted := task.exhausted
+	task.exhausted = false
+	return exhausted
+}
+
+// freeze holds back the retry of a task while its queue is paused, keeping the backoff left until its
+// schedule time. The pending schedule, if any, must be withdrawn first.
+func (task *Task) freeze() {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	task.frozen = true
+	task.frozenBackoff = task.state.GetScheduleTime().AsTime().Sub(task.now())
+	if task.frozenBackoff < 0 {
+		task.frozenBackoff = 0
+	}
+}
+
+// unfreeze clears the frozen retry of a task, reporting whether it had one
+func (task *Task) unfreeze() bool {
+	task.stateMutex.Lock()
+	defer task.stateMutex.Unlock()
+
+	frozen := task.frozen
+	task.frozen = false
+	return frozen
+}
+
+// thaw schedules the frozen retry of a task once its queue resumes, with the backoff it had left
+func (task *Task) thaw() {
+	task.stateMutex.Lock()
+	if !task.frozen {
+		task.stateMutex.Unlock()
+		return
+	}
+	task.frozen = false
+	task.state.ScheduleTime = timestamppb.New(task.now().Add(task.frozenBackoff))
+	task.store()
+	task.stateMutex.Unlock()
+
+	task.Schedule()
+}
+
+// unschedule withdraws the pending schedule, or the frozen retry, without deleting the task. It reports
+// whether it withdrew either before the task was dispatched.
+func (task *Task) unschedule() bool {
+	task.stateMutex.Lock()
+	pending := task.pending
+	task.pending = nil
+	frozen := task.frozen
+	task.frozen = false
+	task.stateMutex.Unlock()
+
+	if pending == nil {
+		return frozen
+	}
+	close(pending.withdraw)
+	<-pending.done
+	return pending.withdrawn || frozen
+}
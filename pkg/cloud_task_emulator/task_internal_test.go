@@ -9,6 +9,19 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func TestSetInitialTaskStateGeneratesProductionLikeName(t *testing.T) {
+	queueName := "projects/bluebook/locations/us-east1/queues/agentq"
+
+	first := &taskspb.Task{}
+	SetInitialTaskState(first, queueName)
+	second := &taskspb.Task{}
+	SetInitialTaskState(second, queueName)
+
+	assert.Regexp(t, "^"+queueName+"/tasks/[1-9][0-9]{18,19}$", first.GetName())
+	assert.Regexp(t, "^"+queueName+"/tasks/[1-9][0-9]{18,19}$", second.GetName())
+	assert.NotEqual(t, first.GetName(), second.GetName())
+}
+
 func TestSetInitialTaskStateAppEngineNoEmulatorDefaults(t *testing.T) {
 	taskState := &taskspb.Task{
 		MessageType: &taskspb.Task_AppEngineHttpRequest{
@@ -70,3 +83,19 @@ func TestSetInitialTaskStateAppEngineEmulatorTargeted(t *testing.T) {
 
 	assert.Equal(t, "http://2.v1.worker.nginx", taskState.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost())
 }
+
+func TestSetInitialTaskStateAppEngineEmulatorHostWithoutScheme(t *testing.T) {
+	defer os.Unsetenv("APP_ENGINE_EMULATOR_HOST")
+	os.Setenv("APP_ENGINE_EMULATOR_HOST", "localhost:8080/")
+
+	taskState := &taskspb.Task{
+		MessageType: &taskspb.Task_AppEngineHttpRequest{
+			AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+				AppEngineRouting: &taskspb.AppEngineRouting{Service: "worker"},
+			},
+		},
+	}
+	SetInitialTaskState(taskState, "projects/bluebook/locations/us-east1/queues/agentq")
+
+	assert.Equal(t, "http://worker.localhost:8080", taskState.GetAppEngineHttpRequest().GetAppEngineRouting().GetHost())
+}
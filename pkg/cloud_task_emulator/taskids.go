@@ -0,0 +1,90 @@
+package cloud_task_emulator
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TaskIDFormat is the template of the IDs of tasks created without a name, e.g. "{queue}-{timestamp}-{id}":
+// {queue} is the ID of the queue, {timestamp} the time the task is created, in UTC on the emulator's clock, as
+// 20060102-150405, and {id} the ID the task would get otherwise. A format without {id} is a prefix of the ID.
+type TaskIDFormat string
+
+// taskIDPlaceholder matches the placeholders of a TaskIDFormat
+var taskIDPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// taskIDLiteral matches what a TaskIDFormat may have besides placeholders, the characters of task IDs
+var taskIDLiteral = regexp.MustCompile(`^[a-zA-Z0-9_-]*$`)
+
+// ParseTaskIDFormat parses a TaskIDFormat, checking its placeholders and that the rest is fit for a task ID
+func ParseTaskIDFormat(value string) (TaskIDFormat, error) {
+	for _, placeholder := range taskIDPlaceholder.FindAllString(value, -1) {
+		switch placeholder {
+		case "{queue}", "{timestamp}", "{id}":
+		default:
+			return "", fmt.Errorf("invalid task ID format %q: unknown placeholder %s, expected {queue}, {timestamp} or {id}", value, placeholder)
+		}
+	}
+	if !taskIDLiteral.MatchString(taskIDPlaceholder.ReplaceAllString(value, "")) {
+		return "", fmt.Errorf("invalid task ID format %q: task IDs only have letters, digits, hyphens and underscores", value)
+	}
+	return TaskIDFormat(value), nil
+}
+
+// expand returns the ID of a task of the queue created at the time, which would get the ID otherwise
+func (format TaskIDFormat) expand(queueID string, now time.Time, taskID string) string {
+	template := string(format)
+	if !strings.Contains(template, "{id}") {
+		template += "{id}"
+	}
+	return strings.NewReplacer(
+		"{queue}", queueID,
+		"{timestamp}", now.UTC().Format("20060102-150405"),
+		"{id}", taskID,
+	).Replace(template)
+}
+
+// newTaskIDs returns the generator of the IDs of the queue's tasks created without a name, nil for production's
+// random IDs. Generated IDs skip the names of tasks that exist or are reserved, e.g. named explicitly.
+func (s *Server) newTaskIDs(queueName string) func() string {
+	var next func() string
+	switch {
+	case s.options.SequentialTaskIDs:
+		count := 0
+		next = func() string {
+			count++
+			return fmt.Sprintf("task-%04d", count)
+		}
+	case s.options.TaskIDSeed != 0:
+		// Seeded per queue, for the IDs of a queue not to depend on the tasks created on others
+		random := rand.New(rand.NewSource(s.options.TaskIDSeed ^ int64(hashTaskName(queueName))))
+		next = func() string {
+			return productionTaskID(random.Uint64())
+		}
+	case s.options.TaskIDFormat != "":
+		next = newTaskID
+	default:
+		return nil
+	}
+	format := s.options.TaskIDFormat
+	if format == "" {
+		format = "{id}"
+	}
+	queueID := queueName[strings.LastIndex(queueName, "/")+1:]
+
+	var mux sync.Mutex
+	return func() string {
+		mux.Lock()
+		defer mux.Unlock()
+		for {
+			taskID := format.expand(queueID, s.clock.Now(), next())
+			if _, known, _ := s.fetchTask(queueName + "/tasks/" + taskID); !known {
+				return taskID
+			}
+		}
+	}
+}
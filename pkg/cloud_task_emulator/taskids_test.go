@@ -0,0 +1,81 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	. "cloud.google.com/go/cloudtasks/apiv2"
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createPausedTasks creates the tasks, named if given a name, on a new paused queue and returns their names
+func createPausedTasks(t *testing.T, client *Client, queueID string, taskIDs ...string) []string {
+	queueState := newQueue(formattedParent, queueID)
+	queueState.State = taskspb.Queue_PAUSED
+	queue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: queueState})
+	require.NoError(t, err)
+
+	var names []string
+	for _, taskID := range taskIDs {
+		task := &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/task"}},
+		}
+		if taskID != "" {
+			task.Name = queue.GetName() + "/tasks/" + taskID
+		}
+		created, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{Parent: queue.GetName(), Task: task})
+		require.NoError(t, err)
+		names = append(names, created.GetName()[len(queue.GetName()+"/tasks/"):])
+	}
+	return names
+}
+
+func TestSequentialTaskIDs(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{SequentialTaskIDs: true})
+
+	assert.Equal(t, []string{"task-0001", "task-0002"}, createPausedTasks(t, client, "sequential", "", ""))
+	// Per queue, skipping the IDs taken
+	assert.Equal(t, []string{"task-0002", "task-0001", "task-0003"}, createPausedTasks(t, client, "other", "task-0002", "", ""))
+}
+
+func TestSeededTaskIDs(t *testing.T) {
+	productionID := regexp.MustCompile(`^[0-9]{19,20}$`)
+	run := func(seed int64) []string {
+		client := RunTWithOptions(t, ServerOptions{TaskIDSeed: seed})
+		taskIDs := createPausedTasks(t, client, "seeded", "", "", "")
+		for _, taskID := range taskIDs {
+			assert.Regexp(t, productionID, taskID)
+		}
+		return taskIDs
+	}
+
+	first := run(42)
+	assert.Equal(t, first, run(42))
+	assert.NotEqual(t, first, run(43))
+}
+
+func TestTaskIDFormat(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	format, err := ParseTaskIDFormat("{queue}-{timestamp}-{id}")
+	require.NoError(t, err)
+	client, _, _ := RunTWithServer(t, ServerOptions{SequentialTaskIDs: true, TaskIDFormat: format}, WithClock(fixedClock(created)))
+	assert.Equal(t, []string{"formatted-20240102-030405-task-0001"}, createPausedTasks(t, client, "formatted", ""))
+
+	// A prefix of production's IDs
+	format, err = ParseTaskIDFormat("checkout_")
+	require.NoError(t, err)
+	client = RunTWithOptions(t, ServerOptions{TaskIDFormat: format})
+	assert.Regexp(t, `^checkout_[0-9]{19,20}$`, createPausedTasks(t, client, "prefixed", "")[0])
+}
+
+func TestParseTaskIDFormatRejectsInvalidFormats(t *testing.T) {
+	for _, value := range []string{"{queue}-{name}", "test case/{id}", "{id}.json"} {
+		_, err := ParseTaskIDFormat(value)
+		assert.Error(t, err, value)
+	}
+}
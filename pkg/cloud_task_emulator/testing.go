@@ -6,29 +6,71 @@ import (
 	"testing"
 
 	. "cloud.google.com/go/cloudtasks/apiv2"
-	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 func RunT(t *testing.T) *Client {
-	grpcServ := grpc.NewServer()
+	return RunTWithOptions(t, ServerOptions{})
+}
 
-	emulatorServer := NewServer()
-	emulatorServer.Options = ServerOptions{}
-	taskspb.RegisterCloudTasksServer(grpcServ, emulatorServer)
+// RunTWithOptions is like RunT but configures the emulator with the given options
+func RunTWithOptions(t *testing.T, options ServerOptions) *Client {
+	client, _, _ := RunTWithServer(t, options)
+	return client
+}
 
+// RunTWithServer is like RunTWithOptions, further configured by opts, but also returns the emulator server and
+// the address it listens on, for tests to combine the client with the server's own methods, e.g.
+// WaitForTaskCompletion, or to connect clients of their own
+func RunTWithServer(t *testing.T, options ServerOptions, opts ...Option) (*Client, *Server, string) {
 	lis, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
+	client, emulatorServer := runT(t, options, opts, lis, grpc.WithInsecure())
+	return client, emulatorServer, lis.Addr().String()
+}
+
+// RunTInMemory is like RunTWithServer, but the client talks to the server through an in-memory connection
+// instead of a TCP listener, for sandboxes that forbid listening sockets. Dispatching tasks to HTTP targets still
+// connects to them, see WithTransport and HandlerTransport to deliver them in memory too.
+func RunTInMemory(t *testing.T, options ServerOptions, opts ...Option) (*Client, *Server) {
+	lis := bufconn.Listen(inMemoryBufferSize)
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	return runT(t, options, opts, lis, grpc.WithContextDialer(dialer), grpc.WithInsecure())
+}
+
+// inMemoryBufferSize is the size of the buffers of the connections of RunTInMemory
+const inMemoryBufferSize = 1 << 20
+
+// runT serves a new emulator on the listener, stopped when the test ends, and returns a client of it dialed with
+// the options
+func runT(t *testing.T, options ServerOptions, opts []Option, lis net.Listener, dialOpts ...grpc.DialOption) (*Client, *Server) {
+	emulatorServer := NewServer(append([]Option{WithOptions(options)}, opts...)...)
+
+	grpcServ := emulatorServer.NewGrpcServer()
+
 	go func() {
 		if err := grpcServ.Serve(lis); err != nil {
-			t.Fatal(err)
+			// Not t.Fatal, which may only be called from the goroutine running the test
+			t.Error(err)
 		}
 	}()
 
-	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	// The client accepts what the server sends, and sends what the server accepts
+	var callOpts []grpc.CallOption
+	if options.MaxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(options.MaxSendMsgSize))
+	}
+	if options.MaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(options.MaxRecvMsgSize))
+	}
+
+	conn, err := grpc.Dial(lis.Addr().String(), append(dialOpts, grpc.WithDefaultCallOptions(callOpts...))...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,7 +83,8 @@ func RunT(t *testing.T) *Client {
 
 	t.Cleanup(func() {
 		grpcServ.Stop()
+		emulatorServer.Shutdown()
 	})
 
-	return client
+	return client, emulatorServer
 }
@@ -0,0 +1,69 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "cloud.google.com/go/cloudtasks/apiv2"
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestRunTWithServer(t *testing.T) {
+	serverURL, requests := startTestServer(t)
+	client, server, addr := RunTWithServer(t, ServerOptions{}, WithHardReset(true))
+	assert.True(t, server.Options().HardResetOnPurgeQueue)
+
+	queue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "white-box")})
+	require.NoError(t, err)
+	task, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: serverURL + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = awaitHttpRequest(requests)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+
+	// Another client of the same server
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	other, err := NewClient(context.Background(), option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	_, err = other.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	assert.NoError(t, err)
+}
+
+func TestRunTInMemory(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	client, server := RunTInMemory(t, ServerOptions{}, WithTransport(HandlerTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))))
+
+	queue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "in-memory")})
+	require.NoError(t, err)
+	task, err := client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://app.invalid/work"}},
+		},
+	})
+	require.NoError(t, err)
+	req, err := awaitHttpRequest(requests)
+	require.NoError(t, err)
+	assert.Equal(t, "/work", req.URL.Path)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+}
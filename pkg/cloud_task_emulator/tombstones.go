@@ -0,0 +1,124 @@
+package cloud_task_emulator
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// defaultTaskNameTombstoneTTL is how long the name of a completed or deleted task stays reserved by default, as
+// in production
+const defaultTaskNameTombstoneTTL = time.Hour
+
+// minTombstoneSweep is the smallest set size at which expired tombstones are swept
+const minTombstoneSweep = 1024
+
+// tombstones is a compact set of recently used task names.
+// Only a hash of each name and its expiry are kept, so that a soak test completing millions of tasks
+// does not keep the names (or the tasks) alive, unless the names are kept for listing.
+// Callers are responsible for synchronisation.
+type tombstones struct {
+	expiries map[uint64]int64
+
+	// names maps the hashes back to the task names, nil unless the names are kept
+	names map[uint64]string
+
+	nextSweep int
+}
+
+func newTombstones(keepNames bool) *tombstones {
+	t := &tombstones{
+		expiries:  make(map[uint64]int64),
+		nextSweep: minTombstoneSweep,
+	}
+	if keepNames {
+		t.names = make(map[uint64]string)
+	}
+	return t
+}
+
+// Tombstone is a task name reserved because its task completed or was deleted recently
+type Tombstone struct {
+	// Name is only known with ServerOptions.KeepTombstonedNames set, or when asked about
+	Name string `json:"name,omitempty"`
+
+	ExpireTime time.Time `json:"expireTime"`
+}
+
+func hashTaskName(taskName string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(taskName))
+	return h.Sum64()
+}
+
+// add reserves the task name for the TTL
+func (t *tombstones) add(taskName string, now time.Time, ttl time.Duration) {
+	hash := hashTaskName(taskName)
+	t.expiries[hash] = now.Add(ttl).UnixNano()
+	if t.names != nil {
+		t.names[hash] = taskName
+	}
+
+	// Amortise the cleanup of expired entries over the insertions
+	if len(t.expiries) >= t.nextSweep {
+		t.sweep(now)
+		t.nextSweep = 2 * len(t.expiries)
+		if t.nextSweep < minTombstoneSweep {
+			t.nextSweep = minTombstoneSweep
+		}
+	}
+}
+
+// contains reports whether the task name is still reserved
+func (t *tombstones) contains(taskName string, now time.Time) bool {
+	_, ok := t.expiry(taskName, now)
+	return ok
+}
+
+// expiry returns when the task name stops being reserved, reporting false if it is not reserved
+func (t *tombstones) expiry(taskName string, now time.Time) (time.Time, bool) {
+	hash := hashTaskName(taskName)
+	expiry, ok := t.expiries[hash]
+	if !ok {
+		return time.Time{}, false
+	}
+	if expiry <= now.UnixNano() {
+		t.remove(hash)
+		return time.Time{}, false
+	}
+	return time.Unix(0, expiry), true
+}
+
+// list returns the reserved task names, ordered by expiry
+func (t *tombstones) list(now time.Time) []Tombstone {
+	t.sweep(now)
+	entries := make([]Tombstone, 0, len(t.expiries))
+	for hash, expiry := range t.expiries {
+		entries = append(entries, Tombstone{Name: t.names[hash], ExpireTime: time.Unix(0, expiry)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ExpireTime.Equal(entries[j].ExpireTime) {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].ExpireTime.Before(entries[j].ExpireTime)
+	})
+	return entries
+}
+
+func (t *tombstones) len() int {
+	return len(t.expiries)
+}
+
+func (t *tombstones) sweep(now time.Time) {
+	nowNanos := now.UnixNano()
+	for hash, expiry := range t.expiries {
+		if expiry <= nowNanos {
+			t.remove(hash)
+		}
+	}
+}
+
+func (t *tombstones) remove(hash uint64) {
+	delete(t.expiries, hash)
+	delete(t.names, hash)
+}
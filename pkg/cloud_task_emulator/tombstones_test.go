@@ -0,0 +1,122 @@
+package cloud_task_emulator
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const benchmarkTaskNames = 100000
+
+func TestTombstonesExpire(t *testing.T) {
+	now := time.Now()
+	ts := newTombstones(false)
+
+	ts.add("projects/p/locations/l/queues/q/tasks/a", now, defaultTaskNameTombstoneTTL)
+
+	assert.True(t, ts.contains("projects/p/locations/l/queues/q/tasks/a", now.Add(defaultTaskNameTombstoneTTL-time.Second)))
+	assert.False(t, ts.contains("projects/p/locations/l/queues/q/tasks/b", now))
+	assert.False(t, ts.contains("projects/p/locations/l/queues/q/tasks/a", now.Add(defaultTaskNameTombstoneTTL)))
+	assert.Equal(t, 0, ts.len())
+}
+
+func TestTombstonesSweepExpired(t *testing.T) {
+	now := time.Now()
+	ts := newTombstones(false)
+
+	for i := 0; i < minTombstoneSweep-1; i++ {
+		ts.add(fmt.Sprintf("projects/p/locations/l/queues/q/tasks/old-%d", i), now, defaultTaskNameTombstoneTTL)
+	}
+	ts.add("projects/p/locations/l/queues/q/tasks/new", now.Add(defaultTaskNameTombstoneTTL), defaultTaskNameTombstoneTTL)
+
+	assert.Equal(t, 1, ts.len())
+}
+
+func TestTaskNameTombstoneTTL(t *testing.T) {
+	assert.Equal(t, time.Hour, NewServer().taskNameTombstoneTTL())
+
+	server := NewServer(WithOptions(ServerOptions{TaskNameTombstoneTTL: 24 * time.Hour}))
+	server.removeTask("projects/p/locations/l/queues/q/tasks/a")
+
+	_, ok, err := server.storage.TaskNameTombstone("projects/p/locations/l/queues/q/tasks/a", time.Now().Add(23*time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestTombstonesList(t *testing.T) {
+	now := time.Now()
+	ts := newTombstones(false)
+	named := newTombstones(true)
+
+	for _, set := range []*tombstones{ts, named} {
+		set.add("projects/p/locations/l/queues/q/tasks/b", now.Add(time.Second), defaultTaskNameTombstoneTTL)
+		set.add("projects/p/locations/l/queues/q/tasks/a", now, defaultTaskNameTombstoneTTL)
+	}
+
+	assert.Equal(t, []Tombstone{
+		{ExpireTime: time.Unix(0, now.Add(defaultTaskNameTombstoneTTL).UnixNano())},
+		{ExpireTime: time.Unix(0, now.Add(time.Second+defaultTaskNameTombstoneTTL).UnixNano())},
+	}, ts.list(now))
+	assert.Equal(t, []Tombstone{
+		{Name: "projects/p/locations/l/queues/q/tasks/a", ExpireTime: time.Unix(0, now.Add(defaultTaskNameTombstoneTTL).UnixNano())},
+		{Name: "projects/p/locations/l/queues/q/tasks/b", ExpireTime: time.Unix(0, now.Add(time.Second+defaultTaskNameTombstoneTTL).UnixNano())},
+	}, named.list(now))
+
+	assert.Equal(t, []Tombstone{
+		{Name: "projects/p/locations/l/queues/q/tasks/b", ExpireTime: time.Unix(0, now.Add(time.Second+defaultTaskNameTombstoneTTL).UnixNano())},
+	}, named.list(now.Add(defaultTaskNameTombstoneTTL)))
+	assert.Len(t, named.names, 1)
+}
+
+func benchmarkTaskName(i int) string {
+	return fmt.Sprintf("projects/benchmark-project/locations/us-central1/queues/benchmark-queue/tasks/%d", 1000000000000000000+i)
+}
+
+// reportRetainedBytes measures the heap retained by the structure built from the task names
+func reportRetainedBytes(b *testing.B, build func() interface{}) {
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	retained := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(retained)
+
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchmarkTaskNames, "B/name")
+}
+
+func BenchmarkTaskNameTombstones(b *testing.B) {
+	build := func() interface{} {
+		ts := newTombstones(false)
+		now := time.Now()
+		for i := 0; i < benchmarkTaskNames; i++ {
+			ts.add(benchmarkTaskName(i), now, defaultTaskNameTombstoneTTL)
+		}
+		return ts
+	}
+
+	for i := 0; i < b.N; i++ {
+		build()
+	}
+	reportRetainedBytes(b, build)
+}
+
+// BenchmarkTaskNameNilEntries measures the previous scheme of keeping nil entries in the task map
+func BenchmarkTaskNameNilEntries(b *testing.B) {
+	build := func() interface{} {
+		ts := make(map[string]*Task)
+		for i := 0; i < benchmarkTaskNames; i++ {
+			ts[benchmarkTaskName(i)] = nil
+		}
+		return ts
+	}
+
+	for i := 0; i < b.N; i++ {
+		build()
+	}
+	reportRetainedBytes(b, build)
+}
@@ -0,0 +1,108 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// traceContext is the trace a task is dispatched in, taken from the CreateTask call or started for the task
+type traceContext struct {
+	// traceID is 32 lowercase hex digits
+	traceID string
+
+	sampled bool
+}
+
+// newTraceContext starts a sampled trace
+func newTraceContext() traceContext {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return traceContext{traceID: hex.EncodeToString(b[:]), sampled: true}
+}
+
+// traceFromContext returns the trace of the traceparent or, failing that, X-Cloud-Trace-Context metadata of the
+// call, or a new trace if it has neither
+func traceFromContext(ctx context.Context) traceContext {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get("traceparent") {
+			if trace, ok := parseTraceparent(value); ok {
+				return trace
+			}
+		}
+		for _, value := range md.Get("x-cloud-trace-context") {
+			if trace, ok := parseCloudTraceContext(value); ok {
+				return trace
+			}
+		}
+	}
+	return newTraceContext()
+}
+
+// parseTraceparent parses a W3C traceparent, "00-<trace ID>-<parent ID>-<flags>"
+func parseTraceparent(value string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceContext{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceContext{}, false
+	}
+	if !validTraceID(parts[1]) {
+		return traceContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: parts[1], sampled: flags[0]&1 == 1}, true
+}
+
+// parseCloudTraceContext parses an X-Cloud-Trace-Context, "<trace ID>/<span ID>;o=<options>" with the span ID
+// and options optional
+func parseCloudTraceContext(value string) (traceContext, bool) {
+	traceID, rest, _ := strings.Cut(strings.TrimSpace(value), "/")
+	traceID = strings.ToLower(traceID)
+	if !validTraceID(traceID) {
+		return traceContext{}, false
+	}
+	_, options, _ := strings.Cut(rest, ";")
+	return traceContext{traceID: traceID, sampled: options == "o=1"}, true
+}
+
+func validTraceID(traceID string) bool {
+	if len(traceID) != 32 || traceID != strings.ToLower(traceID) || strings.Trim(traceID, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(traceID)
+	return err == nil
+}
+
+// setTraceHeaders sets the traceparent and X-Cloud-Trace-Context of a dispatch, in the trace with a new span for
+// it, unless the task sets either of them
+func (trace traceContext) setTraceHeaders(headers map[string]string) {
+	if trace.traceID == "" || hasHeader(headers, "Traceparent") || hasHeader(headers, "X-Cloud-Trace-Context") {
+		return
+	}
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[0] |= 1 // never the invalid all-zero span ID
+	spanID := binary.BigEndian.Uint64(b[:])
+
+	flags, sampled := "00", "0"
+	if trace.sampled {
+		flags, sampled = "01", "1"
+	}
+	headers["Traceparent"] = fmt.Sprintf("00-%s-%016x-%s", trace.traceID, spanID, flags)
+	headers["X-Cloud-Trace-Context"] = trace.traceID + "/" + strconv.FormatUint(spanID, 10) + ";o=" + sampled
+}
@@ -0,0 +1,110 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	traceparentPattern  = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-0([01])$`)
+	cloudTracePattern   = regexp.MustCompile(`^([0-9a-f]{32})/([0-9]+);o=([01])$`)
+	propagatedTraceID   = "4bf92f3577b34da6a3ce929d0e0e4736"
+	propagatedParentID  = "00f067aa0ba902b7"
+	propagatedCloudSpan = "12345"
+)
+
+// dispatchedTrace creates a task in the context of the call and returns the trace ID and sampled flag of its
+// dispatch, checking that both trace headers agree on them
+func dispatchedTrace(t *testing.T, ctx context.Context) (string, string, *http.Request) {
+	client := RunTWithOptions(t, ServerOptions{})
+	serverURL, requests := startTestServer(t)
+
+	queue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "trace")})
+	require.NoError(t, err)
+	_, err = client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: serverURL + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+
+	req, err := awaitHttpRequest(requests)
+	require.NoError(t, err)
+	traceparent := traceparentPattern.FindStringSubmatch(req.Header.Get("traceparent"))
+	require.NotNil(t, traceparent, req.Header.Get("traceparent"))
+	cloudTrace := cloudTracePattern.FindStringSubmatch(req.Header.Get("X-Cloud-Trace-Context"))
+	require.NotNil(t, cloudTrace, req.Header.Get("X-Cloud-Trace-Context"))
+	assert.Equal(t, traceparent[1], cloudTrace[1])
+	assert.Equal(t, traceparent[3], cloudTrace[3])
+	return traceparent[1], traceparent[3], req
+}
+
+func TestDispatchStartsTraceOfTask(t *testing.T) {
+	traceID, sampled, req := dispatchedTrace(t, context.Background())
+
+	assert.NotEqual(t, propagatedTraceID, traceID)
+	assert.Equal(t, "1", sampled)
+	assert.NotEqual(t, "0000000000000000", traceparentPattern.FindStringSubmatch(req.Header.Get("traceparent"))[2])
+
+	otherTraceID, _, _ := dispatchedTrace(t, context.Background())
+	assert.NotEqual(t, traceID, otherTraceID)
+}
+
+func TestDispatchPropagatesTraceparent(t *testing.T) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", "00-"+propagatedTraceID+"-"+propagatedParentID+"-00")
+	traceID, sampled, req := dispatchedTrace(t, ctx)
+
+	assert.Equal(t, propagatedTraceID, traceID)
+	assert.Equal(t, "0", sampled)
+	// In a span of its own
+	assert.NotEqual(t, propagatedParentID, traceparentPattern.FindStringSubmatch(req.Header.Get("traceparent"))[2])
+}
+
+func TestDispatchPropagatesCloudTraceContext(t *testing.T) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-cloud-trace-context", propagatedTraceID+"/"+propagatedCloudSpan+";o=1")
+	traceID, sampled, req := dispatchedTrace(t, ctx)
+
+	assert.Equal(t, propagatedTraceID, traceID)
+	assert.Equal(t, "1", sampled)
+	assert.NotEqual(t, propagatedCloudSpan, cloudTracePattern.FindStringSubmatch(req.Header.Get("X-Cloud-Trace-Context"))[2])
+}
+
+func TestDispatchIgnoresInvalidTraceMetadata(t *testing.T) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", "00-"+propagatedTraceID+"-0000-01")
+	traceID, _, _ := dispatchedTrace(t, ctx)
+
+	assert.NotEqual(t, propagatedTraceID, traceID)
+}
+
+func TestDispatchKeepsTraceHeadersOfTask(t *testing.T) {
+	client := RunTWithOptions(t, ServerOptions{})
+	serverURL, requests := startTestServer(t)
+
+	queue, err := client.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "trace")})
+	require.NoError(t, err)
+	traceparent := "00-" + propagatedTraceID + "-" + propagatedParentID + "-01"
+	_, err = client.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url:     serverURL + "/success",
+				Headers: map[string]string{"traceparent": traceparent},
+			}},
+		},
+	})
+	require.NoError(t, err)
+
+	req, err := awaitHttpRequest(requests)
+	require.NoError(t, err)
+	assert.Equal(t, traceparent, req.Header.Get("traceparent"))
+	assert.Empty(t, req.Header.Get("X-Cloud-Trace-Context"))
+}
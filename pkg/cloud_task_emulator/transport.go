@@ -0,0 +1,89 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+)
+
+// Transport delivers the tasks instead of sending their requests over HTTP, see WithTransport
+type Transport interface {
+	// Deliver delivers an attempt of the task, with the request the emulator would otherwise send, and returns
+	// the response, whose status code decides whether the attempt succeeded, or an error if there is none, e.g.
+	// the target is unreachable. Errors with a Timeout method reporting true count as timeouts. The emulator
+	// closes the body of the response. The task is a copy, not to be changed.
+	Deliver(ctx context.Context, task *tasks.Task, req *http.Request) (*http.Response, error)
+}
+
+// WithTransport delivers tasks with the transport, e.g. straight to a handler in memory, see HandlerTransport,
+// onto a message bus or to a mock. Everything up to sending the request still applies: headers, OIDC tokens,
+// the dispatch hook, chaos, concurrency limits and the dispatch deadline, as the deadline of the context.
+// Dispatches are not checked against the allowed and denied hosts, no connection being made.
+func WithTransport(transport Transport) Option {
+	return func(s *Server) {
+		s.transport = transport
+	}
+}
+
+// HandlerTransport delivers tasks to the handler, e.g. the application under test, without a server in between
+func HandlerTransport(handler http.Handler) Transport {
+	return handlerTransport{handler: handler}
+}
+
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) Deliver(ctx context.Context, task *tasks.Task, req *http.Request) (*http.Response, error) {
+	// As the handler would receive it from a server, the header names in canonical form
+	req = req.Clone(ctx)
+	req.RequestURI = req.URL.RequestURI()
+	header := make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		header[http.CanonicalHeaderKey(name)] = append(header[http.CanonicalHeaderKey(name)], values...)
+	}
+	req.Header = header
+
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, req)
+	return recorder.Result(), nil
+}
+
+// deliver sends the request of the task with the transport if there is one, or the client otherwise
+func (d *dispatcher) deliver(ctx context.Context, client *http.Client, taskState *tasks.Task, req *http.Request) (*http.Response, error) {
+	if d.taskTransport == nil {
+		return client.Do(req)
+	}
+
+	cancel := func() {}
+	if client.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+	}
+	resp, err := d.taskTransport.Deliver(ctx, taskState, req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	// The deadline covers reading the response, like the client's timeout
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels a context once the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+
+	cancel context.CancelFunc
+}
+
+func (body cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
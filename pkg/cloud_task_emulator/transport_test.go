@@ -0,0 +1,102 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// transportFunc delivers tasks with a function
+type transportFunc func(ctx context.Context, task *taskspb.Task, req *http.Request) (*http.Response, error)
+
+func (f transportFunc) Deliver(ctx context.Context, task *taskspb.Task, req *http.Request) (*http.Response, error) {
+	return f(ctx, task, req)
+}
+
+func queueNameOf(task *taskspb.Task) string {
+	return task.GetName()[:strings.LastIndex(task.GetName(), "/tasks/")]
+}
+
+func createTransportTask(t *testing.T, server *Server, url string) *taskspb.Task {
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "transport")})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			DispatchDeadline: durationpb.New(time.Minute),
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{
+				Url:  url,
+				Body: []byte("in memory"),
+			}},
+		},
+	})
+	require.NoError(t, err)
+	return task
+}
+
+func TestHandlerTransport(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := NewServer(WithTransport(HandlerTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+	}))))
+	t.Cleanup(server.Shutdown)
+
+	// Never resolved, let alone connected to
+	task := createTransportTask(t, server, "http://app.invalid/work?id=1")
+
+	req, err := awaitHttpRequest(requests)
+	require.NoError(t, err)
+	assert.Equal(t, "/work?id=1", req.RequestURI)
+	assert.Equal(t, "app.invalid", req.Host)
+	assert.Equal(t, task.GetName(), queueNameOf(task)+"/tasks/"+req.Header.Get("X-CloudTasks-TaskName"))
+	assert.Equal(t, "in memory", <-bodies)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+}
+
+func TestTransportErrors(t *testing.T) {
+	deadlines := make(chan time.Duration, 1)
+	server := NewServer(WithTransport(transportFunc(func(ctx context.Context, task *taskspb.Task, req *http.Request) (*http.Response, error) {
+		deadline, _ := ctx.Deadline()
+		deadlines <- time.Until(deadline)
+		return nil, errors.New("the bus is down")
+	})))
+	t.Cleanup(server.Shutdown)
+
+	task := createTransportTask(t, server, "http://app.invalid/work")
+
+	select {
+	case untilDeadline := <-deadlines:
+		// The dispatch deadline of the task
+		assert.InDelta(t, time.Minute, untilDeadline, float64(time.Second))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task was not delivered")
+	}
+	var status *rpcstatus.Status
+	assert.Eventually(t, func() bool {
+		attempted, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: task.GetName()})
+		require.NoError(t, err)
+		status = attempted.GetLastAttempt().GetResponseStatus()
+		return status != nil
+	}, time.Second, 10*time.Millisecond)
+	// No response, for the reason the transport gave
+	assert.EqualValues(t, grpcCodes.Unavailable, status.GetCode())
+	assert.Contains(t, status.GetMessage(), "the bus is down")
+}
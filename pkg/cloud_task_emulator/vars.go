@@ -0,0 +1,90 @@
+package cloud_task_emulator
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// varsName is the name the emulator's variables are served under, next to those published with expvar
+const varsName = "cloudTasksEmulator"
+
+// counters count the tasks and dispatches of every queue. They are updated atomically.
+type counters struct {
+	tasksCreated       int64
+	dispatches         int64
+	failedDispatches   int64
+	tasksOutOfAttempts int64
+
+	// scheduleGoroutines counts the goroutines waiting for tasks to come due or be taken by their queue
+	scheduleGoroutines int64
+}
+
+func (c *counters) taskCreated() {
+	atomic.AddInt64(&c.tasksCreated, 1)
+}
+
+func (c *counters) dispatched() {
+	atomic.AddInt64(&c.dispatches, 1)
+}
+
+func (c *counters) dispatchFailed() {
+	atomic.AddInt64(&c.failedDispatches, 1)
+}
+
+func (c *counters) ranOutOfAttempts() {
+	atomic.AddInt64(&c.tasksOutOfAttempts, 1)
+}
+
+// scheduling counts a schedule goroutine starting (1) or returning (-1)
+func (c *counters) scheduling(delta int64) {
+	atomic.AddInt64(&c.scheduleGoroutines, delta)
+}
+
+func counterVar(counter *int64) expvar.Func {
+	return func() interface{} {
+		return atomic.LoadInt64(counter)
+	}
+}
+
+// vars returns the emulator's variables, in a map of its own rather than published with expvar, so that
+// several servers can run in a process
+func (s *Server) vars() *expvar.Map {
+	counters := &s.dispatcher.counters
+
+	vars := new(expvar.Map)
+	vars.Set("tasksCreated", counterVar(&counters.tasksCreated))
+	vars.Set("dispatches", counterVar(&counters.dispatches))
+	vars.Set("failedDispatches", counterVar(&counters.failedDispatches))
+	vars.Set("tasksOutOfAttempts", counterVar(&counters.tasksOutOfAttempts))
+	vars.Set("openQueues", expvar.Func(func() interface{} {
+		return len(s.queuesByName())
+	}))
+	vars.Set("scheduleGoroutines", counterVar(&counters.scheduleGoroutines))
+	vars.Set("workerGoroutines", expvar.Func(func() interface{} {
+		workers := 0
+		for _, queue := range s.queuesByName() {
+			queue.stateMux.Lock()
+			workers += queue.workers
+			queue.stateMux.Unlock()
+		}
+		return workers
+	}))
+	vars.Set("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	return vars
+}
+
+// handleVars serves the variables published with expvar (e.g. memstats) along with the emulator's, as
+// expvar.Handler does
+func (s *Server) handleVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "%q: %s\n}\n", varsName, s.vars())
+}
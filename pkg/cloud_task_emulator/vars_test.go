@@ -0,0 +1,75 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type emulatorVars struct {
+	TasksCreated       int64 `json:"tasksCreated"`
+	Dispatches         int64 `json:"dispatches"`
+	FailedDispatches   int64 `json:"failedDispatches"`
+	TasksOutOfAttempts int64 `json:"tasksOutOfAttempts"`
+	OpenQueues         int   `json:"openQueues"`
+	ScheduleGoroutines int64 `json:"scheduleGoroutines"`
+	WorkerGoroutines   int   `json:"workerGoroutines"`
+}
+
+func getVars(t *testing.T, url string) emulatorVars {
+	var body struct {
+		Emulator emulatorVars           `json:"cloudTasksEmulator"`
+		Memstats map[string]interface{} `json:"memstats"`
+	}
+	require.Equal(t, 200, getAdminJSON(t, url, &body))
+	assert.NotEmpty(t, body.Memstats)
+	return body.Emulator
+}
+
+func TestVars(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	admin := httptest.NewServer(server.AdminHandler())
+	t.Cleanup(admin.Close)
+	testServerUrl, receivedRequests := startTestServer(t)
+	varsUrl := admin.URL + "/debug/vars"
+
+	assert.Equal(t, emulatorVars{}, getVars(t, varsUrl))
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "counted")})
+	require.NoError(t, err)
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return getVars(t, varsUrl).ScheduleGoroutines == 1
+	}, time.Second, 10*time.Millisecond)
+	vars := getVars(t, varsUrl)
+	assert.EqualValues(t, 2, vars.TasksCreated)
+	assert.EqualValues(t, 1, vars.Dispatches)
+	assert.EqualValues(t, 0, vars.FailedDispatches)
+	assert.Equal(t, 1, vars.OpenQueues)
+	assert.Positive(t, vars.WorkerGoroutines)
+}
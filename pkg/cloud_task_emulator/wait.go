@@ -0,0 +1,84 @@
+package cloud_task_emulator
+
+import (
+	"context"
+	"sync"
+)
+
+// WaitForTaskCompletion blocks until the task completed, ran out of attempts or was deleted, or until the
+// context ends. Tasks that are already gone return straight away, unknown task names are NotFound.
+func (s *Server) WaitForTaskCompletion(ctx context.Context, taskName string) error {
+	return s.waitForTasks(ctx, func() (bool, error) {
+		task, known, err := s.fetchTask(taskName)
+		if err != nil {
+			return false, err
+		}
+		if task != nil {
+			return task.ranOutOfAttempts(), nil
+		}
+		if known {
+			return true, nil
+		}
+		return false, errTaskNotFound()
+	})
+}
+
+// WaitUntilIdle blocks until the queue has no tasks left to dispatch, including tasks waiting for their
+// schedule time or to be retried, or until the context ends. Tasks that ran out of attempts do not count.
+func (s *Server) WaitUntilIdle(ctx context.Context, queueName string) error {
+	prefix := queueName + "/tasks/"
+	return s.waitForTasks(ctx, func() (bool, error) {
+		for _, task := range s.listTasks(prefix) {
+			if !task.ranOutOfAttempts() {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// waitForTasks waits until done reports true, checking it whenever a task event occurs
+func (s *Server) waitForTasks(ctx context.Context, done func() (bool, error)) error {
+	for {
+		// Listen before checking, not to miss an event in between
+		events := s.taskEvents.listen()
+
+		ok, err := done()
+
+		if ok || err != nil {
+			return err
+		}
+
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// taskEvents wakes those waiting for tasks whenever a task is removed or runs out of attempts
+type taskEvents struct {
+	// occurred is closed, and replaced, on every event
+	occurred chan struct{}
+
+	mux sync.Mutex
+}
+
+func newTaskEvents() *taskEvents {
+	return &taskEvents{occurred: make(chan struct{})}
+}
+
+// listen returns a channel closed on the next event
+func (e *taskEvents) listen() <-chan struct{} {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.occurred
+}
+
+func (e *taskEvents) notify() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	close(e.occurred)
+	e.occurred = make(chan struct{})
+}
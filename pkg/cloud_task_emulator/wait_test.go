@@ -0,0 +1,101 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestWaitForTaskCompletion(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "waited")})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+	require.NoError(t, server.WaitUntilIdle(ctx, queue.GetName()))
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	_, ok := server.TaskSnapshot(task.GetName())
+	assert.False(t, ok)
+
+	// Completed tasks return straight away, unknown ones fail
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+	err = server.WaitForTaskCompletion(ctx, queue.GetName()+"/tasks/unknown")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestWaitUntilIdleTimesOut(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "busy")})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			ScheduleTime: timestamppb.New(time.Now().Add(time.Hour)),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: "http://localhost:1/later"}},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.WaitUntilIdle(ctx, queue.GetName()), context.DeadlineExceeded)
+	assert.ErrorIs(t, server.WaitForTaskCompletion(ctx, task.GetName()), context.DeadlineExceeded)
+}
+
+func TestWaitForTaskOutOfAttempts(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(server.Shutdown)
+	testServerUrl, receivedRequests := startTestServer(t)
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "failing"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 1},
+		},
+	})
+	require.NoError(t, err)
+	task, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: queue.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/not_found"}},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, task.GetName()))
+	require.NoError(t, server.WaitUntilIdle(ctx, queue.GetName()))
+
+	_, err = awaitHttpRequest(receivedRequests)
+	require.NoError(t, err)
+	// The task stays around, as it does once out of attempts
+	snapshot, ok := server.TaskSnapshot(task.GetName())
+	require.True(t, ok)
+	assert.EqualValues(t, 1, snapshot.GetDispatchCount())
+}
@@ -0,0 +1,331 @@
+package cloud_task_emulator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	tasks "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/protobuf/encoding/protojson"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+// The events of the write-ahead log
+const (
+	// walQueue is a queue created or changed, with its state
+	walQueue = "queue"
+
+	// walQueueDeleted is a queue deleted, whose name stays reserved
+	walQueueDeleted = "queueDeleted"
+
+	// walProjectDeleted is a project torn down, see DeleteProject
+	walProjectDeleted = "projectDeleted"
+
+	// walTaskCreated is a task created, with its state
+	walTaskCreated = "taskCreated"
+
+	// walTaskDone is a task completed or deleted, whose name is reserved from the time of the entry
+	walTaskDone = "taskDone"
+
+	// walTaskFailed is a task that ran out of attempts
+	walTaskFailed = "taskFailed"
+
+	// walNamesReleased is the reserved task names of a queue, or of every queue if it is empty, released
+	walNamesReleased = "namesReleased"
+)
+
+// walEntry is a line of the write-ahead log, e.g.
+//
+//	{"time":"2024-01-02T03:04:05.6Z","event":"taskCreated","task":{"name":"projects/dev/locations/here/queues/q/tasks/1",...}}
+//	{"time":"2024-01-02T03:04:06Z","event":"taskDone","name":"projects/dev/locations/here/queues/q/tasks/1"}
+type walEntry struct {
+	Time  time.Time       `json:"time"`
+	Event string          `json:"event"`
+	Name  string          `json:"name,omitempty"`
+	Queue json.RawMessage `json:"queue,omitempty"`
+	Task  json.RawMessage `json:"task,omitempty"`
+}
+
+// writeAheadLog appends the events changing the queues and tasks to a writer, see WithWriteAheadLog.
+// Its methods do nothing on a nil log.
+type writeAheadLog struct {
+	w      io.Writer
+	clock  Clock
+	logger *log.Logger
+
+	mux sync.Mutex
+}
+
+// WithWriteAheadLog appends the creation, change and deletion of queues and the creation and completion of
+// tasks to w, a line of JSON per event, for RecoverWriteAheadLog to restore the state of the emulator after a
+// crash, e.g. during a soak test. Every event is written as it happens, so w is best unbuffered, such as a file
+// opened for appending. Namespaces are not logged.
+func WithWriteAheadLog(w io.Writer) Option {
+	return func(s *Server) {
+		s.wal = &writeAheadLog{w: w}
+	}
+}
+
+func (l *writeAheadLog) append(entry walEntry) {
+	if l == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = l.clock.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		l.logger.Printf("Could not write %s to the write-ahead log: %v\n", entry.Event, err)
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		l.logger.Printf("Could not write %s to the write-ahead log: %v\n", entry.Event, err)
+	}
+}
+
+// encode encodes the state of a queue or task for an entry, reporting false if it could not
+func (l *writeAheadLog) encode(event string, message protov2.Message) (json.RawMessage, bool) {
+	encoded, err := protojson.Marshal(message)
+	if err != nil {
+		l.logger.Printf("Could not write %s to the write-ahead log: %v\n", event, err)
+		return nil, false
+	}
+	return encoded, true
+}
+
+func (l *writeAheadLog) queue(queueState *tasks.Queue) {
+	if l == nil {
+		return
+	}
+	if encoded, ok := l.encode(walQueue, queueState); ok {
+		l.append(walEntry{Event: walQueue, Queue: encoded})
+	}
+}
+
+func (l *writeAheadLog) taskCreated(taskState *tasks.Task) {
+	if l == nil {
+		return
+	}
+	if encoded, ok := l.encode(walTaskCreated, taskState); ok {
+		l.append(walEntry{Event: walTaskCreated, Task: encoded})
+	}
+}
+
+func (l *writeAheadLog) event(event string, name string) {
+	l.append(walEntry{Event: event, Name: name})
+}
+
+// maxWALLine is the longest line of a write-ahead log RecoverWriteAheadLog reads
+const maxWALLine = 64 << 20
+
+// recoveredState is the state of the emulator a write-ahead log ends in
+type recoveredState struct {
+	// queues holds the state of the queues by name, nil if deleted, in the order they were created
+	queues     map[string]*tasks.Queue
+	queueNames []string
+
+	taskStates map[string]*tasks.Task
+	taskNames  []string
+
+	// doneTimes holds when the tasks completed or were deleted, by name
+	doneTimes map[string]time.Time
+}
+
+func newRecoveredState() *recoveredState {
+	return &recoveredState{
+		queues:     make(map[string]*tasks.Queue),
+		taskStates: make(map[string]*tasks.Task),
+		doneTimes:  make(map[string]time.Time),
+	}
+}
+
+func (state *recoveredState) apply(entry walEntry) error {
+	switch entry.Event {
+	case walQueue:
+		queueState := &tasks.Queue{}
+		if err := protojson.Unmarshal(entry.Queue, queueState); err != nil {
+			return err
+		}
+		if _, ok := state.queues[queueState.GetName()]; !ok {
+			state.queueNames = append(state.queueNames, queueState.GetName())
+		}
+		state.queues[queueState.GetName()] = queueState
+	case walQueueDeleted:
+		if _, ok := state.queues[entry.Name]; !ok {
+			state.queueNames = append(state.queueNames, entry.Name)
+		}
+		state.queues[entry.Name] = nil
+	case walProjectDeleted:
+		prefix := "projects/" + entry.Name + "/"
+		for queueName := range state.queues {
+			if strings.HasPrefix(queueName, prefix) {
+				delete(state.queues, queueName)
+			}
+		}
+		for taskName := range state.taskStates {
+			if strings.HasPrefix(taskName, prefix) {
+				delete(state.taskStates, taskName)
+			}
+		}
+		for taskName := range state.doneTimes {
+			if strings.HasPrefix(taskName, prefix) {
+				delete(state.doneTimes, taskName)
+			}
+		}
+	case walTaskCreated:
+		taskState := &tasks.Task{}
+		if err := protojson.Unmarshal(entry.Task, taskState); err != nil {
+			return err
+		}
+		state.taskStates[taskState.GetName()] = taskState
+		state.taskNames = append(state.taskNames, taskState.GetName())
+		delete(state.doneTimes, taskState.GetName())
+	case walTaskDone:
+		delete(state.taskStates, entry.Name)
+		state.doneTimes[entry.Name] = entry.Time
+	case walTaskFailed:
+		delete(state.taskStates, entry.Name)
+	case walNamesReleased:
+		for taskName := range state.doneTimes {
+			if entry.Name == "" || queueNameOf(taskName) == entry.Name {
+				delete(state.doneTimes, taskName)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown event %q", entry.Event)
+	}
+	return nil
+}
+
+// RecoverWriteAheadLog restores the queues, tasks and reserved task names of a log written with
+// WithWriteAheadLog, e.g. on restart after a crash, on a server without any. Tasks are created afresh, due at
+// their schedule time (straight away if it has passed) with their attempts starting over; tasks that ran out of
+// attempts are left out. Reserved names stay reserved for ServerOptions.TaskNameTombstoneTTL from when their
+// task completed or was deleted. A last line cut short by the crash is skipped.
+//
+// The restored state is logged again to the server's write-ahead log, so that writing to a new file and then
+// replacing the old one with it compacts the log.
+func (s *Server) RecoverWriteAheadLog(ctx context.Context, r io.Reader) error {
+	state := newRecoveredState()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxWALLine)
+	var lineErr error
+	for line := 1; scanner.Scan(); line++ {
+		if lineErr != nil {
+			// Only the last line may be cut short
+			return lineErr
+		}
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			lineErr = fmt.Errorf("invalid write-ahead log entry on line %d: %v", line, err)
+			continue
+		}
+		if err := state.apply(entry); err != nil {
+			return fmt.Errorf("invalid write-ahead log entry on line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if lineErr != nil {
+		s.logger.Printf("Skipped the last line of the write-ahead log: %v\n", lineErr)
+	}
+	return s.restore(ctx, state)
+}
+
+// restore creates the queues, tasks and reserved task names of the state a write-ahead log ends in, logging
+// them again to the server's write-ahead log
+func (s *Server) restore(ctx context.Context, state *recoveredState) error {
+	for _, queueName := range state.queueNames {
+		queueState, ok := state.queues[queueName]
+		if !ok {
+			continue
+		}
+		if queueState == nil {
+			if err := s.removeQueue(queueName); err != nil {
+				return fmt.Errorf("could not recover queue %s: %v", queueName, err)
+			}
+			s.wal.event(walQueueDeleted, queueName)
+			continue
+		}
+		if _, err := s.CreateQueue(ctx, &tasks.CreateQueueRequest{Parent: queueParent(queueName), Queue: queueState}); err != nil {
+			return fmt.Errorf("could not recover queue %s: %v", queueName, err)
+		}
+	}
+
+	now := s.clock.Now()
+	for taskName, doneTime := range state.doneTimes {
+		if doneTime.Add(s.taskNameTombstoneTTL()).Before(now) {
+			continue
+		}
+		if err := s.storage.Tombstone(taskName, doneTime, s.taskNameTombstoneTTL()); err != nil {
+			return fmt.Errorf("could not recover task name %s: %v", taskName, err)
+		}
+		s.wal.append(walEntry{Time: doneTime, Event: walTaskDone, Name: taskName})
+	}
+
+	for _, taskName := range state.taskNames {
+		taskState, ok := state.taskStates[taskName]
+		if !ok {
+			continue
+		}
+		// Only the creation recorded last counts
+		delete(state.taskStates, taskName)
+		if s.restoreExhaustedTask(taskState) {
+			continue
+		}
+		if _, err := s.CreateTask(ctx, &tasks.CreateTaskRequest{Parent: queueNameOf(taskName), Task: recoveredTask(taskState)}); err != nil {
+			return fmt.Errorf("could not recover task %s: %v", taskName, err)
+		}
+	}
+	return nil
+}
+
+// restoreExhaustedTask restores a task that ran out of attempts as it was, reporting false for the other tasks,
+// which are created again. The write-ahead log leaves such tasks out, only a storage keeps them.
+func (s *Server) restoreExhaustedTask(taskState *tasks.Task) bool {
+	queue, ok := s.fetchQueue(queueNameOf(taskState.GetName()))
+	if !ok || queue == nil || dispatchState(taskState, queue.retryConfig()) != taskFailed {
+		return false
+	}
+	s.setTask(taskState.GetName(), queue.restoreExhaustedTask(taskState))
+	return true
+}
+
+// recoveredTask is the task to create again for the logged task: its request, name, schedule time and dispatch
+// deadline
+func recoveredTask(taskState *tasks.Task) *tasks.Task {
+	task := &tasks.Task{
+		Name:             taskState.GetName(),
+		ScheduleTime:     taskState.GetScheduleTime(),
+		DispatchDeadline: taskState.GetDispatchDeadline(),
+	}
+	switch message := taskState.GetMessageType().(type) {
+	case *tasks.Task_HttpRequest:
+		task.MessageType = message
+	case *tasks.Task_AppEngineHttpRequest:
+		// Creating the task puts Cloud Tasks' User-Agent after the task's again
+		headers := copyHeaders(message.AppEngineHttpRequest.GetHeaders())
+		if userAgent := strings.TrimSuffix(strings.TrimSuffix(headers["User-Agent"], appEngineUserAgent), " "); userAgent != "" {
+			headers["User-Agent"] = userAgent
+		} else {
+			delete(headers, "User-Agent")
+		}
+		appEngineHTTPRequest := protov2.Clone(message.AppEngineHttpRequest).(*tasks.AppEngineHttpRequest)
+		appEngineHTTPRequest.Headers = headers
+		task.MessageType = &tasks.Task_AppEngineHttpRequest{AppEngineHttpRequest: appEngineHTTPRequest}
+	}
+	return task
+}
@@ -0,0 +1,150 @@
+package cloud_task_emulator_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	. "github.com/ricebin/cloud-tasks-emulator/pkg/cloud_task_emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	grpcCodes "google.golang.org/grpc/codes"
+	grpcStatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// recoverServer starts a server from the write-ahead log, logging to a new one
+func recoverServer(t *testing.T, wal string) (*Server, *lockedBuffer) {
+	var recovered lockedBuffer
+	server := NewServer(WithWriteAheadLog(&recovered))
+	t.Cleanup(server.Shutdown)
+	require.NoError(t, server.RecoverWriteAheadLog(context.Background(), strings.NewReader(wal)))
+	return server, &recovered
+}
+
+func TestRecoverWriteAheadLog(t *testing.T) {
+	testServerUrl, requests := startTestServer(t)
+	var wal lockedBuffer
+	server := NewServer(WithWriteAheadLog(&wal))
+
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{
+		Parent: formattedParent,
+		Queue: &taskspb.Queue{
+			Name:        formatQueueName(formattedParent, "soak"),
+			RetryConfig: &taskspb.RetryConfig{MaxAttempts: 7, MinBackoff: durationpb.New(time.Second)},
+		},
+	})
+	require.NoError(t, err)
+	paused, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "paused")})
+	require.NoError(t, err)
+	_, err = server.PauseQueue(context.Background(), &taskspb.PauseQueueRequest{Name: paused.GetName()})
+	require.NoError(t, err)
+	deleted, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "deleted")})
+	require.NoError(t, err)
+	_, err = server.DeleteQueue(context.Background(), &taskspb.DeleteQueueRequest{Name: deleted.GetName()})
+	require.NoError(t, err)
+
+	createTask := func(queueName string, taskID string, scheduleTime time.Time, path string) *taskspb.Task {
+		task := &taskspb.Task{
+			ScheduleTime: timestamppb.New(scheduleTime),
+			MessageType:  &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + path, Body: []byte("soak")}},
+		}
+		if taskID != "" {
+			task.Name = queueName + "/tasks/" + taskID
+		}
+		created, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{Parent: queueName, Task: task})
+		require.NoError(t, err)
+		return created
+	}
+	pending := createTask(queue.GetName(), "", time.Now().Add(time.Hour), "/success")
+	pausedTask := createTask(paused.GetName(), "held", time.Now(), "/success")
+	appEngineTask, err := server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{
+		Parent: paused.GetName(),
+		Task: &taskspb.Task{
+			MessageType: &taskspb.Task_AppEngineHttpRequest{AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+				RelativeUri: "/work",
+				Headers:     map[string]string{"User-Agent": "soak-test"},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	done := createTask(queue.GetName(), "done", time.Now(), "/success")
+	_, err = awaitHttpRequest(requests)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, server.WaitForTaskCompletion(ctx, done.GetName()))
+	removed := createTask(queue.GetName(), "removed", time.Now().Add(time.Hour), "/success")
+	_, err = server.DeleteTask(context.Background(), &taskspb.DeleteTaskRequest{Name: removed.GetName()})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: removed.GetName()})
+		return grpcStatus.Code(err) == grpcCodes.FailedPrecondition
+	}, time.Second, 10*time.Millisecond)
+
+	// The crash
+	server.Shutdown()
+
+	assertRecovered := func(server *Server) {
+		recoveredQueue, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+		require.NoError(t, err)
+		assert.EqualValues(t, 7, recoveredQueue.GetRetryConfig().GetMaxAttempts())
+		assert.Equal(t, time.Second, recoveredQueue.GetRetryConfig().GetMinBackoff().AsDuration())
+
+		recoveredPaused, err := server.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: paused.GetName()})
+		require.NoError(t, err)
+		assert.Equal(t, taskspb.Queue_PAUSED, recoveredPaused.GetState())
+
+		// Deleted queues and done tasks keep their names reserved
+		_, err = server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "deleted")})
+		assert.Equal(t, grpcCodes.FailedPrecondition, grpcStatus.Code(err))
+		for _, name := range []string{done.GetName(), removed.GetName()} {
+			_, err = server.CreateTask(context.Background(), &taskspb.CreateTaskRequest{Parent: queue.GetName(), Task: &taskspb.Task{
+				Name:        name,
+				MessageType: &taskspb.Task_HttpRequest{HttpRequest: &taskspb.HttpRequest{Url: testServerUrl + "/success"}},
+			}})
+			assert.Equal(t, grpcCodes.AlreadyExists, grpcStatus.Code(err), name)
+		}
+
+		for _, task := range []*taskspb.Task{pending, pausedTask} {
+			recoveredTask, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: task.GetName()})
+			require.NoError(t, err)
+			assert.True(t, task.GetScheduleTime().AsTime().Equal(recoveredTask.GetScheduleTime().AsTime()))
+			assert.Equal(t, task.GetHttpRequest().GetHeaders(), recoveredTask.GetHttpRequest().GetHeaders())
+		}
+		recoveredAppEngineTask, err := server.GetTask(context.Background(), &taskspb.GetTaskRequest{Name: appEngineTask.GetName()})
+		require.NoError(t, err)
+		assert.Equal(t, appEngineTask.GetAppEngineHttpRequest().GetHeaders(), recoveredAppEngineTask.GetAppEngineHttpRequest().GetHeaders())
+		recoveredTasks, err := server.ListTasks(context.Background(), &taskspb.ListTasksRequest{Parent: queue.GetName()})
+		require.NoError(t, err)
+		assert.Len(t, recoveredTasks.GetTasks(), 1)
+	}
+
+	recovered, compacted := recoverServer(t, wal.String())
+	assertRecovered(recovered)
+	recovered.Shutdown()
+
+	// The log of the recovered server is enough to recover from, the history left out
+	assert.Less(t, len(compacted.String()), len(wal.String()))
+	again, _ := recoverServer(t, compacted.String())
+	assertRecovered(again)
+}
+
+func TestRecoverWriteAheadLogSkipsTornLastLine(t *testing.T) {
+	var wal lockedBuffer
+	server := NewServer(WithWriteAheadLog(&wal))
+	t.Cleanup(server.Shutdown)
+	queue, err := server.CreateQueue(context.Background(), &taskspb.CreateQueueRequest{Parent: formattedParent, Queue: newQueue(formattedParent, "torn")})
+	require.NoError(t, err)
+
+	recovered, _ := recoverServer(t, wal.String()+`{"time":"2024-01-02T03:04:05Z","event":"taskCre`)
+	_, err = recovered.GetQueue(context.Background(), &taskspb.GetQueueRequest{Name: queue.GetName()})
+	assert.NoError(t, err)
+
+	// Only the last line may be torn
+	err = NewServer().RecoverWriteAheadLog(context.Background(), strings.NewReader(`{"event":`+"\n"+wal.String()))
+	assert.Error(t, err)
+}